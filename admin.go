@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+)
+
+// adminTokenHeader carries the admin token on requests to /admin/ endpoints.
+const adminTokenHeader = "X-Admin-Token"
+
+// requireAdminToken wraps an admin handler so it only runs when the request carries the configured token.
+func requireAdminToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided := r.Header.Get(adminTokenHeader)
+		if token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			logWarnf("Rejected admin request to %s from %s: missing or invalid token", r.URL.Path, clientIP(r))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON writes v as an indented JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logErrorf("Error encoding admin JSON response: %v", err)
+	}
+}
+
+// createAdminStateHandler returns a handler for GET /admin/state, which reports per-scope
+// key availability, sidelined keys and time-to-reactivation statistics. Key values are never included.
+func createAdminStateHandler(keyMan *keyManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, keyMan.snapshot())
+	}
+}
+
+// adminResetResponse summarizes a POST /admin/reset.
+type adminResetResponse struct {
+	ReactivatedKeys int `json:"reactivatedKeys"`
+	Scopes          int `json:"scopes"`
+}
+
+// createAdminResetHandler returns a handler for POST /admin/reset, which clears all failing-key
+// state, e.g. once the upstream is known to have recovered from an outage.
+func createAdminResetHandler(keyMan *keyManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		keys, scopes := keyMan.resetAll()
+		logWarnf("Admin reset from %s reactivated %d key(s) across %d scope(s)", clientIP(r), keys, scopes)
+		writeJSON(w, http.StatusOK, adminResetResponse{ReactivatedKeys: keys, Scopes: scopes})
+	}
+}
+
+// createAdminReloadHandler returns a handler for POST /admin/reload, which re-reads the key
+// sources like SIGHUP does, for platforms where signaling the process is awkward. It responds
+// with the keyReloadSummary; a failed reload keeps the current keys and returns 422.
+func createAdminReloadHandler(reloader *keyReloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		summary, err := reloader.reload()
+		if err != nil {
+			logErrorf("Admin key reload from %s failed; keeping the current keys: %v", clientIP(r), err)
+			http.Error(w, "Reload failed: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		logInfof("Admin key reload from %s applied.", clientIP(r))
+		writeJSON(w, http.StatusOK, summary)
+	}
+}
+
+// pprofPrefix is the path under which profiling endpoints are served when -enable-pprof is set.
+const pprofPrefix = "/debug/pprof/"
+
+// registerPprofHandlers serves the net/http/pprof endpoints on mux behind the admin token.
+// Because they are registered on the proxy's own mux, these paths are never forwarded upstream.
+func registerPprofHandlers(mux *http.ServeMux, token string) {
+	mux.Handle(pprofPrefix, requireAdminToken(token, http.HandlerFunc(pprof.Index)))
+	mux.Handle(pprofPrefix+"cmdline", requireAdminToken(token, http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle(pprofPrefix+"profile", requireAdminToken(token, http.HandlerFunc(pprof.Profile)))
+	mux.Handle(pprofPrefix+"symbol", requireAdminToken(token, http.HandlerFunc(pprof.Symbol)))
+	mux.Handle(pprofPrefix+"trace", requireAdminToken(token, http.HandlerFunc(pprof.Trace)))
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// doAdminRequest sends a request through the token middleware to the given admin handler.
+func doAdminRequest(t *testing.T, handler http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, "http://localhost:8080"+path, nil)
+	if token != "" {
+		req.Header.Set(adminTokenHeader, token)
+	}
+	rr := httptest.NewRecorder()
+	requireAdminToken("secret", handler).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRequireAdminToken(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1"}, time.Minute)
+	handler := createAdminStateHandler(km)
+
+	assertInt(t, doAdminRequest(t, handler, "GET", "/admin/state", "").Code, http.StatusUnauthorized)
+	assertInt(t, doAdminRequest(t, handler, "GET", "/admin/state", "wrong").Code, http.StatusUnauthorized)
+	assertInt(t, doAdminRequest(t, handler, "GET", "/admin/state", "secret").Code, http.StatusOK)
+}
+
+func TestAdminState_ReportsSidelineDurations(t *testing.T) {
+	removal := 50 * time.Millisecond
+	km, _ := newKeyManager([]string{"k1", "k2"}, removal)
+	scope := buildScopeKey("api.example.com", "/v1beta/models/gemini-pro:generateContent")
+
+	km.markKeyFailed(scope, 0, "test")
+	km.markKeyFailed(scope, 1, "test")
+	time.Sleep(removal + 30*time.Millisecond)
+	km.reactivateKeys()
+
+	rr := doAdminRequest(t, createAdminStateHandler(km), "GET", "/admin/state", "secret")
+	assertInt(t, rr.Code, http.StatusOK)
+
+	var snap keyManagerSnapshot
+	if err := json.Unmarshal(rr.Body.Bytes(), &snap); err != nil {
+		t.Fatalf("failed to decode admin state: %v", err)
+	}
+	assertInt(t, snap.TotalKeys, 2)
+	scopeSnap, ok := snap.Scopes[scope]
+	if !ok {
+		t.Fatalf("expected scope %q in admin state, got %v", scope, snap.Scopes)
+	}
+	assertInt(t, len(scopeSnap.AvailableKeys), 2)
+	assertInt(t, len(scopeSnap.FailingKeys), 0)
+
+	stats := scopeSnap.Sidelined
+	assertInt(t, stats.Count, 2)
+	if stats.MinSeconds < removal.Seconds() {
+		t.Errorf("expected min sideline >= removal duration %s, got %.3fs", removal, stats.MinSeconds)
+	}
+	if stats.MaxSeconds > (removal + 500*time.Millisecond).Seconds() {
+		t.Errorf("expected max sideline close to removal duration %s, got %.3fs", removal, stats.MaxSeconds)
+	}
+	if stats.AvgSeconds < stats.MinSeconds || stats.AvgSeconds > stats.MaxSeconds {
+		t.Errorf("expected avg between min and max, got min=%.3f avg=%.3f max=%.3f", stats.MinSeconds, stats.AvgSeconds, stats.MaxSeconds)
+	}
+}
+
+func TestAdminState_ListsFailingKeysWithoutKeyValues(t *testing.T) {
+	km, _ := newKeyManager([]string{"super-secret-key", "k2"}, time.Hour)
+	km.markKeyFailed("scopeA", 0, "status 401")
+
+	rr := doAdminRequest(t, createAdminStateHandler(km), "GET", "/admin/state", "secret")
+	assertInt(t, rr.Code, http.StatusOK)
+	if body := rr.Body.String(); strings.Contains(body, "super-secret-key") {
+		t.Fatalf("admin state must never include key values, got: %s", body)
+	}
+
+	var snap keyManagerSnapshot
+	json.Unmarshal(rr.Body.Bytes(), &snap)
+	failing := snap.Scopes["scopeA"].FailingKeys
+	assertInt(t, len(failing), 1)
+	assertInt(t, failing[0].Index, 0)
+	assertString(t, failing[0].Reason, "status 401")
+	if !failing[0].ReactivateAt.After(failing[0].FailedAt) {
+		t.Errorf("expected reactivateAt after failedAt, got %v / %v", failing[0].FailedAt, failing[0].ReactivateAt)
+	}
+}
+
+func TestAdminState_ReportsLastError(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `{"error":{"message":"API key `+r.URL.Query().Get("key")+` is not valid"}}`)
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"k-secret-1", "k-secret-2"}, time.Minute)
+	mainHandler := createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{})
+	rr := httptest.NewRecorder()
+	mainHandler(rr, httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil))
+	assertInt(t, rr.Code, http.StatusForbidden)
+
+	targetURL, _ := url.Parse(targetServer.URL)
+	scope := buildScopeKey(targetURL.Host, "/v1beta/models")
+	rr = doAdminRequest(t, createAdminStateHandler(km), "GET", "/admin/state", "secret")
+	if strings.Contains(rr.Body.String(), "k-secret") {
+		t.Fatalf("admin state leaked a key: %s", rr.Body.String())
+	}
+	var snap keyManagerSnapshot
+	if err := json.Unmarshal(rr.Body.Bytes(), &snap); err != nil {
+		t.Fatalf("failed to decode admin state: %v", err)
+	}
+	lastErr := snap.Scopes[scope].LastError
+	if lastErr == nil {
+		t.Fatalf("expected a last error for scope %q, got %+v", scope, snap.Scopes)
+	}
+	assertInt(t, lastErr.Status, http.StatusForbidden)
+	assertString(t, lastErr.Message, `{"error":{"message":"API key [REDACTED] is not valid"}}`)
+
+	// Terminal errors (no upstream response) are recorded with status 0.
+	createProxyErrorHandler(km, nil)(httptest.NewRecorder(), httptest.NewRequest("GET", "http://"+targetURL.Host+"/v1beta/models", nil), errors.New("connection refused"))
+	lastErr = km.snapshot().Scopes[scope].LastError
+	assertInt(t, lastErr.Status, 0)
+	assertString(t, lastErr.Message, "connection refused")
+}
+
+func TestAdminReset_RestoresKeys(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2", "k3"}, time.Hour)
+	km.markKeyFailed(buildScopeKey("host", "/a"), 0, "test")
+	km.markKeyFailed(buildScopeKey("host", "/a"), 1, "test")
+	km.markKeyFailed(buildScopeKey("host", "/b"), 2, "test")
+	km.getNextKey(buildScopeKey("host", "/c")) // scope with nothing to reset
+
+	handler := createAdminResetHandler(km)
+	assertInt(t, doAdminRequest(t, handler, "POST", "/admin/reset", "").Code, http.StatusUnauthorized)
+	assertInt(t, doAdminRequest(t, handler, "GET", "/admin/reset", "secret").Code, http.StatusMethodNotAllowed)
+
+	rr := doAdminRequest(t, handler, "POST", "/admin/reset", "secret")
+	assertInt(t, rr.Code, http.StatusOK)
+	var resp adminResetResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to decode reset response: %v", err)
+	}
+	assertInt(t, resp.ReactivatedKeys, 3)
+	assertInt(t, resp.Scopes, 2)
+
+	km.lockAll()
+	defer km.unlockAll()
+	for _, scope := range []string{buildScopeKey("host", "/a"), buildScopeKey("host", "/b"), buildScopeKey("host", "/c")} {
+		state := getScopeState(t, km, scope)
+		assertInt(t, len(state.availableKeys), 3)
+		assertInt(t, len(state.failingKeys), 0)
+	}
+}
+
+func TestPprofHandlers(t *testing.T) {
+	proxied := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	newMux := func(enabled bool) *http.ServeMux {
+		mux := http.NewServeMux()
+		if enabled {
+			registerPprofHandlers(mux, "secret")
+		}
+		mux.Handle("/", proxied)
+		return mux
+	}
+	serve := func(mux *http.ServeMux, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://localhost:8080"+path, nil)
+		if token != "" {
+			req.Header.Set(adminTokenHeader, token)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	enabled := newMux(true)
+	rr := serve(enabled, "/debug/pprof/", "secret")
+	assertInt(t, rr.Code, http.StatusOK)
+	if !strings.Contains(rr.Body.String(), "goroutine") {
+		t.Errorf("expected pprof index listing profiles, got: %s", rr.Body.String())
+	}
+	assertInt(t, serve(enabled, "/debug/pprof/heap", "secret").Code, http.StatusOK)
+	assertInt(t, serve(enabled, "/debug/pprof/", "").Code, http.StatusUnauthorized)
+
+	// Disabled: the path falls through to the proxy handler.
+	assertInt(t, serve(newMux(false), "/debug/pprof/", "secret").Code, http.StatusTeapot)
+}
+
+func TestAdminState_ReportsKeyLastUsedAndFailed(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", ""}, time.Minute)
+	scope := buildScopeKey("host", "/path")
+
+	rr := doAdminRequest(t, createAdminStateHandler(km), "GET", "/admin/state", "secret")
+	if strings.Contains(rr.Body.String(), "lastUsed") || strings.Contains(rr.Body.String(), "lastFailed") {
+		t.Errorf("expected unset timestamps to be omitted, got %s", rr.Body.String())
+	}
+	var snap keyManagerSnapshot
+	if err := json.Unmarshal(rr.Body.Bytes(), &snap); err != nil {
+		t.Fatalf("failed to decode admin state: %v", err)
+	}
+	assertInt(t, len(snap.Keys), 1) // the empty key slot is not listed
+
+	before := time.Now()
+	km.getNextKey(scope)
+	firstUse := km.snapshot().Keys[0].LastUsed
+	if firstUse.Before(before) {
+		t.Errorf("lastUsed %s not updated by getNextKey", firstUse)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	km.getNextKey(scope)
+	if secondUse := km.snapshot().Keys[0].LastUsed; !secondUse.After(firstUse) {
+		t.Errorf("lastUsed did not advance: %s then %s", firstUse, secondUse)
+	}
+	if !km.snapshot().Keys[0].LastFailed.IsZero() {
+		t.Error("lastFailed set before any failure")
+	}
+
+	km.markKeyFailed(scope, 0, "status 429")
+	key := km.snapshot().Keys[0]
+	if key.LastFailed.Before(key.LastUsed) {
+		t.Errorf("lastFailed %s not updated by markKeyFailed", key.LastFailed)
+	}
+}
+
+func TestAdminReload_AddsKeyAndNoOp(t *testing.T) {
+	path := writeTempFile(t, "keys.txt", "k1\n")
+	km, _ := newKeyManager([]string{"k1"}, time.Hour)
+	handler := createAdminReloadHandler(&keyReloader{keysFile: path, keyMan: km})
+
+	assertInt(t, doAdminRequest(t, handler, "POST", "/admin/reload", "").Code, http.StatusUnauthorized)
+	assertInt(t, doAdminRequest(t, handler, "GET", "/admin/reload", "secret").Code, http.StatusMethodNotAllowed)
+
+	decode := func(rr *httptest.ResponseRecorder) keyReloadSummary {
+		t.Helper()
+		assertInt(t, rr.Code, http.StatusOK)
+		var summary keyReloadSummary
+		if err := json.Unmarshal(rr.Body.Bytes(), &summary); err != nil {
+			t.Fatalf("failed to decode reload response: %v", err)
+		}
+		return summary
+	}
+
+	// Nothing changed on disk: a no-op.
+	summary := decode(doAdminRequest(t, handler, "POST", "/admin/reload", "secret"))
+	assertInt(t, summary.Added, 0)
+	assertInt(t, summary.Removed, 0)
+	assertInt(t, summary.Kept, 1)
+	assertInt(t, summary.TotalKeys, 1)
+
+	// A key added to the file is picked up.
+	if err := os.WriteFile(path, []byte("k1\nk2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	summary = decode(doAdminRequest(t, handler, "POST", "/admin/reload", "secret"))
+	assertInt(t, summary.Added, 1)
+	assertInt(t, summary.Kept, 1)
+	assertInt(t, summary.TotalKeys, 2)
+	assertInt(t, km.snapshot().TotalKeys, 2)
+
+	// A failed reload keeps the current keys.
+	if err := os.WriteFile(path, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rr := doAdminRequest(t, handler, "POST", "/admin/reload", "secret")
+	assertInt(t, rr.Code, http.StatusUnprocessableEntity)
+	assertInt(t, km.snapshot().TotalKeys, 2)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Outcomes of an upstream attempt, as logged in attemptRecord.
+const (
+	// attemptOK: the response is returned to the client.
+	attemptOK = "ok"
+	// attemptRetryable: the attempt failed and another attempt follows, unless the request runs
+	// out of keys or time first.
+	attemptRetryable = "retryable"
+	// attemptFinal: the attempt failed and its response or error is returned without a retry,
+	// including retryable failures once the attempts or the retry budget are used up.
+	attemptFinal = "final"
+	// attemptCanceled: the client went away or its deadline passed during the attempt.
+	attemptCanceled = "canceled"
+)
+
+// attemptRecord summarizes one upstream attempt made by retryTransport.RoundTrip. Exactly one
+// record is logged per attempt, so a retry sequence reads as consecutive attempt=N lines.
+type attemptRecord struct {
+	scope    string
+	attempt  int // 1-based
+	keyIndex int
+	// Upstream status, or 0 if the attempt ended without a response.
+	status   int
+	err      error
+	duration time.Duration
+	outcome  string
+	// Why the attempt was not OK, e.g. "rate_limited" or "server_error". Empty for OK attempts.
+	reason string
+}
+
+// String formats the record as space-separated key=value fields; values that may contain
+// spaces are quoted.
+func (r attemptRecord) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Retry Transport] attempt scope=%q attempt=%d key_index=%d outcome=%s", scopeForLog(r.scope), r.attempt, r.keyIndex, r.outcome)
+	if r.status != 0 {
+		fmt.Fprintf(&b, " status=%d", r.status)
+	}
+	if r.reason != "" {
+		fmt.Fprintf(&b, " reason=%s", r.reason)
+	}
+	if r.err != nil {
+		fmt.Fprintf(&b, " error=%q", r.err.Error())
+	}
+	fmt.Fprintf(&b, " duration=%s", r.duration.Round(time.Microsecond))
+	return b.String()
+}
+
+// level returns the level the record is logged at: failures that are retried at warn, errors
+// returned to the client at warn, non-retryable statuses (e.g. 400 or -no-retry-statuses) at
+// info, and OK attempts at debug, so a healthy request adds no info lines.
+func (r attemptRecord) level() logLevel {
+	switch {
+	case r.outcome == attemptRetryable, r.err != nil:
+		return levelWarn
+	case r.outcome == attemptOK:
+		return levelDebug
+	default:
+		return levelInfo
+	}
+}
+
+// log writes the record at its level.
+func (r attemptRecord) log() {
+	if logEnabled(r.level()) {
+		logf(r.level(), "%s", r)
+	}
+}
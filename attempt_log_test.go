@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAttemptRecord_String(t *testing.T) {
+	record := attemptRecord{scope: "host|/v1/models", attempt: 2, keyIndex: 1, status: 429, outcome: attemptRetryable, reason: "rate_limited", duration: 1500 * time.Microsecond}
+	assertString(t, record.String(), `[Retry Transport] attempt scope="host|/v1/models" attempt=2 key_index=1 outcome=retryable status=429 reason=rate_limited duration=1.5ms`)
+
+	record = attemptRecord{scope: "host|/", attempt: 1, keyIndex: 0, err: errors.New("dial tcp: refused"), outcome: attemptFinal, reason: "transport_error", duration: time.Millisecond}
+	assertString(t, record.String(), `[Retry Transport] attempt scope="host|/" attempt=1 key_index=0 outcome=final reason=transport_error error="dial tcp: refused" duration=1ms`)
+	if record.level() != levelWarn {
+		t.Errorf("expected errors to log at warn, got %v", record.level())
+	}
+	if (attemptRecord{outcome: attemptOK}).level() != levelDebug {
+		t.Error("expected OK attempts to log at debug")
+	}
+}
+
+func TestRetryTransport_LogsOneRecordPerAttempt(t *testing.T) {
+	upstream := newFakeGemini(t, map[string][]int{"k1": {http.StatusTooManyRequests}, "k2": {http.StatusServiceUnavailable, http.StatusOK}})
+	km, _ := newKeyManager([]string{"k1", "k2"}, time.Hour)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+
+	logBuf := captureLogs(t, levelDebug)
+	req := httptest.NewRequest("GET", upstream.URL+"/v1beta/models", nil)
+	req.RequestURI = ""
+	req.Header.Set(keySessionHeader, sessionForKeyIndex(t, km, 0))
+	resp, err := rt.RoundTrip(req)
+	assertNoError(t, err)
+	resp.Body.Close()
+	assertInt(t, resp.StatusCode, http.StatusOK)
+
+	var records []string
+	for _, line := range strings.Split(logBuf.String(), "\n") {
+		if strings.Contains(line, "[Retry Transport] attempt ") {
+			records = append(records, line)
+		}
+	}
+	// k1 is rate limited (and sidelined), k2 fails once with 503 and then succeeds.
+	want := []string{
+		`attempt=1 key_index=0 outcome=retryable status=429 reason=rate_limited duration=`,
+		`attempt=2 key_index=1 outcome=retryable status=503 reason=server_error duration=`,
+		`attempt=3 key_index=1 outcome=ok status=200 duration=`,
+	}
+	assertInt(t, len(records), len(want))
+	scope := `scope="` + requestScope(req) + `"`
+	for i, record := range records {
+		if !strings.Contains(record, want[i]) || !strings.Contains(record, scope) {
+			t.Errorf("record %d = %q, want fields %q and %q", i, record, scope, want[i])
+		}
+	}
+}
+
+func TestRetryTransport_LogsFinalWhenRetriesRunOut(t *testing.T) {
+	upstream := newFakeGemini(t, map[string][]int{"k1": {http.StatusServiceUnavailable}})
+	km, _ := newKeyManager([]string{"k1"}, time.Hour)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+	rt.retryBudget = 1
+
+	logBuf := captureLogs(t, levelDebug)
+	req := httptest.NewRequest("GET", upstream.URL+"/v1beta/models", nil)
+	req.RequestURI = ""
+	_, err := rt.RoundTrip(req)
+	assertErrorContains(t, err, "status 503 after 2 attempts")
+
+	var records []string
+	for _, line := range strings.Split(logBuf.String(), "\n") {
+		if strings.Contains(line, "[Retry Transport] attempt ") {
+			records = append(records, line)
+		}
+	}
+	// The budget allows one retry, so the second 503 is final rather than retryable.
+	want := []string{
+		`attempt=1 key_index=0 outcome=retryable status=503 reason=server_error duration=`,
+		`attempt=2 key_index=0 outcome=final status=503 reason=server_error duration=`,
+	}
+	assertInt(t, len(records), len(want))
+	for i, record := range records {
+		if !strings.Contains(record, want[i]) {
+			t.Errorf("record %d = %q, want fields %q", i, record, want[i])
+		}
+	}
+}
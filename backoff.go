@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// Backoff strategies accepted by -backoff.
+const (
+	backoffNone              = "none"
+	backoffConstant          = "constant"
+	backoffExponential       = "exponential"
+	backoffExponentialJitter = "exponential-jitter"
+)
+
+// backoffPolicy decides how long the retry transport waits before each retry.
+// The zero value never waits.
+type backoffPolicy struct {
+	strategy string
+	// Delay before the first retry (and every retry for "constant").
+	base time.Duration
+	// Upper bound on any single delay. Zero means no bound.
+	max time.Duration
+}
+
+// parseBackoffStrategy validates a -backoff value.
+func parseBackoffStrategy(raw string) (string, error) {
+	switch strategy := strings.ToLower(strings.TrimSpace(raw)); strategy {
+	case backoffNone, backoffConstant, backoffExponential, backoffExponentialJitter:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("invalid backoff strategy %q: expected none, constant, exponential or exponential-jitter", raw)
+	}
+}
+
+// delay returns the wait before retry number retry (1 for the first retry).
+// "exponential" doubles base on every retry; "exponential-jitter" picks a random delay
+// between zero and the exponential delay so that clients retrying together spread out.
+func (b backoffPolicy) delay(retry int) time.Duration {
+	var d time.Duration
+	switch b.strategy {
+	case backoffConstant:
+		d = b.base
+	case backoffExponential, backoffExponentialJitter:
+		d = b.base
+		for i := 1; i < retry && (b.max <= 0 || d < b.max); i++ {
+			d *= 2
+		}
+	default:
+		return 0
+	}
+	if b.max > 0 && d > b.max {
+		d = b.max
+	}
+	if b.strategy == backoffExponentialJitter && d > 0 {
+		d = rand.N(d + 1)
+	}
+	return d
+}
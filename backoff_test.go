@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoffPolicy_Delays(t *testing.T) {
+	ms := time.Millisecond
+	cases := []struct {
+		policy backoffPolicy
+		want   []time.Duration
+	}{
+		{backoffPolicy{}, []time.Duration{0, 0, 0}},
+		{backoffPolicy{strategy: backoffNone, base: 100 * ms}, []time.Duration{0, 0, 0}},
+		{backoffPolicy{strategy: backoffConstant, base: 100 * ms}, []time.Duration{100 * ms, 100 * ms, 100 * ms}},
+		{backoffPolicy{strategy: backoffExponential, base: 100 * ms}, []time.Duration{100 * ms, 200 * ms, 400 * ms, 800 * ms}},
+		{backoffPolicy{strategy: backoffExponential, base: 100 * ms, max: 300 * ms}, []time.Duration{100 * ms, 200 * ms, 300 * ms, 300 * ms}},
+	}
+	for _, tc := range cases {
+		for i, want := range tc.want {
+			if got := tc.policy.delay(i + 1); got != want {
+				t.Errorf("%+v: delay(%d) = %s, want %s", tc.policy, i+1, got, want)
+			}
+		}
+	}
+}
+
+func TestBackoffPolicy_ExponentialJitterBounds(t *testing.T) {
+	ms := time.Millisecond
+	policy := backoffPolicy{strategy: backoffExponentialJitter, base: 100 * ms, max: 300 * ms}
+	for retry, bound := range map[int]time.Duration{1: 100 * ms, 2: 200 * ms, 3: 300 * ms, 10: 300 * ms} {
+		for range 50 {
+			if got := policy.delay(retry); got < 0 || got > bound {
+				t.Fatalf("delay(%d) = %s, want within [0, %s]", retry, got, bound)
+			}
+		}
+	}
+}
+
+func TestParseBackoffStrategy(t *testing.T) {
+	for _, raw := range []string{"none", "constant", "Exponential", " exponential-jitter "} {
+		_, err := parseBackoffStrategy(raw)
+		assertNoError(t, err)
+	}
+	_, err := parseBackoffStrategy("linear")
+	assertErrorContains(t, err, "invalid backoff strategy")
+}
+
+func TestRetryTransport_BackoffWaitsBetweenAttempts(t *testing.T) {
+	var calls int32
+	server := newCountingServer(t, http.StatusInternalServerError, &calls)
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+	rt.retryBudget = 2
+	rt.backoff = backoffPolicy{strategy: backoffConstant, base: 30 * time.Millisecond}
+
+	req := httptest.NewRequest("GET", server.URL+"/v1beta/models", nil)
+	req.RequestURI = ""
+	req = req.WithContext(withRetryTracker(req.Context()))
+
+	start := time.Now()
+	rt.RoundTrip(req)
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("Expected two 30ms waits, request took %s", elapsed)
+	}
+	assertInt(t, int(atomic.LoadInt32(&calls)), 3)
+}
+
+func TestRetryTransport_BackoffStopsOnCancel(t *testing.T) {
+	var calls int32
+	server := newCountingServer(t, http.StatusInternalServerError, &calls)
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+	rt.backoff = backoffPolicy{strategy: backoffConstant, base: time.Minute}
+
+	ctx, cancel := context.WithTimeout(withRetryTracker(context.Background()), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("GET", server.URL+"/v1beta/models", nil).WithContext(ctx)
+	req.RequestURI = ""
+
+	_, err := rt.RoundTrip(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	assertInt(t, int(atomic.LoadInt32(&calls)), 1)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Key entry prefixes marking OAuth access tokens. "bearer:" is followed by the token itself;
+// "bearer-file:" by the path of a file holding the token, re-read by the refresh routine.
+const (
+	bearerKeyPrefix     = "bearer:"
+	bearerFileKeyPrefix = "bearer-file:"
+)
+
+// bearerRefreshCheckInterval is how often runBearerTokenRefresh checks for tokens near expiry.
+const bearerRefreshCheckInterval = 30 * time.Second
+
+// minBearerTokenLifetime is the shortest -bearer-token-lifetime accepted. Token files are
+// checked every tenth of the lifetime, so shorter values would re-read them in a busy loop.
+const minBearerTokenLifetime = 10 * time.Second
+
+// validateBearerTokenLifetime checks a -bearer-token-lifetime value: zero (never re-read) or at
+// least minBearerTokenLifetime.
+func validateBearerTokenLifetime(lifetime time.Duration) error {
+	if lifetime != 0 && lifetime < minBearerTokenLifetime {
+		return fmt.Errorf("lifetime %s must be 0 or at least %s", lifetime, minBearerTokenLifetime)
+	}
+	return nil
+}
+
+// bearerTokenFile is a bearer key whose token is read from path and refreshed before it expires.
+type bearerTokenFile struct {
+	index     int
+	path      string
+	expiresAt time.Time
+}
+
+// readBearerTokenFile reads a token from path, trimming surrounding whitespace.
+func readBearerTokenFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read bearer token file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("bearer token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// splitBearerKeys strips the bearer prefixes from keys (same order and indices), reading
+// file-based tokens. It returns the keys, the set of key indices that are bearer tokens,
+// and the token files to refresh.
+func splitBearerKeys(entries []string) ([]string, map[int]bool, []*bearerTokenFile, error) {
+	keys := make([]string, len(entries))
+	bearer := make(map[int]bool)
+	var files []*bearerTokenFile
+	for i, entry := range entries {
+		switch {
+		case strings.HasPrefix(entry, bearerFileKeyPrefix):
+			path := strings.TrimSpace(strings.TrimPrefix(entry, bearerFileKeyPrefix))
+			token, err := readBearerTokenFile(path)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("key index %d: %w", i, err)
+			}
+			keys[i] = token
+			bearer[i] = true
+			files = append(files, &bearerTokenFile{index: i, path: path})
+		case strings.HasPrefix(entry, bearerKeyPrefix):
+			keys[i] = strings.TrimSpace(strings.TrimPrefix(entry, bearerKeyPrefix))
+			bearer[i] = true
+		default:
+			keys[i] = entry
+		}
+	}
+	return keys, bearer, files, nil
+}
+
+// refreshBearerTokens re-reads every token file whose token expires within a tenth of lifetime
+// of now, and puts the new token in rotation. Returns the number of tokens refreshed.
+// A file that cannot be read keeps its current token and is retried on the next call.
+func refreshBearerTokens(km *keyManager, files []*bearerTokenFile, lifetime time.Duration, now time.Time) int {
+	refreshed := 0
+	for _, f := range files {
+		if !f.expiresAt.IsZero() && now.Before(f.expiresAt.Add(-lifetime/10)) {
+			continue
+		}
+		token, err := readBearerTokenFile(f.path)
+		if err != nil {
+			logErrorf("Error refreshing bearer token for key index %d: %v", f.index, err)
+			continue
+		}
+		km.replaceKey(f.index, token)
+		f.expiresAt = now.Add(lifetime)
+		refreshed++
+		logInfof("Refreshed bearer token for key index %d from %s", f.index, f.path)
+	}
+	return refreshed
+}
+
+// runBearerTokenRefresh refreshes token files near expiry until stop is closed.
+// The tokens read at startup are assumed to be fresh. A nil stop channel runs forever.
+func runBearerTokenRefresh(km *keyManager, files []*bearerTokenFile, lifetime time.Duration, stop <-chan struct{}) {
+	now := time.Now()
+	for _, f := range files {
+		f.expiresAt = now.Add(lifetime)
+	}
+	ticker := time.NewTicker(min(bearerRefreshCheckInterval, lifetime/10))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			refreshBearerTokens(km, files, lifetime, time.Now())
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSplitBearerKeys(t *testing.T) {
+	path := writeTempFile(t, "token", "ya29.file-token\n")
+
+	keys, bearer, files, err := splitBearerKeys([]string{"api-key", "bearer: ya29.static", bearerFileKeyPrefix + path})
+	assertNoError(t, err)
+	assertString(t, keys[0], "api-key")
+	assertString(t, keys[1], "ya29.static")
+	assertString(t, keys[2], "ya29.file-token")
+	if bearer[0] || !bearer[1] || !bearer[2] {
+		t.Errorf("unexpected bearer set %v", bearer)
+	}
+	assertInt(t, len(files), 1)
+	assertInt(t, files[0].index, 2)
+
+	_, _, _, err = splitBearerKeys([]string{bearerFileKeyPrefix + filepath.Join(t.TempDir(), "missing")})
+	assertErrorContains(t, err, "key index 0")
+}
+
+func TestValidateBearerTokenLifetime(t *testing.T) {
+	assertNoError(t, validateBearerTokenLifetime(0))
+	assertNoError(t, validateBearerTokenLifetime(time.Hour))
+	assertNoError(t, validateBearerTokenLifetime(minBearerTokenLifetime))
+	// A tenth of 5ns is 0, which would make the ticker in runBearerTokenRefresh panic.
+	assertErrorContains(t, validateBearerTokenLifetime(5*time.Nanosecond), "must be 0 or at least")
+	assertErrorContains(t, validateBearerTokenLifetime(time.Second), "must be 0 or at least")
+	assertErrorContains(t, validateBearerTokenLifetime(-time.Minute), "must be 0 or at least")
+}
+
+func TestRetryTransport_BearerKeyUsesAuthorizationHeader(t *testing.T) {
+	var gotAuth, gotGoogKey, gotQueryKey string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		gotGoogKey = r.Header.Get("x-goog-api-key")
+		gotQueryKey = r.URL.Query().Get("key")
+	}))
+	defer server.Close()
+
+	km, _ := newKeyManager([]string{"ya29.token"}, time.Minute)
+	// Neither the query parameter default nor a header-auth path may apply to bearer keys.
+	for _, headerPaths := range [][]string{nil, {"/v1beta/models"}} {
+		rt := newRetryTransport(http.DefaultTransport, km, "key", headerPaths)
+		rt.bearerKeys = map[int]bool{0: true}
+		req := httptest.NewRequest("GET", server.URL+"/v1beta/models?key=client", nil)
+		req.RequestURI = ""
+		req.Header.Set("Authorization", "Bearer client-token")
+		resp, err := rt.RoundTrip(req)
+		assertNoError(t, err)
+		resp.Body.Close()
+
+		assertString(t, gotAuth, "Bearer ya29.token")
+		assertString(t, gotGoogKey, "")
+		assertString(t, gotQueryKey, "")
+	}
+}
+
+func TestRefreshBearerTokens_NearExpiry(t *testing.T) {
+	path := writeTempFile(t, "token", "ya29.old")
+	km, _ := newKeyManager([]string{"ya29.old", "api-key"}, time.Minute)
+	scope := buildScopeKey("host", "/v1beta/models")
+	km.getNextKey(scope) // create the scope
+
+	start := time.Now()
+	files := []*bearerTokenFile{{index: 0, path: path, expiresAt: start.Add(time.Hour)}}
+	assertNoError(t, os.WriteFile(path, []byte("ya29.new\n"), 0o600))
+
+	// Well before expiry: nothing is re-read.
+	assertInt(t, refreshBearerTokens(km, files, time.Hour, start.Add(30*time.Minute)), 0)
+	assertString(t, km.originalKeys[0], "ya29.old")
+
+	// Within a tenth of the lifetime of expiry: the new token replaces the old one everywhere.
+	now := start.Add(55 * time.Minute)
+	assertInt(t, refreshBearerTokens(km, files, time.Hour, now), 1)
+	assertString(t, km.originalKeys[0], "ya29.new")
+	km.lockAll()
+	assertString(t, getScopeState(t, km, scope).availableKeys[0], "ya29.new")
+	km.unlockAll()
+	if !files[0].expiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("expiry not extended: %s", files[0].expiresAt)
+	}
+
+	// An unreadable file keeps the current token and is retried.
+	assertNoError(t, os.Remove(path))
+	assertInt(t, refreshBearerTokens(km, files, time.Hour, now.Add(2*time.Hour)), 0)
+	assertString(t, km.originalKeys[0], "ya29.new")
+}
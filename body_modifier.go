@@ -1,73 +1,171 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"regexp"
+	"strings"
 )
 
+// triggerReplaceMode controls what happens to an existing tools array when the search trigger fires.
+type triggerReplaceMode string
+
+const (
+	// triggerReplace replaces the whole tools array with just google_search.
+	triggerReplace triggerReplaceMode = "replace"
+	// triggerMerge appends google_search and drops only functionDeclarations, which conflict with it.
+	triggerMerge triggerReplaceMode = "merge"
+)
+
+// parseTriggerReplaceMode validates a -trigger-replace-mode value.
+func parseTriggerReplaceMode(raw string) (triggerReplaceMode, error) {
+	switch mode := triggerReplaceMode(strings.ToLower(strings.TrimSpace(raw))); mode {
+	case triggerReplace, triggerMerge:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid trigger replace mode %q: must be %q or %q", raw, triggerReplace, triggerMerge)
+	}
+}
+
+// bodyModifierOptions configures how handlePostBody modifies Gemini request bodies.
+type bodyModifierOptions struct {
+	addGoogleSearch bool
+	searchTrigger   string
+	triggerMode     triggerReplaceMode
+	// Where to look for searchTrigger (see parseTriggerPaths). Nil means the default Gemini paths.
+	triggerPaths []triggerPath
+	// Treat the request as triggered regardless of its content (set per request by the main handler).
+	forceSearch bool
+	// Inserted as systemInstruction when the client sends none. Empty disables injection.
+	defaultSystemInstruction string
+	// Declarative rewrites applied after the tool logic (see parseBodyRewrites).
+	rewrites []bodyRewriteRule
+	// Check the modified body with json.Valid and fall back to the original body if it is invalid.
+	validateModified bool
+}
+
 // handlePostBody processes the POST request body and returns the modified body and any error.
-func handlePostBody(body io.ReadCloser, addGoogleSearch bool, searchTrigger string) ([]byte, error) {
-	bodyBytes, err := io.ReadAll(body)
+func handlePostBody(body io.ReadCloser, opts bodyModifierOptions) ([]byte, error) {
+	originalBytes, err := io.ReadAll(body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read request body: %w", err)
 	}
 	// log.Printf("Original Request Body: %s", string(bodyBytes))
 
-	if !addGoogleSearch {
+	bodyBytes, err := modifyPostBody(originalBytes, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.validateModified {
+		return ensureValidModification(originalBytes, bodyBytes), nil
+	}
+	return bodyBytes, nil
+}
+
+// modifyPostBody applies the tool logic, the default system instruction and the rewrites, in that order.
+func modifyPostBody(bodyBytes []byte, opts bodyModifierOptions) ([]byte, error) {
+	var err error
+	if opts.addGoogleSearch {
+		bodyBytes, err = modifyBodyWithGoogleSearch(bodyBytes, opts.searchTrigger, opts.triggerMode, opts.triggerPaths, opts.forceSearch)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.defaultSystemInstruction != "" {
+		bodyBytes, err = injectDefaultSystemInstruction(bodyBytes, opts.defaultSystemInstruction)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(opts.rewrites) > 0 {
+		return applyBodyRewrites(bodyBytes, opts.rewrites)
+	}
+	return bodyBytes, nil
+}
+
+// ensureValidModification returns modified, unless the modification turned the body into
+// invalid JSON, in which case it logs and returns the original body so corrupt data is
+// never forwarded. Bodies that were not modified are returned as-is.
+func ensureValidModification(original, modified []byte) []byte {
+	if bytes.Equal(original, modified) || json.Valid(modified) {
+		return modified
+	}
+	logErrorf("Body modification produced invalid JSON (%d bytes); forwarding the original body instead.", len(modified))
+	return original
+}
+
+// injectDefaultSystemInstruction adds {"systemInstruction": {"parts": [{"text": instruction}]}}
+// to a JSON object body that has no system instruction (in either camelCase or snake_case form).
+// A client-provided instruction is never overridden; non-JSON bodies are returned unchanged.
+func injectDefaultSystemInstruction(bodyBytes []byte, instruction string) ([]byte, error) {
+	var requestData map[string]any
+	if err := decodeJSONPreservingNumbers(bodyBytes, &requestData); err != nil {
+		logWarnf("Failed to parse request body as JSON for system instruction: %v. Proceeding with original body.", err)
+		return bodyBytes, nil
+	}
+	if _, ok := requestData["systemInstruction"]; ok {
 		return bodyBytes, nil
 	}
+	if _, ok := requestData["system_instruction"]; ok {
+		return bodyBytes, nil
+	}
+
+	logDebugf("No systemInstruction in request, adding the default.")
+	requestData["systemInstruction"] = map[string]any{
+		"parts": []any{map[string]any{"text": instruction}},
+	}
+	modifiedBodyBytes, err := marshalJSONPreservingText(requestData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body with system instruction: %w", err)
+	}
+	return modifiedBodyBytes, nil
+}
 
-	return modifyBodyWithGoogleSearch(bodyBytes, searchTrigger)
+// validateJSONBody returns the parse error if bodyBytes is not a single valid JSON value.
+func validateJSONBody(bodyBytes []byte) error {
+	var v any
+	if err := json.Unmarshal(bodyBytes, &v); err != nil {
+		return err
+	}
+	return nil
 }
 
 // modifyBodyWithGoogleSearch conditionally adds the Google Search tool and modifies the request body.
-func modifyBodyWithGoogleSearch(bodyBytes []byte, searchTrigger string) ([]byte, error) {
+// mode decides whether a triggered request keeps its other tools (see triggerReplaceMode), and
+// paths says where to look for the trigger word (nil means the default Gemini paths). forced
+// treats the request as triggered whatever its content (see mainHandlerOptions.forceSearchParam).
+func modifyBodyWithGoogleSearch(bodyBytes []byte, searchTrigger string, mode triggerReplaceMode, paths []triggerPath, forced bool) ([]byte, error) {
 	var requestData map[string]any
-	if err := json.Unmarshal(bodyBytes, &requestData); err != nil {
+	if err := decodeJSONPreservingNumbers(bodyBytes, &requestData); err != nil {
 		// Non-JSON body or parse error, return original
-		log.Printf("Warning: Failed to parse request body as JSON: %v. Proceeding with original body.", err)
+		logWarnf("Failed to parse request body as JSON: %v. Proceeding with original body.", err)
 		return bodyBytes, nil
 	}
 
 	modified := false
-	triggerFound := false
+	triggerFound := forced
 	hasFunctionDeclarations := false
 
 	// --- Check for trigger word in message content ---
-	// Assuming structure: {"contents": [{"parts": [{"text": "..."}]}]}
-	if contents, ok := requestData["contents"].([]any); ok {
-		for _, contentItem := range contents {
-			if contentMap, ok := contentItem.(map[string]any); ok {
-				if parts, ok := contentMap["parts"].([]any); ok {
-					// Compile regex for word boundary matching (case-insensitive)
-					// We compile it here in case searchTrigger changes, though it's passed as an arg
-					// If performance becomes an issue with many parts, consider compiling once outside the loop
-					triggerPattern := `(?i)\b` + regexp.QuoteMeta(searchTrigger) + `\b`
-					triggerRegex, err := regexp.Compile(triggerPattern)
-					if err != nil {
-						log.Printf("Error compiling search trigger regex: %v. Falling back to simple contains.", err)
-						// Fallback or handle error appropriately
-						// For now, let's log and potentially skip regex matching for this part
-						continue // Or use strings.Contains as a fallback
-					}
-
-					for _, partItem := range parts {
-						if partMap, ok := partItem.(map[string]any); ok {
-							if text, ok := partMap["text"].(string); ok {
-								if triggerRegex.MatchString(text) {
-									triggerFound = true
-									log.Printf("Search trigger word '%s' found as whole word in message.", searchTrigger)
-									break // Found in this part, break inner loop
-								}
-							}
-						}
-					}
-				}
-			}
-			if triggerFound {
+	// By default the text lives at {"contents": [{"parts": [{"text": "..."}]}]}; -trigger-paths
+	// points the scan elsewhere for other request shapes.
+	if paths == nil {
+		paths = defaultParsedTriggerPaths
+	}
+	triggerPattern := `(?i)\b` + regexp.QuoteMeta(searchTrigger) + `\b`
+	if forced {
+		logDebugf("Search forced for this request, skipping the trigger word check.")
+	} else if triggerRegex, err := regexp.Compile(triggerPattern); err != nil {
+		logErrorf("Error compiling search trigger regex: %v. Skipping the trigger check.", err)
+	} else {
+		for _, text := range collectTriggerTexts(requestData, paths) {
+			if triggerRegex.MatchString(text) {
+				triggerFound = true
+				logDebugf("Search trigger word '%s' found as whole word in message.", searchTrigger)
 				break
 			}
 		}
@@ -82,7 +180,7 @@ func modifyBodyWithGoogleSearch(bodyBytes []byte, searchTrigger string) ([]byte,
 				if toolMap, ok := tool.(map[string]any); ok {
 					if _, fdExists := toolMap["functionDeclarations"]; fdExists {
 						hasFunctionDeclarations = true
-						log.Println("Found 'functionDeclarations' within tools array.")
+						logDebugf("Found 'functionDeclarations' within tools array.")
 						break // Found it, no need to check further
 					}
 				}
@@ -91,7 +189,7 @@ func modifyBodyWithGoogleSearch(bodyBytes []byte, searchTrigger string) ([]byte,
 			// Check if tools is a map (less common for function declarations, but handle just in case)
 			if _, fdExists := toolsMap["functionDeclarations"]; fdExists {
 				hasFunctionDeclarations = true
-				log.Println("Found 'functionDeclarations' within tools map.")
+				logDebugf("Found 'functionDeclarations' within tools map.")
 			}
 		}
 	}
@@ -103,14 +201,14 @@ func modifyBodyWithGoogleSearch(bodyBytes []byte, searchTrigger string) ([]byte,
 	// --- Apply modification logic ---
 	if triggerFound {
 		// Force google_search, remove functionDeclarations
-		log.Println("Trigger found: Ensuring 'google_search' tool exists and removing 'functionDeclarations'.")
+		logDebugf("Trigger found: Ensuring 'google_search' tool exists and removing 'functionDeclarations'.")
 
 		// Remove functionDeclarations if they exist within a map structure
 		if toolsExist {
 			if toolsMap, ok := toolsVal.(map[string]any); ok {
 				if hasFunctionDeclarations {
 					delete(toolsMap, "functionDeclarations")
-					log.Println("Removed 'functionDeclarations'.")
+					logDebugf("Removed 'functionDeclarations'.")
 					modified = true // Mark modified as we deleted something
 					// If the map becomes empty after deletion, remove the tools key? Or leave empty map?
 					// Let's leave it potentially empty for now. If it causes issues, we can remove it.
@@ -125,24 +223,29 @@ func modifyBodyWithGoogleSearch(bodyBytes []byte, searchTrigger string) ([]byte,
 				}
 				if !googleSearchAlreadyPresent {
 					toolsMap["google_search"] = googleSearchTool["google_search"]
-					log.Println("Added 'google_search' to existing tools map.")
+					logDebugf("Added 'google_search' to existing tools map.")
 					modified = true
 				}
 				requestData["tools"] = toolsMap // Ensure the map is updated
+			} else if toolsSlice, ok := toolsVal.([]any); ok && mode == triggerMerge {
+				// Tools is an array. Keep the client's other tools, dropping only functionDeclarations.
+				logDebugf("Merging 'google_search' into existing tools array, dropping 'functionDeclarations'.")
+				requestData["tools"] = mergeGoogleSearchTool(toolsSlice, googleSearchTool)
+				modified = true
 			} else if _, ok := toolsVal.([]any); ok {
 				// Tools is an array. Replace it entirely with just google_search.
-				log.Println("Replacing existing tools array with just 'google_search'.")
+				logDebugf("Replacing existing tools array with just 'google_search'.")
 				requestData["tools"] = []any{googleSearchTool}
 				modified = true
 			} else {
 				// Tools is some other type, overwrite it.
-				log.Printf("Overwriting existing 'tools' field (type %T) with 'google_search'.", toolsVal)
+				logDebugf("Overwriting existing 'tools' field (type %T) with 'google_search'.", toolsVal)
 				requestData["tools"] = []any{googleSearchTool}
 				modified = true
 			}
 		} else {
 			// Tools field doesn't exist, create it with google_search
-			log.Println("Creating 'tools' field with 'google_search'.")
+			logDebugf("Creating 'tools' field with 'google_search'.")
 			requestData["tools"] = []any{googleSearchTool}
 			modified = true
 		}
@@ -151,11 +254,11 @@ func modifyBodyWithGoogleSearch(bodyBytes []byte, searchTrigger string) ([]byte,
 		// No trigger word found
 		if hasFunctionDeclarations {
 			// FunctionDeclarations exist, do nothing regarding tools
-			log.Println("No trigger found and 'functionDeclarations' present. No tool modification needed.")
+			logDebugf("No trigger found and 'functionDeclarations' present. No tool modification needed.")
 			// modified remains false
 		} else {
 			// No FunctionDeclarations, add google_search if not already present
-			log.Println("No trigger found and no 'functionDeclarations'. Ensuring 'google_search' tool exists.")
+			logDebugf("No trigger found and no 'functionDeclarations'. Ensuring 'google_search' tool exists.")
 			if toolsExist {
 				googleSearchAlreadyPresent := false
 				// Check if it's an array
@@ -169,31 +272,31 @@ func modifyBodyWithGoogleSearch(bodyBytes []byte, searchTrigger string) ([]byte,
 						}
 					}
 					if !googleSearchAlreadyPresent {
-						log.Println("Appending 'google_search' to existing tools array.")
+						logDebugf("Appending 'google_search' to existing tools array.")
 						requestData["tools"] = append(toolsSlice, googleSearchTool)
 						modified = true
 					} else {
-						log.Println("'google_search' tool already present in tools array.")
+						logDebugf("'google_search' tool already present in tools array.")
 					}
 				} else if toolsMap, ok := toolsVal.(map[string]any); ok {
 					// Tools is a map, add google_search if not present
 					if _, gsExists := toolsMap["google_search"]; !gsExists {
-						log.Println("Adding 'google_search' to existing tools map.")
+						logDebugf("Adding 'google_search' to existing tools map.")
 						toolsMap["google_search"] = googleSearchTool["google_search"]
 						requestData["tools"] = toolsMap // Update the map
 						modified = true
 					} else {
-						log.Println("'google_search' tool already present in tools map.")
+						logDebugf("'google_search' tool already present in tools map.")
 					}
 				} else {
 					// Tools is some other type, overwrite it.
-					log.Printf("Overwriting existing 'tools' field (type %T) with 'google_search'.", toolsVal)
+					logDebugf("Overwriting existing 'tools' field (type %T) with 'google_search'.", toolsVal)
 					requestData["tools"] = []any{googleSearchTool}
 					modified = true
 				}
 			} else {
 				// Tools field doesn't exist, create it
-				log.Println("Creating 'tools' field with 'google_search'.")
+				logDebugf("Creating 'tools' field with 'google_search'.")
 				requestData["tools"] = []any{googleSearchTool}
 				modified = true
 			}
@@ -202,11 +305,11 @@ func modifyBodyWithGoogleSearch(bodyBytes []byte, searchTrigger string) ([]byte,
 
 	// --- Marshal back to JSON if modified ---
 	if !modified {
-		log.Println("Request body not modified.")
+		logDebugf("Request body not modified.")
 		return bodyBytes, nil // Return original if no changes
 	}
 
-	modifiedBodyBytes, err := json.Marshal(requestData)
+	modifiedBodyBytes, err := marshalJSONPreservingText(requestData)
 	if err != nil {
 		// Return error, let handlePostBody decide how to handle marshal failure
 		return nil, fmt.Errorf("failed to marshal modified request body: %w", err)
@@ -215,3 +318,56 @@ func modifyBodyWithGoogleSearch(bodyBytes []byte, searchTrigger string) ([]byte,
 	// log.Printf("Modified Request Body: %s", string(modifiedBodyBytes))
 	return modifiedBodyBytes, nil
 }
+
+// mergeGoogleSearchTool returns tools with functionDeclarations removed and google_search appended
+// if not already present. Tool entries left empty by the removal are dropped.
+func mergeGoogleSearchTool(tools []any, googleSearchTool map[string]any) []any {
+	merged := make([]any, 0, len(tools)+1)
+	googleSearchPresent := false
+	for _, tool := range tools {
+		if toolMap, ok := tool.(map[string]any); ok {
+			if _, fdExists := toolMap["functionDeclarations"]; fdExists {
+				delete(toolMap, "functionDeclarations")
+				logDebugf("Removed 'functionDeclarations'.")
+				if len(toolMap) == 0 {
+					continue
+				}
+			}
+			if _, gsExists := toolMap["google_search"]; gsExists {
+				googleSearchPresent = true
+			}
+		}
+		merged = append(merged, tool)
+	}
+	if !googleSearchPresent {
+		merged = append(merged, googleSearchTool)
+	}
+	return merged
+}
+
+// decodeJSONPreservingNumbers unmarshals bodyBytes into v, keeping numbers as json.Number so
+// integers beyond float64 precision (e.g. seeds or token IDs) survive a re-marshal unchanged.
+// Like json.Unmarshal, it rejects trailing data after the first JSON value.
+func decodeJSONPreservingNumbers(bodyBytes []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(bodyBytes))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("invalid character after top-level value")
+	}
+	return nil
+}
+
+// marshalJSONPreservingText marshals v without escaping <, > and &, so text and inline_data
+// parts are forwarded exactly as the client sent them rather than as \u003c-style escapes.
+func marshalJSONPreservingText(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -65,7 +65,7 @@ func TestHandlePostBody(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			bodyReader := stringToReadCloser(tt.body) // Changed tt.tbody to tt.body
-			gotBodyBytes, err := handlePostBody(bodyReader, tt.addGoogleSearch, tt.searchTrigger)
+			gotBodyBytes, err := handlePostBody(bodyReader, bodyModifierOptions{addGoogleSearch: tt.addGoogleSearch, searchTrigger: tt.searchTrigger, triggerMode: triggerReplace})
 
 			if (err != nil) != tt.wantErr {
 				t.Errorf("handlePostBody() error = %v, wantErr %v", err, tt.wantErr)
@@ -173,7 +173,7 @@ func TestModifyBodyWithGoogleSearch(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotBodyBytes, err := modifyBodyWithGoogleSearch(tt.bodyBytes, tt.searchTrigger)
+			gotBodyBytes, err := modifyBodyWithGoogleSearch(tt.bodyBytes, tt.searchTrigger, triggerReplace, nil, false)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("modifyBodyWithGoogleSearch() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -189,3 +189,150 @@ func TestModifyBodyWithGoogleSearch(t *testing.T) {
 		})
 	}
 }
+
+func TestModifyBodyWithGoogleSearch_MultimodalInlineData(t *testing.T) {
+	// Base64 image data, including '+' and '/' characters, must survive modification unchanged.
+	imageData := strings.Repeat("iVBORw0KGgoAAAANSUhEUgAA+/8=", 64)
+	body := `{"contents":[{"role":"user","parts":[` +
+		`{"text":"Describe <this> image & search"},` +
+		`{"inline_data":{"mime_type":"image/png","data":"` + imageData + `"}},` +
+		`{"file_data":{"mime_type":"video/mp4","file_uri":"gs://bucket/clip.mp4"}}` +
+		`]}],"generationConfig":{"seed":9007199254740993,"temperature":0.7}}`
+
+	got, err := modifyBodyWithGoogleSearch([]byte(body), "search", triggerReplace, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Every original part must be present verbatim in the re-marshaled body.
+	for _, fragment := range []string{
+		`{"text":"Describe <this> image & search"}`,
+		`{"inline_data":{"data":"` + imageData + `","mime_type":"image/png"}}`,
+		`{"file_data":{"file_uri":"gs://bucket/clip.mp4","mime_type":"video/mp4"}}`,
+		`"seed":9007199254740993`,
+		`"temperature":0.7`,
+		`"tools":[{"google_search":{}}]`,
+	} {
+		if !strings.Contains(string(got), fragment) {
+			t.Errorf("modified body missing %s\ngot: %s", fragment, got)
+		}
+	}
+
+	var parsed struct {
+		Contents []struct {
+			Parts []json.RawMessage `json:"parts"`
+		} `json:"contents"`
+	}
+	if err := json.Unmarshal(got, &parsed); err != nil {
+		t.Fatalf("modified body is not valid JSON: %v", err)
+	}
+	if len(parsed.Contents) != 1 || len(parsed.Contents[0].Parts) != 3 {
+		t.Errorf("expected 1 content with 3 parts, got %s", got)
+	}
+}
+
+func TestModifyBodyWithGoogleSearch_RejectsTrailingData(t *testing.T) {
+	body := []byte(`{"contents":[]} {"extra":true}`)
+	got, err := modifyBodyWithGoogleSearch(body, "search", triggerReplace, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("expected body with trailing data to pass through unmodified, got %s", got)
+	}
+}
+
+func TestModifyBodyWithGoogleSearch_TriggerReplaceModes(t *testing.T) {
+	body := `{"contents": [{"parts": [{"text": "search now"}]}], "tools": [{"code_execution": {}}, {"functionDeclarations": [{"name": "find_theaters"}]}]}`
+
+	tests := []struct {
+		mode triggerReplaceMode
+		want string
+	}{
+		{triggerReplace, `{"contents": [{"parts": [{"text": "search now"}]}], "tools": [{"google_search": {}}]}`},
+		{triggerMerge, `{"contents": [{"parts": [{"text": "search now"}]}], "tools": [{"code_execution": {}}, {"google_search": {}}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			got, err := modifyBodyWithGoogleSearch([]byte(body), "search", tt.mode, nil, false)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !jsonDeepEqual(got, []byte(tt.want)) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTriggerReplaceMode(t *testing.T) {
+	for raw, want := range map[string]triggerReplaceMode{"replace": triggerReplace, "MERGE": triggerMerge} {
+		got, err := parseTriggerReplaceMode(raw)
+		if err != nil || got != want {
+			t.Errorf("parseTriggerReplaceMode(%q) = %q, %v; want %q", raw, got, err, want)
+		}
+	}
+	if _, err := parseTriggerReplaceMode("append"); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+}
+
+func TestHandlePostBody_DefaultSystemInstruction(t *testing.T) {
+	opts := bodyModifierOptions{defaultSystemInstruction: "You are a helpful assistant."}
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "injected when absent",
+			body: `{"contents": [{"parts": [{"text": "hi"}]}]}`,
+			want: `{"contents": [{"parts": [{"text": "hi"}]}], "systemInstruction": {"parts": [{"text": "You are a helpful assistant."}]}}`,
+		},
+		{
+			name: "client camelCase instruction kept",
+			body: `{"contents": [], "systemInstruction": {"parts": [{"text": "Answer in French."}]}}`,
+			want: `{"contents": [], "systemInstruction": {"parts": [{"text": "Answer in French."}]}}`,
+		},
+		{
+			name: "client snake_case instruction kept",
+			body: `{"contents": [], "system_instruction": {"parts": [{"text": "Answer in French."}]}}`,
+			want: `{"contents": [], "system_instruction": {"parts": [{"text": "Answer in French."}]}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := handlePostBody(stringToReadCloser(tt.body), opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !jsonDeepEqual(got, []byte(tt.want)) {
+				t.Errorf("handlePostBody() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnsureValidModification_FallsBackOnInvalidJSON(t *testing.T) {
+	original := []byte(`{"contents":[{"parts":[{"text":"hello"}]}]}`)
+
+	// A broken modification (e.g. a bad manual splice) is never forwarded.
+	broken := []byte(`{"contents":[{"parts":[{"text":"hello"}]}],"tools":[{"google_search":{}}`)
+	assertString(t, string(ensureValidModification(original, broken)), string(original))
+
+	// A valid modification is kept.
+	valid := []byte(`{"contents":[{"parts":[{"text":"hello"}]}],"tools":[{"google_search":{}}]}`)
+	assertString(t, string(ensureValidModification(original, valid)), string(valid))
+
+	// An unmodified non-JSON body passes through untouched.
+	notJSON := []byte("plain text")
+	assertString(t, string(ensureValidModification(notJSON, notJSON)), "plain text")
+}
+
+func TestHandlePostBody_ValidateModified(t *testing.T) {
+	body := `{"contents":[{"parts":[{"text":"hello"}]}]}`
+	got, err := handlePostBody(stringToReadCloser(body), bodyModifierOptions{addGoogleSearch: true, validateModified: true})
+	assertNoError(t, err)
+	assertString(t, string(got), `{"contents":[{"parts":[{"text":"hello"}]}],"tools":[{"google_search":{}}]}`)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// bodyRewriteRule is one declarative rewrite of a JSON request body. Path is a dot-separated
+// list of object keys, with numeric segments indexing into arrays (e.g. "contents.0.role").
+type bodyRewriteRule struct {
+	Op   string `json:"op"` // "set" or "delete"
+	Path string `json:"path"`
+	// Kept as raw JSON and decoded for each request, so no two bodies share (and later
+	// mutate) the same objects. Empty sets null.
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// newValue decodes a fresh copy of the rule's value.
+func (rule bodyRewriteRule) newValue() (any, error) {
+	if len(rule.Value) == 0 {
+		return nil, nil
+	}
+	var value any
+	if err := decodeJSONPreservingNumbers(rule.Value, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// parseBodyRewrites parses the -body-rewrite flag: a JSON array of rules. An empty value means
+// no rewrites.
+func parseBodyRewrites(raw string) ([]bodyRewriteRule, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	var rules []bodyRewriteRule
+	if err := decodeJSONPreservingNumbers([]byte(raw), &rules); err != nil {
+		return nil, fmt.Errorf("invalid body rewrite spec: %w", err)
+	}
+	for i, rule := range rules {
+		if rule.Op != "set" && rule.Op != "delete" {
+			return nil, fmt.Errorf("body rewrite %d: op must be \"set\" or \"delete\", got %q", i, rule.Op)
+		}
+		if rule.Path == "" {
+			return nil, fmt.Errorf("body rewrite %d: path is required", i)
+		}
+	}
+	return rules, nil
+}
+
+// applyBodyRewrites applies rules in order to a JSON object body. Non-JSON bodies are returned
+// unchanged, and a rule whose path cannot be applied is logged and skipped.
+func applyBodyRewrites(bodyBytes []byte, rules []bodyRewriteRule) ([]byte, error) {
+	var requestData map[string]any
+	if err := decodeJSONPreservingNumbers(bodyBytes, &requestData); err != nil {
+		logWarnf("Failed to parse request body as JSON for rewrites: %v. Proceeding with original body.", err)
+		return bodyBytes, nil
+	}
+
+	modified := false
+	for _, rule := range rules {
+		var err error
+		switch rule.Op {
+		case "set":
+			var value any
+			if value, err = rule.newValue(); err == nil {
+				err = setJSONPath(requestData, strings.Split(rule.Path, "."), value)
+			}
+		case "delete":
+			err = deleteJSONPath(requestData, strings.Split(rule.Path, "."))
+		}
+		if err != nil {
+			logWarnf("Skipping body rewrite %s %q: %v", rule.Op, rule.Path, err)
+			continue
+		}
+		logDebugf("Applied body rewrite: %s %q", rule.Op, rule.Path)
+		modified = true
+	}
+
+	if !modified {
+		return bodyBytes, nil
+	}
+	modifiedBodyBytes, err := marshalJSONPreservingText(requestData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal rewritten request body: %w", err)
+	}
+	return modifiedBodyBytes, nil
+}
+
+// setJSONPath sets the value at path, creating missing intermediate objects.
+func setJSONPath(node any, path []string, value any) error {
+	for i, segment := range path {
+		last := i == len(path)-1
+		switch n := node.(type) {
+		case map[string]any:
+			if last {
+				n[segment] = value
+				return nil
+			}
+			next, ok := n[segment]
+			if !ok || next == nil {
+				next = map[string]any{}
+				n[segment] = next
+			}
+			node = next
+		case []any:
+			idx, err := arrayIndex(n, segment)
+			if err != nil {
+				return err
+			}
+			if last {
+				n[idx] = value
+				return nil
+			}
+			node = n[idx]
+		default:
+			return fmt.Errorf("cannot descend into %T at %q", node, strings.Join(path[:i], "."))
+		}
+	}
+	return nil
+}
+
+// deleteJSONPath removes the object key at path. Deleting a missing key is not an error;
+// array elements cannot be deleted.
+func deleteJSONPath(node any, path []string) error {
+	for i, segment := range path {
+		last := i == len(path)-1
+		switch n := node.(type) {
+		case map[string]any:
+			if last {
+				delete(n, segment)
+				return nil
+			}
+			next, ok := n[segment]
+			if !ok {
+				return nil
+			}
+			node = next
+		case []any:
+			if last {
+				return fmt.Errorf("cannot delete array element %q", segment)
+			}
+			idx, err := arrayIndex(n, segment)
+			if err != nil {
+				return err
+			}
+			node = n[idx]
+		default:
+			return fmt.Errorf("cannot descend into %T at %q", node, strings.Join(path[:i], "."))
+		}
+	}
+	return nil
+}
+
+// arrayIndex parses segment as an index into arr.
+func arrayIndex(arr []any, segment string) (int, error) {
+	idx, err := strconv.Atoi(segment)
+	if err != nil || idx < 0 || idx >= len(arr) {
+		return 0, fmt.Errorf("invalid array index %q (length %d)", segment, len(arr))
+	}
+	return idx, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestApplyBodyRewrites_SetAndDelete(t *testing.T) {
+	rules, err := parseBodyRewrites(`[
+		{"op": "set", "path": "systemInstruction", "value": {"parts": [{"text": "Be concise."}]}},
+		{"op": "set", "path": "generationConfig.temperature", "value": 0.2},
+		{"op": "set", "path": "contents.0.role", "value": "user"},
+		{"op": "delete", "path": "safetySettings"}
+	]`)
+	assertNoError(t, err)
+
+	body := `{"contents": [{"parts": [{"text": "hi"}]}], "generationConfig": {"topK": 40}, "safetySettings": [{"category": "HARM_CATEGORY_HARASSMENT"}]}`
+	got, err := applyBodyRewrites([]byte(body), rules)
+	assertNoError(t, err)
+
+	want := `{"contents": [{"role": "user", "parts": [{"text": "hi"}]}], "generationConfig": {"topK": 40, "temperature": 0.2}, "systemInstruction": {"parts": [{"text": "Be concise."}]}}`
+	if !jsonDeepEqual(got, []byte(want)) {
+		t.Errorf("applyBodyRewrites() = %s, want %s", got, want)
+	}
+}
+
+func TestApplyBodyRewrites_InvalidPathsAreSkipped(t *testing.T) {
+	rules, err := parseBodyRewrites(`[
+		{"op": "set", "path": "contents.5.role", "value": "user"},
+		{"op": "set", "path": "model.name", "value": "x"},
+		{"op": "delete", "path": "contents.0"},
+		{"op": "delete", "path": "missing.field"}
+	]`)
+	assertNoError(t, err)
+
+	body := `{"contents": [{"parts": []}], "model": "gemini-pro"}`
+	got, err := applyBodyRewrites([]byte(body), rules)
+	assertNoError(t, err)
+	if !jsonDeepEqual(got, []byte(body)) {
+		t.Errorf("expected body unchanged by inapplicable rules, got %s", got)
+	}
+
+	// Non-JSON bodies pass through.
+	got, err = applyBodyRewrites([]byte("not json"), rules)
+	assertNoError(t, err)
+	assertString(t, string(got), "not json")
+}
+
+func TestParseBodyRewrites_Errors(t *testing.T) {
+	rules, err := parseBodyRewrites("")
+	assertNoError(t, err)
+	assertInt(t, len(rules), 0)
+
+	_, err = parseBodyRewrites(`{"op": "set"}`)
+	assertErrorContains(t, err, "invalid body rewrite spec")
+	_, err = parseBodyRewrites(`[{"op": "replace", "path": "a"}]`)
+	assertErrorContains(t, err, `op must be "set" or "delete"`)
+	_, err = parseBodyRewrites(`[{"op": "delete"}]`)
+	assertErrorContains(t, err, "path is required")
+}
+
+func TestApplyBodyRewrites_ForceModel(t *testing.T) {
+	rules, err := parseBodyRewrites(`[{"op": "set", "path": "model", "value": "gemini-2.5-flash"}]`)
+	assertNoError(t, err)
+
+	for _, body := range []string{
+		`{"model": "gemini-2.5-pro", "messages": [{"role": "user", "content": "hi"}]}`,
+		`{"messages": [{"role": "user", "content": "hi"}]}`,
+	} {
+		got, err := applyBodyRewrites([]byte(body), rules)
+		assertNoError(t, err)
+		want := `{"model": "gemini-2.5-flash", "messages": [{"role": "user", "content": "hi"}]}`
+		if !jsonDeepEqual(got, []byte(want)) {
+			t.Errorf("applyBodyRewrites(%s) = %s, want %s", body, got, want)
+		}
+	}
+}
+
+func TestApplyBodyRewrites_ValuesAreNotSharedBetweenBodies(t *testing.T) {
+	// The second rule writes into the object set by the first; with a shared value, concurrent
+	// requests would write to the same map.
+	rules, err := parseBodyRewrites(`[
+		{"op": "set", "path": "generationConfig", "value": {"temperature": 0.2}},
+		{"op": "set", "path": "generationConfig.topK", "value": 40}
+	]`)
+	assertNoError(t, err)
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				got, err := applyBodyRewrites([]byte(`{"contents": []}`), rules)
+				assertNoError(t, err)
+				if !jsonDeepEqual(got, []byte(`{"contents": [], "generationConfig": {"temperature": 0.2, "topK": 40}}`)) {
+					t.Errorf("unexpected rewritten body %s", got)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// bufferedResponse is a minimal http.ResponseWriter that records a response in memory
+// so it can be replayed to several clients.
+type bufferedResponse struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(statusCode int) {
+	if b.statusCode == 0 {
+		b.statusCode = statusCode
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.statusCode == 0 {
+		b.statusCode = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// replay writes the recorded response to w.
+func (b *bufferedResponse) replay(w http.ResponseWriter) {
+	for name, values := range b.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	statusCode := b.statusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	w.WriteHeader(statusCode)
+	w.Write(b.body.Bytes())
+}
+
+// coalescedCall tracks a single in-flight upstream call shared by duplicate requests.
+type coalescedCall struct {
+	done chan struct{}
+	resp *bufferedResponse // nil if the leader did not complete normally
+	dups int               // number of requests waiting on this call besides the leader
+}
+
+// requestCoalescer deduplicates identical concurrent requests (single-flight).
+// Requests are keyed by a hash of method, request URI and body; while one request
+// for a given key is in flight, identical requests wait for it and receive a copy
+// of its response. Responses are buffered, so coalesced requests do not stream.
+type requestCoalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+	// Path prefixes for which non-GET/HEAD requests may also be coalesced.
+	paths []string
+}
+
+// newRequestCoalescer creates a coalescer. GET and HEAD requests are always eligible;
+// other methods are only eligible for paths starting with one of the given prefixes.
+func newRequestCoalescer(paths []string) *requestCoalescer {
+	return &requestCoalescer{
+		calls: make(map[string]*coalescedCall),
+		paths: paths,
+	}
+}
+
+// isEligible reports whether a request may be coalesced with identical requests. WebSocket
+// upgrades never are: each client needs its own connection.
+func (c *requestCoalescer) isEligible(r *http.Request) bool {
+	if isWebSocketUpgrade(r) {
+		return false
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	for _, p := range c.paths {
+		if strings.HasPrefix(r.URL.Path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// coalesceKey builds the deduplication key for a request and its (already read) body.
+func coalesceKey(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method)
+	h.Write([]byte{0})
+	io.WriteString(h, r.URL.RequestURI())
+	h.Write([]byte{0})
+	// Responses may be encoded differently depending on what the client accepts.
+	io.WriteString(h, r.Header.Get("Accept-Encoding"))
+	h.Write([]byte{0})
+	// These headers change the upstream target, the modified body or the key used, so requests
+	// that differ only in them must not share a response.
+	for _, name := range []string{targetOverrideHeader, disableToolInjectionHeader, keySessionHeader} {
+		io.WriteString(h, r.Header.Get(name))
+		h.Write([]byte{0})
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// wrap returns a handler that coalesces eligible identical requests before passing them to next.
+func (c *requestCoalescer) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.isEligible(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var bodyBytes []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			var err error
+			bodyBytes, err = io.ReadAll(io.LimitReader(r.Body, bodyReadLimit+1))
+			if err != nil {
+				logWarnf("[Coalescer] Error reading request body for %s: %v", r.URL.Path, err)
+				http.Error(w, "Error reading request body", http.StatusBadRequest)
+				return
+			}
+			if len(bodyBytes) > bodyReadLimit {
+				// Too large to hash and hold safely; forward without coalescing.
+				r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(bodyBytes), r.Body))
+				next.ServeHTTP(w, r)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+		}
+
+		key := coalesceKey(r, bodyBytes)
+
+		c.mu.Lock()
+		if call, ok := c.calls[key]; ok {
+			call.dups++
+			c.mu.Unlock()
+			logDebugf("[Coalescer] Joining in-flight request for %s %s", r.Method, r.URL.Path)
+			select {
+			case <-call.done:
+			case <-r.Context().Done():
+				return
+			}
+			if call.resp == nil {
+				http.Error(w, "Proxy Error: Coalesced upstream request failed", http.StatusBadGateway)
+				return
+			}
+			call.resp.replay(w)
+			return
+		}
+		call := &coalescedCall{done: make(chan struct{})}
+		c.calls[key] = call
+		c.mu.Unlock()
+
+		defer func() {
+			c.mu.Lock()
+			delete(c.calls, key)
+			dups := call.dups
+			c.mu.Unlock()
+			close(call.done)
+			if dups > 0 {
+				logInfof("[Coalescer] Shared response for %s %s with %d duplicate request(s)", r.Method, r.URL.Path, dups)
+			}
+		}()
+
+		resp := newBufferedResponse()
+		next.ServeHTTP(resp, r)
+		call.resp = resp
+		resp.replay(w)
+	})
+}
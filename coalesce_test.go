@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForDuplicates polls until the coalescer reports the expected number of waiting duplicates.
+func waitForDuplicates(t *testing.T, c *requestCoalescer, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		dups := 0
+		for _, call := range c.calls {
+			dups += call.dups
+		}
+		c.mu.Unlock()
+		if dups >= want {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d duplicate request(s) to join", want)
+}
+
+func TestRequestCoalescer_IdenticalConcurrentRequestsShareUpstreamCall(t *testing.T) {
+	var upstreamCalls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&upstreamCalls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		w.Header().Set("X-Upstream", "yes")
+		fmt.Fprint(w, "shared response")
+	})
+
+	c := newRequestCoalescer(nil)
+	handler := c.wrap(next)
+
+	var wg sync.WaitGroup
+	recorders := []*httptest.ResponseRecorder{httptest.NewRecorder(), httptest.NewRecorder()}
+	serve := func(rr *httptest.ResponseRecorder) {
+		defer wg.Done()
+		req := httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil)
+		handler.ServeHTTP(rr, req)
+	}
+
+	wg.Add(1)
+	go serve(recorders[0])
+	<-started // First request is now in flight upstream
+
+	wg.Add(1)
+	go serve(recorders[1])
+	waitForDuplicates(t, c, 1)
+
+	close(release)
+	wg.Wait()
+
+	assertInt(t, int(atomic.LoadInt32(&upstreamCalls)), 1)
+	for i, rr := range recorders {
+		resp := rr.Result()
+		body, _ := io.ReadAll(resp.Body)
+		assertInt(t, resp.StatusCode, http.StatusOK)
+		assertString(t, string(body), "shared response")
+		if resp.Header.Get("X-Upstream") != "yes" {
+			t.Errorf("response %d: expected replayed header X-Upstream, got %q", i, resp.Header.Get("X-Upstream"))
+		}
+	}
+
+	c.mu.Lock()
+	assertInt(t, len(c.calls), 0) // In-flight entry must be cleaned up
+	c.mu.Unlock()
+}
+
+func TestRequestCoalescer_DifferentBodiesAreNotCoalesced(t *testing.T) {
+	var upstreamCalls int32
+	var bodies sync.Map
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamCalls, 1)
+		b, _ := io.ReadAll(r.Body)
+		bodies.Store(string(b), true)
+		fmt.Fprint(w, string(b))
+	})
+
+	c := newRequestCoalescer([]string{"/v1beta/models/"})
+	handler := c.wrap(next)
+
+	for _, body := range []string{`{"a":1}`, `{"a":2}`} {
+		req := httptest.NewRequest("POST", "http://localhost:8080/v1beta/models/gemini-pro:generateContent", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assertString(t, rr.Body.String(), body) // Body must still reach the upstream intact
+	}
+
+	assertInt(t, int(atomic.LoadInt32(&upstreamCalls)), 2)
+}
+
+func TestRequestCoalescer_DifferentTargetOverridesAreNotCoalesced(t *testing.T) {
+	var upstreamCalls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&upstreamCalls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		fmt.Fprint(w, r.Header.Get(targetOverrideHeader))
+	})
+
+	c := newRequestCoalescer(nil)
+	handler := c.wrap(next)
+
+	var wg sync.WaitGroup
+	recorders := []*httptest.ResponseRecorder{httptest.NewRecorder(), httptest.NewRecorder()}
+	targets := []string{"https://a.example.com", "https://b.example.com"}
+	serve := func(i int) {
+		defer wg.Done()
+		req := httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil)
+		req.Header.Set(targetOverrideHeader, targets[i])
+		handler.ServeHTTP(recorders[i], req)
+	}
+
+	wg.Add(1)
+	go serve(0)
+	<-started // First request is now in flight upstream
+
+	wg.Add(1)
+	go serve(1)
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&upstreamCalls) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+
+	assertInt(t, int(atomic.LoadInt32(&upstreamCalls)), 2)
+	for i, rr := range recorders {
+		assertString(t, rr.Body.String(), targets[i])
+	}
+}
+
+func TestRequestCoalescer_IsEligible(t *testing.T) {
+	c := newRequestCoalescer([]string{"/v1beta/models/"})
+
+	tests := []struct {
+		method string
+		path   string
+		want   bool
+	}{
+		{"GET", "/anything", true},
+		{"HEAD", "/anything", true},
+		{"POST", "/v1beta/models/gemini-pro:generateContent", true},
+		{"POST", "/openai/chat/completions", false},
+		{"DELETE", "/anything", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "http://localhost:8080"+tt.path, nil)
+		if got := c.isEligible(req); got != tt.want {
+			t.Errorf("isEligible(%s %s) = %t, want %t", tt.method, tt.path, got, tt.want)
+		}
+	}
+
+	upgrade := httptest.NewRequest("GET", "http://localhost:8080/ws/live", nil)
+	upgrade.Header.Set("Connection", "Upgrade")
+	upgrade.Header.Set("Upgrade", "websocket")
+	if c.isEligible(upgrade) {
+		t.Error("Expected a WebSocket upgrade not to be coalesced")
+	}
+}
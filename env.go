@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envString returns the value of the environment variable name, or def if it is unset or empty.
+// Used as a flag default so precedence is: command line > environment > built-in default.
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envErrors collects the invalid values seen by envDuration and envBool. main refuses to
+// start while any are present (see envError), so a typo never silently falls back to a default.
+var envErrors []error
+
+// envError returns the invalid environment values seen so far, joined, or nil.
+func envError() error {
+	return errors.Join(envErrors...)
+}
+
+// envDuration is like envString for durations. Unparseable values are recorded in envErrors
+// and def is returned.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		envErrors = append(envErrors, fmt.Errorf("invalid %s=%q: %w", name, v, err))
+		return def
+	}
+	return d
+}
+
+// envBool is like envString for booleans. Unparseable values are recorded in envErrors and
+// def is returned.
+func envBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		envErrors = append(envErrors, fmt.Errorf("invalid %s=%q: %w", name, v, err))
+		return def
+	}
+	return b
+}
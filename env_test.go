@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnvString(t *testing.T) {
+	t.Setenv("PROXY_TEST_STRING", "")
+	assertString(t, envString("PROXY_TEST_STRING", "default"), "default")
+
+	t.Setenv("PROXY_TEST_STRING", "https://staging.example.com")
+	assertString(t, envString("PROXY_TEST_STRING", "default"), "https://staging.example.com")
+}
+
+func TestEnvDuration(t *testing.T) {
+	t.Setenv("PROXY_TEST_DURATION", "")
+	if got := envDuration("PROXY_TEST_DURATION", time.Hour); got != time.Hour {
+		t.Errorf("unset: got %s, want 1h", got)
+	}
+
+	t.Setenv("PROXY_TEST_DURATION", "90s")
+	if got := envDuration("PROXY_TEST_DURATION", time.Hour); got != 90*time.Second {
+		t.Errorf("set: got %s, want 1m30s", got)
+	}
+
+	assertNoError(t, envError())
+
+	t.Cleanup(func() { envErrors = nil })
+	t.Setenv("PROXY_TEST_DURATION", "soon")
+	if got := envDuration("PROXY_TEST_DURATION", time.Hour); got != time.Hour {
+		t.Errorf("invalid: got %s, want default 1h", got)
+	}
+	assertErrorContains(t, envError(), `invalid PROXY_TEST_DURATION="soon"`)
+}
+
+func TestEnvBool(t *testing.T) {
+	t.Setenv("PROXY_TEST_BOOL", "false")
+	if envBool("PROXY_TEST_BOOL", true) {
+		t.Error("expected false from environment")
+	}
+
+	assertNoError(t, envError())
+
+	t.Cleanup(func() { envErrors = nil })
+	t.Setenv("PROXY_TEST_BOOL", "maybe")
+	if !envBool("PROXY_TEST_BOOL", true) {
+		t.Error("expected default true for invalid value")
+	}
+	assertErrorContains(t, envError(), `invalid PROXY_TEST_BOOL="maybe"`)
+}
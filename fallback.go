@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// fallbackResponse is a canned response served instead of 503 when no keys are available for a
+// request whose path starts with Path. Body is any JSON value and is sent as-is.
+type fallbackResponse struct {
+	Path   string          `json:"path"`
+	Status int             `json:"status,omitempty"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// parseFallbackResponses parses the -fallback-responses flag: a JSON array of fallbacks.
+// Status defaults to 200. The result is ordered longest path first, so the most specific
+// fallback wins. An empty value means no fallbacks.
+func parseFallbackResponses(raw string) ([]fallbackResponse, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	var fallbacks []fallbackResponse
+	dec := json.NewDecoder(strings.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fallbacks); err != nil {
+		return nil, fmt.Errorf("invalid fallback response spec: %w", err)
+	}
+	for i := range fallbacks {
+		fb := &fallbacks[i]
+		fb.Path = normalizePathPrefix(fb.Path)
+		if fb.Path == "" {
+			return nil, fmt.Errorf("fallback response %d: path is required", i)
+		}
+		if fb.Status == 0 {
+			fb.Status = http.StatusOK
+		}
+		if fb.Status < 200 || fb.Status > 599 {
+			return nil, fmt.Errorf("fallback response %d: invalid status %d", i, fb.Status)
+		}
+		if len(bytes.TrimSpace(fb.Body)) == 0 {
+			return nil, fmt.Errorf("fallback response %d: body is required", i)
+		}
+	}
+	sort.SliceStable(fallbacks, func(i, j int) bool { return len(fallbacks[i].Path) > len(fallbacks[j].Path) })
+	return fallbacks, nil
+}
+
+// findFallbackResponse returns the fallback for urlPath, or nil if none matches.
+func findFallbackResponse(urlPath string, fallbacks []fallbackResponse) *fallbackResponse {
+	for i := range fallbacks {
+		if strings.HasPrefix(urlPath, fallbacks[i].Path) {
+			return &fallbacks[i]
+		}
+	}
+	return nil
+}
+
+// serve writes the fallback response to w.
+func (fb *fallbackResponse) serve(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(fb.Status)
+	w.Write(fb.Body)
+}
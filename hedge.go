@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// hedgeResult is the outcome of one of the concurrent attempts started by hedgedRoundTrip.
+type hedgeResult struct {
+	resp     *http.Response
+	err      error
+	keyIndex int
+	key      string
+	cancel   context.CancelFunc
+}
+
+// usable reports whether the attempt produced a response worth returning over the other
+// attempt: no transport error and no rate limit or server error.
+func (r hedgeResult) usable() bool {
+	return r.err == nil && r.resp.StatusCode != http.StatusTooManyRequests && r.resp.StatusCode < 500
+}
+
+// discard cancels the attempt and closes its response body, if any.
+func (r hedgeResult) discard() {
+	r.cancel()
+	if r.resp != nil && r.resp.Body != nil {
+		io.Copy(io.Discard, io.LimitReader(r.resp.Body, bodyReadLimit))
+		r.resp.Body.Close()
+	}
+}
+
+// sidelinesKey reports whether the attempt's response would have sidelined its key had the
+// attempt been the one returned: a rate limit, as in the retry loop, or another client error,
+// as in ModifyResponse.
+func (r hedgeResult) sidelinesKey() bool {
+	return r.err == nil && r.resp.StatusCode >= 400 && r.resp.StatusCode < 500
+}
+
+// cancelOnCloseBody cancels the context of a hedged attempt once its response body is closed,
+// so the winning attempt's context lives exactly as long as its body is being read.
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close closes the wrapped body and cancels the attempt's context.
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// isHedgeable reports whether req may be sent twice concurrently: only idempotent methods,
+// and never WebSocket upgrades.
+func isHedgeable(req *http.Request) bool {
+	return isIdempotentMethod(req.Method) && !isWebSocketUpgrade(req)
+}
+
+// hedgedRoundTrip sends the attempt with the key at keyIndex and, if no response has arrived
+// after rt.hedgeDelay, a second attempt with another key from the scope. The first usable
+// response is returned with the index and value of the key that produced it; the other attempt is
+// canceled and its body drained in the background; a discarded attempt that was rate limited
+// or got a client error still sidelines its key. If neither is usable, the first
+// attempt's result is returned so the retry loop handles it as usual.
+func (rt *retryTransport) hedgedRoundTrip(req *http.Request, bodyBytes []byte, scope string, keyIndex int, apiKey string, attempt int) (*http.Response, int, string, error) {
+	results := make(chan hedgeResult, 2)
+	// Cancel functions of the attempts started so far, by key index, so a loser still waiting
+	// for its response headers can be stopped right away.
+	cancels := make(map[int]context.CancelFunc, 2)
+	launch := func(index int, key string) {
+		attemptReq := rt.newAttemptRequest(req, bodyBytes, scope, index, key, attempt)
+		ctx, cancel := context.WithCancel(attemptReq.Context())
+		cancels[index] = cancel
+		attemptReq = attemptReq.WithContext(ctx)
+		go func() {
+			resp, err := rt.underlyingTransport.RoundTrip(attemptReq)
+			results <- hedgeResult{resp: resp, err: err, keyIndex: index, key: key, cancel: cancel}
+		}()
+	}
+	// drop discards an attempt that is not returned, first sidelining its key if its response
+	// calls for it, since the retry loop never sees that response.
+	drop := func(r hedgeResult) {
+		if r.sidelinesKey() {
+			rt.keyMan.markKeyFailedIfCurrent(scope, r.keyIndex, r.key, fmt.Sprintf("status %d", r.resp.StatusCode))
+		}
+		r.discard()
+	}
+	launch(keyIndex, apiKey)
+	pending := 1
+
+	timer := time.NewTimer(rt.hedgeDelay)
+	defer timer.Stop()
+
+	var firstFailure *hedgeResult
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			hedgeKey, hedgeIndex, err := rt.keyMan.getOtherKey(scope, keyIndex)
+			if err != nil {
+				logDebugf("[Retry Transport] Scope '%s': No other key available to hedge key index %d.", scopeForLog(scope), keyIndex)
+				continue
+			}
+			logInfof("[Retry Transport] Scope '%s': No response from key index %d after %s; hedging with key index %d.", scopeForLog(scope), keyIndex, rt.hedgeDelay, hedgeIndex)
+			launch(hedgeIndex, hedgeKey)
+			pending++
+			continue
+		case result := <-results:
+			pending--
+			if result.usable() || (pending == 0 && firstFailure == nil) {
+				// Once an attempt has answered, the hedge is no longer needed.
+				timer.Stop()
+				if firstFailure != nil {
+					drop(*firstFailure)
+				}
+				if pending > 0 {
+					for index, cancel := range cancels {
+						if index != result.keyIndex {
+							cancel()
+						}
+					}
+					go func() { drop(<-results) }()
+				}
+				if result.err != nil {
+					result.cancel()
+					return nil, result.keyIndex, result.key, result.err
+				}
+				if result.resp.Body != nil {
+					result.resp.Body = &cancelOnCloseBody{ReadCloser: result.resp.Body, cancel: result.cancel}
+				}
+				if result.keyIndex != keyIndex {
+					logInfof("[Retry Transport] Scope '%s': Hedged attempt with key index %d answered first.", scopeForLog(scope), result.keyIndex)
+				}
+				return result.resp, result.keyIndex, result.key, nil
+			}
+			if pending == 0 {
+				// Both attempts failed; report the first failure and drop the other.
+				drop(result)
+				break
+			}
+			// Wait for the other attempt before giving up on this one.
+			firstFailure = &result
+		}
+	}
+
+	if firstFailure.err != nil {
+		firstFailure.cancel()
+		return nil, firstFailure.keyIndex, firstFailure.key, firstFailure.err
+	}
+	if firstFailure.resp.Body != nil {
+		firstFailure.resp.Body = &cancelOnCloseBody{ReadCloser: firstFailure.resp.Body, cancel: firstFailure.cancel}
+	}
+	return firstFailure.resp, firstFailure.keyIndex, firstFailure.key, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryTransport_HedgeFasterResponseWins(t *testing.T) {
+	var calls int32
+	slowCanceled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// The first attempt stalls until the proxy gives up on it.
+			select {
+			case <-r.Context().Done():
+				close(slowCanceled)
+			case <-time.After(5 * time.Second):
+			}
+			io.WriteString(w, "slow "+r.URL.Query().Get("key"))
+			return
+		}
+		io.WriteString(w, "fast "+r.URL.Query().Get("key"))
+	}))
+	defer server.Close()
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+	rt.hedgeDelay = 20 * time.Millisecond
+
+	req := httptest.NewRequest("GET", server.URL+"/v1beta/models", nil)
+	req.RequestURI = ""
+	start := time.Now()
+	resp, err := rt.RoundTrip(req)
+	assertNoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Hedged request took %s; expected the fast response", elapsed)
+	}
+	assertInt(t, resp.StatusCode, http.StatusOK)
+	if got := string(body); got != "fast k1" && got != "fast k2" {
+		t.Fatalf("Expected the fast response, got %q", got)
+	}
+	// The winning key is reported with the response.
+	keyIndex, _ := resp.Request.Context().Value(keyIndexContextKey).(int)
+	assertString(t, string(body), "fast "+km.originalKeys[keyIndex])
+	assertInt(t, int(atomic.LoadInt32(&calls)), 2)
+
+	select {
+	case <-slowCanceled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the slower attempt to be canceled")
+	}
+}
+
+func TestRetryTransport_HedgeLoserRateLimitSidelinesKey(t *testing.T) {
+	var calls int32
+	var limitedKey atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// The first attempt is rate limited after the hedge has started...
+			time.Sleep(60 * time.Millisecond)
+			limitedKey.Store(r.URL.Query().Get("key"))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		// ...and the hedge answers successfully after that.
+		time.Sleep(150 * time.Millisecond)
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+	rt.hedgeDelay = 20 * time.Millisecond
+
+	req := httptest.NewRequest("GET", server.URL+"/v1beta/models", nil)
+	req.RequestURI = ""
+	resp, err := rt.RoundTrip(req)
+	assertNoError(t, err)
+	resp.Body.Close()
+	assertInt(t, resp.StatusCode, http.StatusOK)
+	assertInt(t, int(atomic.LoadInt32(&calls)), 2)
+
+	// The discarded 429 still sidelines the key that received it.
+	failing := km.snapshot().Scopes[requestScope(req)].FailingKeys
+	assertInt(t, len(failing), 1)
+	assertString(t, km.originalKeys[failing[0].Index], limitedKey.Load().(string))
+	assertString(t, failing[0].Reason, "status 429")
+}
+
+func TestRetryTransport_HedgeNotNeeded(t *testing.T) {
+	var calls int32
+	server := newCountingServer(t, http.StatusOK, &calls)
+	defer server.Close()
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+	rt.hedgeDelay = time.Second
+
+	req := httptest.NewRequest("GET", server.URL+"/v1beta/models", nil)
+	req.RequestURI = ""
+	resp, err := rt.RoundTrip(req)
+	assertNoError(t, err)
+	resp.Body.Close()
+	assertInt(t, resp.StatusCode, http.StatusOK)
+	assertInt(t, int(atomic.LoadInt32(&calls)), 1)
+}
+
+func TestRetryTransport_HedgeSkipsNonIdempotent(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+	rt.hedgeDelay = 10 * time.Millisecond
+
+	req := httptest.NewRequest("POST", server.URL+"/v1beta/models/gemini-pro:generateContent", nil)
+	req.RequestURI = ""
+	resp, err := rt.RoundTrip(req)
+	assertNoError(t, err)
+	resp.Body.Close()
+	assertInt(t, int(atomic.LoadInt32(&calls)), 1)
+}
+
+func TestGetOtherKey(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	scope := buildScopeKey("example.com", "/v1beta/models")
+	for range 10 {
+		key, index, err := km.getOtherKey(scope, 0)
+		assertNoError(t, err)
+		assertInt(t, index, 1)
+		assertString(t, key, "k2")
+	}
+
+	km.markKeyFailed(scope, 1, "test")
+	_, _, err := km.getOtherKey(scope, 0)
+	assertErrorContains(t, err, errNoKeysAvailable.Error())
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGeminiRequest is one request received by a fakeGemini server.
+type fakeGeminiRequest struct {
+	key    string
+	path   string
+	body   string
+	status int
+}
+
+// fakeGemini is a scriptable stand-in for the Gemini API. Each key has a script of statuses
+// returned to its requests in order; the last status repeats once the script runs out, and keys
+// without a script always get 200. 200 responses carry a minimal generateContent answer and
+// 429s an API-style error with Retry-After.
+type fakeGemini struct {
+	*httptest.Server
+	mu       sync.Mutex
+	scripts  map[string][]int
+	requests []fakeGeminiRequest
+}
+
+// newFakeGemini starts a fakeGemini server with the given per-key status scripts.
+func newFakeGemini(t *testing.T, scripts map[string][]int) *fakeGemini {
+	t.Helper()
+	f := &fakeGemini{scripts: scripts}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// serveHTTP answers a request with the next status in its key's script.
+func (f *fakeGemini) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	body, _ := io.ReadAll(r.Body)
+
+	f.mu.Lock()
+	status := http.StatusOK
+	if script := f.scripts[key]; len(script) > 0 {
+		status = script[0]
+		if len(script) > 1 {
+			f.scripts[key] = script[1:]
+		}
+	}
+	f.requests = append(f.requests, fakeGeminiRequest{key: key, path: r.URL.Path, body: string(body), status: status})
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "30")
+	}
+	w.WriteHeader(status)
+	if status == http.StatusOK {
+		fmt.Fprintf(w, `{"candidates":[{"content":{"parts":[{"text":"answer from %s"}]}}]}`, key)
+		return
+	}
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":"scripted failure"}}`, status)
+}
+
+// received returns a copy of the requests received so far.
+func (f *fakeGemini) received() []fakeGeminiRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeGeminiRequest(nil), f.requests...)
+}
+
+// keysUsed returns the key of each request received so far, in order.
+func (f *fakeGemini) keysUsed() []string {
+	var keys []string
+	for _, req := range f.received() {
+		keys = append(keys, req.key)
+	}
+	return keys
+}
+
+// newIntegrationProxy serves the full pipeline (main handler, body modifier, retry transport,
+// key manager) in front of upstream, the way main wires it up, and returns its URL.
+func newIntegrationProxy(t *testing.T, upstream *fakeGemini, km *keyManager) string {
+	t.Helper()
+	handler := createMainHandler(newTestProxy(upstream.Server, km, "key", nil), mainHandlerOptions{
+		bodyModifierOptions: bodyModifierOptions{addGoogleSearch: true, searchTrigger: "search", triggerMode: triggerReplace},
+		toolMethods:         splitCommaList(defaultToolMethods),
+	})
+	proxyServer := httptest.NewServer(handler)
+	t.Cleanup(proxyServer.Close)
+	return proxyServer.URL
+}
+
+// sessionForKeyIndex returns an X-Key-Session value that km pins to the key at index, so a test
+// can choose which key a request tries first.
+func sessionForKeyIndex(t *testing.T, km *keyManager, index int) string {
+	t.Helper()
+	for i := range 1000 {
+		if session := fmt.Sprintf("session-%d", i); km.sessionKeyIndex(session) == index {
+			return session
+		}
+	}
+	t.Fatalf("no session maps to key index %d", index)
+	return ""
+}
+
+// postGenerateContent sends a generateContent request through the proxy at proxyURL.
+func postGenerateContent(t *testing.T, proxyURL, session string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest("POST", proxyURL+"/v1beta/models/gemini-pro:generateContent", strings.NewReader(`{"contents":[{"parts":[{"text":"hello"}]}]}`))
+	assertNoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	if session != "" {
+		req.Header.Set(keySessionHeader, session)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assertNoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assertNoError(t, err)
+	return resp, string(body)
+}
+
+// failingKeyIndices returns the sidelined key indices of every scope in km.
+func failingKeyIndices(km *keyManager) []int {
+	var indices []int
+	for _, scope := range km.snapshot().Scopes {
+		for _, failing := range scope.FailingKeys {
+			indices = append(indices, failing.Index)
+		}
+	}
+	return indices
+}
+
+func TestIntegration_RateLimitedKeyIsSidelinedAndRetried(t *testing.T) {
+	upstream := newFakeGemini(t, map[string][]int{"k1": {http.StatusTooManyRequests}})
+	km, _ := newKeyManager([]string{"k1", "k2"}, time.Hour)
+	proxyURL := newIntegrationProxy(t, upstream, km)
+
+	// Pin the first attempt to k1, which is rate limited.
+	resp, body := postGenerateContent(t, proxyURL, sessionForKeyIndex(t, km, 0))
+
+	assertInt(t, resp.StatusCode, http.StatusOK)
+	assertString(t, body, `{"candidates":[{"content":{"parts":[{"text":"answer from k2"}]}}]}`)
+	assertString(t, resp.Header.Get(proxyAttemptsHeader), "2")
+	assertString(t, strings.Join(upstream.keysUsed(), ","), "k1,k2")
+
+	// Both attempts carried the modified body.
+	for _, req := range upstream.received() {
+		var sent map[string]any
+		assertNoError(t, json.Unmarshal([]byte(req.body), &sent))
+		if !strings.Contains(req.body, "google_search") {
+			t.Errorf("attempt with %s was sent without google_search: %s", req.key, req.body)
+		}
+	}
+
+	// k1 is sidelined, so later requests go straight to k2, even when pinned to k1.
+	assertString(t, fmt.Sprint(failingKeyIndices(km)), "[0]")
+	for range 3 {
+		resp, _ := postGenerateContent(t, proxyURL, sessionForKeyIndex(t, km, 0))
+		assertInt(t, resp.StatusCode, http.StatusOK)
+		assertString(t, resp.Header.Get(proxyAttemptsHeader), "1")
+	}
+	assertString(t, strings.Join(upstream.keysUsed(), ","), "k1,k2,k2,k2,k2")
+}
+
+func TestIntegration_AllKeysRateLimited(t *testing.T) {
+	upstream := newFakeGemini(t, map[string][]int{
+		"k1": {http.StatusTooManyRequests},
+		"k2": {http.StatusTooManyRequests},
+	})
+	km, _ := newKeyManager([]string{"k1", "k2"}, time.Hour)
+	proxyURL := newIntegrationProxy(t, upstream, km)
+
+	resp, _ := postGenerateContent(t, proxyURL, "")
+
+	// Each key is tried once and sidelined; the client sees the upstream's 429 and Retry-After.
+	assertInt(t, resp.StatusCode, http.StatusTooManyRequests)
+	assertString(t, resp.Header.Get("Retry-After"), "30")
+	keys := upstream.keysUsed()
+	assertInt(t, len(keys), 2)
+	if keys[0] == keys[1] {
+		t.Errorf("expected both keys to be tried, got %v", keys)
+	}
+	assertInt(t, len(failingKeyIndices(km)), 2)
+}
+
+func TestIntegration_ScriptedRecovery(t *testing.T) {
+	// A 5xx does not sideline the key, so once the upstream recovers the same key serves again.
+	upstream := newFakeGemini(t, map[string][]int{"k1": {http.StatusServiceUnavailable, http.StatusOK}})
+	km, _ := newKeyManager([]string{"k1"}, time.Hour)
+	proxyURL := newIntegrationProxy(t, upstream, km)
+
+	resp, body := postGenerateContent(t, proxyURL, "")
+	assertInt(t, resp.StatusCode, http.StatusOK)
+	assertString(t, body, `{"candidates":[{"content":{"parts":[{"text":"answer from k1"}]}}]}`)
+	assertString(t, strings.Join(upstream.keysUsed(), ","), "k1,k1")
+	assertInt(t, len(failingKeyIndices(km)), 0)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// keyExclusion keeps the keys at the listed indices out of every scope matching pattern,
+// e.g. keys without access to a model.
+type keyExclusion struct {
+	pattern *regexp.Regexp
+	keys    []int
+}
+
+// keyExclusionSpec is the JSON form of a keyExclusion in the -scope-key-exclusions flag.
+type keyExclusionSpec struct {
+	Scope string `json:"scope"`
+	Keys  []int  `json:"keys"`
+}
+
+// parseKeyExclusions parses the -scope-key-exclusions flag: a JSON array of rules, each a
+// regular expression matched against the scope ("host|path") and the key indices it excludes.
+// numKeys bounds the indices. An empty value means no exclusions.
+func parseKeyExclusions(raw string, numKeys int) ([]keyExclusion, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	var specs []keyExclusionSpec
+	dec := json.NewDecoder(strings.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&specs); err != nil {
+		return nil, fmt.Errorf("invalid scope key exclusion spec: %w", err)
+	}
+	exclusions := make([]keyExclusion, 0, len(specs))
+	for i, spec := range specs {
+		if spec.Scope == "" {
+			return nil, fmt.Errorf("scope key exclusion %d: scope pattern is required", i)
+		}
+		pattern, err := regexp.Compile(spec.Scope)
+		if err != nil {
+			return nil, fmt.Errorf("scope key exclusion %d: %w", i, err)
+		}
+		if len(spec.Keys) == 0 {
+			return nil, fmt.Errorf("scope key exclusion %d: at least one key index is required", i)
+		}
+		for _, index := range spec.Keys {
+			if index < 0 || index >= numKeys {
+				return nil, fmt.Errorf("scope key exclusion %d: key index %d out of range (%d keys)", i, index, numKeys)
+			}
+		}
+		exclusions = append(exclusions, keyExclusion{pattern: pattern, keys: spec.Keys})
+	}
+	return exclusions, nil
+}
+
+// validateDefaultKeyIndex checks a -default-key-index value against the configured keys.
+// Negative values disable the fallback.
+func validateDefaultKeyIndex(index int, keys []string) error {
+	if index < 0 {
+		return nil
+	}
+	if index >= len(keys) {
+		return fmt.Errorf("key index %d out of range (%d keys)", index, len(keys))
+	}
+	if keys[index] == "" {
+		return fmt.Errorf("key index %d is empty or a duplicate of an earlier key", index)
+	}
+	return nil
+}
+
+// excludedKeysFor returns the indices of the keys excluded from scope by any matching rule,
+// or nil if none are. If the rules would exclude every key, the key at defaultKeyIndex (when
+// set) stays in the scope, so its requests still proceed instead of failing with 503.
+func (km *keyManager) excludedKeysFor(scope string) map[int]bool {
+	var excluded map[int]bool
+	matchable := unescapeScopeKey(scope)
+	for _, exclusion := range km.keyExclusions {
+		if !exclusion.pattern.MatchString(matchable) {
+			continue
+		}
+		if excluded == nil {
+			excluded = make(map[int]bool)
+		}
+		for _, index := range exclusion.keys {
+			excluded[index] = true
+		}
+	}
+	if excluded != nil && km.allKeysExcluded(excluded) && km.defaultKeyIndex >= 0 &&
+		km.defaultKeyIndex < len(km.originalKeys) && km.originalKeys[km.defaultKeyIndex] != "" {
+		logInfof("Scope '%s': Every key is excluded; using default key index %d.", scopeForLog(scope), km.defaultKeyIndex)
+		delete(excluded, km.defaultKeyIndex)
+	}
+	return excluded
+}
+
+// allKeysExcluded reports whether excluded covers every valid (non-empty) key.
+func (km *keyManager) allKeysExcluded(excluded map[int]bool) bool {
+	for i, key := range km.originalKeys {
+		if key != "" && !excluded[i] {
+			return false
+		}
+	}
+	return true
+}
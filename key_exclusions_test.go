@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseKeyExclusions(t *testing.T) {
+	exclusions, err := parseKeyExclusions(`[{"scope":"gemini-2\\.5-pro","keys":[0,2]},{"scope":"^files\\.example\\.com\\|","keys":[1]}]`, 3)
+	assertNoError(t, err)
+	assertInt(t, len(exclusions), 2)
+	assertInt(t, len(exclusions[0].keys), 2)
+
+	exclusions, err = parseKeyExclusions("", 3)
+	assertNoError(t, err)
+	assertInt(t, len(exclusions), 0)
+
+	_, err = parseKeyExclusions(`[{"scope":"gemini","keys":[3]}]`, 3)
+	assertErrorContains(t, err, "key index 3 out of range")
+	_, err = parseKeyExclusions(`[{"scope":"gemini("}]`, 3)
+	assertErrorContains(t, err, "scope key exclusion 0")
+	_, err = parseKeyExclusions(`[{"scope":"gemini","keys":[]}]`, 3)
+	assertErrorContains(t, err, "at least one key index")
+	_, err = parseKeyExclusions(`[{"path":"gemini","keys":[0]}]`, 3)
+	assertErrorContains(t, err, "invalid scope key exclusion spec")
+}
+
+func TestKeyExclusions_ScopeAvailableKeys(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2", "k3"}, 1*time.Minute)
+	var err error
+	km.keyExclusions, err = parseKeyExclusions(`[{"scope":"gemini-2\\.5-pro","keys":[0]}]`, 3)
+	assertNoError(t, err)
+
+	excludedScope := buildScopeKey("example.com", "/v1beta/models/gemini-2.5-pro:generateContent")
+	otherScope := buildScopeKey("example.com", "/v1beta/models/gemini-2.0-flash:generateContent")
+	for range 20 {
+		_, index, err := km.getNextKey(excludedScope)
+		assertNoError(t, err)
+		if index == 0 {
+			t.Fatal("Excluded key index 0 was selected for the matching scope")
+		}
+	}
+	_, _, err = km.getNextKey(otherScope)
+	assertNoError(t, err)
+
+	snap := km.snapshot()
+	assertInt(t, len(snap.Scopes[excludedScope].AvailableKeys), 2)
+	if snap.Scopes[excludedScope].AvailableKeys[0] != 1 {
+		t.Errorf("Expected key index 0 to be absent from the excluded scope, got %v", snap.Scopes[excludedScope].AvailableKeys)
+	}
+	assertInt(t, len(snap.Scopes[otherScope].AvailableKeys), 3)
+
+	// Reactivation and resets never bring the excluded key back.
+	km.markKeyFailed(excludedScope, 1, "test")
+	km.markKeyFailed(excludedScope, 2, "test")
+	km.resetAll()
+	assertInt(t, len(km.snapshot().Scopes[excludedScope].AvailableKeys), 2)
+}
+
+func TestKeyExclusions_AllKeysExcluded(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	km.keyExclusions, _ = parseKeyExclusions(`[{"scope":"gemini-ultra","keys":[0,1]}]`, 2)
+
+	_, _, err := km.getNextKey(buildScopeKey("example.com", "/v1beta/models/gemini-ultra:generateContent"))
+	assertErrorContains(t, err, "every key is excluded")
+}
+
+func TestKeyExclusions_DefaultKeyFallback(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2", "k3"}, 1*time.Minute)
+	km.keyExclusions, _ = parseKeyExclusions(`[{"scope":"gemini-ultra","keys":[0,1,2]},{"scope":"gemini-2\\.5-pro","keys":[0]}]`, 3)
+	km.defaultKeyIndex = 1
+
+	// A scope with no keys left falls back to the default key.
+	noKeysScope := buildScopeKey("example.com", "/v1beta/models/gemini-ultra:generateContent")
+	for range 5 {
+		key, index, err := km.getNextKey(noKeysScope)
+		assertNoError(t, err)
+		assertInt(t, index, 1)
+		assertString(t, key, "k2")
+	}
+	assertInt(t, len(km.snapshot().Scopes[noKeysScope].AvailableKeys), 1)
+
+	// The default key is sidelined like any other; the scope is then exhausted until it returns.
+	km.markKeyFailed(noKeysScope, 1, "status 429")
+	_, _, err := km.getNextKey(noKeysScope)
+	assertErrorContains(t, err, "temporarily rate limited")
+
+	// Scopes that still have keys of their own keep their exclusions.
+	partialScope := buildScopeKey("example.com", "/v1beta/models/gemini-2.5-pro:generateContent")
+	_, _, err = km.getNextKey(partialScope)
+	assertNoError(t, err)
+	assertInt(t, len(km.snapshot().Scopes[partialScope].AvailableKeys), 2)
+}
+
+func TestValidateDefaultKeyIndex(t *testing.T) {
+	keys := []string{"k1", "", "k3"}
+	assertNoError(t, validateDefaultKeyIndex(-1, keys))
+	assertNoError(t, validateDefaultKeyIndex(2, keys))
+	assertErrorContains(t, validateDefaultKeyIndex(3, keys), "out of range")
+	assertErrorContains(t, validateDefaultKeyIndex(1, keys), "empty or a duplicate")
+}
+
+func TestKeyExclusions_MatchUnescapedScope(t *testing.T) {
+	prev := scopeSeparator
+	t.Cleanup(func() { setScopeSeparator(prev) })
+	setScopeSeparator(":")
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	km.keyExclusions, _ = parseKeyExclusions(`[{"scope":"^example\\.com:/v1beta/models/gemini-pro:generateContent$","keys":[0]}]`, 2)
+	km.removalOverrides = []removalOverride{{prefix: "/v1beta/models/gemini-pro:gen", duration: 5 * time.Second}}
+
+	// The ':' in the path is escaped in the scope key, but rules see the path as sent.
+	scope := buildScopeKey("example.com", "/v1beta/models/gemini-pro:generateContent")
+	assertString(t, scope, "example.com:/v1beta/models/gemini-pro%3AgenerateContent")
+	assertInt(t, len(km.excludedKeysFor(scope)), 1)
+	if got := km.removalDurationFor(scope); got != 5*time.Second {
+		t.Errorf("removalDurationFor() = %v, want 5s", got)
+	}
+}
@@ -1,43 +1,195 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
+	"hash/fnv"
+	"math"
 	"math/rand/v2"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// failInfo describes why and when a key was sidelined in a scope.
+type failInfo struct {
+	// why the key was sidelined, e.g. "status 429" or "manual"
+	reason string
+	// when the key was sidelined
+	failedAt time.Time
+	// when the key becomes eligible for reactivation
+	reactivateAt time.Time
+}
+
+// sidelineStats aggregates how long keys actually stayed sidelined in a scope.
+type sidelineStats struct {
+	count int
+	total time.Duration
+	min   time.Duration
+	max   time.Duration
+}
+
+// record adds one observed sideline duration.
+func (s *sidelineStats) record(d time.Duration) {
+	if s.count == 0 || d < s.min {
+		s.min = d
+	}
+	if d > s.max {
+		s.max = d
+	}
+	s.count++
+	s.total += d
+}
+
 // scopeState holds the state for a specific host+path combination.
 type scopeState struct {
 	// map of original key index -> key string for keys currently available for this scope
 	availableKeys map[int]string
-	// map of original key index -> reactivation time for keys currently failing for this scope
-	failingKeys map[int]time.Time
+	// map of original key index -> failure details for keys currently failing for this scope
+	failingKeys map[int]failInfo
 	// round-robin index for this scope
 	// We store it per-scope to avoid needing a global counter,
 	// but we don't actually use it for selection anymore (we use random).
 	// Could potentially be removed or repurposed.
 	currentIndex int
+	// last time a key was requested or marked failed in this scope, used for idle pruning
+	lastActivity time.Time
+	// observed time-to-reactivation for keys in this scope
+	sidelined sidelineStats
+	// most recent upstream error in this scope (see recordScopeError); status 0 means no response
+	lastError     string
+	lastStatus    int
+	lastErrorTime time.Time
+	// when a pool_exhausted webhook event was last sent for this scope
+	lastExhaustedEvent time.Time
+	// when the available key alarm was last logged for this scope (see checkAvailableKeyThreshold)
+	lastThresholdAlarm time.Time
+	// number of times each key index was handed out in this scope, for fairness reporting
+	selections map[int]uint64
+	// key indices never used in this scope (see keyExclusion); nil when none are excluded
+	excludedKeys map[int]bool
 }
 
 // keyManager manages the API keys, rotation, and failure handling per scope.
 type keyManager struct {
-	mu sync.Mutex
-	// Original list of keys, used for indexing and reactivation.
+	// Scopes (host+path -> scopeState) are spread over shards by hash (see shardFor), each
+	// with its own lock, so requests for different scopes do not contend. Operations on all
+	// scopes at once (reset, key replacement, snapshots) lock every shard (see lockAll).
+	shards [scopeShardCount]*scopeShard
+	// Original list of keys, used for indexing and reactivation. Only changed with every
+	// shard locked, so holding any one shard's lock is enough to read it.
 	originalKeys []string
-	// Map of scope (host+path) -> scopeState
-	scopes map[string]*scopeState
+	// len(originalKeys), for callers that hold no shard lock (see sessionKeyIndex).
+	keyCount atomic.Int64
+	// Guards keyUsage, which is shared by all shards.
+	statsMu sync.Mutex
 	// Default duration a key is sidelined after failure in a scope.
 	removalDuration time.Duration
+	// Per-path-prefix removal durations, longest prefix first (see parseRemovalOverrides).
+	// Must be set before the key manager is used.
+	removalOverrides []removalOverride
+	// For warmupDuration after startedAt, keys are sidelined for at most warmupRemovalDuration,
+	// so transient errors right after a deploy do not take keys out for the full duration.
+	// Zero warmupDuration disables the warm-up. Must be set before the key manager is used.
+	startedAt             time.Time
+	warmupDuration        time.Duration
+	warmupRemovalDuration time.Duration
+	// Scopes idle for longer than this with no failing keys are pruned. Zero disables pruning.
+	// Must be set before the key manager is used.
+	scopeTTL time.Duration
+	// Maximum number of scopes tracked; creating one more evicts the least recently used scope
+	// (see evictLRUScope). The limit is split evenly across shards. Zero means no limit.
+	// Must be set before the key manager is used.
+	maxScopes int
+	// Alarm when a scope has fewer available keys than this. Zero disables the alarm.
+	// Must be set before the key manager is used.
+	minAvailableKeys int
+	// Minimum time between threshold alarm logs for a scope, so a persistent breach does not
+	// flood the log.
+	thresholdAlarmInterval time.Duration
+	// When each key (by original index) was last handed out and last sidelined, in any scope.
+	keyUsage []keyUsage
+	// Receives key_sidelined and pool_exhausted events. Nil disables notifications.
+	// Must be set before the key manager is used.
+	notifier *webhookNotifier
+	// Called with each scope removed by evictLRUScope or pruneIdleScopes, with its shard
+	// locked, e.g. to drop its metrics. Nil is allowed. Must be set before the key manager is used.
+	onScopeRemoved func(scope string)
+	// Keys kept out of matching scopes (see parseKeyExclusions). Must be set before the key
+	// manager is used.
+	keyExclusions []keyExclusion
+	// Index of the key kept in a scope whose keys would otherwise all be excluded (see
+	// excludedKeysFor). Negative disables the fallback. Must be set before the key manager is used.
+	defaultKeyIndex int
+	// Log a warning when acquiring a shard lock takes longer than this (see lockShard). Zero disables the
+	// check. Must be set before the key manager is used.
+	contentionWarn time.Duration
 }
 
+// keyUsage records when a key was last used and last failed, across all scopes.
+type keyUsage struct {
+	lastUsed   time.Time
+	lastFailed time.Time
+}
+
+// removalOverride sidelines keys for scopes whose path starts with prefix for duration
+// instead of the global removal duration.
+type removalOverride struct {
+	prefix   string
+	duration time.Duration
+}
+
+// parseRemovalOverrides parses a comma-separated list of PATH_PREFIX=DURATION entries
+// (e.g. "/v1beta/models/gemini-pro=10m"), sorted so the longest prefix is matched first.
+func parseRemovalOverrides(raw string) ([]removalOverride, error) {
+	var overrides []removalOverride
+	for _, entry := range splitCommaList(raw) {
+		prefix, rawDuration, found := strings.Cut(entry, "=")
+		prefix = strings.TrimSpace(prefix)
+		if !found || prefix == "" {
+			return nil, fmt.Errorf("invalid removal override %q: expected PATH_PREFIX=DURATION", entry)
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(rawDuration))
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid removal override %q: duration must be positive", entry)
+		}
+		overrides = append(overrides, removalOverride{prefix: prefix, duration: duration})
+	}
+	sort.SliceStable(overrides, func(i, j int) bool { return len(overrides[i].prefix) > len(overrides[j].prefix) })
+	return overrides, nil
+}
+
+// removalDurationFor returns how long a key failing in scope is sidelined: the duration of the
+// longest matching path-prefix override, or the global removal duration. During the warm-up
+// period the result is capped at warmupRemovalDuration.
+func (km *keyManager) removalDurationFor(scope string) time.Duration {
+	duration := km.removalDuration
+	path := scopePath(scope)
+	for _, override := range km.removalOverrides {
+		if strings.HasPrefix(path, override.prefix) {
+			duration = override.duration
+			break
+		}
+	}
+	if km.warmupDuration > 0 && time.Since(km.startedAt) < km.warmupDuration && duration > km.warmupRemovalDuration {
+		duration = km.warmupRemovalDuration
+	}
+	return duration
+}
+
+// errNoKeysAvailable is wrapped by getNextKey when every key in a scope is sidelined.
+var errNoKeysAvailable = errors.New("all keys are temporarily rate limited or failing")
+
 // Context key type for associating values with a request.
 type contextKey string
 
 const (
 	keyIndexContextKey   contextKey = "keyIndex"
+	apiKeyContextKey     contextKey = "apiKey"
 	proxyErrorContextKey contextKey = "proxyError"
 )
 
@@ -50,27 +202,23 @@ func newKeyManager(keys []string, removalDuration time.Duration) (*keyManager, e
 		return nil, errors.New("key removal duration must be positive")
 	}
 
-	// Validate keys - count valid ones
-	validKeyCount := 0
-	for i, k := range keys {
-		if k == "" {
-			log.Printf("Warning: Empty key provided at index %d, skipping.", i)
-		} else {
-			validKeyCount++
-		}
-	}
-
+	keys, validKeyCount := blankDuplicateKeys(keys)
 	if validKeyCount == 0 {
 		return nil, errors.New("no valid (non-empty) API keys found")
 	}
 
-	log.Printf("Initialized Key Manager with %d valid keys. Scopes will be created on demand.", validKeyCount)
+	logInfof("Initialized Key Manager with %d valid keys. Scopes will be created on demand.", validKeyCount)
 
 	km := &keyManager{
-		originalKeys:    keys,
-		scopes:          make(map[string]*scopeState),
-		removalDuration: removalDuration,
+		originalKeys:           keys,
+		shards:                 newScopeShards(),
+		removalDuration:        removalDuration,
+		keyUsage:               make([]keyUsage, len(keys)),
+		startedAt:              time.Now(),
+		defaultKeyIndex:        -1,
+		thresholdAlarmInterval: 1 * time.Minute,
 	}
+	km.keyCount.Store(int64(len(keys)))
 
 	// Start background goroutine for reactivating keys
 	go km.reactivationLoop()
@@ -78,163 +226,584 @@ func newKeyManager(keys []string, removalDuration time.Duration) (*keyManager, e
 	return km, nil
 }
 
+// distinctKeyCount returns the number of distinct non-empty keys, without logging: blank
+// entries and repeats add no failover.
+func distinctKeyCount(keys []string) int {
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if k != "" {
+			seen[k] = true
+		}
+	}
+	return len(seen)
+}
+
+// blankDuplicateKeys returns a copy of keys with repeated keys blanked out, and the number of
+// valid (non-empty) keys. A repeated key would be rotated into more often and stay available
+// through its duplicate while sidelined, so later copies are dropped. Blanking (rather than
+// removing) keeps every key at its configured index.
+func blankDuplicateKeys(keys []string) ([]string, int) {
+	keys = append([]string(nil), keys...)
+	firstIndex := make(map[string]int, len(keys))
+	validKeyCount := 0
+	for i, k := range keys {
+		if k == "" {
+			logWarnf("Empty key provided at index %d, skipping.", i)
+		} else if first, dup := firstIndex[k]; dup {
+			logWarnf("Key at index %d duplicates the key at index %d, skipping.", i, first)
+			keys[i] = ""
+		} else {
+			firstIndex[k] = i
+			validKeyCount++
+		}
+	}
+	return keys, validKeyCount
+}
+
 // getOrCreateScopeState returns the scopeState for a given scope string,
 // creating it if it doesn't exist.
-// This function MUST be called with the keyManager mutex held.
+// This function MUST be called with the scope's shard locked.
 func (km *keyManager) getOrCreateScopeState(scope string) *scopeState {
-	if state, exists := km.scopes[scope]; exists {
+	shard := km.shardFor(scope)
+	if state, exists := shard.scopes[scope]; exists {
 		return state
 	}
 
+	// Make room first if the shard is at its share of maxScopes.
+	if km.maxScopes > 0 && len(shard.scopes) >= km.maxScopesPerShard() {
+		km.evictLRUScope(shard)
+	}
+
 	// Scope doesn't exist, create it.
 	newState := &scopeState{
 		availableKeys: make(map[int]string),
-		failingKeys:   make(map[int]time.Time),
+		failingKeys:   make(map[int]failInfo),
+		selections:    make(map[int]uint64),
 		currentIndex:  0, // Initialize index
+		lastActivity:  time.Now(),
+		excludedKeys:  km.excludedKeysFor(scope),
 	}
 
-	// Populate availableKeys with all *valid* original keys
+	// Populate availableKeys with all *valid* original keys not excluded from this scope
 	for i, key := range km.originalKeys {
-		if key != "" { // Only add non-empty keys
+		if key != "" && !newState.excludedKeys[i] { // Only add non-empty keys
 			newState.availableKeys[i] = key
 		}
 	}
 
-	km.scopes[scope] = newState
-	log.Printf("Created new scope state for: %s with %d initial available keys", scope, len(newState.availableKeys))
+	shard.scopes[scope] = newState
+	logDebugf("Created new scope state for: %s with %d initial available keys", scopeForLog(scope), len(newState.availableKeys))
 	return newState
 }
 
-// buildScopeKey creates the key for the scopes map.
+// maxScopesPerShard returns each shard's share of maxScopes, rounded up so the shards together
+// hold at least maxScopes scopes.
+func (km *keyManager) maxScopesPerShard() int {
+	return (km.maxScopes + scopeShardCount - 1) / scopeShardCount
+}
+
+// evictLRUScope removes the least recently active scope in shard, sidelined keys and all.
+// This MUST be called with the shard locked.
+func (km *keyManager) evictLRUScope(shard *scopeShard) {
+	var lruScope string
+	var lruState *scopeState
+	for scope, state := range shard.scopes {
+		if lruState == nil || state.lastActivity.Before(lruState.lastActivity) {
+			lruScope, lruState = scope, state
+		}
+	}
+	if lruState == nil {
+		return
+	}
+	delete(shard.scopes, lruScope)
+	km.scopeRemoved(lruScope)
+	logInfof("Scope limit of %d reached: evicted least recently used scope '%s' (idle since %s, %d sidelined key(s)).", km.maxScopes, scopeForLog(lruScope), lruState.lastActivity.Format(time.RFC3339), len(lruState.failingKeys))
+}
+
+// hashScopeLogs controls whether scopeForLog masks scopes. Set once at startup.
+var hashScopeLogs bool
+
+// scopeForLog returns the scope as it should appear in logs and client-facing errors.
+// When hashScopeLogs is enabled it returns a stable short hash instead of the raw
+// host|path, so tenant-identifying paths are not written to shared logs.
+// Map keys always use the real scope.
+func scopeForLog(scope string) string {
+	if !hashScopeLogs {
+		return scope
+	}
+	sum := sha256.Sum256([]byte(scope))
+	return "scope-" + hex.EncodeToString(sum[:6])
+}
+
+// defaultScopeHost names the host of scopes built for requests without one (e.g. relative
+// URLs). main sets it to the target host at startup.
+var defaultScopeHost = "default"
+
+// scopeSeparator joins the host and path of a scope key. main sets it from -scope-separator
+// with setScopeSeparator.
+var scopeSeparator = "|"
+
+// scopeEscaper and scopeUnescaper escape and unescape scope key components for scopeSeparator
+// (see newScopeComponentReplacers).
+var scopeEscaper, scopeUnescaper = newScopeComponentReplacers(scopeSeparator)
+
+// setScopeSeparator sets scopeSeparator and rebuilds the replacers for it.
+func setScopeSeparator(sep string) {
+	scopeSeparator = sep
+	scopeEscaper, scopeUnescaper = newScopeComponentReplacers(sep)
+}
+
+// parseScopeSeparator validates a -scope-separator value. "%" is reserved for escaping.
+func parseScopeSeparator(raw string) (string, error) {
+	if raw == "" {
+		return "", errors.New("scope separator must not be empty")
+	}
+	if strings.Contains(raw, "%") {
+		return "", fmt.Errorf("scope separator %q must not contain %%", raw)
+	}
+	return raw, nil
+}
+
+// newScopeComponentReplacers returns replacers that percent-encode "%" and sep in a scope key
+// component, so a path containing the separator cannot produce the same key as another host
+// and path, and that undo the encoding.
+func newScopeComponentReplacers(sep string) (escaper, unescaper *strings.Replacer) {
+	encoded := ""
+	for i := 0; i < len(sep); i++ {
+		encoded += fmt.Sprintf("%%%02X", sep[i])
+	}
+	return strings.NewReplacer("%", "%25", sep, encoded), strings.NewReplacer("%25", "%", encoded, sep)
+}
+
+// escapeScopeComponent escapes host or path for use in a scope key (see newScopeComponentReplacers).
+func escapeScopeComponent(component string) string {
+	if !strings.Contains(component, "%") && !strings.Contains(component, scopeSeparator) {
+		return component
+	}
+	return scopeEscaper.Replace(component)
+}
+
+// unescapeScopeComponent reverses escapeScopeComponent.
+func unescapeScopeComponent(component string) string {
+	if !strings.Contains(component, "%") {
+		return component
+	}
+	return scopeUnescaper.Replace(component)
+}
+
+// scopePath returns the path part of a scope key built by buildScopeKey, unescaped, so
+// path-prefix rules match the request path as sent.
+func scopePath(scope string) string {
+	_, path, _ := strings.Cut(scope, scopeSeparator)
+	return unescapeScopeComponent(path)
+}
+
+// unescapeScopeKey returns scope with both components unescaped, for matching rules written
+// against the plain "host<separator>path" form.
+func unescapeScopeKey(scope string) string {
+	if !strings.Contains(scope, "%") {
+		return scope
+	}
+	host, path, _ := strings.Cut(scope, scopeSeparator)
+	return unescapeScopeComponent(host) + scopeSeparator + unescapeScopeComponent(path)
+}
+
+// buildScopeKey creates the key for the scopes map: host and path joined by scopeSeparator,
+// each escaped so the separator only ever appears once. An empty host falls back to
+// defaultScopeHost, and trailing slashes are dropped from the path so "/models" and
+// "/models/" share a scope; an empty path becomes "/".
 func buildScopeKey(host, path string) string {
-	// Simple concatenation might be okay, but consider edge cases
-	// like empty host or path if that's possible in your setup.
-	// Using a separator ensures uniqueness if path could start with host chars.
-	return fmt.Sprintf("%s|%s", host, path)
+	if host == "" {
+		host = defaultScopeHost
+	}
+	path = strings.TrimRight(path, "/")
+	if path == "" {
+		path = "/"
+	}
+	return escapeScopeComponent(host) + scopeSeparator + escapeScopeComponent(path)
 }
 
+// getNextKey selects an available key for the scope, starting from a random index.
 func (km *keyManager) getNextKey(scope string) (string, int, error) {
-	km.mu.Lock()
-	defer km.mu.Unlock()
+	return km.getNextKeyPreferring(scope, -1)
+}
+
+// getNextKeyPreferring selects a key for the scope like getNextKey, but returns the key at
+// preferredIndex if it is currently available in the scope. A negative preferredIndex means
+// no preference; an unavailable (e.g. sidelined) preferred key falls back to random selection.
+func (km *keyManager) getNextKeyPreferring(scope string, preferredIndex int) (string, int, error) {
+	return km.getNextKeyExcluding(scope, preferredIndex, nil)
+}
+
+// getNextKeyExcluding selects a key like getNextKeyPreferring, but avoids the key indices in
+// exclude (e.g. keys already tried for the same request) while any other key is available.
+// If every available key is excluded, one of them is returned rather than failing.
+func (km *keyManager) getNextKeyExcluding(scope string, preferredIndex int, exclude map[int]bool) (string, int, error) {
+	shard := km.shardFor(scope)
+	km.lockShard(shard)
+	defer shard.mu.Unlock()
 
 	numOriginalKeys := uint64(len(km.originalKeys))
 	if numOriginalKeys == 0 {
-		log.Println("Error: Original key list is empty in getNextKey.")
+		logErrorf("Original key list is empty in getNextKey.")
 		return "", -1, errors.New("internal error: key list is empty")
 	}
 
 	state := km.getOrCreateScopeState(scope)
+	state.lastActivity = time.Now()
 
 	// 1. Check if any keys are available *in this scope*
 	if len(state.availableKeys) == 0 {
 		// Count how many *valid* original keys exist.
 		validOriginalKeyCount := 0
-		for _, k := range km.originalKeys {
-			if k != "" {
+		for i, k := range km.originalKeys {
+			if k != "" && !state.excludedKeys[i] {
 				validOriginalKeyCount++
 			}
 		}
+		if validOriginalKeyCount == 0 {
+			return "", -1, fmt.Errorf("scope '%s': every key is excluded from this scope", scopeForLog(scope))
+		}
 
 		// Check if the reason for no available keys is that all *valid* original keys are currently failing *in this scope*.
 		if len(state.failingKeys) > 0 && len(state.failingKeys) == validOriginalKeyCount {
 			// If we reach here, it means all *valid* original keys are temporarily failing *in this scope*.
 			// Let's perform an immediate reactivation check for *this scope*.
-			log.Printf("Scope '%s': All valid keys temporarily failing. Performing immediate reactivation check for this scope.", scope)
-			keysReactivated := km.reactivateScopeKeys(state) // Call helper to reactivate expired keys in this scope
-			log.Printf("Scope '%s': Immediate check reactivated %d keys.", scope, keysReactivated)
+			logWarnf("Scope '%s': All valid keys temporarily failing. Performing immediate reactivation check for this scope.", scopeForLog(scope))
+			keysReactivated := km.reactivateScopeKeys(scope, state) // Call helper to reactivate expired keys in this scope
+			logInfof("Scope '%s': Immediate check reactivated %d keys.", scopeForLog(scope), keysReactivated)
 
 			// After attempting reactivation, check availability again.
 			if len(state.availableKeys) == 0 {
 				// If still no keys available after check, return the error.
-				log.Printf("Scope '%s': Still no keys available after immediate reactivation check.", scope)
-				return "", -1, fmt.Errorf("scope '%s': all keys are temporarily rate limited or failing", scope)
+				logWarnf("Scope '%s': Still no keys available after immediate reactivation check.", scopeForLog(scope))
+				km.checkAvailableKeyThreshold(scope, state)
+				km.notifyPoolExhausted(scope, state)
+				return "", -1, fmt.Errorf("scope '%s': %w", scopeForLog(scope), errNoKeysAvailable)
 			} // else, proceed to select a key below
 		} else { // This means len(state.availableKeys) == 0, but it's NOT because all valid keys are failing.
 			// This could happen if all keys were initially empty or if somehow
 			// availableKeys became empty without failingKeys reflecting it (shouldn't happen often).
-			log.Printf("Error: Scope '%s': No API keys currently available, and not all valid keys were failing (Available: 0, Failing: %d, Valid Original: %d).", scope, len(state.failingKeys), validOriginalKeyCount)
-			return "", -1, fmt.Errorf("scope '%s': no keys configured or available", scope)
+			// Repair the state: every valid key that is not failing should be available.
+			repaired := km.reconcileScopeState(state)
+			logErrorf("Scope '%s': Inconsistent key state detected (Available: 0, Failing: %d, Valid Original: %d). Restored %d key(s) not marked as failing.", scopeForLog(scope), len(state.failingKeys), validOriginalKeyCount, repaired)
+			if len(state.availableKeys) == 0 {
+				return "", -1, fmt.Errorf("scope '%s': no keys configured or available", scopeForLog(scope))
+			}
 		}
 	} // End of outer check: if len(state.availableKeys) == 0 initially
+	km.checkAvailableKeyThreshold(scope, state)
+
+	// 2. Use the preferred key if it is available in this scope
+	if preferredIndex >= 0 && !exclude[preferredIndex] {
+		if key, ok := state.availableKeys[preferredIndex]; ok {
+			km.markKeyUsed(preferredIndex, state.lastActivity)
+			state.selections[preferredIndex]++
+			logDebugf("Scope '%s': Selected preferred key index %d. Available keys remaining in scope: %d", scopeForLog(scope), preferredIndex, len(state.availableKeys))
+			return key, preferredIndex, nil
+		}
+		logDebugf("Scope '%s': Preferred key index %d not available, falling back to random selection.", scopeForLog(scope), preferredIndex)
+	}
 
-	// 2. Find the next available key using random start within the original key indices
+	// 3. Find the next available key using random start within the original key indices,
+	// skipping excluded keys unless nothing else is available
 	startIndex := rand.IntN(int(numOriginalKeys)) // Generate a random starting index
-	for i := range int(numOriginalKeys) {
-		currentIndex := (startIndex + i) % int(numOriginalKeys)
-		keyIndex := currentIndex
+	for _, allowExcluded := range []bool{false, true} {
+		if allowExcluded && len(exclude) == 0 {
+			break
+		}
+		for i := range int(numOriginalKeys) {
+			currentIndex := (startIndex + i) % int(numOriginalKeys)
+			keyIndex := currentIndex
+			if exclude[keyIndex] && !allowExcluded {
+				continue
+			}
+
+			if key, ok := state.availableKeys[keyIndex]; ok {
+				// Found an available key for this scope
+				km.markKeyUsed(keyIndex, state.lastActivity)
+				state.selections[keyIndex]++
+				if allowExcluded {
+					logDebugf("Scope '%s': Every available key was already tried; reusing key index %d.", scopeForLog(scope), keyIndex)
+				}
+				logDebugf("Scope '%s': Selected key index %d. Available keys remaining in scope: %d", scopeForLog(scope), keyIndex, len(state.availableKeys))
+				return key, keyIndex, nil
+			}
+		}
+	}
 
+	// Should be unreachable if len(state.availableKeys) > 0
+	logErrorf("Scope '%s': Could not find an available key despite availableKeys map (len %d) not being empty (Concurrency issue?). Failing keys: %d", scopeForLog(scope), len(state.availableKeys), len(state.failingKeys))
+	return "", -1, fmt.Errorf("scope '%s': no available key found after checking all indices", scopeForLog(scope))
+}
+
+// getOtherKey selects a random key available in the scope other than the key at excludeIndex,
+// without the reactivation checks of getNextKey. It is used to send a request concurrently
+// with a second key, so it fails rather than return the excluded key.
+func (km *keyManager) getOtherKey(scope string, excludeIndex int) (string, int, error) {
+	shard := km.shardFor(scope)
+	km.lockShard(shard)
+	defer shard.mu.Unlock()
+
+	state := km.getOrCreateScopeState(scope)
+	numOriginalKeys := len(km.originalKeys)
+	if numOriginalKeys == 0 {
+		return "", -1, errors.New("internal error: key list is empty")
+	}
+	startIndex := rand.IntN(numOriginalKeys)
+	for i := range numOriginalKeys {
+		keyIndex := (startIndex + i) % numOriginalKeys
+		if keyIndex == excludeIndex {
+			continue
+		}
 		if key, ok := state.availableKeys[keyIndex]; ok {
-			// Found an available key for this scope
-			log.Printf("Scope '%s': Selected key index %d. Available keys remaining in scope: %d", scope, keyIndex, len(state.availableKeys))
+			state.lastActivity = time.Now()
+			km.markKeyUsed(keyIndex, state.lastActivity)
+			state.selections[keyIndex]++
 			return key, keyIndex, nil
 		}
 	}
+	return "", -1, fmt.Errorf("scope '%s': %w", scopeForLog(scope), errNoKeysAvailable)
+}
 
-	// Should be unreachable if len(state.availableKeys) > 0
-	log.Printf("Error: Scope '%s': Could not find an available key despite availableKeys map (len %d) not being empty (Concurrency issue?). Failing keys: %d", scope, len(state.availableKeys), len(state.failingKeys))
-	return "", -1, fmt.Errorf("scope '%s': no available key found after checking all indices", scope)
+// markKeyUsed records that the key at index was handed out at t.
+func (km *keyManager) markKeyUsed(index int, t time.Time) {
+	km.statsMu.Lock()
+	defer km.statsMu.Unlock()
+	km.keyUsage[index].lastUsed = t
+}
+
+// reconcileScopeState rebuilds availableKeys from originalKeys minus failingKeys and excluded keys.
+// Returns the number of keys that were missing from availableKeys and got restored.
+// This MUST be called with the scope's shard locked.
+func (km *keyManager) reconcileScopeState(state *scopeState) int {
+	restored := 0
+	for i, key := range km.originalKeys {
+		if key == "" || state.excludedKeys[i] {
+			continue
+		}
+		if _, failing := state.failingKeys[i]; failing {
+			continue
+		}
+		if _, available := state.availableKeys[i]; !available {
+			state.availableKeys[i] = key
+			restored++
+		}
+	}
+	return restored
 }
 
 // markKeyFailed temporarily removes a key from rotation *for a specific scope*.
-func (km *keyManager) markKeyFailed(scope string, keyIndex int) {
-	km.mu.Lock()
-	defer km.mu.Unlock()
+// The reason is kept for observability (admin state) and logging.
+func (km *keyManager) markKeyFailed(scope string, keyIndex int, reason string) {
+	shard := km.shardFor(scope)
+	km.lockShard(shard)
+	defer shard.mu.Unlock()
+
+	km.sidelineKey(scope, keyIndex, reason)
+}
+
+// markKeyFailedIfCurrent is markKeyFailed for a request that selected key at keyIndex: if a
+// key reload has since put another key at that index (or removed it), nothing is marked, so
+// a late failure cannot sideline a key the request never used.
+func (km *keyManager) markKeyFailedIfCurrent(scope string, keyIndex int, key string, reason string) {
+	shard := km.shardFor(scope)
+	km.lockShard(shard)
+	defer shard.mu.Unlock()
 
+	// reloadKeys replaces originalKeys with every shard locked, so holding one is enough here.
+	if keyIndex < 0 || keyIndex >= len(km.originalKeys) || km.originalKeys[keyIndex] != key {
+		logDebugf("Scope '%s': Key index %d changed in a key reload since it was selected; not marking it as failing.", scopeForLog(scope), keyIndex)
+		return
+	}
+	km.sidelineKey(scope, keyIndex, reason)
+}
+
+// sidelineKey does the work of markKeyFailed. This MUST be called with the scope's shard locked.
+func (km *keyManager) sidelineKey(scope string, keyIndex int, reason string) {
 	state := km.getOrCreateScopeState(scope)
+	state.lastActivity = time.Now()
 
 	// Only mark as failed if it's currently considered available *in this scope*
 	if _, ok := state.availableKeys[keyIndex]; ok {
-		reactivationTime := time.Now().Add(km.removalDuration)
-		state.failingKeys[keyIndex] = reactivationTime
+		now := time.Now()
+		reactivationTime := now.Add(km.removalDurationFor(scope))
+		state.failingKeys[keyIndex] = failInfo{reason: reason, failedAt: now, reactivateAt: reactivationTime}
 		delete(state.availableKeys, keyIndex)
-		log.Printf("Scope '%s': Marking key index %d as failing. Will reactivate around %s", scope, keyIndex, reactivationTime.Format(time.RFC1123))
+		km.statsMu.Lock()
+		km.keyUsage[keyIndex].lastFailed = now
+		km.statsMu.Unlock()
+		logWarnf("Scope '%s': Marking key index %d as failing (%s). Will reactivate around %s", scopeForLog(scope), keyIndex, reason, reactivationTime.Format(time.RFC1123))
+		km.checkAvailableKeyThreshold(scope, state)
+		km.notifier.notify(webhookEvent{Type: webhookEventKeySidelined, Scope: scopeForLog(scope), KeyIndex: keyIndex, Reason: reason, Timestamp: now})
+		if distinctKeyCount(km.originalKeys) == 1 {
+			logErrorf("SINGLE KEY SIDELINED: Scope '%s': The only configured API key is failing (%s) and there is no failover key. Requests for this scope will return 503 until around %s", scopeForLog(scope), reason, reactivationTime.Format(time.RFC1123))
+		}
 	} else {
 		// It might already be marked as failing by another concurrent request for this scope,
 		// or the keyIndex might be invalid (e.g., for an initially empty key slot)
 		if _, failing := state.failingKeys[keyIndex]; !failing {
 			// Only log if it's not already known to be failing
-			log.Printf("Scope '%s': Key index %d is not currently available; cannot mark as failing.", scope, keyIndex)
+			logDebugf("Scope '%s': Key index %d is not currently available; cannot mark as failing.", scopeForLog(scope), keyIndex)
+		}
+	}
+}
+
+// notifyPoolExhausted sends a pool_exhausted event for scope, at most once per
+// poolExhaustedEventInterval. This MUST be called with the scope's shard locked.
+func (km *keyManager) notifyPoolExhausted(scope string, state *scopeState) {
+	if km.notifier == nil {
+		return
+	}
+	now := time.Now()
+	if !state.lastExhaustedEvent.IsZero() && now.Sub(state.lastExhaustedEvent) < poolExhaustedEventInterval {
+		return
+	}
+	state.lastExhaustedEvent = now
+	km.notifier.notify(webhookEvent{Type: webhookEventPoolExhausted, Scope: scopeForLog(scope), KeyIndex: -1, Timestamp: now})
+}
+
+// checkAvailableKeyThreshold logs an ERROR alarm, at most once per thresholdAlarmInterval
+// for each scope, when the scope has fewer available keys than minAvailableKeys, so a breach
+// in one scope does not hide a breach in another.
+// This MUST be called with the scope's shard locked.
+func (km *keyManager) checkAvailableKeyThreshold(scope string, state *scopeState) {
+	if km.minAvailableKeys <= 0 || len(state.availableKeys) >= km.minAvailableKeys {
+		return
+	}
+	now := time.Now()
+	if !state.lastThresholdAlarm.IsZero() && now.Sub(state.lastThresholdAlarm) < km.thresholdAlarmInterval {
+		return
+	}
+	state.lastThresholdAlarm = now
+	logErrorf("Scope '%s': Only %d available key(s) (%d failing), below the minimum of %d.", scopeForLog(scope), len(state.availableKeys), len(state.failingKeys), km.minAvailableKeys)
+}
+
+// scopesBelowMinAvailable returns the (log-safe) names of scopes that currently have fewer
+// available keys than minAvailableKeys, sorted. It returns nil when the alarm is disabled.
+func (km *keyManager) scopesBelowMinAvailable() []string {
+	if km.minAvailableKeys <= 0 {
+		return nil
+	}
+	var below []string
+	for _, shard := range km.shards {
+		km.rlockShard(shard)
+		for scope, state := range shard.scopes {
+			if len(state.availableKeys) < km.minAvailableKeys {
+				below = append(below, scopeForLog(scope))
+			}
 		}
+		shard.mu.RUnlock()
+	}
+	sort.Strings(below)
+	return below
+}
+
+const (
+	// reactivationInterval is how often sidelined keys are checked for reactivation.
+	reactivationInterval = 1 * time.Minute
+	// reactivationJitter is the maximum random delay added to each interval, so instances
+	// started together do not reactivate keys (and retry against upstream) in lockstep.
+	reactivationJitter = 10 * time.Second
+)
+
+// jitteredDelay returns base plus a random duration in [0, maxJitter).
+func jitteredDelay(base, maxJitter time.Duration) time.Duration {
+	if maxJitter <= 0 {
+		return base
 	}
+	return base + rand.N(maxJitter)
 }
 
 // reactivationLoop runs in the background to reactivate keys whose removal duration has passed.
 func (km *keyManager) reactivationLoop() {
-	// Check more frequently than the removal duration, e.g., every minute
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
+	km.runReactivationLoop(reactivationInterval, reactivationJitter, nil)
+}
+
+// runReactivationLoop reactivates keys and prunes idle scopes every interval (plus jitter) until stop
+// is closed. The first check is delayed by a random extra fraction of an interval, which spreads the
+// phase of the loop across instances. A nil stop channel runs forever.
+func (km *keyManager) runReactivationLoop(interval, maxJitter time.Duration, stop <-chan struct{}) {
+	timer := time.NewTimer(jitteredDelay(interval, interval))
+	defer timer.Stop()
 
-	log.Println("Key reactivation loop started.")
+	logInfof("Key reactivation loop started.")
 
-	for range ticker.C {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
 		km.reactivateKeys()
+		km.pruneIdleScopes()
+		timer.Reset(jitteredDelay(interval, maxJitter))
+	}
+}
+
+// pruneIdleScopes removes scopes that have been idle for longer than scopeTTL.
+// Scopes with keys still sidelined are retained so their failure state is not lost.
+// Returns the number of scopes removed.
+func (km *keyManager) pruneIdleScopes() int {
+	if km.scopeTTL <= 0 {
+		return 0
+	}
+
+	cutoff := time.Now().Add(-km.scopeTTL)
+	pruned := 0
+	for _, shard := range km.shards {
+		km.lockShard(shard)
+		for scope, state := range shard.scopes {
+			if len(state.failingKeys) == 0 && state.lastActivity.Before(cutoff) {
+				delete(shard.scopes, scope)
+				km.scopeRemoved(scope)
+				pruned++
+			}
+		}
+		shard.mu.Unlock()
+	}
+	if pruned > 0 {
+		logInfof("Pruned %d idle scope(s). Active scopes: %d", pruned, km.scopeCount())
+	}
+	return pruned
+}
+
+// scopeRemoved calls onScopeRemoved, if set, for a scope just removed from its shard.
+func (km *keyManager) scopeRemoved(scope string) {
+	if km.onScopeRemoved != nil {
+		km.onScopeRemoved(scope)
 	}
 }
 
+// scopeCount returns the number of scopes currently tracked.
+func (km *keyManager) scopeCount() int {
+	count := 0
+	for _, shard := range km.shards {
+		km.rlockShard(shard)
+		count += len(shard.scopes)
+		shard.mu.RUnlock()
+	}
+	return count
+}
+
 // reactivateScopeKeys checks and reactivates keys for a *single given scope*.
-// This MUST be called with the keyManager mutex held.
-func (km *keyManager) reactivateScopeKeys(state *scopeState) int {
+// The scope string is passed by the caller and only used for logging.
+// This MUST be called with the scope's shard locked.
+func (km *keyManager) reactivateScopeKeys(scope string, state *scopeState) int {
 	now := time.Now()
 	keysReactivated := 0
-	scopeIdentifier := "<unknown scope>" // Placeholder
-	// Find the scope string for logging (inefficient, but only used in error/reactivation paths)
-	for s, st := range km.scopes {
-		if st == state {
-			scopeIdentifier = s
-			break
-		}
-	}
 
-	for index, reactivateTime := range state.failingKeys {
-		if now.After(reactivateTime) {
+	for index, info := range state.failingKeys {
+		if now.After(info.reactivateAt) {
 			// Ensure the index is valid for the original key list and the key wasn't initially empty
 			if index >= 0 && index < len(km.originalKeys) && km.originalKeys[index] != "" {
-				log.Printf("Scope '%s': Reactivating key index %d (immediate check)", scopeIdentifier, index)
+				logInfof("Scope '%s': Reactivating key index %d (immediate check)", scopeForLog(scope), index)
 				state.availableKeys[index] = km.originalKeys[index]
+				state.sidelined.record(now.Sub(info.failedAt))
 				delete(state.failingKeys, index)
 				keysReactivated++
 			} else {
-				log.Printf("Scope '%s': Removing invalid/empty key index %d from failing list (immediate check).", scopeIdentifier, index)
+				logWarnf("Scope '%s': Removing invalid/empty key index %d from failing list (immediate check).", scopeForLog(scope), index)
 				delete(state.failingKeys, index)
 			}
 		}
@@ -243,30 +812,242 @@ func (km *keyManager) reactivateScopeKeys(state *scopeState) int {
 }
 
 // reactivateKeys checks all scopes and reactivates keys within each scope if their time is up.
+// Shards are locked one at a time, so requests for other shards' scopes are not held up.
 func (km *keyManager) reactivateKeys() {
-	km.mu.Lock()
-	defer km.mu.Unlock()
+	for _, shard := range km.shards {
+		km.lockShard(shard)
+		km.reactivateShardKeys(shard)
+		shard.mu.Unlock()
+	}
+}
 
+// reactivateShardKeys reactivates the keys whose time is up in every scope of shard.
+// This MUST be called with the shard locked.
+func (km *keyManager) reactivateShardKeys(shard *scopeShard) {
 	now := time.Now()
 	// log.Println("Running periodic key reactivation check...") // Debug log
 
-	for scope, state := range km.scopes {
+	for scope, state := range shard.scopes {
 		keysReactivatedInScope := 0
-		for index, reactivateTime := range state.failingKeys {
-			if now.After(reactivateTime) {
+		for index, info := range state.failingKeys {
+			if now.After(info.reactivateAt) {
 				// Ensure the index is valid for the original key list
 				if index >= 0 && index < len(km.originalKeys) && km.originalKeys[index] != "" {
-					log.Printf("Scope '%s': Reactivating key index %d", scope, index)
+					logInfof("Scope '%s': Reactivating key index %d", scopeForLog(scope), index)
 					state.availableKeys[index] = km.originalKeys[index] // Add back to available
-					delete(state.failingKeys, index)                    // Remove from failing
+					state.sidelined.record(now.Sub(info.failedAt))
+					delete(state.failingKeys, index) // Remove from failing
 					keysReactivatedInScope++
 				} else {
 					// This case handles invalid indices or indices corresponding to initially empty keys.
 					// Just remove it from the failing map for this scope.
-					log.Printf("Scope '%s': Removing invalid/empty key index %d from failing list.", scope, index)
+					logWarnf("Scope '%s': Removing invalid/empty key index %d from failing list.", scopeForLog(scope), index)
 					delete(state.failingKeys, index)
 				}
 			}
 		}
 	}
 }
+
+// recordScopeError stores the latest error observed in scope for /admin/state.
+// Any configured API key appearing in message is redacted.
+func (km *keyManager) recordScopeError(scope string, status int, message string) {
+	shard := km.shardFor(scope)
+	km.lockShard(shard)
+	defer shard.mu.Unlock()
+
+	for _, key := range km.originalKeys {
+		if key != "" {
+			message = strings.ReplaceAll(message, key, "[REDACTED]")
+		}
+	}
+	state := km.getOrCreateScopeState(scope)
+	state.lastError = message
+	state.lastStatus = status
+	state.lastErrorTime = time.Now()
+}
+
+// replaceKey changes the value of the key at index (e.g. a refreshed bearer token) in every
+// scope, keeping its availability state.
+func (km *keyManager) replaceKey(index int, key string) {
+	km.lockAll()
+	defer km.unlockAll()
+
+	km.originalKeys[index] = key
+	for _, shard := range km.shards {
+		for _, state := range shard.scopes {
+			if _, ok := state.availableKeys[index]; ok {
+				state.availableKeys[index] = key
+			}
+		}
+	}
+}
+
+// resetAll clears failing-key state in every scope, returning all valid keys to rotation.
+// Returns the number of keys reactivated and the number of scopes that had any.
+func (km *keyManager) resetAll() (keys, scopes int) {
+	km.lockAll()
+	defer km.unlockAll()
+
+	for _, shard := range km.shards {
+		for scope, state := range shard.scopes {
+			if len(state.failingKeys) == 0 {
+				continue
+			}
+			keys += len(state.failingKeys)
+			scopes++
+			logInfof("Scope '%s': Reset reactivated %d key(s)", scopeForLog(scope), len(state.failingKeys))
+			state.failingKeys = make(map[int]failInfo)
+			for i, key := range km.originalKeys {
+				if key != "" && !state.excludedKeys[i] {
+					state.availableKeys[i] = key
+				}
+			}
+		}
+	}
+	return keys, scopes
+}
+
+// failingKeySnapshot is the exported view of a sidelined key. It never contains the key itself.
+type failingKeySnapshot struct {
+	Index        int       `json:"index"`
+	Reason       string    `json:"reason"`
+	FailedAt     time.Time `json:"failedAt"`
+	ReactivateAt time.Time `json:"reactivateAt"`
+}
+
+// sidelineStatsSnapshot summarizes observed time-to-reactivation in seconds.
+type sidelineStatsSnapshot struct {
+	Count      int     `json:"count"`
+	MinSeconds float64 `json:"minSeconds"`
+	AvgSeconds float64 `json:"avgSeconds"`
+	MaxSeconds float64 `json:"maxSeconds"`
+}
+
+// scopeErrorSnapshot is the most recent error observed in a scope. Status 0 means no upstream response.
+type scopeErrorSnapshot struct {
+	Status  int       `json:"status"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// scopeSnapshot is the exported view of a single scope's state.
+type scopeSnapshot struct {
+	AvailableKeys []int                 `json:"availableKeys"`
+	FailingKeys   []failingKeySnapshot  `json:"failingKeys"`
+	LastActivity  time.Time             `json:"lastActivity"`
+	Sidelined     sidelineStatsSnapshot `json:"sidelined"`
+	LastError     *scopeErrorSnapshot   `json:"lastError,omitempty"`
+	// Times each key index was selected, and their coefficient of variation across all valid
+	// keys (0 means perfectly even use).
+	Selections  map[int]uint64 `json:"selections"`
+	SelectionCV float64        `json:"selectionCV"`
+}
+
+// keySnapshot is the exported usage of a single key, across all scopes. Unset times are omitted.
+type keySnapshot struct {
+	Index      int       `json:"index"`
+	LastUsed   time.Time `json:"lastUsed,omitzero"`
+	LastFailed time.Time `json:"lastFailed,omitzero"`
+}
+
+// keyManagerSnapshot is a point-in-time copy of the key manager state for admin endpoints.
+type keyManagerSnapshot struct {
+	TotalKeys int                      `json:"totalKeys"`
+	Keys      []keySnapshot            `json:"keys"`
+	Scopes    map[string]scopeSnapshot `json:"scopes"`
+}
+
+// snapshot returns a copy of the current state that is safe to use without the shard locks.
+func (km *keyManager) snapshot() keyManagerSnapshot {
+	km.rlockAll()
+	defer km.runlockAll()
+
+	snap := keyManagerSnapshot{
+		TotalKeys: len(km.originalKeys),
+		Keys:      make([]keySnapshot, 0, len(km.originalKeys)),
+		Scopes:    make(map[string]scopeSnapshot),
+	}
+	km.statsMu.Lock()
+	for index, key := range km.originalKeys {
+		if key == "" {
+			continue
+		}
+		usage := km.keyUsage[index]
+		snap.Keys = append(snap.Keys, keySnapshot{Index: index, LastUsed: usage.lastUsed, LastFailed: usage.lastFailed})
+	}
+	km.statsMu.Unlock()
+	for scope, state := range km.allScopes() {
+		ss := scopeSnapshot{
+			AvailableKeys: make([]int, 0, len(state.availableKeys)),
+			FailingKeys:   make([]failingKeySnapshot, 0, len(state.failingKeys)),
+			LastActivity:  state.lastActivity,
+		}
+		for index := range state.availableKeys {
+			ss.AvailableKeys = append(ss.AvailableKeys, index)
+		}
+		sort.Ints(ss.AvailableKeys)
+		for index, info := range state.failingKeys {
+			ss.FailingKeys = append(ss.FailingKeys, failingKeySnapshot{
+				Index:        index,
+				Reason:       info.reason,
+				FailedAt:     info.failedAt,
+				ReactivateAt: info.reactivateAt,
+			})
+		}
+		sort.Slice(ss.FailingKeys, func(i, j int) bool { return ss.FailingKeys[i].Index < ss.FailingKeys[j].Index })
+		if stats := state.sidelined; stats.count > 0 {
+			ss.Sidelined = sidelineStatsSnapshot{
+				Count:      stats.count,
+				MinSeconds: stats.min.Seconds(),
+				AvgSeconds: (stats.total / time.Duration(stats.count)).Seconds(),
+				MaxSeconds: stats.max.Seconds(),
+			}
+		}
+		if !state.lastErrorTime.IsZero() {
+			ss.LastError = &scopeErrorSnapshot{Status: state.lastStatus, Message: state.lastError, Time: state.lastErrorTime}
+		}
+		ss.Selections = make(map[int]uint64, len(state.selections))
+		counts := make([]uint64, 0, len(km.originalKeys))
+		for index, key := range km.originalKeys {
+			if key == "" || state.excludedKeys[index] {
+				continue
+			}
+			if n := state.selections[index]; n > 0 {
+				ss.Selections[index] = n
+			}
+			counts = append(counts, state.selections[index])
+		}
+		ss.SelectionCV = coefficientOfVariation(counts)
+		snap.Scopes[scope] = ss
+	}
+	return snap
+}
+
+// coefficientOfVariation returns the standard deviation of counts divided by their mean,
+// or 0 when there are no counts.
+func coefficientOfVariation(counts []uint64) float64 {
+	var total float64
+	for _, n := range counts {
+		total += float64(n)
+	}
+	if total == 0 {
+		return 0
+	}
+	mean := total / float64(len(counts))
+	var variance float64
+	for _, n := range counts {
+		d := float64(n) - mean
+		variance += d * d
+	}
+	variance /= float64(len(counts))
+	return math.Sqrt(variance) / mean
+}
+
+// sessionKeyIndex deterministically maps a session identifier to a key index,
+// so requests carrying the same session prefer the same key.
+func (km *keyManager) sessionKeyIndex(session string) int {
+	h := fnv.New32a()
+	h.Write([]byte(session))
+	return int(h.Sum32() % uint32(km.keyCount.Load()))
+}
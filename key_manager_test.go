@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"log"
 	"math/rand/v2" // Use v2 consistently
+	"os"
 	"reflect"
 	"strings"
 	"sync"
@@ -82,11 +85,11 @@ func assertMapLength(t *testing.T, m interface{}, want int) {
 	}
 }
 
-// Helper to get scope state (requires km mutex to be held)
+// Helper to get scope state (requires the km shards to be locked)
 func getScopeState(t *testing.T, km *keyManager, scope string) *scopeState {
 	t.Helper()
-	// km.mu must be locked before calling this
-	state, exists := km.scopes[scope]
+	// km.lockAll must be called before calling this
+	state, exists := km.lookupScope(scope)
 	if !exists {
 		// In most tests, we expect the scope to be created by getNextKey or markKeyFailed
 		// If we need to explicitly test creation, use getOrCreateScopeState
@@ -107,13 +110,13 @@ func TestNewKeyManager_Success(t *testing.T) {
 		t.Fatal("expected keyManager to be non-nil")
 	}
 	assertInt(t, len(km.originalKeys), 3)
-	assertInt(t, len(km.scopes), 0) // Scopes map starts empty
+	assertInt(t, km.scopeCount(), 0) // Scopes map starts empty
 	assertInt(t, int(km.removalDuration), int(duration))
 
 	// Force scope creation to check initial state
-	km.mu.Lock()
+	km.lockAll()
 	scopeState := km.getOrCreateScopeState("testScope")
-	km.mu.Unlock()
+	km.unlockAll()
 	assertInt(t, len(scopeState.availableKeys), 3)
 	assertInt(t, len(scopeState.failingKeys), 0)
 	assertString(t, scopeState.availableKeys[0], "key1")
@@ -133,6 +136,34 @@ func TestNewKeyManager_EmptyKeys(t *testing.T) {
 	assertErrorContains(t, err, "no valid (non-empty) API keys found")
 }
 
+func TestNewKeyManager_DeduplicatesKeys(t *testing.T) {
+	keys := []string{"key1", "key2", "key1", "key3", "key2"}
+	km, err := newKeyManager(keys, time.Hour)
+	assertNoError(t, err)
+	assertString(t, keys[2], "key1") // The caller's slice is not modified
+
+	// Indices stay stable; duplicates become empty slots.
+	assertInt(t, len(km.originalKeys), 5)
+	assertString(t, km.originalKeys[3], "key3")
+	assertString(t, km.originalKeys[2], "")
+	assertString(t, km.originalKeys[4], "")
+
+	scope := "dedupeScope"
+	km.lockAll()
+	assertInt(t, len(km.getOrCreateScopeState(scope).availableKeys), 3)
+	km.unlockAll()
+
+	// Sidelining key1 removes it from rotation entirely: no duplicate remains available.
+	km.markKeyFailed(scope, 0, "status 429")
+	for i := 0; i < 20; i++ {
+		key, _, err := km.getNextKey(scope)
+		assertNoError(t, err)
+		if key == "key1" {
+			t.Fatal("expected sidelined key1 not to be selected via a duplicate")
+		}
+	}
+}
+
 func TestNewKeyManager_MixedEmptyKeys(t *testing.T) {
 	keys := []string{"key1", "", "key3"}
 	duration := 5 * time.Minute
@@ -143,12 +174,12 @@ func TestNewKeyManager_MixedEmptyKeys(t *testing.T) {
 		t.Fatal("expected keyManager to be non-nil")
 	}
 	assertInt(t, len(km.originalKeys), 3) // Original keys count remains 3
-	assertInt(t, len(km.scopes), 0)       // Scopes map starts empty
+	assertInt(t, km.scopeCount(), 0)      // Scopes map starts empty
 
 	// Force scope creation to check initial state
-	km.mu.Lock()
+	km.lockAll()
 	scopeState := km.getOrCreateScopeState("testScope")
-	km.mu.Unlock()
+	km.unlockAll()
 
 	assertInt(t, len(scopeState.availableKeys), 2)
 	assertInt(t, len(scopeState.failingKeys), 0)
@@ -196,9 +227,9 @@ func TestGetNextKey_RoundRobinAndScopeCreation(t *testing.T) {
 	}
 
 	// Check if scope was created
-	km.mu.Lock()
-	_, scopeExists := km.scopes[scope]
-	km.mu.Unlock()
+	km.lockAll()
+	_, scopeExists := km.lookupScope(scope)
+	km.unlockAll()
 	if !scopeExists {
 		t.Errorf("scope %q was not created after getNextKey calls", scope)
 	}
@@ -224,12 +255,12 @@ func TestGetNextKey_ReactivationWithinScope(t *testing.T) {
 	assertNoError(t, err)
 
 	// Mark it as failed
-	km.markKeyFailed(scope, index1)
-	km.mu.Lock()
+	km.markKeyFailed(scope, index1, "test")
+	km.lockAll()
 	state1 := getScopeState(t, km, scope)
 	assertInt(t, len(state1.availableKeys), 1)
 	assertInt(t, len(state1.failingKeys), 1)
-	km.mu.Unlock()
+	km.unlockAll()
 
 	// Get the other key (should be the only one available)
 	key2, index2, err := km.getNextKey(scope)
@@ -240,12 +271,12 @@ func TestGetNextKey_ReactivationWithinScope(t *testing.T) {
 	}
 
 	// Mark the second key as failed
-	km.markKeyFailed(scope, index2)
-	km.mu.Lock()
+	km.markKeyFailed(scope, index2, "test")
+	km.lockAll()
 	state2 := getScopeState(t, km, scope)
 	assertInt(t, len(state2.availableKeys), 0)
 	assertInt(t, len(state2.failingKeys), 2)
-	km.mu.Unlock()
+	km.unlockAll()
 
 	// --- Test reactivation ---
 	// Try getting a key now - should fail as reactivation loop hasn't run
@@ -265,11 +296,11 @@ func TestGetNextKey_ReactivationWithinScope(t *testing.T) {
 		t.Fatalf("Expected a valid key after reactivation, got key=%q, index=%d", key3, index3)
 	}
 
-	km.mu.Lock()
+	km.lockAll()
 	state3 := getScopeState(t, km, scope)
 	assertInt(t, len(state3.availableKeys), 2) // Both should be back
 	assertInt(t, len(state3.failingKeys), 0)
-	km.mu.Unlock()
+	km.unlockAll()
 
 	// Check if the returned key is one of the original ones
 	found := false
@@ -292,13 +323,13 @@ func TestGetNextKey_NoKeysAvailableInScope(t *testing.T) {
 	scope := "allFailingScope"
 
 	// Mark the only key as failed in this scope
-	km.markKeyFailed(scope, 0)
+	km.markKeyFailed(scope, 0, "test")
 
-	km.mu.Lock()
+	km.lockAll()
 	state := getScopeState(t, km, scope)
 	assertInt(t, len(state.availableKeys), 0)
 	assertInt(t, len(state.failingKeys), 1)
-	km.mu.Unlock()
+	km.unlockAll()
 
 	// Try to get a key - should fail until reactivation
 	_, _, err := km.getNextKey(scope)
@@ -313,10 +344,10 @@ func TestGetNextKey_ScopeIsolation(t *testing.T) {
 	scopeB := "scopeB"
 
 	// Mark key 0 as failed in scope A
-	km.markKeyFailed(scopeA, 0)
+	km.markKeyFailed(scopeA, 0, "test")
 
 	// Check scope A state
-	km.mu.Lock()
+	km.lockAll()
 	stateA := getScopeState(t, km, scopeA)
 	assertInt(t, len(stateA.availableKeys), 1)
 	assertInt(t, len(stateA.failingKeys), 1)
@@ -328,7 +359,7 @@ func TestGetNextKey_ScopeIsolation(t *testing.T) {
 	if !key0FailingA {
 		t.Error("Scope A: Key 0 should be failing")
 	}
-	km.mu.Unlock()
+	km.unlockAll()
 
 	// Try to get key 0 in scope B - should succeed
 	// Need to loop until we specifically get index 0 or give up
@@ -347,11 +378,11 @@ func TestGetNextKey_ScopeIsolation(t *testing.T) {
 	}
 
 	// Check scope B state (after potential creation)
-	km.mu.Lock()
+	km.lockAll()
 	stateB := getScopeState(t, km, scopeB)
 	assertInt(t, len(stateB.availableKeys), 2) // Both keys should be available initially
 	assertInt(t, len(stateB.failingKeys), 0)
-	km.mu.Unlock()
+	km.unlockAll()
 }
 
 // --- Test MarkKeyFailed ---
@@ -366,9 +397,9 @@ func TestMarkKeyFailed_MarkAvailableKeyInScope(t *testing.T) {
 	_, _, _ = km.getNextKey(scope)
 
 	// Mark key at index 0
-	km.markKeyFailed(scope, 0)
+	km.markKeyFailed(scope, 0, "test")
 
-	km.mu.Lock()
+	km.lockAll()
 	state := getScopeState(t, km, scope)
 	assertInt(t, len(state.availableKeys), 1)
 	_, availableOk := state.availableKeys[0]
@@ -380,8 +411,8 @@ func TestMarkKeyFailed_MarkAvailableKeyInScope(t *testing.T) {
 	if !failingOk {
 		t.Error("key 0 should be in failingKeys after marking failed")
 	}
-	reactivationTime := state.failingKeys[0]
-	km.mu.Unlock()
+	reactivationTime := state.failingKeys[0].reactivateAt
+	km.unlockAll()
 
 	// Check reactivation time is roughly correct
 	expectedReactivation := time.Now().Add(duration)
@@ -397,24 +428,24 @@ func TestMarkKeyFailed_MarkAlreadyFailedKeyInScope(t *testing.T) {
 	scope := "doubleMarkScope"
 
 	// Mark key 0 as failed
-	km.markKeyFailed(scope, 0)
-	km.mu.Lock()
+	km.markKeyFailed(scope, 0, "test")
+	km.lockAll()
 	state1 := getScopeState(t, km, scope)
-	initialReactivationTime := state1.failingKeys[0]
+	initialReactivationTime := state1.failingKeys[0].reactivateAt
 	assertInt(t, len(state1.availableKeys), 0)
 	assertInt(t, len(state1.failingKeys), 1)
-	km.mu.Unlock()
+	km.unlockAll()
 
 	// Mark key 0 as failed *again*
-	km.markKeyFailed(scope, 0) // Should be a no-op
+	km.markKeyFailed(scope, 0, "test") // Should be a no-op
 
-	km.mu.Lock()
+	km.lockAll()
 	state2 := getScopeState(t, km, scope)
 	assertInt(t, len(state2.availableKeys), 0) // Still 0 available
 	assertInt(t, len(state2.failingKeys), 1)   // Still 1 failing
 	// Ensure reactivation time didn't change
-	assertInt(t, int(state2.failingKeys[0].UnixNano()), int(initialReactivationTime.UnixNano()))
-	km.mu.Unlock()
+	assertInt(t, int(state2.failingKeys[0].reactivateAt.UnixNano()), int(initialReactivationTime.UnixNano()))
+	km.unlockAll()
 }
 
 func TestMarkKeyFailed_MarkInvalidIndexInScope(t *testing.T) {
@@ -427,17 +458,123 @@ func TestMarkKeyFailed_MarkInvalidIndexInScope(t *testing.T) {
 	_, _, _ = km.getNextKey(scope)
 
 	// Mark an invalid index
-	km.markKeyFailed(scope, 99) // Should be a no-op, logged
+	km.markKeyFailed(scope, 99, "test") // Should be a no-op, logged
 
-	km.mu.Lock()
+	km.lockAll()
 	state := getScopeState(t, km, scope)
 	assertInt(t, len(state.availableKeys), 1) // Should still be 1 available
 	assertInt(t, len(state.failingKeys), 0)   // Should still be 0 failing
-	km.mu.Unlock()
+	km.unlockAll()
 }
 
 // --- Test Reactivation Loop ---
 
+func TestRunReactivationLoop_RunsAfterJitteredDelay(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2"}, 10*time.Millisecond)
+	scope := "jitterScope"
+	km.markKeyFailed(scope, 0, "test")
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go km.runReactivationLoop(20*time.Millisecond, 10*time.Millisecond, stop)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		km.lockAll()
+		failing := len(getScopeState(t, km, scope).failingKeys)
+		km.unlockAll()
+		if failing == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the jittered loop to reactivate the key")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestJitteredDelay(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jitteredDelay(time.Second, 100*time.Millisecond)
+		if d < time.Second || d >= 1100*time.Millisecond {
+			t.Fatalf("jitteredDelay out of range: %s", d)
+		}
+	}
+	if d := jitteredDelay(time.Second, 0); d != time.Second {
+		t.Errorf("expected no jitter, got %s", d)
+	}
+}
+
+func TestMarkKeyFailed_PerScopeRemovalDuration(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2"}, time.Hour)
+	overrides, err := parseRemovalOverrides("/v1beta/models=5m, /v1beta/models/gemini-pro=10m")
+	assertNoError(t, err)
+	km.removalOverrides = overrides
+
+	heavy := buildScopeKey("api.example.com", "/v1beta/models/gemini-pro:generateContent")
+	light := buildScopeKey("api.example.com", "/v1beta/models/gemini-1.5-flash:generateContent")
+	other := buildScopeKey("api.example.com", "/v1beta/files")
+	for _, scope := range []string{heavy, light, other} {
+		km.markKeyFailed(scope, 0, "status 429")
+	}
+
+	km.lockAll()
+	defer km.unlockAll()
+	wants := map[string]time.Duration{heavy: 10 * time.Minute, light: 5 * time.Minute, other: time.Hour}
+	for scope, want := range wants {
+		info := getScopeState(t, km, scope).failingKeys[0]
+		if got := info.reactivateAt.Sub(info.failedAt); got != want {
+			t.Errorf("%s: sidelined for %s, want %s", scope, got, want)
+		}
+	}
+}
+
+func TestMarkKeyFailed_WarmupShortensSideline(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2"}, time.Hour)
+	km.warmupDuration = time.Minute
+	km.warmupRemovalDuration = 10 * time.Second
+	scope := buildScopeKey("api.example.com", "/v1beta/models")
+
+	sidelinedFor := func() time.Duration {
+		km.lockAll()
+		defer km.unlockAll()
+		info := getScopeState(t, km, scope).failingKeys[0]
+		return info.reactivateAt.Sub(info.failedAt)
+	}
+
+	// Inside the warm-up window.
+	km.markKeyFailed(scope, 0, "status 429")
+	if got := sidelinedFor(); got != 10*time.Second {
+		t.Errorf("sidelined for %s during warm-up, want 10s", got)
+	}
+
+	// Outside the warm-up window.
+	km.resetAll()
+	km.startedAt = time.Now().Add(-2 * time.Minute)
+	km.markKeyFailed(scope, 0, "status 429")
+	if got := sidelinedFor(); got != time.Hour {
+		t.Errorf("sidelined for %s after warm-up, want 1h", got)
+	}
+
+	// Shorter per-path overrides are not lengthened by the warm-up.
+	km.resetAll()
+	km.startedAt = time.Now()
+	km.removalOverrides = []removalOverride{{prefix: "/v1beta/models", duration: 5 * time.Second}}
+	km.markKeyFailed(scope, 0, "status 429")
+	if got := sidelinedFor(); got != 5*time.Second {
+		t.Errorf("sidelined for %s with a shorter override, want 5s", got)
+	}
+}
+
+func TestParseRemovalOverrides_Invalid(t *testing.T) {
+	_, err := parseRemovalOverrides("/v1beta/models")
+	assertErrorContains(t, err, "expected PATH_PREFIX=DURATION")
+	_, err = parseRemovalOverrides("/v1beta/models=soon")
+	assertErrorContains(t, err, "duration must be positive")
+	_, err = parseRemovalOverrides("/v1beta/models=-1m")
+	assertErrorContains(t, err, "duration must be positive")
+}
+
 func TestReactivationLoop(t *testing.T) {
 	// This test relies on time passing, making it potentially flaky.
 	// A manual trigger of reactivateKeys is generally preferred for unit tests.
@@ -450,18 +587,18 @@ func TestReactivationLoop(t *testing.T) {
 	scope2 := "loopScope2"
 
 	// Mark k1 in scope1, k2 in scope2
-	km.markKeyFailed(scope1, 0)
-	km.markKeyFailed(scope2, 1)
+	km.markKeyFailed(scope1, 0, "test")
+	km.markKeyFailed(scope2, 1, "test")
 
 	// Check initial state
-	km.mu.Lock()
+	km.lockAll()
 	s1 := getScopeState(t, km, scope1)
 	s2 := getScopeState(t, km, scope2)
 	assertInt(t, len(s1.availableKeys), 1)
 	assertInt(t, len(s1.failingKeys), 1)
 	assertInt(t, len(s2.availableKeys), 1)
 	assertInt(t, len(s2.failingKeys), 1)
-	km.mu.Unlock()
+	km.unlockAll()
 
 	// Wait for slightly longer than the duration
 	time.Sleep(shortDuration + 20*time.Millisecond)
@@ -470,14 +607,14 @@ func TestReactivationLoop(t *testing.T) {
 	km.reactivateKeys()
 
 	// Check state after reactivation
-	km.mu.Lock()
+	km.lockAll()
 	s1_after := getScopeState(t, km, scope1)
 	s2_after := getScopeState(t, km, scope2)
 	assertInt(t, len(s1_after.availableKeys), 2) // k1 should be back
 	assertInt(t, len(s1_after.failingKeys), 0)
 	assertInt(t, len(s2_after.availableKeys), 2) // k2 should be back
 	assertInt(t, len(s2_after.failingKeys), 0)
-	km.mu.Unlock()
+	km.unlockAll()
 
 	// Ensure we can get keys again
 	_, _, err1 := km.getNextKey(scope1)
@@ -532,7 +669,7 @@ func TestKeyManager_Concurrency(t *testing.T) {
 
 					// Simulate some keys failing
 					if rand.IntN(10) == 0 {
-						km.markKeyFailed(scope, index)
+						km.markKeyFailed(scope, index, "test")
 						time.Sleep(5 * time.Millisecond)
 					} else {
 						time.Sleep(time.Duration(rand.IntN(5)+1) * time.Millisecond)
@@ -551,11 +688,11 @@ func TestKeyManager_Concurrency(t *testing.T) {
 		// Final check: Wait and ensure keys reactivate
 		time.Sleep(duration * 2)
 		km.reactivateKeys() // Manual trigger
-		km.mu.Lock()
+		km.lockAll()
 		finalState := getScopeState(t, km, scope)
 		assertInt(t, len(finalState.availableKeys), len(keys))
 		assertInt(t, len(finalState.failingKeys), 0)
-		km.mu.Unlock()
+		km.unlockAll()
 	})
 
 	t.Run("ConcurrentAccessDifferentScopes", func(t *testing.T) {
@@ -599,7 +736,7 @@ func TestKeyManager_Concurrency(t *testing.T) {
 
 					// Simulate failure only in some scopes
 					if routineID%5 == 0 && rand.IntN(5) == 0 { // Fail more often in scope-0
-						km.markKeyFailed(scope, index)
+						km.markKeyFailed(scope, index, "test")
 						time.Sleep(5 * time.Millisecond)
 					} else {
 						time.Sleep(time.Duration(rand.IntN(5)+1) * time.Millisecond)
@@ -619,16 +756,411 @@ func TestKeyManager_Concurrency(t *testing.T) {
 		time.Sleep(duration * 2)
 		km.reactivateKeys() // Manual trigger
 
-		km.mu.Lock()
+		km.lockAll()
 		for i := 0; i < 5; i++ {
 			scopeName := fmt.Sprintf("scope-%d", i)
-			if finalState, exists := km.scopes[scopeName]; exists {
+			if finalState, exists := km.lookupScope(scopeName); exists {
 				assertInt(t, len(finalState.availableKeys), len(keys))
 				assertInt(t, len(finalState.failingKeys), 0)
 			} else {
 				t.Errorf("Scope %s was expected to exist but didn't", scopeName)
 			}
 		}
-		km.mu.Unlock()
+		km.unlockAll()
 	})
 }
+
+// --- Test Scope Pruning ---
+
+func TestPruneIdleScopes(t *testing.T) {
+	keys := []string{"k1", "k2"}
+	km, _ := newKeyManager(keys, 5*time.Minute)
+	km.scopeTTL = 50 * time.Millisecond
+
+	idleScope := "idleScope"
+	activeScope := "activeScope"
+	sidelinedScope := "sidelinedScope"
+
+	_, _, _ = km.getNextKey(idleScope)
+	km.markKeyFailed(sidelinedScope, 0, "test")
+
+	time.Sleep(km.scopeTTL + 20*time.Millisecond)
+	_, _, _ = km.getNextKey(activeScope) // Fresh activity
+
+	assertInt(t, km.scopeCount(), 3)
+	assertInt(t, km.pruneIdleScopes(), 1)
+	assertInt(t, km.scopeCount(), 2)
+
+	km.lockAll()
+	defer km.unlockAll()
+	if _, exists := km.lookupScope(idleScope); exists {
+		t.Errorf("expected idle all-available scope %q to be pruned", idleScope)
+	}
+	if _, exists := km.lookupScope(activeScope); !exists {
+		t.Errorf("expected active scope %q to be retained", activeScope)
+	}
+	if _, exists := km.lookupScope(sidelinedScope); !exists {
+		t.Errorf("expected scope %q with a sidelined key to be retained", sidelinedScope)
+	}
+}
+
+func TestPruneIdleScopes_DisabledByDefault(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1"}, 5*time.Minute)
+	_, _, _ = km.getNextKey("someScope")
+
+	km.lockAll()
+	getScopeState(t, km, "someScope").lastActivity = time.Now().Add(-24 * time.Hour)
+	km.unlockAll()
+
+	assertInt(t, km.pruneIdleScopes(), 0)
+	assertInt(t, km.scopeCount(), 1)
+}
+
+func TestReactivateScopeKeys_LogsGivenScope(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2"}, 5*time.Minute)
+
+	// A state that is deliberately not registered in any shard: the scope name
+	// must come from the argument, not from a reverse lookup.
+	state := &scopeState{
+		availableKeys: map[int]string{1: "k2"},
+		failingKeys:   map[int]failInfo{0: {failedAt: time.Now().Add(-1 * time.Minute), reactivateAt: time.Now().Add(-1 * time.Second)}},
+	}
+
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	km.lockAll()
+	reactivated := km.reactivateScopeKeys("api.example.com|/v1/models", state)
+	km.unlockAll()
+
+	assertInt(t, reactivated, 1)
+	assertMapLength(t, state.availableKeys, 2)
+	assertMapLength(t, state.failingKeys, 0)
+	if !strings.Contains(logBuf.String(), "Scope 'api.example.com|/v1/models': Reactivating key index 0") {
+		t.Errorf("expected log to name the given scope, got: %s", logBuf.String())
+	}
+}
+
+// --- Test Scope Log Masking ---
+
+func TestScopeForLog_HashesWhenEnabled(t *testing.T) {
+	scope := buildScopeKey("generativelanguage.googleapis.com", "/v1beta/tenants/acme-corp/models")
+	assertString(t, scopeForLog(scope), scope) // Disabled by default
+
+	hashScopeLogs = true
+	defer func() { hashScopeLogs = false }()
+
+	masked := scopeForLog(scope)
+	if masked == scope || !strings.HasPrefix(masked, "scope-") {
+		t.Fatalf("expected hashed scope, got %q", masked)
+	}
+	assertString(t, scopeForLog(scope), masked) // Stable across calls
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, 5*time.Minute)
+
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	_, index, err := km.getNextKey(scope)
+	assertNoError(t, err)
+	km.markKeyFailed(scope, index, "test")
+
+	logOutput := logBuf.String()
+	if strings.Contains(logOutput, "acme-corp") {
+		t.Errorf("expected raw scope path to be absent from logs, got: %s", logOutput)
+	}
+	if !strings.Contains(logOutput, masked) {
+		t.Errorf("expected hashed scope %q in logs, got: %s", masked, logOutput)
+	}
+
+	// Internal state is still keyed by the real scope.
+	km.lockAll()
+	defer km.unlockAll()
+	if _, exists := km.lookupScope(scope); !exists {
+		t.Errorf("expected scopes map to be keyed by the raw scope")
+	}
+}
+
+func TestGetNextKey_RepairsInconsistentState(t *testing.T) {
+	keys := []string{"k1", "k2", "k3"}
+	km, _ := newKeyManager(keys, 5*time.Minute)
+	scope := "corruptScope"
+
+	km.markKeyFailed(scope, 0, "test")
+
+	// Corrupt the state: keys 1 and 2 are neither available nor failing.
+	km.lockAll()
+	state := getScopeState(t, km, scope)
+	state.availableKeys = map[int]string{}
+	km.unlockAll()
+
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	key, index, err := km.getNextKey(scope)
+	assertNoError(t, err)
+	if index != 1 && index != 2 {
+		t.Errorf("expected a repaired key (index 1 or 2), got index %d", index)
+	}
+	assertString(t, key, keys[index])
+
+	km.lockAll()
+	assertMapLength(t, state.availableKeys, 2)
+	assertMapLength(t, state.failingKeys, 1) // Key 0 stays sidelined
+	km.unlockAll()
+
+	if !strings.Contains(logBuf.String(), "Inconsistent key state detected") {
+		t.Errorf("expected a diagnostic about the repaired state, got: %s", logBuf.String())
+	}
+}
+
+func TestMarkKeyFailed_RecordsReason(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2"}, 5*time.Minute)
+	scope := "reasonScope"
+
+	before := time.Now()
+	km.markKeyFailed(scope, 1, "status 429")
+
+	km.lockAll()
+	defer km.unlockAll()
+	info, ok := getScopeState(t, km, scope).failingKeys[1]
+	if !ok {
+		t.Fatal("expected key 1 to be failing")
+	}
+	assertString(t, info.reason, "status 429")
+	if info.failedAt.Before(before) || info.failedAt.After(time.Now()) {
+		t.Errorf("expected failedAt to be the time of marking, got %v", info.failedAt)
+	}
+	if got := info.reactivateAt.Sub(info.failedAt); got != km.removalDuration {
+		t.Errorf("expected reactivateAt = failedAt + %s, got +%s", km.removalDuration, got)
+	}
+}
+
+// --- Test Preferred Key Selection ---
+
+func TestGetNextKeyPreferring(t *testing.T) {
+	keys := []string{"k1", "k2", "k3", "k4"}
+	km, _ := newKeyManager(keys, 5*time.Minute)
+	scope := "stickyScope"
+
+	for i := 0; i < 10; i++ {
+		key, index, err := km.getNextKeyPreferring(scope, 2)
+		assertNoError(t, err)
+		assertInt(t, index, 2)
+		assertString(t, key, "k3")
+	}
+
+	// Once the preferred key is sidelined, selection falls back to another key.
+	km.markKeyFailed(scope, 2, "test")
+	_, index, err := km.getNextKeyPreferring(scope, 2)
+	assertNoError(t, err)
+	if index == 2 {
+		t.Error("expected fallback to a different key while the preferred key is sidelined")
+	}
+}
+
+func TestGetNextKeyExcluding(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2", "k3"}, 5*time.Minute)
+	scope := "excludeScope"
+
+	// Excluded keys are skipped, including a preferred one, while another key is available.
+	for i := 0; i < 20; i++ {
+		_, index, err := km.getNextKeyExcluding(scope, 0, map[int]bool{0: true, 1: true})
+		assertNoError(t, err)
+		assertInt(t, index, 2)
+	}
+
+	// With every available key excluded, an excluded key is reused rather than failing.
+	km.markKeyFailed(scope, 2, "test")
+	_, index, err := km.getNextKeyExcluding(scope, -1, map[int]bool{0: true, 1: true})
+	assertNoError(t, err)
+	if index != 0 && index != 1 {
+		t.Errorf("expected an excluded but available key, got index %d", index)
+	}
+}
+
+func TestSessionKeyIndex_IsDeterministic(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2", "k3"}, 5*time.Minute)
+	first := km.sessionKeyIndex("conversation-42")
+	for i := 0; i < 5; i++ {
+		assertInt(t, km.sessionKeyIndex("conversation-42"), first)
+	}
+	if first < 0 || first >= 3 {
+		t.Errorf("session index %d out of range", first)
+	}
+}
+
+func TestKeyManager_MinAvailableKeysAlarm(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2", "k3"}, 1*time.Minute)
+	km.minAvailableKeys = 2
+	scope := buildScopeKey("host", "/alarm")
+
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	km.getNextKey(scope)
+	km.markKeyFailed(scope, 0, "status 400")
+	if strings.Contains(logBuf.String(), "below the minimum") {
+		t.Fatalf("alarm fired with 2 of 3 keys available:\n%s", logBuf.String())
+	}
+	if below := km.scopesBelowMinAvailable(); len(below) != 0 {
+		t.Errorf("expected no scopes below threshold, got %v", below)
+	}
+
+	km.markKeyFailed(scope, 1, "status 400")
+	assertInt(t, strings.Count(logBuf.String(), "below the minimum of 2"), 1)
+	if below := km.scopesBelowMinAvailable(); len(below) != 1 || below[0] != scope {
+		t.Errorf("expected %q below threshold, got %v", scope, below)
+	}
+
+	// A persistent breach is throttled.
+	km.getNextKey(scope)
+	assertInt(t, strings.Count(logBuf.String(), "below the minimum of 2"), 1)
+
+	// Once the interval passes, the alarm fires again.
+	km.lockAll()
+	getScopeState(t, km, scope).lastThresholdAlarm = time.Now().Add(-2 * km.thresholdAlarmInterval)
+	km.unlockAll()
+	km.getNextKey(scope)
+	assertInt(t, strings.Count(logBuf.String(), "below the minimum of 2"), 2)
+
+	// A breach in another scope alarms on its own, within the first scope's interval.
+	other := buildScopeKey("host", "/other")
+	km.getNextKey(other)
+	km.markKeyFailed(other, 0, "status 400")
+	km.markKeyFailed(other, 1, "status 400")
+	assertInt(t, strings.Count(logBuf.String(), "below the minimum of 2"), 3)
+}
+
+func TestBuildScopeKey_EmptyHostAndTrailingSlash(t *testing.T) {
+	prev := defaultScopeHost
+	defaultScopeHost = "target.example.com"
+	t.Cleanup(func() { defaultScopeHost = prev })
+
+	assertString(t, buildScopeKey("", "/v1beta/models"), "target.example.com|/v1beta/models")
+	assertString(t, buildScopeKey("api.example.com", "/v1beta/models/"), "api.example.com|/v1beta/models")
+	assertString(t, buildScopeKey("api.example.com", "/v1beta/models//"), "api.example.com|/v1beta/models")
+	assertString(t, buildScopeKey("api.example.com", "/"), "api.example.com|/")
+	assertString(t, buildScopeKey("api.example.com", ""), "api.example.com|/")
+	assertString(t, buildScopeKey("", ""), "target.example.com|/")
+}
+
+func TestBuildScopeKey_SeparatorInPathDoesNotCollide(t *testing.T) {
+	// Without escaping, both would be "a|b|/c".
+	first := buildScopeKey("a", "b|/c")
+	second := buildScopeKey("a|b", "/c")
+	if first == second {
+		t.Fatalf("scopes collide: %q", first)
+	}
+	assertString(t, first, "a|b%7C/c")
+	assertString(t, scopePath(first), "b|/c")
+
+	// A literal escape sequence in a path does not collide with an escaped separator.
+	if buildScopeKey("a", "/x%7Cy") == buildScopeKey("a", "/x|y") {
+		t.Error("escaped and literal separator collide")
+	}
+
+	// Key state is kept apart as well.
+	km, _ := newKeyManager([]string{"k1", "k2"}, time.Minute)
+	km.markKeyFailed(first, 0, "test")
+	_, _, err := km.getNextKey(second)
+	assertNoError(t, err)
+	km.lockAll()
+	assertInt(t, len(getScopeState(t, km, second).failingKeys), 0)
+	km.unlockAll()
+}
+
+func TestScopeSeparator_Configurable(t *testing.T) {
+	prev := scopeSeparator
+	t.Cleanup(func() { setScopeSeparator(prev) })
+
+	sep, err := parseScopeSeparator("::")
+	assertNoError(t, err)
+	setScopeSeparator(sep)
+	assertString(t, buildScopeKey("api.example.com", "/v1/a::b"), "api.example.com::/v1/a%3A%3Ab")
+	assertString(t, buildScopeKey("api.example.com", "/v1/a|b"), "api.example.com::/v1/a|b")
+	assertString(t, scopePath(buildScopeKey("api.example.com", "/v1/models")), "/v1/models")
+	// Paths come back unescaped, for matching against path-prefix rules.
+	assertString(t, scopePath(buildScopeKey("api.example.com", "/v1/a::b%2F")), "/v1/a::b%2F")
+	assertString(t, unescapeScopeKey(buildScopeKey("api.example.com", "/v1/a::b")), "api.example.com::/v1/a::b")
+
+	_, err = parseScopeSeparator("")
+	assertErrorContains(t, err, "must not be empty")
+	_, err = parseScopeSeparator("%")
+	assertErrorContains(t, err, "must not contain")
+}
+
+func TestMaxScopes_EvictsLeastRecentlyUsed(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2"}, 5*time.Minute)
+	km.maxScopes = 2 * scopeShardCount // two scopes per shard
+
+	// Find three scopes sharing a shard, so they compete for its two slots.
+	var scopes []string
+	shard := km.shardFor(buildScopeKey("example.com", "/path-0"))
+	for i := 0; len(scopes) < 3; i++ {
+		scope := buildScopeKey("example.com", fmt.Sprintf("/path-%d", i))
+		if km.shardFor(scope) == shard {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	_, _, _ = km.getNextKey(scopes[0])
+	_, _, _ = km.getNextKey(scopes[1])
+	km.markKeyFailed(scopes[1], 0, "status 429")
+	km.lockAll()
+	getScopeState(t, km, scopes[0]).lastActivity = time.Now().Add(-time.Minute)
+	getScopeState(t, km, scopes[1]).lastActivity = time.Now().Add(-2 * time.Minute)
+	km.unlockAll()
+	// Using scopes[1] again makes scopes[0] the least recently used.
+	_, _, _ = km.getNextKey(scopes[1])
+
+	_, _, _ = km.getNextKey(scopes[2])
+	km.lockAll()
+	defer km.unlockAll()
+	if _, exists := km.lookupScope(scopes[0]); exists {
+		t.Error("Expected the least recently used scope to be evicted")
+	}
+	for _, scope := range scopes[1:] {
+		if _, exists := km.lookupScope(scope); !exists {
+			t.Errorf("Expected scope %s to be kept", scope)
+		}
+	}
+	assertInt(t, len(shard.scopes), 2)
+}
+
+func TestMaxScopes_StopsGrowth(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1"}, 5*time.Minute)
+	for i := range 100 {
+		_, _, _ = km.getNextKey(buildScopeKey("example.com", fmt.Sprintf("/path-%d", i)))
+	}
+	assertInt(t, km.scopeCount(), 100)
+
+	km.maxScopes = scopeShardCount
+	for i := 100; i < 200; i++ {
+		_, _, _ = km.getNextKey(buildScopeKey("example.com", fmt.Sprintf("/path-%d", i)))
+	}
+	if count := km.scopeCount(); count > 100 {
+		t.Errorf("Expected the limit to stop scope growth, got %d scopes", count)
+	}
+}
+
+func TestMarkKeyFailed_SingleKeyCountsDistinctKeys(t *testing.T) {
+	logs := captureLogs(t, levelInfo)
+	// A duplicate and a blank entry add no failover, so this is still a single key.
+	km, _ := newKeyManager([]string{"onlykey", "", "onlykey"}, 1*time.Minute)
+	km.markKeyFailed("scope", 0, "status 429")
+	if !strings.Contains(logs.String(), "SINGLE KEY SIDELINED") {
+		t.Errorf("expected single-key sideline log, got:\n%s", logs.String())
+	}
+
+	logs = captureLogs(t, levelInfo)
+	km, _ = newKeyManager([]string{"k1", "k2", "k1"}, 1*time.Minute)
+	km.markKeyFailed("scope", 0, "status 429")
+	if strings.Contains(logs.String(), "SINGLE KEY SIDELINED") {
+		t.Errorf("unexpected single-key sideline log with two distinct keys:\n%s", logs.String())
+	}
+}
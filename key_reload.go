@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// keyReloadSummary describes what a key reload changed.
+type keyReloadSummary struct {
+	// Keys in the new list that were not configured before.
+	Added int `json:"added"`
+	// Previously configured keys missing from the new list; their state is dropped.
+	Removed int `json:"removed"`
+	// Keys in both lists, which keep their state (sidelined or not) under their new index.
+	Kept int `json:"kept"`
+	// Number of valid keys after the reload.
+	TotalKeys int `json:"totalKeys"`
+}
+
+// changed reports whether the reload added or removed any key.
+func (s keyReloadSummary) changed() bool {
+	return s.Added > 0 || s.Removed > 0
+}
+
+// reloadKeys replaces the key list. Indices follow the new list, so per-scope state is carried
+// over by key value, not index: a key that is still configured keeps its sidelined state and
+// selection count under its new index, a removed key's state is dropped, and a new key starts
+// out available (unless excluded from the scope). Failures reported by requests that selected
+// a key before the reload are checked against the key value (markKeyFailedIfCurrent). A list
+// that moves or removes a key the exclusions or default key index refer to is rejected.
+func (km *keyManager) reloadKeys(keys []string) (keyReloadSummary, error) {
+	keys, validKeyCount := blankDuplicateKeys(keys)
+	if validKeyCount == 0 {
+		return keyReloadSummary{}, errors.New("no valid (non-empty) API keys found")
+	}
+
+	km.lockAll()
+	defer km.unlockAll()
+
+	if err := km.checkPinnedKeys(keys); err != nil {
+		return keyReloadSummary{}, err
+	}
+
+	oldIndex := make(map[string]int, len(km.originalKeys))
+	for i, key := range km.originalKeys {
+		if key != "" {
+			oldIndex[key] = i
+		}
+	}
+	summary := keyReloadSummary{TotalKeys: validKeyCount}
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if _, ok := oldIndex[key]; ok {
+			summary.Kept++
+		} else {
+			summary.Added++
+		}
+	}
+	summary.Removed = len(oldIndex) - summary.Kept
+
+	km.statsMu.Lock()
+	usage := make([]keyUsage, len(keys))
+	for i, key := range keys {
+		if old, ok := oldIndex[key]; ok && key != "" {
+			usage[i] = km.keyUsage[old]
+		}
+	}
+	km.keyUsage = usage
+	km.statsMu.Unlock()
+
+	// Set before the scopes are remapped: excludedKeysFor checks the new list.
+	km.originalKeys = keys
+	for _, shard := range km.shards {
+		for scope, state := range shard.scopes {
+			available := make(map[int]string)
+			failing := make(map[int]failInfo)
+			selections := make(map[int]uint64)
+			excluded := km.excludedKeysFor(scope)
+			for i, key := range keys {
+				if key == "" || excluded[i] {
+					continue
+				}
+				old, known := oldIndex[key]
+				if info, isFailing := state.failingKeys[old]; known && isFailing {
+					failing[i] = info
+				} else {
+					available[i] = key
+				}
+				if n := state.selections[old]; known && n > 0 {
+					selections[i] = n
+				}
+			}
+			state.availableKeys = available
+			state.failingKeys = failing
+			state.selections = selections
+			state.excludedKeys = excluded
+		}
+	}
+	km.keyCount.Store(int64(len(keys)))
+	return summary, nil
+}
+
+// checkPinnedKeys returns an error if keys would put a different key (or none) at an index
+// that -scope-key-exclusions or -default-key-index refers to. Both name keys by index, so
+// such a reload would silently apply them to another key. An index that held no key before
+// may take a new one. This MUST be called with all shards locked.
+func (km *keyManager) checkPinnedKeys(keys []string) error {
+	check := func(flagName string, index int) error {
+		if index < 0 || index >= len(km.originalKeys) || km.originalKeys[index] == "" {
+			return nil
+		}
+		if index >= len(keys) || keys[index] != km.originalKeys[index] {
+			return fmt.Errorf("%s refers to key index %d, which would hold a different key after the reload; keep that key at the same position or restart the proxy", flagName, index)
+		}
+		return nil
+	}
+	for _, exclusion := range km.keyExclusions {
+		for _, index := range exclusion.keys {
+			if err := check("-scope-key-exclusions", index); err != nil {
+				return err
+			}
+		}
+	}
+	return check("-default-key-index", km.defaultKeyIndex)
+}
+
+// keyReloader re-reads the key sources given at startup (-keys, -keys-file, -keys-json-env)
+// and applies them with keyManager.reloadKeys.
+type keyReloader struct {
+	keysRaw     string
+	keysFile    string
+	keysJSONEnv string
+	keyMan      *keyManager
+	// Set when the startup list had per-key targets or bearer entries. The transport and the
+	// bearer token refresher hold those by key index, so no reload is possible.
+	indexBoundKeys bool
+	// -scope-key-exclusions and -default-key-index, re-validated against each new list.
+	keyExclusionsRaw string
+	defaultKeyIndex  int
+	// Serializes reloads, so two at once cannot interleave reading and applying.
+	mu sync.Mutex
+}
+
+// reload reads the key sources and applies the result. Per-key targets and bearer keys are
+// tied to key indices in the transport, so lists using them (now or at startup) cannot be
+// reloaded. A list the key exclusions or default key index no longer fit is rejected too.
+func (r *keyReloader) reload() (keyReloadSummary, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.indexBoundKeys {
+		return keyReloadSummary{}, errors.New("the proxy was started with per-key targets or bearer tokens, which are bound to key indices; restart it to change the keys")
+	}
+	entries, err := loadKeys(r.keysRaw, r.keysFile, r.keysJSONEnv)
+	if err != nil {
+		return keyReloadSummary{}, err
+	}
+	entries, keyTargets, err := splitKeyTargets(entries)
+	if err != nil {
+		return keyReloadSummary{}, err
+	}
+	keys, bearerKeys, _, err := splitBearerKeys(entries)
+	if err != nil {
+		return keyReloadSummary{}, err
+	}
+	if len(keyTargets) > 0 || len(bearerKeys) > 0 {
+		return keyReloadSummary{}, errors.New("keys with per-key targets or bearer tokens cannot be reloaded; restart the proxy to change them")
+	}
+	if _, err := parseKeyExclusions(r.keyExclusionsRaw, len(keys)); err != nil {
+		return keyReloadSummary{}, fmt.Errorf("-scope-key-exclusions does not fit the new keys: %w", err)
+	}
+	blanked, _ := blankDuplicateKeys(keys)
+	if err := validateDefaultKeyIndex(r.defaultKeyIndex, blanked); err != nil {
+		return keyReloadSummary{}, fmt.Errorf("-default-key-index does not fit the new keys: %w", err)
+	}
+	summary, err := r.keyMan.reloadKeys(keys)
+	if err != nil {
+		return summary, err
+	}
+	if !summary.changed() {
+		logInfof("Reloaded keys: no changes (%d total).", summary.TotalKeys)
+		return summary, nil
+	}
+	logInfof("Reloaded keys: %d added, %d removed, %d kept (%d total).", summary.Added, summary.Removed, summary.Kept, summary.TotalKeys)
+	if summary.TotalKeys == 1 {
+		logWarnf("Only one API key is configured after the reload. There is no failover.")
+	}
+	return summary, nil
+}
+
+// runReloadOnSignal reloads the keys each time a signal arrives (SIGHUP in main) until the
+// channel is closed. A failed reload is logged and the current keys stay in use.
+func runReloadOnSignal(r *keyReloader, signals <-chan os.Signal) {
+	for sig := range signals {
+		if _, err := r.reload(); err != nil {
+			logErrorf("Key reload on %v failed; keeping the current keys: %v", sig, err)
+		}
+	}
+}
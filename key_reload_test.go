@@ -0,0 +1,187 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReloadKeys_ShorterListKeepsStateByKey(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2", "k3"}, 5*time.Minute)
+	scope := buildScopeKey("example.com", "/v1beta/models")
+	_, _, _ = km.getNextKey(scope)
+	km.markKeyFailed(scope, 0, "status 429") // k1, removed below
+	km.markKeyFailed(scope, 2, "status 403") // k3, moves to index 0
+
+	summary, err := km.reloadKeys([]string{"k3", "k2"})
+	assertNoError(t, err)
+	assertInt(t, summary.Added, 0)
+	assertInt(t, summary.Removed, 1)
+	assertInt(t, summary.Kept, 2)
+	assertInt(t, summary.TotalKeys, 2)
+
+	snap := km.snapshot()
+	assertInt(t, snap.TotalKeys, 2)
+	ss := snap.Scopes[scope]
+	assertInt(t, len(ss.FailingKeys), 1)
+	assertInt(t, ss.FailingKeys[0].Index, 0)
+	assertString(t, ss.FailingKeys[0].Reason, "status 403")
+	assertInt(t, len(ss.AvailableKeys), 1)
+	assertInt(t, ss.AvailableKeys[0], 1)
+
+	// Selection and sidelining use the new indices.
+	key, index, err := km.getNextKey(scope)
+	assertNoError(t, err)
+	assertString(t, key, "k2")
+	assertInt(t, index, 1)
+	km.markKeyFailed(scope, index, "status 429")
+	_, _, err = km.getNextKey(scope)
+	assertErrorContains(t, err, errNoKeysAvailable.Error())
+
+	// Out-of-range indices no longer exist anywhere.
+	km.lockAll()
+	state := getScopeState(t, km, scope)
+	for index := range state.failingKeys {
+		if index >= 2 {
+			t.Errorf("Failing key index %d is out of range after the reload", index)
+		}
+	}
+	km.unlockAll()
+	assertInt(t, km.sessionKeyIndex("session")%2, km.sessionKeyIndex("session"))
+}
+
+func TestReloadKeys_AddsKeyAsAvailable(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1"}, 5*time.Minute)
+	km.keyExclusions, _ = parseKeyExclusions(`[{"scope":"restricted","keys":[1]}]`, 2)
+	scope := buildScopeKey("example.com", "/v1beta/models")
+	restricted := buildScopeKey("example.com", "/v1beta/models/restricted")
+	_, _, _ = km.getNextKey(scope)
+	_, _, _ = km.getNextKey(restricted)
+	km.markKeyFailed(scope, 0, "status 429")
+
+	summary, err := km.reloadKeys([]string{"k1", "k2", "k1", ""})
+	assertNoError(t, err)
+	assertInt(t, summary.Added, 1)
+	assertInt(t, summary.Kept, 1)
+	assertInt(t, summary.TotalKeys, 2)
+
+	key, index, err := km.getNextKey(scope)
+	assertNoError(t, err)
+	assertString(t, key, "k2")
+	assertInt(t, index, 1)
+	// The new index 1 is excluded from the restricted scope.
+	assertInt(t, len(km.snapshot().Scopes[restricted].AvailableKeys), 1)
+
+	_, err = km.reloadKeys([]string{"", ""})
+	assertErrorContains(t, err, "no valid")
+	assertInt(t, km.snapshot().TotalKeys, 4)
+}
+
+func TestReloadKeys_StaleFailureDoesNotSidelineNewKeyAtIndex(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2"}, 5*time.Minute)
+	scope := buildScopeKey("example.com", "/v1beta/models")
+	key, index, err := km.getNextKey(scope)
+	assertNoError(t, err)
+
+	// The selected key leaves index 0 before its request reports the failure.
+	_, err = km.reloadKeys([]string{"k2", "k1"})
+	assertNoError(t, err)
+	km.markKeyFailedIfCurrent(scope, index, key, "status 429")
+	assertInt(t, len(km.snapshot().Scopes[scope].FailingKeys), 0)
+
+	// A failure against the key still at its index is applied as usual.
+	km.markKeyFailedIfCurrent(scope, 0, "k2", "status 429")
+	assertInt(t, len(km.snapshot().Scopes[scope].FailingKeys), 1)
+	km.markKeyFailedIfCurrent(scope, 5, "k1", "status 429") // Out of range is a no-op
+	assertInt(t, len(km.snapshot().Scopes[scope].FailingKeys), 1)
+}
+
+func TestReloadKeys_RejectsMovingPinnedKeys(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2", "k3"}, 5*time.Minute)
+	km.keyExclusions, _ = parseKeyExclusions(`[{"scope":"pro","keys":[1]}]`, 3)
+
+	_, err := km.reloadKeys([]string{"k1", "k3", "k2"})
+	assertErrorContains(t, err, "-scope-key-exclusions refers to key index 1")
+	_, err = km.reloadKeys([]string{"k1"})
+	assertErrorContains(t, err, "-scope-key-exclusions refers to key index 1")
+	assertInt(t, km.snapshot().TotalKeys, 3)
+
+	km.defaultKeyIndex = 2
+	_, err = km.reloadKeys([]string{"k1", "k2", "k4"})
+	assertErrorContains(t, err, "-default-key-index refers to key index 2")
+
+	// Other keys may move or change while the pinned ones stay put.
+	_, err = km.reloadKeys([]string{"k4", "k2", "k3", "k1"})
+	assertNoError(t, err)
+	assertInt(t, km.snapshot().TotalKeys, 4)
+}
+
+func TestKeyReloader_ReadsKeysFile(t *testing.T) {
+	path := writeTempFile(t, "keys.txt", "k1\n")
+	km, _ := newKeyManager([]string{"k1"}, 5*time.Minute)
+	reloader := &keyReloader{keysFile: path, keyMan: km}
+
+	summary, err := reloader.reload()
+	assertNoError(t, err)
+	if summary.changed() {
+		t.Errorf("Expected an unchanged keys file to be a no-op, got %+v", summary)
+	}
+
+	if err := os.WriteFile(path, []byte("k1\nk2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	summary, err = reloader.reload()
+	assertNoError(t, err)
+	assertInt(t, summary.Added, 1)
+	assertInt(t, km.snapshot().TotalKeys, 2)
+
+	// Per-key targets are index-bound in the transport, so the reload is refused.
+	if err := os.WriteFile(path, []byte("k1@https://eu.example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = reloader.reload()
+	assertErrorContains(t, err, "cannot be reloaded")
+	assertInt(t, km.snapshot().TotalKeys, 2)
+}
+
+func TestKeyReloader_RefusesIndexBoundStartupKeys(t *testing.T) {
+	path := writeTempFile(t, "keys.txt", "k1\nk2\n")
+	km, _ := newKeyManager([]string{"k1", "k2"}, 5*time.Minute)
+	reloader := &keyReloader{keysFile: path, keyMan: km, indexBoundKeys: true}
+
+	// Even a plain new list would shift the targets and bearer keys the transport holds by index.
+	_, err := reloader.reload()
+	assertErrorContains(t, err, "bound to key indices")
+	assertInt(t, km.snapshot().TotalKeys, 2)
+}
+
+func TestKeyReloader_RevalidatesExclusionsAndDefaultKey(t *testing.T) {
+	path := writeTempFile(t, "keys.txt", "k1\nk2\nk3\n")
+	km, _ := newKeyManager([]string{"k1", "k2", "k3"}, 5*time.Minute)
+	reloader := &keyReloader{keysFile: path, keyMan: km, keyExclusionsRaw: `[{"scope":"pro","keys":[2]}]`, defaultKeyIndex: -1}
+
+	// Key index 2 is excluded, so a two-key list no longer fits.
+	if err := os.WriteFile(path, []byte("k1\nk2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := reloader.reload()
+	assertErrorContains(t, err, "-scope-key-exclusions")
+	assertInt(t, km.snapshot().TotalKeys, 3)
+
+	// The default key must not become a duplicate of an earlier key.
+	reloader.keyExclusionsRaw = ""
+	reloader.defaultKeyIndex = 1
+	if err := os.WriteFile(path, []byte("k1\nk1\nk3\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = reloader.reload()
+	assertErrorContains(t, err, "-default-key-index")
+	assertInt(t, km.snapshot().TotalKeys, 3)
+
+	if err := os.WriteFile(path, []byte("k1\nk2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = reloader.reload()
+	assertNoError(t, err)
+	assertInt(t, km.snapshot().TotalKeys, 2)
+}
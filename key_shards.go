@@ -0,0 +1,82 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// scopeShardCount is the number of independently locked shards the scopes are spread over.
+const scopeShardCount = 16
+
+// scopeShard holds the scopes hashed to it (see shardFor) under its own lock. Operations that
+// only read scope state take the read lock; anything that selects or sidelines a key (which
+// updates counters and timestamps) takes the write lock.
+type scopeShard struct {
+	mu     sync.RWMutex
+	scopes map[string]*scopeState
+}
+
+// newScopeShards returns scopeShardCount empty shards.
+func newScopeShards() [scopeShardCount]*scopeShard {
+	var shards [scopeShardCount]*scopeShard
+	for i := range shards {
+		shards[i] = &scopeShard{scopes: make(map[string]*scopeState)}
+	}
+	return shards
+}
+
+// shardFor returns the shard holding scope.
+func (km *keyManager) shardFor(scope string) *scopeShard {
+	h := fnv.New32a()
+	h.Write([]byte(scope))
+	return km.shards[h.Sum32()%scopeShardCount]
+}
+
+// lockAll locks every shard, always in the same order so concurrent callers cannot deadlock.
+// It is used by operations that must see or change all scopes at once.
+func (km *keyManager) lockAll() {
+	for _, shard := range km.shards {
+		km.lockShard(shard)
+	}
+}
+
+// unlockAll unlocks every shard locked by lockAll.
+func (km *keyManager) unlockAll() {
+	for _, shard := range km.shards {
+		shard.mu.Unlock()
+	}
+}
+
+// rlockAll read-locks every shard, in the same order as lockAll, for operations that read
+// all scopes at once.
+func (km *keyManager) rlockAll() {
+	for _, shard := range km.shards {
+		km.rlockShard(shard)
+	}
+}
+
+// runlockAll unlocks every shard locked by rlockAll.
+func (km *keyManager) runlockAll() {
+	for _, shard := range km.shards {
+		shard.mu.RUnlock()
+	}
+}
+
+// lookupScope returns the state of scope without creating it.
+// This MUST be called with the scope's shard (or every shard) locked, for reading at least.
+func (km *keyManager) lookupScope(scope string) (*scopeState, bool) {
+	state, ok := km.shardFor(scope).scopes[scope]
+	return state, ok
+}
+
+// allScopes returns every scope's state, keyed by scope.
+// This MUST be called with every shard locked, for reading at least.
+func (km *keyManager) allScopes() map[string]*scopeState {
+	scopes := make(map[string]*scopeState)
+	for _, shard := range km.shards {
+		for scope, state := range shard.scopes {
+			scopes[scope] = state
+		}
+	}
+	return scopes
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShardFor_SpreadsScopes(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1"}, 1*time.Minute)
+	scope := buildScopeKey("example.com", "/v1beta/models/gemini-pro")
+	if km.shardFor(scope) != km.shardFor(scope) {
+		t.Fatal("Expected a scope to always map to the same shard")
+	}
+
+	used := make(map[*scopeShard]bool)
+	for i := range 200 {
+		used[km.shardFor(buildScopeKey("example.com", fmt.Sprintf("/v1beta/models/model-%d", i)))] = true
+	}
+	if len(used) < scopeShardCount/2 {
+		t.Errorf("Expected scopes to spread over the shards, got %d of %d used", len(used), scopeShardCount)
+	}
+}
+
+func TestKeyManager_ConcurrentScopes(t *testing.T) {
+	keys := []string{"k1", "k2", "k3", "k4"}
+	km, _ := newKeyManager(keys, 1*time.Minute)
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				scope := buildScopeKey("example.com", fmt.Sprintf("/v1beta/models/model-%d", (g+i)%32))
+				if _, index, err := km.getNextKey(scope); err == nil && i%3 == 0 {
+					km.markKeyFailed(scope, index, "status 429")
+				}
+				if i%50 == 0 {
+					km.snapshot()
+					km.resetAll()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every key is in exactly one of the available and failing sets of each scope.
+	snap := km.snapshot()
+	assertInt(t, len(snap.Scopes), 32)
+	assertInt(t, km.scopeCount(), 32)
+	for scope, ss := range snap.Scopes {
+		if got := len(ss.AvailableKeys) + len(ss.FailingKeys); got != len(keys) {
+			t.Errorf("Scope %s: %d available + failing keys, expected %d", scope, got, len(keys))
+		}
+	}
+}
+
+// benchmarkGetNextKeyParallel selects keys from parallel goroutines spread over
+// numScopes scopes.
+func benchmarkGetNextKeyParallel(b *testing.B, numScopes int) {
+	km, _ := newKeyManager([]string{"k1", "k2", "k3", "k4"}, 1*time.Minute)
+	scopes := make([]string, numScopes)
+	for i := range scopes {
+		scopes[i] = buildScopeKey("example.com", fmt.Sprintf("/v1beta/models/model-%d", i))
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			km.getNextKey(scopes[i%numScopes])
+			i++
+		}
+	})
+}
+
+// With a single scope every goroutine contends for one shard; with many scopes they mostly
+// use different shards, which is where sharding pays off.
+func BenchmarkGetNextKeyParallel_OneScope(b *testing.B) {
+	benchmarkGetNextKeyParallel(b, 1)
+}
+
+func BenchmarkGetNextKeyParallel_ManyScopes(b *testing.B) {
+	benchmarkGetNextKeyParallel(b, 64)
+}
+
+func TestKeyManager_ConcurrentReaders(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	km.minAvailableKeys = 2
+	scope := buildScopeKey("example.com", "/v1beta/models")
+	km.getNextKey(scope)
+
+	// Read locks are shared: a second reader does not wait for the first.
+	shard := km.shardFor(scope)
+	km.rlockShard(shard)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		km.snapshot()
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("snapshot blocked behind another reader")
+	}
+	shard.mu.RUnlock()
+
+	// Readers and writers together; run with -race to check the locking.
+	var wg sync.WaitGroup
+	for g := range 4 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				if _, index, err := km.getNextKey(scope); err == nil && g == 0 {
+					km.markKeyFailed(scope, index, "status 429")
+					km.resetAll()
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				km.snapshot()
+				km.scopesBelowMinAvailable()
+				km.exportFailingState()
+			}
+		}()
+	}
+	wg.Wait()
+	assertInt(t, km.scopeCount(), 1)
+}
+
+// BenchmarkScopesBelowMinAvailableParallel measures the availability check behind /healthz,
+// a read-only path that only takes read locks.
+func BenchmarkScopesBelowMinAvailableParallel(b *testing.B) {
+	km, _ := newKeyManager([]string{"k1", "k2", "k3", "k4"}, 1*time.Minute)
+	km.minAvailableKeys = 2
+	for i := range 64 {
+		km.getNextKey(buildScopeKey("example.com", fmt.Sprintf("/v1beta/models/model-%d", i)))
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			km.scopesBelowMinAvailable()
+		}
+	})
+}
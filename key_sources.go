@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// readKeysFile reads API keys from a file containing one key per line.
+// Blank lines and lines starting with '#' are ignored; surrounding whitespace is trimmed.
+func readKeysFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open keys file: %w", err)
+	}
+	defer f.Close()
+
+	keys := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read keys file %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// jsonKeyEntry is a key in a -keys-json-env blob written as an object rather than a string.
+// Weight and tier are accepted so secret-manager blobs can carry them, but key selection
+// is uniform and does not use them.
+type jsonKeyEntry struct {
+	Key    string   `json:"key"`
+	Weight *float64 `json:"weight,omitempty"`
+	Tier   string   `json:"tier,omitempty"`
+}
+
+// UnmarshalJSON accepts either a bare key string or an object with a "key" field.
+func (e *jsonKeyEntry) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		return json.Unmarshal(data, &e.Key)
+	}
+	type plain jsonKeyEntry
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode((*plain)(e)); err != nil {
+		return err
+	}
+	if e.Weight != nil && *e.Weight < 0 {
+		return fmt.Errorf("negative weight %v", *e.Weight)
+	}
+	return nil
+}
+
+// parseKeysJSON parses a JSON blob of keys: either an array, whose entries keep their order,
+// or an object mapping names to entries, ordered by name. Each entry is a key string or an
+// object such as {"key": "...", "weight": 2, "tier": "paid"}.
+func parseKeysJSON(raw string) ([]string, error) {
+	var entries []jsonKeyEntry
+	trimmed := strings.TrimSpace(raw)
+	switch {
+	case strings.HasPrefix(trimmed, "["):
+		if err := json.Unmarshal([]byte(trimmed), &entries); err != nil {
+			return nil, fmt.Errorf("invalid JSON key array: %w", err)
+		}
+	case strings.HasPrefix(trimmed, "{"):
+		var named map[string]jsonKeyEntry
+		if err := json.Unmarshal([]byte(trimmed), &named); err != nil {
+			return nil, fmt.Errorf("invalid JSON key object: %w", err)
+		}
+		names := make([]string, 0, len(named))
+		for name := range named {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			entries = append(entries, named[name])
+		}
+	default:
+		return nil, errors.New("JSON keys must be an array or an object")
+	}
+
+	keys := make([]string, 0, len(entries))
+	for i, entry := range entries {
+		key := strings.TrimSpace(entry.Key)
+		if key == "" {
+			return nil, fmt.Errorf("JSON key entry %d has no key", i)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// loadKeys merges keys from the comma-separated list, the optional keys file and the optional
+// environment variable holding a JSON key blob (in that order) and validates that at least one
+// non-empty key results.
+func loadKeys(keysRaw, keysFile, keysJSONEnv string) ([]string, error) {
+	keys := splitCommaList(keysRaw)
+	if keysFile != "" {
+		fileKeys, err := readKeysFile(keysFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, fileKeys...)
+	}
+	if keysJSONEnv != "" {
+		raw, ok := os.LookupEnv(keysJSONEnv)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s (from -keys-json-env) is not set", keysJSONEnv)
+		}
+		jsonKeys, err := parseKeysJSON(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse keys from %s: %w", keysJSONEnv, err)
+		}
+		keys = append(keys, jsonKeys...)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no non-empty API keys provided via -keys, GEMINI_API_KEYS, -keys-file or -keys-json-env")
+	}
+	return keys, nil
+}
+
+// keyTargetSeparator separates a key from its optional per-key target in a key entry,
+// e.g. "AIza...@https://europe-west4-generativelanguage.googleapis.com". API keys never contain '@'.
+const keyTargetSeparator = "@"
+
+// splitKeyTargets strips optional per-key targets from key entries. It returns the bare keys
+// (same order and indices) and the target scheme/host for each key index that has one.
+func splitKeyTargets(entries []string) ([]string, map[int]*url.URL, error) {
+	keys := make([]string, len(entries))
+	targets := make(map[int]*url.URL)
+	for i, entry := range entries {
+		key, rawTarget, found := strings.Cut(entry, keyTargetSeparator)
+		keys[i] = strings.TrimSpace(key)
+		if !found {
+			continue
+		}
+		target, err := parseTargetOverride(strings.TrimSpace(rawTarget))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid target for key index %d: %w", i, err)
+		}
+		targets[i] = target
+	}
+	return keys, targets, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTempFile writes content to a file in a per-test temp directory and returns its path.
+func writeTempFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write temp file: %v", err)
+	}
+	return path
+}
+
+func TestReadKeysFile_IgnoresCommentsAndBlankLines(t *testing.T) {
+	path := writeTempFile(t, "keys.txt", `# production pool
+key-one
+
+   key-two   
+# key-disabled
+	key-three
+`)
+
+	keys, err := readKeysFile(path)
+	assertNoError(t, err)
+	want := []string{"key-one", "key-two", "key-three"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("readKeysFile() = %v, want %v", keys, want)
+	}
+}
+
+func TestReadKeysFile_MissingFile(t *testing.T) {
+	_, err := readKeysFile(filepath.Join(t.TempDir(), "does-not-exist.txt"))
+	assertErrorContains(t, err, "failed to open keys file")
+}
+
+func TestLoadKeys_MergesListAndFile(t *testing.T) {
+	path := writeTempFile(t, "keys.txt", "file-key-1\n# comment\nfile-key-2\n")
+
+	keys, err := loadKeys(" list-key-1, ,list-key-2 ", path, "")
+	assertNoError(t, err)
+	want := []string{"list-key-1", "list-key-2", "file-key-1", "file-key-2"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("loadKeys() = %v, want %v", keys, want)
+	}
+}
+
+func TestLoadKeys_NoValidKeys(t *testing.T) {
+	path := writeTempFile(t, "keys.txt", "# only comments\n\n")
+
+	_, err := loadKeys(" , ", path, "")
+	assertErrorContains(t, err, "no non-empty API keys provided")
+}
+
+func TestParseKeysJSON_Array(t *testing.T) {
+	keys, err := parseKeysJSON(` ["key-a", {"key": "key-b", "weight": 2, "tier": "paid"}, " key-c "] `)
+	assertNoError(t, err)
+	want := []string{"key-a", "key-b", "key-c"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("parseKeysJSON() = %v, want %v", keys, want)
+	}
+}
+
+func TestParseKeysJSON_Object(t *testing.T) {
+	keys, err := parseKeysJSON(`{"secondary": {"key": "key-b"}, "primary": "key-a"}`)
+	assertNoError(t, err)
+	want := []string{"key-a", "key-b"} // ordered by name
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("parseKeysJSON() = %v, want %v", keys, want)
+	}
+}
+
+func TestParseKeysJSON_Invalid(t *testing.T) {
+	cases := map[string]string{
+		`"key-a"`:                         "must be an array or an object",
+		`["key-a",`:                       "invalid JSON key array",
+		`[123]`:                           "invalid JSON key array",
+		`[{"key": ""}]`:                   "entry 0 has no key",
+		`[{"key": "k", "weight": -1}]`:    "negative weight",
+		`[{"key": "k", "priority": 1}]`:   "unknown field",
+		`{"primary": {"weight": 1}}`:      "entry 0 has no key",
+		`{"primary": ["nested", "list"]}`: "invalid JSON key object",
+	}
+	for raw, want := range cases {
+		_, err := parseKeysJSON(raw)
+		assertErrorContains(t, err, want)
+	}
+}
+
+func TestLoadKeys_MergesJSONEnv(t *testing.T) {
+	t.Setenv("TEST_PROXY_KEYS_JSON", `["json-key-1", "json-key-2"]`)
+
+	keys, err := loadKeys("list-key-1", "", "TEST_PROXY_KEYS_JSON")
+	assertNoError(t, err)
+	want := []string{"list-key-1", "json-key-1", "json-key-2"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("loadKeys() = %v, want %v", keys, want)
+	}
+
+	_, err = loadKeys("", "", "TEST_PROXY_KEYS_JSON_UNSET")
+	assertErrorContains(t, err, "is not set")
+}
+
+func TestSplitKeyTargets(t *testing.T) {
+	keys, targets, err := splitKeyTargets([]string{"key-one", "key-two@https://europe-west4.example.com/ignored/path", "key-three @ http://localhost:9000"})
+	assertNoError(t, err)
+	want := []string{"key-one", "key-two", "key-three"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("splitKeyTargets() keys = %v, want %v", keys, want)
+	}
+	assertInt(t, len(targets), 2)
+	assertString(t, targets[1].Scheme+"://"+targets[1].Host, "https://europe-west4.example.com")
+	assertString(t, targets[2].Scheme+"://"+targets[2].Host, "http://localhost:9000")
+
+	_, _, err = splitKeyTargets([]string{"key-one@ftp://example.com"})
+	assertErrorContains(t, err, "invalid target for key index 0")
+}
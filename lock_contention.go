@@ -0,0 +1,53 @@
+package main
+
+import (
+	"runtime"
+	"time"
+)
+
+// While waiting, lock yields the processor between its first lockSpinYields attempts, then
+// sleeps lockSpinSleep between attempts.
+const (
+	lockSpinYields = 100
+	lockSpinSleep  = 100 * time.Microsecond
+)
+
+// lockShard write-locks the shard (see acquireLock).
+func (km *keyManager) lockShard(shard *scopeShard) {
+	km.acquireLock(shard.mu.Lock, shard.mu.TryLock)
+}
+
+// rlockShard read-locks the shard (see acquireLock).
+func (km *keyManager) rlockShard(shard *scopeShard) {
+	km.acquireLock(shard.mu.RLock, shard.mu.TryRLock)
+}
+
+// acquireLock acquires a shard lock with lock. With contentionWarn set, it polls with tryLock
+// instead of blocking and logs a warning once the wait exceeds the threshold, and again when
+// the lock is finally acquired, so a stalled or deadlocked key manager shows up in the logs
+// without a profiler.
+func (km *keyManager) acquireLock(lock func(), tryLock func() bool) {
+	if km.contentionWarn <= 0 {
+		lock()
+		return
+	}
+	if tryLock() {
+		return
+	}
+	start := time.Now()
+	warned := false
+	for spins := 0; !tryLock(); spins++ {
+		if spins < lockSpinYields {
+			runtime.Gosched()
+		} else {
+			time.Sleep(lockSpinSleep)
+		}
+		if !warned && time.Since(start) > km.contentionWarn {
+			warned = true
+			logWarnf("Key manager lock not acquired after %s; possible contention or deadlock.", km.contentionWarn)
+		}
+	}
+	if warned {
+		logWarnf("Key manager lock acquired after waiting %s.", time.Since(start).Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyManagerLock_WarnsOnContention(t *testing.T) {
+	buf := captureLogs(t, levelWarn)
+	km := &keyManager{contentionWarn: 10 * time.Millisecond}
+	shard := &scopeShard{}
+
+	shard.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		km.lockShard(shard)
+		shard.mu.Unlock()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	shard.mu.Unlock()
+	<-done
+
+	logs := buf.String()
+	if !strings.Contains(logs, "Key manager lock not acquired after 10ms") {
+		t.Errorf("Expected a contention warning, got logs: %s", logs)
+	}
+	if !strings.Contains(logs, "Key manager lock acquired after waiting") {
+		t.Errorf("Expected the wait to be reported once acquired, got logs: %s", logs)
+	}
+}
+
+func TestKeyManagerLock_NoWarningWithoutContention(t *testing.T) {
+	buf := captureLogs(t, levelWarn)
+	km := &keyManager{contentionWarn: 10 * time.Millisecond}
+	shard := &scopeShard{}
+
+	km.lockShard(shard)
+	shard.mu.Unlock()
+	if strings.Contains(buf.String(), "Key manager lock") {
+		t.Errorf("Expected no contention warning, got logs: %s", buf.String())
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// logLevel orders log messages by severity.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// logLevelNames maps each level to the tag prefixed to its messages and accepted by -log-level.
+var logLevelNames = map[logLevel]string{
+	levelDebug: "DEBUG",
+	levelInfo:  "INFO",
+	levelWarn:  "WARN",
+	levelError: "ERROR",
+}
+
+// minLogLevel suppresses messages below it. Set from -log-level at startup through
+// setMinLogLevel. It is atomic because tests change it while background goroutines log.
+var minLogLevel atomic.Int32
+
+func init() {
+	setMinLogLevel(levelInfo)
+}
+
+// setMinLogLevel sets the minimum level of printed messages.
+func setMinLogLevel(level logLevel) {
+	minLogLevel.Store(int32(level))
+}
+
+// currentLogLevel returns the minimum level of printed messages.
+func currentLogLevel() logLevel {
+	return logLevel(minLogLevel.Load())
+}
+
+// parseLogLevel parses a -log-level value (case-insensitive).
+func parseLogLevel(raw string) (logLevel, error) {
+	name := strings.ToUpper(strings.TrimSpace(raw))
+	if name == "WARNING" {
+		name = "WARN"
+	}
+	for level, levelName := range logLevelNames {
+		if levelName == name {
+			return level, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("invalid log level %q: must be debug, info, warn or error", raw)
+}
+
+// logEnabled reports whether messages at level are printed. Hot paths check it before building
+// log arguments, which are otherwise computed (and allocated) even when the message is dropped.
+func logEnabled(level logLevel) bool {
+	return level >= currentLogLevel()
+}
+
+// logf writes a message tagged with its level if the level is enabled.
+func logf(level logLevel, format string, args ...any) {
+	if !logEnabled(level) {
+		return
+	}
+	log.Print("[" + logLevelNames[level] + "] " + fmt.Sprintf(format, args...))
+}
+
+// logDebugf logs per-request detail such as key selection and body modification steps.
+func logDebugf(format string, args ...any) { logf(levelDebug, format, args...) }
+
+// logInfof logs normal operational events.
+func logInfof(format string, args ...any) { logf(levelInfo, format, args...) }
+
+// logWarnf logs recoverable problems such as sidelined keys or rejected requests.
+func logWarnf(format string, args ...any) { logf(levelWarn, format, args...) }
+
+// logErrorf logs terminal failures that need operator attention.
+func logErrorf(format string, args ...any) { logf(levelError, format, args...) }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe to read while background goroutines are logging to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// Write appends p to the buffer.
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// String returns the logs written so far.
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Len returns the number of bytes written so far.
+func (b *syncBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+// captureLogs sets the minimum log level and redirects the standard logger for the duration of
+// the test.
+func captureLogs(t *testing.T, level logLevel) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	prevLevel := currentLogLevel()
+	setMinLogLevel(level)
+	log.SetOutput(buf)
+	t.Cleanup(func() {
+		setMinLogLevel(prevLevel)
+		log.SetOutput(os.Stderr)
+	})
+	return buf
+}
+
+func TestLogLevel_InfoSuppressesDebug(t *testing.T) {
+	buf := captureLogs(t, levelInfo)
+
+	logDebugf("debug detail %d", 1)
+	logInfof("info event %d", 2)
+	logWarnf("warn event %d", 3)
+	logErrorf("error event %d", 4)
+
+	out := buf.String()
+	if strings.Contains(out, "debug detail") || strings.Contains(out, "[DEBUG]") {
+		t.Errorf("DEBUG line printed at INFO level: %s", out)
+	}
+	for _, want := range []string{"[INFO] info event 2", "[WARN] warn event 3", "[ERROR] error event 4"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in log output, got: %s", want, out)
+		}
+	}
+}
+
+func TestLogLevel_KeySelectionIsDebug(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2"}, time.Minute)
+
+	buf := captureLogs(t, levelInfo)
+	if _, _, err := km.getNextKey(buildScopeKey("host", "/path")); err != nil {
+		t.Fatalf("getNextKey: %v", err)
+	}
+	if strings.Contains(buf.String(), "Selected key index") {
+		t.Errorf("Key selection logged at INFO level: %s", buf.String())
+	}
+
+	buf = captureLogs(t, levelDebug)
+	if _, _, err := km.getNextKey(buildScopeKey("host", "/path")); err != nil {
+		t.Fatalf("getNextKey: %v", err)
+	}
+	if !strings.Contains(buf.String(), "[DEBUG]") || !strings.Contains(buf.String(), "Selected key index") {
+		t.Errorf("Expected DEBUG key selection line, got: %s", buf.String())
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	cases := map[string]logLevel{
+		"debug":   levelDebug,
+		"INFO":    levelInfo,
+		" warn ":  levelWarn,
+		"warning": levelWarn,
+		"Error":   levelError,
+	}
+	for raw, want := range cases {
+		got, err := parseLogLevel(raw)
+		assertNoError(t, err)
+		assertInt(t, int(got), int(want))
+	}
+
+	_, err := parseLogLevel("verbose")
+	assertErrorContains(t, err, "invalid log level")
+}
@@ -1,55 +1,228 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
 	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
 	// --- Command Line Flags ---
-	targetHost := flag.String("target", "https://generativelanguage.googleapis.com", "Target host to forward requests to")
-	listenAddr := flag.String("listen", ":8080", "Address and port to listen on")
-	keysRaw := flag.String("keys", os.Getenv("GEMINI_API_KEYS"), "Comma-separated list of API keys (required)")
-	removalDuration := flag.Duration("removal-duration", 1*time.Hour, "Duration to remove a failing key from rotation")
-	overrideKeyParam := flag.String("key-param", "key", "The name of the query parameter containing the API key to override")
-	headerAuthPathsRaw := flag.String("header-auth-paths", "/openai", "Comma-separated list of path prefixes that should use Authorization header instead of query param")
-	addGoogleSearch := flag.Bool("add-google-search", true, "Automatically add google_search tool based on conditions")
-	searchTrigger := flag.String("search-trigger", "search", "Word in user message that forces google_search and removes functionDeclarations")
+	targetHost := flag.String("target", envString("PROXY_TARGET", "https://generativelanguage.googleapis.com"), "Target host to forward requests to (env PROXY_TARGET)")
+	checkTargetFlag := flag.Bool("check-target", false, "Dial the target at startup and log an error if it is unreachable")
+	requireTarget := flag.Bool("require-target", false, "Like -check-target, but exit non-zero if the target is unreachable")
+	listenAddr := flag.String("listen", envString("PROXY_LISTEN", ":8080"), "Address and port to listen on (env PROXY_LISTEN)")
+	tlsCert := flag.String("tls-cert", "", "Path to a PEM certificate; with -tls-key, serve HTTPS instead of HTTP")
+	tlsKey := flag.String("tls-key", "", "Path to the PEM private key for -tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", "", "Path to PEM CA certificates; when set, clients must present a certificate signed by one of them (mTLS)")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "Minimum TLS version when serving HTTPS (1.0, 1.1, 1.2 or 1.3)")
+	keysRaw := flag.String("keys", os.Getenv("GEMINI_API_KEYS"), "Comma-separated list of API keys (required unless -keys-file is set) (env GEMINI_API_KEYS)")
+	keysFile := flag.String("keys-file", envString("PROXY_KEYS_FILE", ""), "Path to a file with one API key per line (blank lines and # comments ignored), merged with -keys (env PROXY_KEYS_FILE)")
+	bearerTokenLifetime := flag.Duration("bearer-token-lifetime", 0, "Lifetime of tokens read from bearer-file: key entries; each file is re-read shortly before its token expires (0 never re-reads)")
+	keysJSONEnv := flag.String("keys-json-env", "", "Name of an environment variable holding a JSON array or object of API keys, merged with -keys and -keys-file")
+	removalDuration := flag.Duration("removal-duration", envDuration("PROXY_REMOVAL_DURATION", 1*time.Hour), "Duration to remove a failing key from rotation (env PROXY_REMOVAL_DURATION)")
+	authHeader := flag.String("auth-header", "Authorization", "Header carrying the API key on -header-auth-paths")
+	authScheme := flag.String("auth-scheme", "Bearer", "Scheme prefixed to the API key in -auth-header (empty sends the bare key)")
+	noRetryStatusesRaw := flag.String("no-retry-statuses", defaultNoRetryStatuses, "Comma-separated upstream status codes that are never retried, regardless of class")
+	retryBudget := flag.Int("retry-budget", 0, "Maximum retries across a whole client request, on top of the per-call limit (0 means no extra cap)")
+	minAvailableKeys := flag.Int("min-available-keys", 0, "Log an ERROR alarm when any scope has fewer available keys than this (0 disables)")
+	mutexContentionWarn := flag.Duration("mutex-contention-warn", 0, "Log a warning when acquiring the key manager lock takes longer than this (0 disables)")
+	degradeHealthz := flag.Bool("degrade-healthz", false, "Make /healthz return 503 while any scope is below -min-available-keys")
+	removalOverridesRaw := flag.String("removal-duration-overrides", "", "Comma-separated PATH_PREFIX=DURATION removal durations for scopes under a path prefix (e.g. /v1beta/models/gemini-pro=10m); others use -removal-duration")
+	defaultKeyIndex := flag.Int("default-key-index", -1, "Index of the key used by scopes whose keys are all excluded by -scope-key-exclusions, instead of failing with 503 (-1 disables)")
+	keyExclusionsRaw := flag.String("scope-key-exclusions", "", `JSON array of rules keeping keys out of scopes matching a regular expression on "host|path", e.g. [{"scope":"gemini-2\\.5-pro","keys":[0,2]}]`)
+	stateFile := flag.String("state-file", "", "Path of a JSON file where sidelined-key state is saved periodically and restored at startup (empty disables)")
+	webhookURL := flag.String("webhook-url", "", "URL that receives a JSON POST when a key is sidelined or a scope runs out of keys (empty disables)")
+	webhookDrainTimeout := flag.Duration("webhook-drain-timeout", 5*time.Second, "On shutdown, how long to wait for queued webhook events to be delivered")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "On SIGINT or SIGTERM, how long to wait for in-flight requests before closing them")
+	stateSaveInterval := flag.Duration("state-save-interval", 30*time.Second, "How often to save -state-file")
+	scopeTTL := flag.Duration("scope-ttl", 0, "Prune per-scope key state idle for longer than this when no keys are sidelined (0 disables)")
+	maxScopes := flag.Int("max-scopes", 0, "Maximum number of scopes tracked; the least recently used scope is evicted to make room (0 means no limit)")
+	noBodyLogging := flag.Bool("no-body-logging", false, "Never read or log upstream response bodies, not even for errors; only statuses are logged")
+	scopeSeparatorRaw := flag.String("scope-separator", scopeSeparator, "String joining host and path in scope keys (as matched by -scope-key-exclusions and shown in logs and metrics); occurrences inside a host or path are percent-encoded")
+	hashScopeLogsFlag := flag.Bool("hash-scope-logs", false, "Log a short hash of each scope (host|path) instead of the raw value")
+	overrideKeyParam := flag.String("key-param", envString("PROXY_KEY_PARAM", "key"), "The name of the query parameter containing the API key to override (env PROXY_KEY_PARAM)")
+	headerAuthPathsRaw := flag.String("header-auth-paths", envString("PROXY_HEADER_AUTH_PATHS", "/openai"), "Comma-separated list of path prefixes that should use Authorization header instead of query param (env PROXY_HEADER_AUTH_PATHS)")
+	addGoogleSearch := flag.Bool("add-google-search", envBool("PROXY_ADD_GOOGLE_SEARCH", true), "Automatically add google_search tool based on conditions (env PROXY_ADD_GOOGLE_SEARCH)")
+	searchTrigger := flag.String("search-trigger", envString("PROXY_SEARCH_TRIGGER", "search"), "Word in user message that forces google_search and removes functionDeclarations (env PROXY_SEARCH_TRIGGER)")
+	triggerReplaceModeRaw := flag.String("trigger-replace-mode", string(triggerReplace), "When the search trigger fires: 'replace' the tools array with google_search, or 'merge' it in and drop only functionDeclarations")
+	triggerPathsRaw := flag.String("trigger-paths", defaultTriggerPaths, "Comma-separated JSON paths (dot/bracket notation, [] for every array element) whose text is scanned for the search trigger")
+	defaultSystemInstruction := flag.String("default-system-instruction", "", "System instruction text added to Gemini generateContent bodies that don't set one")
+	bodyRewriteRaw := flag.String("body-rewrite", "", `JSON array of rewrites applied to Gemini POST bodies after tool injection, e.g. [{"op":"set","path":"generationConfig.temperature","value":0.2},{"op":"delete","path":"safetySettings"}]`)
+	validateModifiedBody := flag.Bool("validate-modified-body", true, "Check modified request bodies with json.Valid and forward the original body if the modification produced invalid JSON")
+	allowPathsRaw := flag.String("allow-paths", "", "Comma-separated path prefixes (or ^-anchored regexes) that may be forwarded; other paths get 404 (empty allows all)")
+	denyPathsRaw := flag.String("deny-paths", "", "Comma-separated path prefixes (or ^-anchored regexes) that are never forwarded; they get 403")
+	restrictPaths := flag.Bool("restrict-paths", false, "Return 404 locally for paths not matching -known-paths instead of forwarding them")
+	knownPathsRaw := flag.String("known-paths", defaultKnownPaths, "Comma-separated path prefixes (or ^-anchored regexes) of the upstream API, for -restrict-paths")
+	allowTrace := flag.Bool("allow-trace", false, "Forward TRACE requests upstream (with the key injected) instead of rejecting them with 405")
+	forceSearchParam := flag.String("force-search-param", "force_search", "Query parameter that forces google_search injection for a request when true (e.g. ?force_search=true); stripped before forwarding (empty disables)")
+	allowInjectionOverride := flag.Bool("allow-injection-override", false, "Let clients skip body modification for a request by sending X-Disable-Tool-Injection: true")
+	strictJSON := flag.Bool("strict-json", false, "Reject malformed JSON bodies on Gemini paths with 400 instead of forwarding them")
+	geminiPathPattern := flag.String("gemini-path-regex", defaultGeminiPathPattern, "Regular expression matching the request paths whose POST bodies are eligible for tool injection and rewrites")
+	searchModelsRaw := flag.String("search-models", "", "Comma-separated model name patterns (e.g. gemini-1.5-*,gemini-2.0-flash) that may receive the google_search tool (empty allows all)")
+	toolMethods := flag.String("tool-methods", "", "Comma-separated Gemini model methods (path suffix after ':') whose POST bodies get tool injection; empty means "+defaultToolMethods+" plus Gemini paths without a method suffix")
+	corsMaxAge := flag.Duration("cors-max-age", 0, "How long browsers may cache CORS preflight results, sent as Access-Control-Max-Age (0 omits it)")
+	corsAllowMethods := flag.String("cors-allow-methods", defaultCORSAllowMethods, "Comma-separated methods sent as Access-Control-Allow-Methods")
+	corsAllowHeaders := flag.String("cors-allow-headers", defaultCORSAllowHeaders, "Comma-separated request headers sent as Access-Control-Allow-Headers")
+	corsExposeHeaders := flag.String("cors-expose-headers", "", "Comma-separated response headers browsers may read, sent as Access-Control-Expose-Headers (e.g. X-Request-ID,X-Proxy-Attempts)")
+	adminToken := flag.String("admin-token", os.Getenv("PROXY_ADMIN_TOKEN"), "Token required in the X-Admin-Token header for /admin/ endpoints (admin endpoints are disabled when empty) (env PROXY_ADMIN_TOKEN)")
+	metricsPath := flag.String("metrics-path", "/metrics", "Path of the local Prometheus metrics endpoint (requires the X-Admin-Token header when -admin-token is set); empty disables it, so the path is proxied like any other")
+	enablePprof := flag.Bool("enable-pprof", false, "Serve net/http/pprof profiling endpoints under /debug/pprof/ (requires -admin-token)")
+	clientRPS := flag.Float64("client-rps", 0, "Per-client-IP request rate limit in requests per second (0 disables)")
+	maxConcurrent := flag.Int("max-concurrent", 0, "Maximum number of proxied requests in flight; excess requests get 503 with Retry-After (0 means unlimited)")
+	clientBurst := flag.Int("client-burst", 10, "Per-client-IP burst size used with -client-rps")
+	maxClientTimeout := flag.Duration("max-client-timeout", 5*time.Minute, "Upper bound for the client-supplied X-Proxy-Timeout header (0 means no cap)")
+	allowedQueryParamsRaw := flag.String("allowed-query-params", "", "Comma-separated query parameters forwarded upstream; others are dropped (the key parameter is always sent). Empty forwards all")
+	stripPrefix := flag.String("strip-prefix", "", "Path prefix removed from request paths before forwarding (e.g. /gemini)")
+	addPrefix := flag.String("add-prefix", "", "Path prefix added to request paths before forwarding, unless already present (e.g. /v1beta)")
+	userAgent := flag.String("user-agent", "", "User-Agent sent on forwarded requests, followed by the proxy version (empty passes the client's User-Agent through)")
+	stripRequestHeadersRaw := flag.String("strip-request-headers", defaultStripRequestHeaders, "Comma-separated client request headers removed before forwarding upstream")
+	forwardClientIP := flag.Bool("forward-client-ip", true, "Pass the client IP upstream via X-Forwarded-For/-Host/-Proto (false strips them)")
+	allowTargetOverride := flag.Bool("allow-target-override", false, "Allow clients to redirect a request to another upstream via the X-Target-Override header (testing only)")
+	responseHeadersRaw := flag.String("response-headers", "", "Comma-separated Name:Value headers added to every proxied response (e.g. X-Proxy-Version:1.2), or a JSON object of names to values for values containing commas")
+	logSampleRate := flag.Float64("log-sample-rate", 0, "Fraction (0.0-1.0) of requests whose method, path, key index and status are logged at INFO, including successful ones")
+	logStreamChunks := flag.Int("log-stream-chunks", 0, "Log the first N chunks of each streamed (text/event-stream) response at INFO, for debugging (0 disables)")
+	maxResponseBytes := flag.Int64("max-response-bytes", 0, "Maximum size of a non-streaming upstream response body in bytes; larger responses are rejected with 502 or truncated (0 means unlimited)")
+	serverTiming := flag.Bool("server-timing", false, "Add a Server-Timing header reporting time spent in the final upstream attempt and in retries")
+	exposeKeyIndex := flag.Bool("expose-key-index", false, "Add an X-Key-Index response header with the index (never the value) of the key that served the request, for debugging")
+	coalesce := flag.Bool("coalesce", false, "Share one upstream call between identical concurrent requests (GET/HEAD and -coalesce-paths only)")
+	logLevelRaw := flag.String("log-level", envString("PROXY_LOG_LEVEL", "info"), "Minimum level of log messages to print: debug, info, warn or error (env PROXY_LOG_LEVEL)")
+	cacheTTL := flag.Duration("cache-ttl", 0, "Cache successful GET/HEAD and countTokens responses for this long (0 disables the response cache)")
+	cacheMaxEntries := flag.Int("cache-max-entries", 1000, "Maximum number of responses held by the response cache")
+	backoffRaw := flag.String("backoff", backoffNone, "Delay between retries: none, constant, exponential or exponential-jitter")
+	backoffBase := flag.Duration("backoff-base", 100*time.Millisecond, "Delay before the first retry for -backoff (every retry for constant)")
+	backoffMax := flag.Duration("backoff-max", 5*time.Second, "Maximum delay between retries for -backoff (0 means no maximum)")
+	requestMaxAge := flag.Duration("request-max-age", 0, "Stop retrying and return 504 once a request is this old (0 disables)")
+	decompressResponses := flag.Bool("decompress-responses", false, "Request gzip from the upstream and decompress responses in the proxy, so clients always receive uncompressed bodies")
+	warmupDuration := flag.Duration("warmup-duration", 0, "After startup, sideline failing keys for at most -warmup-removal-duration for this long (0 disables the warm-up)")
+	warmupRemovalDuration := flag.Duration("warmup-removal-duration", 10*time.Second, "How long keys are sidelined during -warmup-duration")
+	fallbackResponsesRaw := flag.String("fallback-responses", "", `JSON array of responses served instead of 503 when no keys are available, by path prefix, e.g. [{"path":"/v1beta/models","status":200,"body":{"models":[]}}]`)
+	hedgeDelay := flag.Duration("hedge-delay", 0, "Send an idempotent request again with another key if the upstream has not responded after this long; the first usable response wins (0 disables)")
+	retryBodyPatternRaw := flag.String("retry-body-pattern", "", "Regular expression; a non-streaming 2xx response whose body matches is retried with another key, which is sidelined (empty disables)")
+	coalescePathsRaw := flag.String("coalesce-paths", "", "Comma-separated list of path prefixes where non-GET requests may also be coalesced")
 
 	flag.Parse()
 
+	level, err := parseLogLevel(*logLevelRaw)
+	if err != nil {
+		log.Fatalf("Error parsing -log-level: %v", err)
+	}
+	setMinLogLevel(level)
+
 	// --- Input Validation ---
-	if *keysRaw == "" {
-		log.Fatal("Error: -keys flag is required.")
-	}
-	keys := strings.Split(*keysRaw, ",")
-	validKeys := []string{}
-	for _, k := range keys {
-		trimmedKey := strings.TrimSpace(k)
-		if trimmedKey != "" {
-			validKeys = append(validKeys, trimmedKey)
-		}
+	if err := envError(); err != nil {
+		log.Fatalf("Error in environment: %v", err)
+	}
+	if *enablePprof && *adminToken == "" {
+		log.Fatal("Error: -enable-pprof requires -admin-token.")
+	}
+	if *cacheTTL > 0 && *cacheMaxEntries <= 0 {
+		log.Fatal("Error: -cache-max-entries must be positive when -cache-ttl is set.")
+	}
+	if err := validateBearerTokenLifetime(*bearerTokenLifetime); err != nil {
+		log.Fatalf("Error parsing -bearer-token-lifetime: %v", err)
+	}
+	if *warmupDuration > 0 && *warmupRemovalDuration <= 0 {
+		log.Fatal("Error: -warmup-removal-duration must be positive when -warmup-duration is set.")
+	}
+	if *logSampleRate < 0 || *logSampleRate > 1 {
+		log.Fatalf("Error: -log-sample-rate must be between 0 and 1, got %v", *logSampleRate)
+	}
+	if *keysRaw == "" && *keysFile == "" && *keysJSONEnv == "" {
+		log.Fatal("Error: -keys flag (or -keys-file or -keys-json-env) is required.")
+	}
+	keyEntries, err := loadKeys(*keysRaw, *keysFile, *keysJSONEnv)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
 	}
-	if len(validKeys) == 0 {
-		log.Fatal("Error: No non-empty API keys provided in the -keys flag.")
+	keyEntries, keyTargets, err := splitKeyTargets(keyEntries)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	validKeys, bearerKeys, bearerFiles, err := splitBearerKeys(keyEntries)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if distinctKeyCount(validKeys) == 1 {
+		logWarnf("Only one API key is configured. There is no failover: if it is rate limited or fails, requests will return 503 until it is reactivated.")
 	}
 
-	// Process header auth paths
-	headerAuthPaths := []string{}
-	if *headerAuthPathsRaw != "" {
-		for _, p := range strings.Split(*headerAuthPathsRaw, ",") {
-			trimmedPath := strings.TrimSpace(p)
-			if trimmedPath != "" {
-				headerAuthPaths = append(headerAuthPaths, trimmedPath)
-			}
+	sep, err := parseScopeSeparator(*scopeSeparatorRaw)
+	if err != nil {
+		log.Fatalf("Error parsing -scope-separator: %v", err)
+	}
+	setScopeSeparator(sep)
+	hashScopeLogs = *hashScopeLogsFlag
+	disableBodyLogging = *noBodyLogging
+	if *noBodyLogging && *logStreamChunks > 0 {
+		logWarnf("Ignoring -log-stream-chunks: response body logging is disabled by -no-body-logging.")
+		*logStreamChunks = 0
+	}
+
+	geminiPathRegex, err = regexp.Compile(*geminiPathPattern)
+	if err != nil {
+		log.Fatalf("Error parsing -gemini-path-regex: %v", err)
+	}
+
+	noRetryStatuses, err := parseStatusCodes(*noRetryStatusesRaw)
+	if err != nil {
+		log.Fatalf("Error parsing -no-retry-statuses: %v", err)
+	}
+	var retryBodyPattern *regexp.Regexp
+	if *retryBodyPatternRaw != "" {
+		retryBodyPattern, err = regexp.Compile(*retryBodyPatternRaw)
+		if err != nil {
+			log.Fatalf("Error parsing -retry-body-pattern: %v", err)
 		}
 	}
+	backoffStrategy, err := parseBackoffStrategy(*backoffRaw)
+	if err != nil {
+		log.Fatalf("Error parsing -backoff: %v", err)
+	}
+
+	triggerMode, err := parseTriggerReplaceMode(*triggerReplaceModeRaw)
+	if err != nil {
+		log.Fatalf("Error parsing -trigger-replace-mode: %v", err)
+	}
+
+	triggerPaths, err := parseTriggerPaths(*triggerPathsRaw)
+	if err != nil {
+		log.Fatalf("Error parsing -trigger-paths: %v", err)
+	}
+
+	tlsConfig, err := buildTLSConfig(*tlsCert, *tlsKey, *tlsMinVersion, *tlsClientCA)
+	if err != nil {
+		log.Fatalf("Error configuring TLS: %v", err)
+	}
+
+	bodyRewrites, err := parseBodyRewrites(*bodyRewriteRaw)
+	if err != nil {
+		log.Fatalf("Error parsing -body-rewrite: %v", err)
+	}
+
+	responseHeaders, err := parseResponseHeaders(*responseHeadersRaw)
+	if err != nil {
+		log.Fatalf("Error parsing -response-headers: %v", err)
+	}
+
+	fallbacks, err := parseFallbackResponses(*fallbackResponsesRaw)
+	if err != nil {
+		log.Fatalf("Error parsing -fallback-responses: %v", err)
+	}
+
+	// Process path lists
+	headerAuthPaths := splitCommaList(*headerAuthPathsRaw)
+	coalescePaths := splitCommaList(*coalescePathsRaw)
 
 	targetURL, err := url.Parse(*targetHost)
 	if err != nil {
@@ -58,12 +231,73 @@ func main() {
 	if targetURL.Scheme == "" || targetURL.Host == "" {
 		log.Fatalf("Error: Invalid target URL '%s'. Must include scheme (e.g., https://) and host.", *targetHost)
 	}
+	defaultScopeHost = targetURL.Host
+	if *checkTargetFlag || *requireTarget {
+		if err := checkTarget(targetURL, targetCheckTimeout); err != nil {
+			if *requireTarget {
+				log.Fatalf("Error: Target %s is unreachable: %v", targetURL, err)
+			}
+			logErrorf("Target %s is unreachable: %v. Requests will fail until it is reachable; check -target.", targetURL, err)
+		} else {
+			logInfof("Target %s is reachable.", targetURL)
+		}
+	}
 
 	// --- Initialize Key Manager ---
 	keyMan, err := newKeyManager(validKeys, *removalDuration)
 	if err != nil {
 		log.Fatalf("Error initializing key manager: %v", err)
 	}
+	keyMan.scopeTTL = *scopeTTL
+	keyMan.maxScopes = *maxScopes
+	keyMan.removalOverrides, err = parseRemovalOverrides(*removalOverridesRaw)
+	if err != nil {
+		log.Fatalf("Error parsing -removal-duration-overrides: %v", err)
+	}
+	keyMan.keyExclusions, err = parseKeyExclusions(*keyExclusionsRaw, len(validKeys))
+	if err != nil {
+		log.Fatalf("Error parsing -scope-key-exclusions: %v", err)
+	}
+	if err := validateDefaultKeyIndex(*defaultKeyIndex, keyMan.originalKeys); err != nil {
+		log.Fatalf("Error parsing -default-key-index: %v", err)
+	}
+	keyMan.defaultKeyIndex = *defaultKeyIndex
+	keyMan.minAvailableKeys = *minAvailableKeys
+	keyMan.contentionWarn = *mutexContentionWarn
+	keyMan.warmupDuration = *warmupDuration
+	// Reload the key sources on SIGHUP (and on POST /admin/reload when admin endpoints are enabled).
+	reloader := &keyReloader{
+		keysRaw:          *keysRaw,
+		keysFile:         *keysFile,
+		keysJSONEnv:      *keysJSONEnv,
+		keyMan:           keyMan,
+		indexBoundKeys:   len(keyTargets) > 0 || len(bearerKeys) > 0,
+		keyExclusionsRaw: *keyExclusionsRaw,
+		defaultKeyIndex:  *defaultKeyIndex,
+	}
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go runReloadOnSignal(reloader, hangups)
+	if len(bearerFiles) > 0 && *bearerTokenLifetime > 0 {
+		logInfof("Refreshing %d bearer token file(s) before their %s lifetime ends", len(bearerFiles), *bearerTokenLifetime)
+		go runBearerTokenRefresh(keyMan, bearerFiles, *bearerTokenLifetime, nil)
+	}
+	keyMan.warmupRemovalDuration = *warmupRemovalDuration
+	if *webhookURL != "" {
+		keyMan.notifier = newWebhookNotifier(*webhookURL, defaultWebhookQueueSize)
+		logInfof("Sending key events to webhook %s", *webhookURL)
+	}
+	// Per-scope byte counters, dropped along with the key manager's scopes.
+	metrics := newProxyMetrics()
+	keyMan.onScopeRemoved = metrics.forget
+	if *stateFile != "" {
+		restored, err := loadStateFile(keyMan, *stateFile)
+		if err != nil {
+			log.Fatalf("Error loading -state-file: %v", err)
+		}
+		logInfof("Restored %d sidelined key(s) from %s; saving every %s", restored, *stateFile, *stateSaveInterval)
+		go runStatePersistence(keyMan, *stateFile, *stateSaveInterval, nil)
+	}
 
 	// --- Create Reverse Proxy ---
 	proxy := httputil.NewSingleHostReverseProxy(targetURL)
@@ -71,37 +305,204 @@ func main() {
 	// --- Customize Proxy ---
 	// Create the custom transport with retry logic
 	retryTransport := newRetryTransport(http.DefaultTransport, keyMan, *overrideKeyParam, headerAuthPaths)
+	retryTransport.retryBudget = *retryBudget
+	retryTransport.noRetryStatuses = noRetryStatuses
+	retryTransport.requestMaxAge = *requestMaxAge
+	retryTransport.decompressResponses = *decompressResponses
+	retryTransport.hedgeDelay = *hedgeDelay
+	retryTransport.backoff = backoffPolicy{strategy: backoffStrategy, base: *backoffBase, max: *backoffMax}
+	retryTransport.metrics = metrics
+	if allowed := splitCommaList(*allowedQueryParamsRaw); len(allowed) > 0 {
+		logInfof("Forwarding only these query parameters: %v", allowed)
+		retryTransport.allowedQueryParams = make(map[string]bool, len(allowed))
+		for _, name := range allowed {
+			retryTransport.allowedQueryParams[name] = true
+		}
+	}
+	retryTransport.authHeader = *authHeader
+	retryTransport.authScheme = *authScheme
+	retryTransport.keyTargets = keyTargets
+	retryTransport.bearerKeys = bearerKeys
+	retryTransport.retryBodyPattern = retryBodyPattern
 	proxy.Transport = retryTransport
 
 	// Simplify the Director: It only needs to set the host/scheme via the original director.
 	// Key selection and auth are now handled by the retryTransport.
-	originalDirector := proxy.Director                                // Save original director from NewSingleHostReverseProxy
-	proxy.Director = createProxyDirector(targetURL, originalDirector) // Pass only necessary args
+	originalDirector := proxy.Director // Save original director from NewSingleHostReverseProxy
+	proxy.Director = createProxyDirector(targetURL, originalDirector, directorOptions{
+		forwardClientIP:     *forwardClientIP,
+		allowTargetOverride: *allowTargetOverride,
+		stripHeaders:        splitCommaList(*stripRequestHeadersRaw),
+		stripPrefix:         normalizePathPrefix(*stripPrefix),
+		addPrefix:           normalizePathPrefix(*addPrefix),
+		userAgent:           *userAgent,
+	})
 
 	// ModifyResponse can still be used for logging or handling non-retryable errors detected after response.
-	proxy.ModifyResponse = createProxyModifyResponse(keyMan) // Keep keyMan for now for non-retry 4xx
+	proxy.ModifyResponse = createProxyModifyResponse(keyMan, modifyResponseOptions{ // Keep keyMan for now for non-retry 4xx
+		responseHeaders:  responseHeaders,
+		serverTiming:     *serverTiming,
+		maxResponseBytes: *maxResponseBytes,
+		logSampleRate:    *logSampleRate,
+		logStreamChunks:  *logStreamChunks,
+		exposeKeyIndex:   *exposeKeyIndex,
+	})
 
 	// ErrorHandler handles terminal errors after retries are exhausted by the transport.
-	proxy.ErrorHandler = createProxyErrorHandler()
+	proxy.ErrorHandler = createProxyErrorHandler(keyMan, fallbacks)
 
 	// --- Start HTTP Server ---
-	log.Printf("Starting proxy server on %s", *listenAddr)
-	log.Printf("Forwarding requests to %s", targetURL.String())
-	log.Printf("Using query parameter '%s' for API key (default)", *overrideKeyParam)
+	logInfof("Starting proxy server on %s", *listenAddr)
+	logInfof("Forwarding requests to %s", targetURL.String())
+	logInfof("Using query parameter '%s' for API key (default)", *overrideKeyParam)
 	if len(headerAuthPaths) > 0 {
-		log.Printf("Using Authorization header for paths starting with: %v", headerAuthPaths)
+		logInfof("Using %s header for paths starting with: %v", *authHeader, headerAuthPaths)
+	}
+	logInfof("Key removal duration on failure: %s", *removalDuration)
+	for _, override := range keyMan.removalOverrides {
+		logInfof("Key removal duration for paths under %s: %s", override.prefix, override.duration)
 	}
-	log.Printf("Key removal duration on failure: %s", *removalDuration)
-	log.Printf("Add google_search tool conditionally: %t", *addGoogleSearch)
+	if *allowTargetOverride {
+		logWarnf("per-request target override via %s is enabled", targetOverrideHeader)
+	}
+	if *scopeTTL > 0 {
+		logInfof("Pruning idle scopes after: %s", *scopeTTL)
+	}
+	logInfof("Add google_search tool conditionally: %t", *addGoogleSearch)
 	if *addGoogleSearch {
-		log.Printf("Search trigger word: '%s'", *searchTrigger)
+		logInfof("Search trigger word: '%s'", *searchTrigger)
 	}
 
-	// --- Register Handler ---
-	http.HandleFunc("/", createMainHandler(proxy, *addGoogleSearch, *searchTrigger))
+	searchModels, err := parseSearchModels(*searchModelsRaw)
+	if err != nil {
+		log.Fatalf("Error parsing -search-models: %v", err)
+	}
+	if *addGoogleSearch && len(searchModels) > 0 {
+		logInfof("Injecting google_search only for models: %v", searchModels)
+	}
+
+	allowPaths, err := parsePathRules(*allowPathsRaw)
+	if err != nil {
+		log.Fatalf("Error parsing -allow-paths: %v", err)
+	}
+	denyPaths, err := parsePathRules(*denyPathsRaw)
+	if err != nil {
+		log.Fatalf("Error parsing -deny-paths: %v", err)
+	}
+	var knownPaths []pathRule
+	if *restrictPaths {
+		if knownPaths, err = parsePathRules(*knownPathsRaw); err != nil {
+			log.Fatalf("Error parsing -known-paths: %v", err)
+		}
+		if len(knownPaths) == 0 {
+			log.Fatalf("-restrict-paths requires at least one -known-paths entry")
+		}
+	}
+
+	// --- Register Handlers ---
+	var handler http.Handler = createMainHandler(proxy, mainHandlerOptions{
+		bodyModifierOptions: bodyModifierOptions{
+			addGoogleSearch:          *addGoogleSearch,
+			searchTrigger:            *searchTrigger,
+			triggerMode:              triggerMode,
+			triggerPaths:             triggerPaths,
+			rewrites:                 bodyRewrites,
+			validateModified:         *validateModifiedBody,
+			defaultSystemInstruction: *defaultSystemInstruction,
+		},
+		toolMethods:            splitCommaList(*toolMethods),
+		searchModels:           searchModels,
+		strictJSON:             *strictJSON,
+		allowInjectionOverride: *allowInjectionOverride,
+		forceSearchParam:       *forceSearchParam,
+		allowTrace:             *allowTrace,
+		allowPaths:             allowPaths,
+		denyPaths:              denyPaths,
+		knownPaths:             knownPaths,
+
+		corsMaxAge:        *corsMaxAge,
+		corsExposeHeaders: splitCommaList(*corsExposeHeaders),
+		corsAllowMethods:  splitCommaList(*corsAllowMethods),
+		corsAllowHeaders:  splitCommaList(*corsAllowHeaders),
+	})
+	if *coalesce {
+		logInfof("Coalescing identical in-flight requests (GET/HEAD and paths: %v)", coalescePaths)
+		handler = newRequestCoalescer(coalescePaths).wrap(handler)
+	}
+	if *cacheTTL > 0 {
+		logInfof("Caching responses for %s (up to %d entries)", *cacheTTL, *cacheMaxEntries)
+		handler = newResponseCache(*cacheTTL, *cacheMaxEntries).wrap(handler)
+	}
+	handler = createClientTimeoutHandler(handler, *maxClientTimeout)
+	if *clientRPS > 0 {
+		logInfof("Rate limiting clients to %.2f req/s (burst %d) per IP", *clientRPS, *clientBurst)
+		handler = newClientRateLimiter(*clientRPS, *clientBurst).wrap(handler)
+	}
+	if *maxConcurrent > 0 {
+		logInfof("Limiting proxied requests to %d in flight", *maxConcurrent)
+		handler = newConcurrencyLimiter(*maxConcurrent).wrap(handler)
+	}
+
+	if tlsConfig != nil && tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+		logInfof("Requiring client certificates signed by %s", *tlsClientCA)
+		handler = withClientCertSubject(handler)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", createHealthHandler(keyMan, *degradeHealthz))
+	if *metricsPath != "" {
+		var metricsHandler http.Handler = createMetricsHandler(metrics, keyMan)
+		if *adminToken != "" {
+			metricsHandler = requireAdminToken(*adminToken, metricsHandler)
+		}
+		mux.Handle(*metricsPath, metricsHandler)
+	}
+	if *adminToken != "" {
+		logInfof("Admin endpoints enabled under /admin/")
+		mux.Handle("/admin/state", requireAdminToken(*adminToken, createAdminStateHandler(keyMan)))
+		mux.Handle("/admin/reset", requireAdminToken(*adminToken, createAdminResetHandler(keyMan)))
+		mux.Handle("/admin/reload", requireAdminToken(*adminToken, createAdminReloadHandler(reloader)))
+	}
+	if *enablePprof {
+		logInfof("Profiling endpoints enabled under %s", pprofPrefix)
+		registerPprofHandlers(mux, *adminToken)
+	}
+	mux.Handle("/", handler)
 
 	// --- Run Server ---
-	if err := http.ListenAndServe(*listenAddr, nil); err != nil {
+	server := &http.Server{
+		Addr:      *listenAddr,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+	// Stop gracefully on SIGINT/SIGTERM, flushing webhook events before exiting.
+	stopSignals := make(chan os.Signal, 1)
+	signal.Notify(stopSignals, os.Interrupt, syscall.SIGTERM)
+	shutdownDone := make(chan struct{})
+	go func() {
+		shutdownOnSignal(server, keyMan.notifier, stopSignals, *shutdownTimeout, *webhookDrainTimeout)
+		close(shutdownDone)
+	}()
+	if tlsConfig != nil {
+		logInfof("Serving HTTPS (minimum TLS %s)", *tlsMinVersion)
+		err = server.ListenAndServeTLS("", "") // Certificates come from TLSConfig
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("Failed to start server: %v", err)
 	}
+	<-shutdownDone
+}
+
+// splitCommaList splits a comma-separated flag value, trimming whitespace and dropping empty entries.
+func splitCommaList(raw string) []string {
+	items := []string{}
+	for _, item := range strings.Split(raw, ",") {
+		trimmed := strings.TrimSpace(item)
+		if trimmed != "" {
+			items = append(items, trimmed)
+		}
+	}
+	return items
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// byteCounters accumulates the body bytes exchanged with the upstream for one scope.
+type byteCounters struct {
+	requestBytes  atomic.Int64
+	responseBytes atomic.Int64
+}
+
+// proxyMetrics holds per-scope counters served on /metrics.
+type proxyMetrics struct {
+	mu     sync.Mutex
+	scopes map[string]*byteCounters
+}
+
+// newProxyMetrics creates an empty metrics registry.
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{scopes: make(map[string]*byteCounters)}
+}
+
+// counters returns the byte counters for scope, creating them on first use.
+func (m *proxyMetrics) counters(scope string) *byteCounters {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.scopes[scope]
+	if !ok {
+		c = &byteCounters{}
+		m.scopes[scope] = c
+	}
+	return c
+}
+
+// forget drops the counters for scope. The key manager calls it when it evicts or prunes the
+// scope, so the metrics track no more scopes than the key manager does.
+func (m *proxyMetrics) forget(scope string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.scopes, scope)
+}
+
+// countingReadCloser adds the bytes read through it to counter as they flow, so streamed
+// responses are counted without buffering.
+type countingReadCloser struct {
+	io.ReadCloser
+	counter *atomic.Int64
+}
+
+// Read reads from the wrapped body and counts the bytes returned.
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.counter.Add(int64(n))
+	return n, err
+}
+
+// createMetricsHandler returns a handler for GET /metrics, which reports per-scope upstream
+// byte counters, the number of tracked scopes and key selection counts in the Prometheus text
+// format. Scopes are named as in the logs (see scopeForLog). A nil keyMan omits the scope count
+// and key selection metrics.
+func createMetricsHandler(m *proxyMetrics, keyMan *keyManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		m.mu.Lock()
+		scopes := make([]string, 0, len(m.scopes))
+		for scope := range m.scopes {
+			scopes = append(scopes, scope)
+		}
+		counters := make(map[string]*byteCounters, len(m.scopes))
+		for scope, c := range m.scopes {
+			counters[scope] = c
+		}
+		m.mu.Unlock()
+		sort.Strings(scopes)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprintln(w, "# HELP ai_proxy_request_bytes_total Request body bytes sent upstream, per scope (every attempt counts).")
+		fmt.Fprintln(w, "# TYPE ai_proxy_request_bytes_total counter")
+		for _, scope := range scopes {
+			fmt.Fprintf(w, "ai_proxy_request_bytes_total{scope=%s} %d\n", strconv.Quote(scopeForLog(scope)), counters[scope].requestBytes.Load())
+		}
+		fmt.Fprintln(w, "# HELP ai_proxy_response_bytes_total Response body bytes received from upstream, per scope.")
+		fmt.Fprintln(w, "# TYPE ai_proxy_response_bytes_total counter")
+		for _, scope := range scopes {
+			fmt.Fprintf(w, "ai_proxy_response_bytes_total{scope=%s} %d\n", strconv.Quote(scopeForLog(scope)), counters[scope].responseBytes.Load())
+		}
+		if keyMan != nil {
+			fmt.Fprintln(w, "# HELP ai_proxy_scopes Number of scopes the key manager currently tracks (see -scope-ttl and -max-scopes).")
+			fmt.Fprintln(w, "# TYPE ai_proxy_scopes gauge")
+			fmt.Fprintf(w, "ai_proxy_scopes %d\n", keyMan.scopeCount())
+			writeKeySelectionMetrics(w, keyMan.snapshot())
+		}
+	}
+}
+
+// writeKeySelectionMetrics writes how often each key was selected per scope, and the
+// coefficient of variation of those counts as a fairness indicator.
+func writeKeySelectionMetrics(w io.Writer, snap keyManagerSnapshot) {
+	scopes := make([]string, 0, len(snap.Scopes))
+	for scope := range snap.Scopes {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+
+	fmt.Fprintln(w, "# HELP ai_proxy_key_selections_total Times each key index was selected, per scope.")
+	fmt.Fprintln(w, "# TYPE ai_proxy_key_selections_total counter")
+	for _, scope := range scopes {
+		selections := snap.Scopes[scope].Selections
+		indices := make([]int, 0, len(selections))
+		for index := range selections {
+			indices = append(indices, index)
+		}
+		sort.Ints(indices)
+		for _, index := range indices {
+			fmt.Fprintf(w, "ai_proxy_key_selections_total{scope=%s,key_index=\"%d\"} %d\n", strconv.Quote(scopeForLog(scope)), index, selections[index])
+		}
+	}
+	fmt.Fprintln(w, "# HELP ai_proxy_key_selection_cv Coefficient of variation of key selection counts per scope (0 is perfectly even).")
+	fmt.Fprintln(w, "# TYPE ai_proxy_key_selection_cv gauge")
+	for _, scope := range scopes {
+		fmt.Fprintf(w, "ai_proxy_key_selection_cv{scope=%s} %g\n", strconv.Quote(scopeForLog(scope)), snap.Scopes[scope].SelectionCV)
+	}
+}
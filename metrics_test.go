@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryTransport_CountsRequestAndResponseBytes(t *testing.T) {
+	responseBody := strings.Repeat("r", 250)
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, "retry me") // Drained before the retry, still counted
+			return
+		}
+		io.WriteString(w, responseBody)
+	}))
+	defer server.Close()
+
+	km, _ := newKeyManager([]string{"k1"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+	rt.metrics = newProxyMetrics()
+
+	requestBody := strings.Repeat("q", 100)
+	req := httptest.NewRequest("POST", server.URL+"/v1beta/models/gemini-pro:generateContent", strings.NewReader(requestBody))
+	req.RequestURI = ""
+	resp, err := rt.RoundTrip(req)
+	assertNoError(t, err)
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assertString(t, string(got), responseBody)
+
+	serverURL, _ := url.Parse(server.URL)
+	counters := rt.metrics.counters(buildScopeKey(serverURL.Host, "/v1beta/models/gemini-pro:generateContent"))
+	assertInt(t, int(counters.requestBytes.Load()), 2*len(requestBody)) // Sent on both attempts
+	assertInt(t, int(counters.responseBytes.Load()), len("retry me")+len(responseBody))
+}
+
+func TestCreateMetricsHandler(t *testing.T) {
+	m := newProxyMetrics()
+	c := m.counters("api.example.com|/v1beta/models")
+	c.requestBytes.Add(12)
+	c.responseBytes.Add(34)
+
+	rr := httptest.NewRecorder()
+	createMetricsHandler(m, nil)(rr, httptest.NewRequest("GET", "http://localhost:8080/metrics", nil))
+	assertInt(t, rr.Code, http.StatusOK)
+	for _, want := range []string{
+		`ai_proxy_request_bytes_total{scope="api.example.com|/v1beta/models"} 12`,
+		`ai_proxy_response_bytes_total{scope="api.example.com|/v1beta/models"} 34`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("expected %q in metrics, got:\n%s", want, rr.Body.String())
+		}
+	}
+}
+
+func TestKeySelectionFairness(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2", "k3", "k4"}, 1*time.Minute)
+	scope := buildScopeKey("api.example.com", "/v1beta/models")
+	const selections = 4000
+	for range selections {
+		if _, _, err := km.getNextKey(scope); err != nil {
+			t.Fatalf("getNextKey: %v", err)
+		}
+	}
+
+	ss := km.snapshot().Scopes[scope]
+	assertInt(t, len(ss.Selections), 4)
+	var total uint64
+	for index, n := range ss.Selections {
+		total += n
+		// Each key expects 1000 selections; allow a generous margin for randomness.
+		if n < 800 || n > 1200 {
+			t.Errorf("key index %d selected %d times, expected about %d", index, n, selections/4)
+		}
+	}
+	assertInt(t, int(total), selections)
+	if ss.SelectionCV > 0.1 {
+		t.Errorf("selection CV = %.3f, expected a roughly uniform distribution", ss.SelectionCV)
+	}
+
+	rr := httptest.NewRecorder()
+	createMetricsHandler(newProxyMetrics(), km)(rr, httptest.NewRequest("GET", "http://localhost:8080/metrics", nil))
+	for _, want := range []string{
+		`ai_proxy_key_selections_total{scope="api.example.com|/v1beta/models",key_index="0"} `,
+		`ai_proxy_key_selection_cv{scope="api.example.com|/v1beta/models"} `,
+		"ai_proxy_scopes 1\n",
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("expected %q in metrics, got:\n%s", want, rr.Body.String())
+		}
+	}
+}
+
+func TestCoefficientOfVariation(t *testing.T) {
+	if cv := coefficientOfVariation(nil); cv != 0 {
+		t.Errorf("empty CV = %v, want 0", cv)
+	}
+	if cv := coefficientOfVariation([]uint64{5, 5, 5}); cv != 0 {
+		t.Errorf("even CV = %v, want 0", cv)
+	}
+	// Mean 2, standard deviation 2.
+	if cv := coefficientOfVariation([]uint64{4, 0}); cv != 1 {
+		t.Errorf("CV = %v, want 1", cv)
+	}
+}
+
+func TestProxyMetrics_ForgetsScopesRemovedByKeyManager(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1"}, 1*time.Minute)
+	m := newProxyMetrics()
+	km.onScopeRemoved = m.forget
+	km.scopeTTL = time.Minute
+
+	idle := buildScopeKey("api.example.com", "/v1beta/models/idle")
+	active := buildScopeKey("api.example.com", "/v1beta/models/active")
+	for _, scope := range []string{idle, active} {
+		_, _, _ = km.getNextKey(scope)
+		m.counters(scope).requestBytes.Add(1)
+	}
+	km.lockAll()
+	getScopeState(t, km, idle).lastActivity = time.Now().Add(-2 * time.Minute)
+	km.unlockAll()
+
+	assertInt(t, km.pruneIdleScopes(), 1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	assertInt(t, len(m.scopes), 1)
+	if _, ok := m.scopes[active]; !ok {
+		t.Errorf("Expected the active scope's counters to be kept, got %v", m.scopes)
+	}
+}
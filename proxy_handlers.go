@@ -2,23 +2,147 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"encoding/json"
 	"errors" // Added errors import
+	"fmt"
 	"io"
-	"log"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"path"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// targetOverrideHeader lets a client redirect a single request to another upstream (testing only).
+const targetOverrideHeader = "X-Target-Override"
+
+// noKeysAvailableHeader marks 503 responses caused by every key in the scope being sidelined.
+const noKeysAvailableHeader = "X-No-Keys-Available"
+
+// directorOptions configures createProxyDirector.
+type directorOptions struct {
+	// Pass the client's address upstream via X-Forwarded-* headers instead of stripping them.
+	forwardClientIP bool
+	// Honor X-Target-Override to rewrite the upstream scheme/host per request.
+	allowTargetOverride bool
+	// Client request headers removed before forwarding (see defaultStripRequestHeaders).
+	stripHeaders []string
+	// Path prefix removed from, then added to, the forwarded path (see rewritePathPrefix).
+	stripPrefix string
+	addPrefix   string
+	// When set, replaces the client's User-Agent on forwarded requests (see upstreamUserAgent).
+	userAgent string
+}
+
+// proxyVersion identifies this build in the upstream User-Agent. Release builds set it with
+// -ldflags "-X main.proxyVersion=<version>".
+var proxyVersion = "dev"
+
+// upstreamUserAgent returns the User-Agent sent upstream for a configured -user-agent value:
+// the value followed by the proxy's own product token.
+func upstreamUserAgent(userAgent string) string {
+	return userAgent + " ai-proxy/" + proxyVersion
+}
+
+const (
+	// originalPathContextKey holds the client's request path when the director rewrote it.
+	originalPathContextKey contextKey = "originalPath"
+	// scopeContextKey holds the scope of a proxied request, set by the director from the
+	// target host (and passed on to each upstream attempt by retryTransport).
+	scopeContextKey contextKey = "scope"
+)
+
+// requestScope returns the scope key for a proxied request: the upstream host plus the path
+// the client sent, before any prefix rewrite by the director. The scope recorded by the
+// director is used when present, so it never depends on the client-facing host.
+func requestScope(req *http.Request) string {
+	if scope, ok := req.Context().Value(scopeContextKey).(string); ok {
+		return scope
+	}
+	path := req.URL.Path
+	if original, ok := req.Context().Value(originalPathContextKey).(string); ok {
+		path = original
+	}
+	return buildScopeKey(req.URL.Host, path)
+}
+
+// normalizePathPrefix returns prefix with a leading slash and without a trailing slash.
+// An empty or "/" prefix becomes "".
+func normalizePathPrefix(prefix string) string {
+	prefix = strings.TrimRight(strings.TrimSpace(prefix), "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return prefix
+}
+
+// hasPathPrefix reports whether urlPath is prefix or lies under it, matching whole segments only,
+// so "/api" matches "/api" and "/api/x" but not "/apis".
+func hasPathPrefix(urlPath, prefix string) bool {
+	return urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/")
+}
+
+// rewritePathPrefix removes strip from the start of urlPath, then adds add unless the path
+// already starts with it. Both prefixes must be normalized (see normalizePathPrefix).
+func rewritePathPrefix(urlPath, strip, add string) string {
+	if strip != "" && hasPathPrefix(urlPath, strip) {
+		urlPath = strings.TrimPrefix(urlPath, strip)
+		if urlPath == "" {
+			urlPath = "/"
+		}
+	}
+	if add != "" && !hasPathPrefix(urlPath, add) {
+		if urlPath == "/" {
+			urlPath = add
+		} else {
+			urlPath = add + urlPath
+		}
+	}
+	return urlPath
+}
+
+// defaultStripRequestHeaders lists the request headers stripped by default: the
+// hop-by-hop headers from RFC 7230 plus Cookie, which the upstream API never needs.
+const defaultStripRequestHeaders = "Connection,Keep-Alive,Proxy-Authenticate,Proxy-Authorization,Proxy-Connection,Te,Trailer,Transfer-Encoding,Upgrade,Cookie"
+
 // createProxyDirector returns a function that modifies the request before forwarding.
 // With the retryTransport handling key selection and auth, this director is simplified.
 // It primarily ensures the default director logic (setting scheme, host, path) runs
-// and sets the Host header correctly.
-func createProxyDirector(targetURL *url.URL, originalDirector func(*http.Request)) func(*http.Request) {
+// and sets the Host header correctly. When forwardClientIP is true, the client's address
+// is passed upstream via the X-Forwarded-* headers; otherwise they are stripped.
+func createProxyDirector(targetURL *url.URL, originalDirector func(*http.Request), opts directorOptions) func(*http.Request) {
 	return func(req *http.Request) {
+		stripRequestHeaders(req, opts.stripHeaders)
+
+		// Capture the client-facing host before it is replaced with the target host.
+		clientHost := req.Host
+		override := req.Header.Get(targetOverrideHeader)
+		req.Header.Del(targetOverrideHeader) // Never forward the control header
+
+		// Rewrite the client path before the target path is joined onto it. The scope keeps
+		// the client's path, so the original is kept on the context (see requestScope).
+		if opts.stripPrefix != "" || opts.addPrefix != "" {
+			originalPath := req.URL.Path
+			req.URL.Path = rewritePathPrefix(req.URL.Path, opts.stripPrefix, opts.addPrefix)
+			if req.URL.RawPath != "" {
+				req.URL.RawPath = rewritePathPrefix(req.URL.RawPath, opts.stripPrefix, opts.addPrefix)
+			}
+			if req.URL.Path != originalPath {
+				logDebugf("Rewrote path %s to %s", originalPath, req.URL.Path)
+				*req = *req.WithContext(context.WithValue(req.Context(), originalPathContextKey, originalPath))
+			}
+		}
+
 		// Run the original director provided by NewSingleHostReverseProxy
 		// This sets req.URL.Scheme, req.URL.Host, and potentially req.URL.Path
 		originalDirector(req)
@@ -26,18 +150,246 @@ func createProxyDirector(targetURL *url.URL, originalDirector func(*http.Request
 		// Set the Host header to the target host. The retryTransport will handle auth.
 		req.Host = targetURL.Host
 
+		// Optionally redirect this request to another upstream. The scope is built from
+		// req.URL.Host below, so it follows the overridden host.
+		if override != "" {
+			if !opts.allowTargetOverride {
+				logWarnf("Ignoring %s header: target override is disabled", targetOverrideHeader)
+			} else if overrideURL, err := parseTargetOverride(override); err != nil {
+				logWarnf("Ignoring malformed %s header %q: %v", targetOverrideHeader, override, err)
+			} else {
+				logInfof("Overriding target for %s to %s://%s", req.URL.Path, overrideURL.Scheme, overrideURL.Host)
+				req.URL.Scheme = overrideURL.Scheme
+				req.URL.Host = overrideURL.Host
+				req.Host = overrideURL.Host
+			}
+		}
+
+		if opts.forwardClientIP {
+			// httputil.ReverseProxy appends the client IP (from RemoteAddr) to any existing
+			// X-Forwarded-For chain after the Director runs, so only Host/Proto are set here.
+			// Values set by a proxy in front of us are preserved.
+			if req.Header.Get("X-Forwarded-Host") == "" && clientHost != "" {
+				req.Header.Set("X-Forwarded-Host", clientHost)
+			}
+			if req.Header.Get("X-Forwarded-Proto") == "" {
+				proto := "http"
+				if req.TLS != nil {
+					proto = "https"
+				}
+				req.Header.Set("X-Forwarded-Proto", proto)
+			}
+		} else {
+			// A nil value tells httputil.ReverseProxy not to add X-Forwarded-For at all.
+			req.Header["X-Forwarded-For"] = nil
+			req.Header.Del("X-Forwarded-Host")
+			req.Header.Del("X-Forwarded-Proto")
+		}
+
+		// Present a single identity upstream instead of each client's own.
+		if opts.userAgent != "" {
+			req.Header.Set("User-Agent", upstreamUserAgent(opts.userAgent))
+		}
+
+		// Fix the scope now, from the upstream host (the target, or the override) and the
+		// client's path, so key state never follows the client-facing Host header.
+		*req = *req.WithContext(context.WithValue(req.Context(), scopeContextKey, requestScope(req)))
+
 		// No key selection or auth logic needed here anymore.
-		// No context modification needed here (retryTransport handles keyIndexContextKey).
 		// Logging of headers can be moved to retryTransport if needed per-attempt.
 	}
 }
 
+// stripRequestHeaders removes the named headers from a client request before it is forwarded.
+// Connection and Upgrade are kept on WebSocket upgrades, which httputil.ReverseProxy needs
+// to perform the handshake. Headers listed in Connection are removed along with it, since
+// httputil.ReverseProxy can no longer find them once Connection itself is gone.
+func stripRequestHeaders(req *http.Request, names []string) {
+	upgrade := isWebSocketUpgrade(req)
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+		if upgrade && (name == "Connection" || name == "Upgrade") {
+			continue
+		}
+		if name == "Connection" {
+			for _, value := range req.Header.Values("Connection") {
+				for _, listed := range strings.Split(value, ",") {
+					if listed = strings.TrimSpace(listed); listed != "" {
+						req.Header.Del(listed)
+					}
+				}
+			}
+		}
+		req.Header.Del(name)
+	}
+}
+
+// parseTargetOverride validates an X-Target-Override value. It must be an absolute
+// http(s) URL with a host; only the scheme and host are used.
+func parseTargetOverride(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("host is required")
+	}
+	return u, nil
+}
+
+// modifyResponseOptions configures createProxyModifyResponse.
+type modifyResponseOptions struct {
+	// Headers added to every proxied response (see parseResponseHeaders).
+	responseHeaders http.Header
+	// Add a Server-Timing header with the upstream and retry latency (see setServerTimingHeader).
+	serverTiming bool
+	// Maximum size of a non-streaming response body. Zero means unlimited.
+	maxResponseBytes int64
+	// Fraction (0.0-1.0) of responses whose request line, key index and status are logged at INFO.
+	logSampleRate float64
+	// Number of chunks of each streamed response to log at INFO (see chunkLoggingBody). Zero disables.
+	logStreamChunks int
+	// Report the index (never the value) of the key that served the response in keyIndexHeader.
+	exposeKeyIndex bool
+}
+
+// keyIndexHeader reports to the client which key served the response, with -expose-key-index.
+const keyIndexHeader = "X-Key-Index"
+
+// errResponseTooLarge is returned when an upstream response body exceeds -max-response-bytes.
+var errResponseTooLarge = errors.New("upstream response exceeds the maximum response size")
+
+// isStreamingResponse reports whether resp is a streamed response (server-sent events, or a
+// :streamGenerateContent call), whose size cannot be known up front and must not be capped.
+func isStreamingResponse(resp *http.Response) bool {
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return true
+	}
+	return resp.Request != nil && strings.HasSuffix(resp.Request.URL.Path, ":streamGenerateContent")
+}
+
+// maxBytesBody wraps a response body and fails with errResponseTooLarge once more than
+// the allowed number of bytes would be read, so at most that many reach the client.
+type maxBytesBody struct {
+	io.ReadCloser
+	remaining int64
+	path      string
+}
+
+// Read reads up to the remaining allowance, then probes for extra data to detect an oversized body.
+func (b *maxBytesBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		var probe [1]byte
+		n, err := b.ReadCloser.Read(probe[:])
+		if n > 0 {
+			logErrorf("Response body for %s exceeded the maximum response size; truncating.", b.path)
+			return 0, errResponseTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// streamChunkLogLimit is the maximum number of bytes of each stream chunk that is logged.
+const streamChunkLogLimit = 200
+
+// chunkLoggingBody logs the first chunks read from a streamed response body as they pass
+// through to the client. Nothing is buffered; each read is logged once, then forwarded.
+type chunkLoggingBody struct {
+	io.ReadCloser
+	remaining int
+	chunk     int
+	path      string
+	// Content-Encoding of the body; encoded chunks are logged as a byte count only.
+	encoding string
+}
+
+// Read reads from the wrapped body and logs the data read while chunks remain to be logged.
+func (b *chunkLoggingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.remaining > 0 {
+		b.remaining--
+		b.chunk++
+		if b.encoding != "" {
+			logInfof("Stream chunk %d for %s: <%d bytes of %s-encoded data>", b.chunk, b.path, n, b.encoding)
+		} else {
+			sample := p[:n]
+			suffix := ""
+			if len(sample) > streamChunkLogLimit {
+				sample = sample[:streamChunkLogLimit]
+				suffix = "... (truncated)"
+			}
+			logInfof("Stream chunk %d for %s (%d bytes): %q%s", b.chunk, b.path, n, sample, suffix)
+		}
+	}
+	return n, err
+}
+
+// limitResponseBody enforces maxBytes on a non-streaming response. A body whose declared
+// Content-Length is over the limit is rejected outright, so the error handler can respond 502;
+// a body of unknown length is cut off once it exceeds the limit.
+func limitResponseBody(resp *http.Response, maxBytes int64) error {
+	if maxBytes <= 0 || resp.Body == nil || resp.Body == http.NoBody || isStreamingResponse(resp) {
+		return nil
+	}
+	if resp.ContentLength > maxBytes {
+		logErrorf("Response for %s is %d bytes, over the maximum of %d.", resp.Request.URL.Path, resp.ContentLength, maxBytes)
+		return &proxyErrorWithStatus{
+			error:      fmt.Errorf("%w (%d > %d bytes)", errResponseTooLarge, resp.ContentLength, maxBytes),
+			StatusCode: http.StatusBadGateway,
+		}
+	}
+	resp.Body = &maxBytesBody{ReadCloser: resp.Body, remaining: maxBytes, path: resp.Request.URL.Path}
+	return nil
+}
+
 // createProxyModifyResponse returns a function that modifies the response from the target.
 // It checks for specific status codes and marks the used key as failed if necessary.
 // This is still useful for handling non-retryable errors (like 400 Bad Request)
 // or logging the final outcome. The retryTransport handles marking keys for retryable errors (like 429).
-func createProxyModifyResponse(keyMan *keyManager) func(*http.Response) error {
+func createProxyModifyResponse(keyMan *keyManager, opts modifyResponseOptions) func(*http.Response) error {
 	return func(resp *http.Response) error {
+		// Switching Protocols: the body is the live upgraded connection (e.g. a WebSocket),
+		// so it must not be read or logged.
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			logInfof("Connection upgraded to %q for %s", resp.Header.Get("Upgrade"), resp.Request.URL.Path)
+			return nil
+		}
+
+		if err := limitResponseBody(resp, opts.maxResponseBytes); err != nil {
+			return err
+		}
+		if opts.logStreamChunks > 0 && resp.Body != nil && resp.Body != http.NoBody && isStreamingResponse(resp) {
+			resp.Body = &chunkLoggingBody{
+				ReadCloser: resp.Body,
+				remaining:  opts.logStreamChunks,
+				path:       resp.Request.URL.Path,
+				encoding:   resp.Header.Get("Content-Encoding"),
+			}
+		}
+
+		if sampleRequest(opts.logSampleRate) {
+			logSampledResponse(resp)
+		}
+
+		setAttemptsHeader(resp.Header, resp.Request.Context())
+		if opts.serverTiming {
+			setServerTimingHeader(resp.Header, resp.Request.Context())
+		}
+
+		// Inject configured headers. Only headers are touched, so streaming bodies are unaffected.
+		for name, values := range opts.responseHeaders {
+			resp.Header[name] = append([]string(nil), values...)
+		}
+
 		// Get the key index used in the *last* attempt from the context set by retryTransport.
 		keyIndexVal := resp.Request.Context().Value(keyIndexContextKey)
 		keyIndex, keyIndexOk := keyIndexVal.(int)
@@ -45,33 +397,40 @@ func createProxyModifyResponse(keyMan *keyManager) func(*http.Response) error {
 		if !keyIndexOk {
 			// This might happen if the request failed before the transport even ran (e.g., context canceled)
 			// or if the transport failed to get a key initially.
-			log.Println("Warning: No key index found in request context for ModifyResponse.")
+			logWarnf("No key index found in request context for ModifyResponse.")
 			// Log non-2xx status even if key index is missing
 			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-				log.Printf("Received non-2xx status: %d (Key Index Unknown, Scope Unknown)", resp.StatusCode)
+				logWarnf("Received non-2xx status: %d (Key Index Unknown, Scope Unknown)", resp.StatusCode)
 				// Log body without key context
 				logResponseBody(resp)
 			}
 			return nil // Return early as there's no key index to process further
 		}
 
-		// Build scope key from the original request URL in the response context
-		// Note: Use resp.Request.URL, not the original request's URL, as the host/path might have been modified.
-		// However, the director we use doesn't modify the path, and retryTransport uses the *original* req for scope.
-		// For consistency, let's build the scope the same way retryTransport does.
-		scope := buildScopeKey(resp.Request.URL.Host, resp.Request.URL.Path)
+		if opts.exposeKeyIndex {
+			resp.Header.Set(keyIndexHeader, strconv.Itoa(keyIndex))
+		}
+
+		// Per-key targets change the attempt's host, so use the scope the request was tracked under.
+		scope := requestScope(resp.Request)
 
 		// Log response body for non-2xx status codes, now with key index and scope context
 		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-			log.Printf("Scope '%s': Request using key index %d (last attempt) received non-2xx status: %d", scope, keyIndex, resp.StatusCode)
-			logResponseBody(resp) // Use helper to read/restore body
+			logWarnf("Scope '%s': Request using key index %d (last attempt) received non-2xx status: %d", scopeForLog(scope), keyIndex, resp.StatusCode)
+			body := logResponseBody(resp) // Use helper to read/restore body
+			keyMan.recordScopeError(scope, resp.StatusCode, body)
 
 			// Mark key as failed for non-retryable client errors (4xx) that weren't handled by transport.
 			// Transport handles 429. This handles things like 400, 401, 403 etc.
 			// Avoid marking for 5xx here, as transport might retry those, and they aren't key-specific.
 			if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
-				log.Printf("Scope '%s': Marking key index %d as failing due to non-retryable client error status %d.", scope, keyIndex, resp.StatusCode)
-				keyMan.markKeyFailed(scope, keyIndex) // Use scope here
+				logWarnf("Scope '%s': Marking key index %d as failing due to non-retryable client error status %d.", scopeForLog(scope), keyIndex, resp.StatusCode)
+				reason := fmt.Sprintf("status %d", resp.StatusCode)
+				if key, ok := resp.Request.Context().Value(apiKeyContextKey).(string); ok {
+					keyMan.markKeyFailedIfCurrent(scope, keyIndex, key, reason)
+				} else {
+					keyMan.markKeyFailed(scope, keyIndex, reason)
+				}
 			}
 		}
 
@@ -79,104 +438,614 @@ func createProxyModifyResponse(keyMan *keyManager) func(*http.Response) error {
 	}
 }
 
+// sampleRequest reports whether a request should be logged under -log-sample-rate.
+// Rates of 0 or 1 are decided without drawing a random number.
+func sampleRequest(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	return rate >= 1 || rand.Float64() < rate
+}
+
+// logSampledResponse logs the request line, the key index of the last attempt, and the
+// response status at INFO. The key index is -1 when the transport did not record one.
+func logSampledResponse(resp *http.Response) {
+	ctx := resp.Request.Context()
+	keyIndex, ok := ctx.Value(keyIndexContextKey).(int)
+	if !ok {
+		keyIndex = -1
+	}
+	scope := requestScope(resp.Request)
+	logInfof("Sampled: %s %s (scope '%s') key index %d -> status %d", resp.Request.Method, resp.Request.URL.Path, scopeForLog(scope), keyIndex, resp.StatusCode)
+}
+
+// parseResponseHeaders parses the headers injected into every response: either a JSON object
+// of names to values, for values containing commas (e.g. {"Cache-Control":"no-cache, no-store"}),
+// or a comma-separated list of Name:Value pairs. CORS headers are skipped because
+// createMainHandler already sets them and duplicates would break browser clients.
+func parseResponseHeaders(raw string) (http.Header, error) {
+	var pairs [][2]string
+	if trimmed := strings.TrimSpace(raw); strings.HasPrefix(trimmed, "{") {
+		var obj map[string]string
+		if err := json.Unmarshal([]byte(trimmed), &obj); err != nil {
+			return nil, fmt.Errorf("invalid response headers JSON: %w", err)
+		}
+		for name, value := range obj {
+			pairs = append(pairs, [2]string{name, value})
+		}
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+	} else {
+		for _, pair := range splitCommaList(raw) {
+			name, value, found := strings.Cut(pair, ":")
+			if !found {
+				return nil, fmt.Errorf("invalid response header %q: expected Name:Value", pair)
+			}
+			pairs = append(pairs, [2]string{name, value})
+		}
+	}
+
+	headers := make(http.Header)
+	for _, pair := range pairs {
+		name := strings.TrimSpace(pair[0])
+		if name == "" {
+			return nil, fmt.Errorf("invalid response header %q: empty name", pair[0]+":"+pair[1])
+		}
+		if strings.HasPrefix(strings.ToLower(name), "access-control-") {
+			logWarnf("Ignoring response header %q; CORS headers are managed by the proxy.", name)
+			continue
+		}
+		headers.Add(name, strings.TrimSpace(pair[1]))
+	}
+	return headers, nil
+}
+
+// disableBodyLogging stops logResponseBody from reading or logging response bodies. Set once at startup.
+var disableBodyLogging bool
+
 // logResponseBody reads, logs, and restores the response body. Used for error logging.
-func logResponseBody(resp *http.Response) {
+// Returns the logged (decoded, truncated) body text. When disableBodyLogging is set the body
+// is left untouched and only the status is logged.
+func logResponseBody(resp *http.Response) string {
+	if disableBodyLogging {
+		logWarnf("Non-2xx Response (Status %d); body logging is disabled.", resp.StatusCode)
+		return ""
+	}
 	if resp.Body == nil || resp.Body == http.NoBody {
-		log.Printf("Non-2xx Response (Status %d) had no body.", resp.StatusCode)
-		return
+		logInfof("Non-2xx Response (Status %d) had no body.", resp.StatusCode)
+		return ""
 	}
 	bodyBytes, err := io.ReadAll(resp.Body)
 	resp.Body.Close() // Close original body reader
 	if err != nil {
-		log.Printf("Error reading non-2xx response body (Status %d): %v", resp.StatusCode, err)
+		logErrorf("Error reading non-2xx response body (Status %d): %v", resp.StatusCode, err)
 		// Restore empty body if read fails
 		resp.Body = io.NopCloser(bytes.NewBuffer(nil))
-	} else {
-		// Limit logged body size to avoid flooding logs
-		logLimit := 512
-		bodyString := string(bodyBytes)
-		if len(bodyString) > logLimit {
-			bodyString = bodyString[:logLimit] + "... (truncated)"
+		return ""
+	}
+	// Limit logged body size to avoid flooding logs
+	logLimit := 512
+	bodyString := string(bodyBytes)
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+		decoded, decodeErr := decodeBodyForLog(encoding, bodyBytes, logLimit)
+		if decodeErr != nil {
+			if !errors.Is(decodeErr, errBrotliUnsupported) {
+				logWarnf("Could not decode %s-encoded response body for logging: %v", encoding, decodeErr)
+			}
+			bodyString = fmt.Sprintf("<%d bytes of %s-encoded data>", len(bodyBytes), encoding)
+		} else {
+			bodyString = decoded
 		}
-		log.Printf("Non-2xx Response Body (Status %d): %s", resp.StatusCode, bodyString)
-		// Restore the body so the client can read it
-		resp.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 	}
+	if len(bodyString) > logLimit {
+		bodyString = bodyString[:logLimit] + "... (truncated)"
+	}
+	logWarnf("Non-2xx Response Body (Status %d): %s", resp.StatusCode, bodyString)
+	// Restore the body so the client can read it (still encoded, exactly as the upstream sent it)
+	resp.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+	return bodyString
+}
+
+// errBrotliUnsupported is returned by decodeBodyForLog for Brotli bodies: the standard library
+// has no Brotli decoder, so they are logged as a byte count only.
+var errBrotliUnsupported = errors.New("brotli decoding is not supported")
+
+// decodeBodyForLog decodes a Content-Encoding'd response body for logging only.
+// At most limit+1 decoded bytes are read so a small compressed body cannot expand without bound.
+func decodeBodyForLog(encoding string, bodyBytes []byte, limit int) (string, error) {
+	var reader io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(bodyBytes))
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		reader = gz
+	case "deflate":
+		// HTTP "deflate" is zlib-wrapped per the RFC, but some servers send raw deflate.
+		if zr, err := zlib.NewReader(bytes.NewReader(bodyBytes)); err == nil {
+			defer zr.Close()
+			reader = zr
+		} else {
+			fr := flate.NewReader(bytes.NewReader(bodyBytes))
+			defer fr.Close()
+			reader = fr
+		}
+	case "br":
+		return "", errBrotliUnsupported
+	case "identity":
+		return string(bodyBytes), nil
+	default:
+		return "", fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
 }
 
 // createProxyErrorHandler returns a function that handles terminal errors during proxying,
 // typically errors returned by the custom transport after exhausting retries.
-func createProxyErrorHandler() func(http.ResponseWriter, *http.Request, error) {
+// The error is recorded as the scope's last error in keyMan, if non-nil. When no keys are
+// available, a matching fallback (see parseFallbackResponses) is served instead of the error.
+func createProxyErrorHandler(keyMan *keyManager, fallbacks []fallbackResponse) func(http.ResponseWriter, *http.Request, error) {
 	return func(rw http.ResponseWriter, req *http.Request, err error) {
-		log.Printf("Proxy ErrorHandler triggered after transport/retries: %v", err)
+		logErrorf("Proxy ErrorHandler triggered after transport/retries: %v", err)
 
 		// Log key index and scope if available
-		scope := buildScopeKey(req.URL.Host, req.URL.Path)
+		scope := requestScope(req)
+		if keyMan != nil {
+			// Status 0 means no upstream response (e.g. a connection or DNS error).
+			lastStatus := 0
+			var statusErr *proxyErrorWithStatus
+			if errors.As(err, &statusErr) {
+				lastStatus = statusErr.StatusCode
+			}
+			keyMan.recordScopeError(scope, lastStatus, err.Error())
+		}
 		keyIndexVal := req.Context().Value(keyIndexContextKey)
 		if keyIndex, ok := keyIndexVal.(int); ok {
-			log.Printf("-> Scope '%s': Last attempt used key index %d", scope, keyIndex)
+			logInfof("-> Scope '%s': Last attempt used key index %d", scopeForLog(scope), keyIndex)
 		} else {
-			log.Printf("-> Scope '%s': Key index for last attempt not found in context.", scope)
+			logInfof("-> Scope '%s': Key index for last attempt not found in context.", scopeForLog(scope))
+		}
+
+		setAttemptsHeader(rw.Header(), req.Context())
+		if errors.Is(err, errNoKeysAvailable) {
+			rw.Header().Set(noKeysAvailableHeader, "true")
+			clientPath := req.URL.Path
+			if original, ok := req.Context().Value(originalPathContextKey).(string); ok {
+				clientPath = original
+			}
+			if fb := findFallbackResponse(clientPath, fallbacks); fb != nil {
+				logInfof("--> Scope '%s': No keys available, serving fallback response with status %d", scopeForLog(scope), fb.Status)
+				fb.serve(rw)
+				return
+			}
 		}
 
 		// Check for specific error types to determine the response status code.
 		var proxyErrWithStatus *proxyErrorWithStatus
+		var dnsErr *net.DNSError
 		if errors.As(err, &proxyErrWithStatus) {
 			// Use the status code from the error returned by the transport
-			log.Printf("--> Scope '%s': Responding to client with upstream status: %d", scope, proxyErrWithStatus.StatusCode)
+			logInfof("--> Scope '%s': Responding to client with upstream status: %d", scopeForLog(scope), proxyErrWithStatus.StatusCode)
+			if proxyErrWithStatus.RetryAfter != "" {
+				rw.Header().Set("Retry-After", proxyErrWithStatus.RetryAfter)
+			}
 			http.Error(rw, err.Error(), proxyErrWithStatus.StatusCode)
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			// Client-supplied (or server) deadline expired, possibly mid-retry
+			logInfof("--> Scope '%s': Responding to client with status: %d (Deadline Exceeded)", scopeForLog(scope), http.StatusGatewayTimeout)
+			http.Error(rw, "Proxy Error: Deadline exceeded before upstream responded", http.StatusGatewayTimeout)
 		} else if errors.Is(err, context.Canceled) {
 			// Client closed the connection
-			log.Printf("--> Scope '%s': Responding to client with status: %d (Context Canceled)", scope, http.StatusRequestTimeout)
+			logInfof("--> Scope '%s': Responding to client with status: %d (Context Canceled)", scopeForLog(scope), http.StatusRequestTimeout)
 			http.Error(rw, "Client connection closed", http.StatusRequestTimeout) // 499 Client Closed Request is common
+		} else if errors.As(err, &dnsErr) {
+			// The target (or a per-key endpoint) could not be resolved; usually a misconfigured -target.
+			logErrorf("--> Scope '%s': Upstream host %q not found (DNS: %v). Check -target and per-key endpoints.", scopeForLog(scope), dnsErr.Name, dnsErr.Err)
+			logInfof("--> Scope '%s': Responding to client with status: %d (Upstream Host Not Found)", scopeForLog(scope), http.StatusBadGateway)
+			http.Error(rw, fmt.Sprintf("Proxy Error: upstream host not found: %s", dnsErr.Name), http.StatusBadGateway)
 		} else {
-			// Generic transport error (connection refused, DNS error, etc.)
-			log.Printf("--> Scope '%s': Responding to client with status: %d (Bad Gateway)", scope, http.StatusBadGateway)
+			// Generic transport error (connection refused, etc.)
+			logInfof("--> Scope '%s': Responding to client with status: %d (Bad Gateway)", scopeForLog(scope), http.StatusBadGateway)
 			// Use the message expected by the test for generic upstream failures
 			http.Error(rw, "Proxy Error: Upstream server failed after retries", http.StatusBadGateway) // 502
 		}
 	}
 }
 
-// Compile the regex for matching Gemini model paths once
-var geminiPathRegex = regexp.MustCompile(`^/v1beta/models/gemini-.*`)
+// createHealthHandler returns a handler for the /healthz liveness endpoint.
+// It is served locally and never forwarded to the upstream. When degradeOnLowKeys is set,
+// it responds 503 while any scope is below the key manager's minimum available keys.
+func createHealthHandler(keyMan *keyManager, degradeOnLowKeys bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if degradeOnLowKeys && keyMan != nil {
+			if below := keyMan.scopesBelowMinAvailable(); len(below) > 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintf(w, "degraded: %d scope(s) below %d available keys: %s\n", len(below), keyMan.minAvailableKeys, strings.Join(below, ", "))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "ok\n")
+	}
+}
+
+// proxyTimeoutHeader lets clients cap how long the proxy spends on a request, retries included.
+const proxyTimeoutHeader = "X-Proxy-Timeout"
+
+// createClientTimeoutHandler returns a handler that applies a client-supplied timeout
+// (X-Proxy-Timeout, a Go duration such as "5s") as a deadline on the request context,
+// capped at maxTimeout. The retryTransport stops retrying once the deadline expires and
+// the error handler responds with 504. The header is not forwarded upstream.
+func createClientTimeoutHandler(next http.Handler, maxTimeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := r.Header.Get(proxyTimeoutHeader)
+		if raw == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Header.Del(proxyTimeoutHeader)
+
+		timeout, err := time.ParseDuration(raw)
+		if err != nil || timeout <= 0 {
+			logWarnf("Rejecting request with invalid %s header %q", proxyTimeoutHeader, raw)
+			http.Error(w, fmt.Sprintf("Invalid %s header: must be a positive duration like 5s", proxyTimeoutHeader), http.StatusBadRequest)
+			return
+		}
+		if maxTimeout > 0 && timeout > maxTimeout {
+			logInfof("Capping client %s of %s to server maximum %s", proxyTimeoutHeader, timeout, maxTimeout)
+			timeout = maxTimeout
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// defaultGeminiPathPattern matches Gemini model paths on both the stable v1 and the v1beta API.
+const defaultGeminiPathPattern = `^/v1(beta)?/models/gemini-.*`
+
+// geminiPathRegex selects the paths whose POST bodies are eligible for modification.
+// Compiled once; main replaces it when -gemini-path-regex is set.
+var geminiPathRegex = regexp.MustCompile(defaultGeminiPathPattern)
+
+// disableToolInjectionHeader ("true") skips all body modification for a request when -allow-injection-override is set.
+const disableToolInjectionHeader = "X-Disable-Tool-Injection"
+
+// defaultToolMethods lists the Gemini model methods whose bodies get tool injection by default.
+// Methods such as :countTokens, :embedContent and :batchEmbedContents reject a tools field.
+const defaultToolMethods = "generateContent,streamGenerateContent"
+
+// mainHandlerOptions configures createMainHandler. The zero value modifies no bodies and
+// uses the default tool methods.
+type mainHandlerOptions struct {
+	bodyModifierOptions
+	// Gemini model methods (the suffix after ':' in the path) eligible for body modification.
+	// Empty means the defaults (see isToolInjectionPath).
+	toolMethods []string
+	// Model name patterns (path.Match syntax) allowed to receive google_search. Empty allows all models.
+	searchModels []string
+	// Reject malformed JSON bodies on eligible paths with 400 instead of forwarding them.
+	strictJSON bool
+	// Honor disableToolInjectionHeader, letting clients opt a request out of body modification.
+	allowInjectionOverride bool
+	// Query parameter (e.g. "force_search") that, when true, forces google_search injection for
+	// the request as if the search trigger had been found. It is stripped before forwarding.
+	// Empty disables it.
+	forceSearchParam string
+	// Forward TRACE requests upstream instead of rejecting them with 405.
+	allowTrace bool
+	// Path access control (see parsePathRules): denied paths get 403; when allowPaths is
+	// non-empty, paths matching none of its rules get 404.
+	allowPaths []pathRule
+	denyPaths  []pathRule
+	// With -restrict-paths, the known upstream API paths (see defaultKnownPaths); requests for
+	// any other path get 404 without using a key. Empty forwards every path.
+	knownPaths []pathRule
+	// How long browsers may cache preflight results (Access-Control-Max-Age). Zero omits the header.
+	corsMaxAge time.Duration
+	// Response headers browsers may expose to scripts (Access-Control-Expose-Headers).
+	corsExposeHeaders []string
+	// Methods and request headers allowed on cross-origin requests (Access-Control-Allow-Methods
+	// and -Headers). Empty uses defaultCORSAllowMethods and defaultCORSAllowHeaders.
+	corsAllowMethods []string
+	corsAllowHeaders []string
+}
+
+// Default CORS allow lists, used when -cors-allow-methods or -cors-allow-headers is empty.
+const (
+	defaultCORSAllowMethods = "GET, POST, PUT, DELETE, OPTIONS, PATCH"
+	defaultCORSAllowHeaders = "Content-Type, Authorization, X-Requested-With"
+)
+
+// corsAllowList joins a configured CORS allow list, or returns fallback when none is configured.
+func corsAllowList(values []string, fallback string) string {
+	if len(values) == 0 {
+		return fallback
+	}
+	return strings.Join(values, ", ")
+}
+
+// corsHeaderValues builds the CORS headers set on every response once, so the handler can assign
+// them without joining lists or allocating a value slice per header per request. Each value
+// slice has len == cap, so an Add on the response header copies instead of writing into it.
+func corsHeaderValues(opts mainHandlerOptions) http.Header {
+	headers := http.Header{
+		"Access-Control-Allow-Origin":  {"*"},
+		"Access-Control-Allow-Methods": {corsAllowList(opts.corsAllowMethods, defaultCORSAllowMethods)},
+		"Access-Control-Allow-Headers": {corsAllowList(opts.corsAllowHeaders, defaultCORSAllowHeaders)},
+	}
+	if len(opts.corsExposeHeaders) > 0 {
+		headers["Access-Control-Expose-Headers"] = []string{strings.Join(opts.corsExposeHeaders, ", ")}
+	}
+	return headers
+}
+
+// defaultToolMethodList is defaultToolMethods, split once.
+var defaultToolMethodList = splitCommaList(defaultToolMethods)
+
+// isToolInjectionPath reports whether path is a Gemini model path whose method suffix
+// (e.g. "generateContent" in "/v1beta/models/gemini-pro:generateContent") is in methods.
+// Empty methods means -tool-methods is not set: the default methods are used, and paths
+// without a method suffix stay eligible as they were before the flag existed.
+func isToolInjectionPath(path string, methods []string) bool {
+	if !geminiPathRegex.MatchString(path) {
+		return false
+	}
+	idx := strings.LastIndex(path, ":")
+	if idx < 0 {
+		return len(methods) == 0
+	}
+	if len(methods) == 0 {
+		methods = defaultToolMethodList
+	}
+	method := path[idx+1:]
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultKnownPaths matches the paths of the Gemini API (including uploads and the
+// OpenAI-compatible endpoints), for -restrict-paths.
+const defaultKnownPaths = `^/(upload/)?v1(alpha|beta)?/(models|tunedModels|files|cachedContents|corpora|batches|operations|generatedFiles|openai)(/|$)`
+
+// pathRule matches request paths by prefix or, for entries starting with '^', by regular expression.
+type pathRule struct {
+	prefix string
+	re     *regexp.Regexp
+}
+
+// matches reports whether urlPath matches the rule.
+func (r pathRule) matches(urlPath string) bool {
+	if r.re != nil {
+		return r.re.MatchString(urlPath)
+	}
+	return strings.HasPrefix(urlPath, r.prefix)
+}
+
+// parsePathRules parses a comma-separated list of path prefixes and '^'-anchored regular expressions.
+func parsePathRules(raw string) ([]pathRule, error) {
+	var rules []pathRule
+	for _, entry := range splitCommaList(raw) {
+		if !strings.HasPrefix(entry, "^") {
+			rules = append(rules, pathRule{prefix: entry})
+			continue
+		}
+		re, err := regexp.Compile(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path pattern %q: %w", entry, err)
+		}
+		rules = append(rules, pathRule{re: re})
+	}
+	return rules, nil
+}
+
+// matchesAnyPathRule reports whether urlPath matches one of rules.
+func matchesAnyPathRule(urlPath string, rules []pathRule) bool {
+	for _, rule := range rules {
+		if rule.matches(urlPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// modelFromPath extracts the model name from a Gemini model path,
+// e.g. "gemini-pro" from "/v1beta/models/gemini-pro:generateContent".
+func modelFromPath(urlPath string) string {
+	idx := strings.Index(urlPath, "/models/")
+	if idx < 0 {
+		return ""
+	}
+	model := urlPath[idx+len("/models/"):]
+	if end := strings.IndexAny(model, ":/"); end >= 0 {
+		model = model[:end]
+	}
+	return model
+}
+
+// parseSearchModels validates a comma-separated -search-models list of path.Match patterns.
+func parseSearchModels(raw string) ([]string, error) {
+	patterns := splitCommaList(raw)
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid model pattern %q: %w", pattern, err)
+		}
+	}
+	return patterns, nil
+}
+
+// searchModelAllowed reports whether model matches one of patterns. An empty list allows every model.
+func searchModelAllowed(model string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, model); ok {
+			return true
+		}
+	}
+	return false
+}
 
 // createMainHandler returns the main HTTP handler function.
 // It logs requests, handles CORS, optionally modifies POST bodies for specific paths, and forwards requests to the proxy.
-func createMainHandler(proxy *httputil.ReverseProxy, addGoogleSearch bool, searchTrigger string) http.HandlerFunc {
+func createMainHandler(proxy *httputil.ReverseProxy, opts mainHandlerOptions) http.HandlerFunc {
+	corsHeaders := corsHeaderValues(opts)
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Received request: %s %s%s", r.Method, r.Host, r.URL.RequestURI())
+		if logEnabled(levelInfo) {
+			logInfof("Received request: %s %s%s", r.Method, r.Host, r.URL.RequestURI())
+		}
 
 		// Handle CORS headers first
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS, PATCH")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
+		header := w.Header()
+		for name, values := range corsHeaders {
+			header[name] = values
+		}
+
+		// Path access control. /healthz and -metrics-path are served by the mux and never get here.
+		if matchesAnyPathRule(r.URL.Path, opts.denyPaths) {
+			logWarnf("Rejecting request for denied path %s from %s", r.URL.Path, clientIP(r))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if len(opts.allowPaths) > 0 && !matchesAnyPathRule(r.URL.Path, opts.allowPaths) {
+			logWarnf("Rejecting request for path %s from %s: not in the allowed paths", r.URL.Path, clientIP(r))
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		if len(opts.knownPaths) > 0 && !matchesAnyPathRule(r.URL.Path, opts.knownPaths) {
+			logInfof("Rejecting request for unknown upstream path %s from %s", r.URL.Path, clientIP(r))
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+
+		// TRACE echoes the request back, including headers such as the injected key, so it is
+		// only forwarded when explicitly allowed.
+		if r.Method == http.MethodTrace && !opts.allowTrace {
+			logWarnf("Rejecting TRACE request for %s from %s", r.URL.Path, clientIP(r))
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
 		if r.Method == http.MethodOptions {
+			if opts.corsMaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(opts.corsMaxAge.Seconds())))
+			}
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 
+		// Per-request search forcing. The parameter is never forwarded.
+		forceSearch := false
+		if opts.forceSearchParam != "" {
+			// Only parse the query when the parameter can be in it; most requests never carry it.
+			query := url.Values(nil)
+			if strings.Contains(r.URL.RawQuery, opts.forceSearchParam) {
+				query = r.URL.Query()
+			}
+			if query.Has(opts.forceSearchParam) {
+				forceSearch, _ = strconv.ParseBool(query.Get(opts.forceSearchParam))
+				query.Del(opts.forceSearchParam)
+				r.URL.RawQuery = query.Encode()
+			}
+		}
+
+		// WebSocket upgrades are passed straight through: no body modification, and the
+		// retryTransport injects the key as a query param.
+		if isWebSocketUpgrade(r) {
+			logInfof("WebSocket upgrade request for %s, passing through without body modification.", r.URL.Path)
+			proxy.ServeHTTP(w, r)
+			return
+		}
+
+		// Per-request opt-out of body modification (A/B testing). The header is never forwarded.
+		skipModification := false
+		if raw := r.Header.Get(disableToolInjectionHeader); raw != "" {
+			r.Header.Del(disableToolInjectionHeader)
+			if disable, _ := strconv.ParseBool(raw); disable {
+				if opts.allowInjectionOverride {
+					skipModification = true
+				} else {
+					logWarnf("Ignoring %s header: injection override is disabled", disableToolInjectionHeader)
+				}
+			}
+		}
+
 		// Conditionally process POST request body for specific paths
-		if r.Method == http.MethodPost && r.Body != nil && geminiPathRegex.MatchString(r.URL.Path) {
-			log.Printf("Path %s matches Gemini pattern, processing POST body.", r.URL.Path)
-			modifiedBody, err := handlePostBody(r.Body, addGoogleSearch, searchTrigger)
+		if skipModification && r.Method == http.MethodPost {
+			logDebugf("%s set, forwarding POST body for %s unmodified.", disableToolInjectionHeader, r.URL.Path)
+		} else if r.Method == http.MethodPost && r.Body != nil && isToolInjectionPath(r.URL.Path, opts.toolMethods) {
+			logDebugf("Path %s matches Gemini pattern, processing POST body.", r.URL.Path)
+			bodyBytes, err := io.ReadAll(r.Body)
 			if err != nil {
-				log.Printf("Error processing request body for %s: %v", r.URL.Path, err)
-				http.Error(w, "Error processing request body", http.StatusInternalServerError)
+				logWarnf("Error reading request body for %s: %v", r.URL.Path, err)
+				http.Error(w, "Error reading request body", http.StatusBadRequest)
 				return
 			}
+			if len(bodyBytes) == 0 {
+				// Nothing to modify. Forwarded as a known empty body so it is sent with
+				// Content-Length: 0 rather than chunked.
+				if opts.strictJSON {
+					logWarnf("Rejecting empty JSON body for %s", r.URL.Path)
+					http.Error(w, "Invalid JSON request body: empty body", http.StatusBadRequest)
+					return
+				}
+				logDebugf("Empty POST body for %s, forwarding without modification.", r.URL.Path)
+				r.Body = http.NoBody
+				r.ContentLength = 0
+				r.Header.Set("Content-Length", "0")
+			} else {
+				if opts.strictJSON {
+					if err := validateJSONBody(bodyBytes); err != nil {
+						logWarnf("Rejecting malformed JSON body for %s: %v", r.URL.Path, err)
+						http.Error(w, fmt.Sprintf("Invalid JSON request body: %v", err), http.StatusBadRequest)
+						return
+					}
+				}
+				bodyOpts := opts.bodyModifierOptions
+				if forceSearch {
+					logDebugf("%s set, forcing google_search for %s.", opts.forceSearchParam, r.URL.Path)
+					bodyOpts.addGoogleSearch = true
+					bodyOpts.forceSearch = true
+				}
+				if bodyOpts.addGoogleSearch {
+					if model := modelFromPath(r.URL.Path); !searchModelAllowed(model, opts.searchModels) {
+						logDebugf("Model %q is not in -search-models, skipping google_search injection.", model)
+						bodyOpts.addGoogleSearch = false
+					}
+				}
+				modifiedBody, err := handlePostBody(io.NopCloser(bytes.NewReader(bodyBytes)), bodyOpts)
+				if err != nil {
+					logErrorf("Error processing request body for %s: %v", r.URL.Path, err)
+					http.Error(w, "Error processing request body", http.StatusInternalServerError)
+					return
+				}
 
-			// Update request with modified body only if it was processed
-			newBodyReader := bytes.NewReader(modifiedBody)
-			r.Body = io.NopCloser(newBodyReader)
-			r.ContentLength = int64(len(modifiedBody))
-			r.Header.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
-			log.Printf("Updated Content-Length to: %d for %s", r.ContentLength, r.URL.Path)
-		} else if r.Method == http.MethodPost && r.Body != nil {
-			log.Printf("Path %s does not match Gemini pattern, forwarding POST body unmodified.", r.URL.Path)
+				// Update request with modified body only if it was processed
+				newBodyReader := bytes.NewReader(modifiedBody)
+				r.Body = io.NopCloser(newBodyReader)
+				r.ContentLength = int64(len(modifiedBody))
+				r.Header.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+				logDebugf("Updated Content-Length to: %d for %s", r.ContentLength, r.URL.Path)
+			}
+		} else if r.Method == http.MethodPost && r.Body != nil && logEnabled(levelDebug) {
+			logDebugf("Path %s does not match Gemini pattern, forwarding POST body unmodified.", r.URL.Path)
 		}
 
+		// Track retries across the whole request lifetime (see retryTransport.retryBudget).
+		r = r.WithContext(withRetryTracker(r.Context()))
+
 		proxy.ServeHTTP(w, r)
 	}
 }
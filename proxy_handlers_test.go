@@ -1,19 +1,28 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/sha1"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"reflect" // Ensure reflect is imported for helpers
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -39,9 +48,9 @@ func assertNotNil(t *testing.T, val interface{}, msgAndArgs ...interface{}) {
 func TestCreateProxyModifyResponse_MarksKeyFailedOnNonRetryable4xx(t *testing.T) {
 	keys := []string{"key1", "key2"}
 	km, _ := newKeyManager(keys, 5*time.Minute)
-	modifier := createProxyModifyResponse(km)
+	modifier := createProxyModifyResponse(km, modifyResponseOptions{})
 
-	scope := "test.com|/v1/fail" // Example scope
+	scope := buildScopeKey("test.com", "/v1/fail") // Example scope
 	baseURL := "http://test.com/v1/fail"
 
 	// Simulate key 0 was used for a 400 Bad Request
@@ -63,11 +72,11 @@ func TestCreateProxyModifyResponse_MarksKeyFailedOnNonRetryable4xx(t *testing.T)
 	assertNoError(t, err)
 
 	// Check state for key 0 in the specific scope
-	km.mu.Lock()
+	km.lockAll()
 	state0 := getScopeState(t, km, scope) // Use helper to get state
 	_, isAvailable0 := state0.availableKeys[0]
 	_, isFailing0 := state0.failingKeys[0]
-	km.mu.Unlock()
+	km.unlockAll()
 
 	if isAvailable0 {
 		t.Errorf("Scope '%s': Expected key 0 to be removed from available keys for 400", scope)
@@ -90,11 +99,11 @@ func TestCreateProxyModifyResponse_MarksKeyFailedOnNonRetryable4xx(t *testing.T)
 	assertNoError(t, err)
 
 	// Check state for key 1 in the specific scope
-	km.mu.Lock()
+	km.lockAll()
 	state1 := getScopeState(t, km, scope) // Get state again
 	_, isAvailable1 := state1.availableKeys[1]
 	_, isFailing1 := state1.failingKeys[1]
-	km.mu.Unlock()
+	km.unlockAll()
 
 	if isAvailable1 {
 		t.Errorf("Scope '%s': Expected key 1 to be removed from available keys for 403", scope)
@@ -104,21 +113,21 @@ func TestCreateProxyModifyResponse_MarksKeyFailedOnNonRetryable4xx(t *testing.T)
 	}
 
 	// Check that both keys are now failing IN THIS SCOPE
-	km.mu.Lock()
+	km.lockAll()
 	finalState := getScopeState(t, km, scope)
 	assertInt(t, len(finalState.availableKeys), 0)
 	assertInt(t, len(finalState.failingKeys), 2)
-	km.mu.Unlock()
+	km.unlockAll()
 
 	// Check another scope remains unaffected
-	otherScope := "unaffected.com|/v1/ok"
+	otherScope := buildScopeKey("unaffected.com", "/v1/ok")
 	_, _, errOther := km.getNextKey(otherScope) // Access to create/check
 	assertNoError(t, errOther)
-	km.mu.Lock()
+	km.lockAll()
 	otherState := getScopeState(t, km, otherScope)
 	assertInt(t, len(otherState.availableKeys), 2) // Both keys should be available
 	assertInt(t, len(otherState.failingKeys), 0)
-	km.mu.Unlock()
+	km.unlockAll()
 
 	// Ensure response bodies are still readable after being logged
 	bodyBytes0, readErr0 := io.ReadAll(resp0.Body)
@@ -134,8 +143,8 @@ func TestCreateProxyModifyResponse_MarksKeyFailedOnNonRetryable4xx(t *testing.T)
 func TestCreateProxyModifyResponse_DoesNotMarkKeyFailedOnSuccessOrRetryable(t *testing.T) {
 	keys := []string{"key1"}
 	km, _ := newKeyManager(keys, 5*time.Minute)
-	modifier := createProxyModifyResponse(km)
-	scope := "test.com|/v1/ok" // Example scope
+	modifier := createProxyModifyResponse(km, modifyResponseOptions{})
+	scope := buildScopeKey("test.com", "/v1/ok") // Example scope
 	baseURL := "http://test.com/v1/ok"
 
 	// Test 200 OK
@@ -159,15 +168,15 @@ func TestCreateProxyModifyResponse_DoesNotMarkKeyFailedOnSuccessOrRetryable(t *t
 	// because getNextKey is called elsewhere (in transport).
 	// In this test, the scope *shouldn't* exist yet as we haven't called getNextKey
 	// for this specific scope before calling modifier(resp) for the 200 OK.
-	km.mu.Lock()
-	state, scopeExists := km.scopes[scope]
-	km.mu.Unlock()
+	km.lockAll()
+	state, scopeExists := km.lookupScope(scope)
+	km.unlockAll()
 
 	if scopeExists && state != nil {
-		km.mu.Lock() // Lock again to access state fields safely
+		km.lockAll() // Lock again to access state fields safely
 		_, isAvailable := state.availableKeys[0]
 		_, isFailing := state.failingKeys[0]
-		km.mu.Unlock()
+		km.unlockAll()
 		// If the scope somehow exists (it shouldn't at this point), the key should still be available and not failing
 		if !isAvailable {
 			t.Errorf("Scope '%s': Expected key 0 to still be available after 200", scope)
@@ -199,11 +208,11 @@ func TestCreateProxyModifyResponse_DoesNotMarkKeyFailedOnSuccessOrRetryable(t *t
 	}
 	err = modifier(resp500)
 	assertNoError(t, err)
-	km.mu.Lock()
+	km.lockAll()
 	state500 := getScopeState(t, km, scope) // Now we can safely get the state
 	_, isAvailable500 := state500.availableKeys[0]
 	_, isFailing500 := state500.failingKeys[0]
-	km.mu.Unlock()
+	km.unlockAll()
 	if !isAvailable500 {
 		t.Errorf("Scope '%s': Expected key 0 to still be available after 500", scope)
 	}
@@ -226,11 +235,11 @@ func TestCreateProxyModifyResponse_DoesNotMarkKeyFailedOnSuccessOrRetryable(t *t
 	}
 	err = modifier(resp429)
 	assertNoError(t, err)
-	km.mu.Lock()
+	km.lockAll()
 	state429 := getScopeState(t, km, scope) // Scope should exist from 500 test setup
 	_, isAvailable429 := state429.availableKeys[0]
 	_, isFailing429 := state429.failingKeys[0]
-	km.mu.Unlock()
+	km.unlockAll()
 	if !isAvailable429 {
 		t.Errorf("Scope '%s': Expected key 0 to still be available after 429 (handled by transport)", scope)
 	}
@@ -247,8 +256,8 @@ func TestCreateProxyModifyResponse_DoesNotMarkKeyFailedOnSuccessOrRetryable(t *t
 func TestCreateProxyModifyResponse_HandlesMissingKeyIndex(t *testing.T) {
 	keys := []string{"key1"}
 	km, _ := newKeyManager(keys, 5*time.Minute)
-	modifier := createProxyModifyResponse(km)
-	scope := "test.com|/v1/mising" // Example scope
+	modifier := createProxyModifyResponse(km, modifyResponseOptions{})
+	scope := buildScopeKey("test.com", "/v1/mising") // Example scope
 	baseURL := "http://test.com/v1/mising"
 
 	req := httptest.NewRequest("GET", baseURL, nil) // No key index in context
@@ -270,15 +279,15 @@ func TestCreateProxyModifyResponse_HandlesMissingKeyIndex(t *testing.T) {
 	assertNoError(t, err) // Should not return an error itself
 
 	// Check key 0 was NOT marked as failed (scope state shouldn't even exist unless created elsewhere)
-	km.mu.Lock()
-	_, scopeExists := km.scopes[scope]
-	km.mu.Unlock()
+	km.lockAll()
+	_, scopeExists := km.lookupScope(scope)
+	km.unlockAll()
 	if scopeExists {
 		// If the scope exists, check the key wasn't marked failed
-		km.mu.Lock()
+		km.lockAll()
 		state := getScopeState(t, km, scope)
 		_, isFailing := state.failingKeys[0]
-		km.mu.Unlock()
+		km.unlockAll()
 		if isFailing {
 			t.Errorf("Scope '%s': Expected key 0 not to be failing when index missing from context", scope)
 		}
@@ -286,7 +295,7 @@ func TestCreateProxyModifyResponse_HandlesMissingKeyIndex(t *testing.T) {
 
 	// Check log output for warning
 	logOutput := logBuf.String()
-	if !strings.Contains(logOutput, "Warning: No key index found in request context") {
+	if !strings.Contains(logOutput, "[WARN] No key index found in request context") {
 		t.Errorf("Expected log warning about missing key index, got: %s", logOutput)
 	}
 	// Check that the non-2xx logging happened without key index info
@@ -299,8 +308,8 @@ func TestCreateProxyModifyResponse_HandlesMissingKeyIndex(t *testing.T) {
 
 // Test the error handler when a generic error is passed
 func TestCreateProxyErrorHandler_HandlesGenericError(t *testing.T) {
-	handler := createProxyErrorHandler()
-	scope := "testerror.com|/v1/err"
+	handler := createProxyErrorHandler(nil, nil)
+	scope := buildScopeKey("testerror.com", "/v1/err")
 	baseURL := "http://testerror.com/v1/err"
 	req := httptest.NewRequest("GET", baseURL, nil)
 	parsedURL, _ := url.Parse(baseURL)
@@ -340,8 +349,8 @@ func TestCreateProxyErrorHandler_HandlesGenericError(t *testing.T) {
 
 // Test the error handler when the error includes status code (proxyErrorWithStatus)
 func TestCreateProxyErrorHandler_HandlesProxyErrorWithStatus(t *testing.T) {
-	handler := createProxyErrorHandler()
-	scope := "testerror.com|/v1/statuserr"
+	handler := createProxyErrorHandler(nil, nil)
+	scope := buildScopeKey("testerror.com", "/v1/statuserr")
 	baseURL := "http://testerror.com/v1/statuserr"
 	req := httptest.NewRequest("GET", baseURL, nil)
 	parsedURL, _ := url.Parse(baseURL)
@@ -377,8 +386,8 @@ func TestCreateProxyErrorHandler_HandlesProxyErrorWithStatus(t *testing.T) {
 
 // Test the error handler when the error is context.Canceled
 func TestCreateProxyErrorHandler_HandlesContextCanceled(t *testing.T) {
-	handler := createProxyErrorHandler()
-	scope := "testerror.com|/v1/cancel"
+	handler := createProxyErrorHandler(nil, nil)
+	scope := buildScopeKey("testerror.com", "/v1/cancel")
 	baseURL := "http://testerror.com/v1/cancel"
 	req := httptest.NewRequest("GET", baseURL, nil)
 	parsedURL, _ := url.Parse(baseURL)
@@ -426,14 +435,88 @@ func newTestProxy(targetServer *httptest.Server, keyMan *keyManager, keyParam st
 
 	// Setup simplified director
 	originalDirector := proxy.Director
-	proxy.Director = createProxyDirector(targetURL, originalDirector)
+	proxy.Director = createProxyDirector(targetURL, originalDirector, directorOptions{forwardClientIP: true})
 
 	// Setup other handlers
-	proxy.ModifyResponse = createProxyModifyResponse(keyMan)
-	proxy.ErrorHandler = createProxyErrorHandler()
+	proxy.ModifyResponse = createProxyModifyResponse(keyMan, modifyResponseOptions{})
+	proxy.ErrorHandler = createProxyErrorHandler(keyMan, nil)
 	return proxy
 }
 
+func TestCreateMainHandler_CORSHeadersNotSharedAcrossResponses(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An upstream CORS header is added to the proxy's own by the reverse proxy.
+		w.Header().Set("Access-Control-Allow-Origin", "https://upstream.example")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"corskey"}, 1*time.Minute)
+	mainHandler := createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{})
+	for range 2 {
+		rr := httptest.NewRecorder()
+		mainHandler(rr, httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil))
+		assertInt(t, rr.Code, http.StatusOK)
+		assertString(t, strings.Join(rr.Header().Values("Access-Control-Allow-Origin"), ","), "*,https://upstream.example")
+	}
+
+	preflight := httptest.NewRecorder()
+	mainHandler(preflight, httptest.NewRequest("OPTIONS", "http://localhost:8080/v1beta/models", nil))
+	assertString(t, strings.Join(preflight.Header().Values("Access-Control-Allow-Origin"), ","), "*")
+}
+
+// stubTransport answers every request with an empty 200 response, without any network I/O.
+type stubTransport struct{}
+
+// RoundTrip returns an empty 200 response for req.
+func (stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+}
+
+// benchmarkMainHandler measures the main handler forwarding requests built by newReq to a stub
+// upstream, with logs at level discarded.
+func benchmarkMainHandler(b *testing.B, level logLevel, newReq func() *http.Request) {
+	prevLevel, prevOutput := currentLogLevel(), log.Writer()
+	setMinLogLevel(level)
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() {
+		setMinLogLevel(prevLevel)
+		log.SetOutput(prevOutput)
+	})
+
+	proxy := &httputil.ReverseProxy{Director: func(*http.Request) {}, Transport: stubTransport{}}
+	mainHandler := createMainHandler(proxy, mainHandlerOptions{
+		bodyModifierOptions: bodyModifierOptions{addGoogleSearch: true, searchTrigger: "search", triggerMode: triggerReplace},
+		toolMethods:         splitCommaList(defaultToolMethods),
+		forceSearchParam:    "force_search",
+	})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		mainHandler(httptest.NewRecorder(), newReq())
+	}
+}
+
+func BenchmarkMainHandler_GET(b *testing.B) {
+	for _, level := range []logLevel{levelInfo, levelWarn} {
+		b.Run(logLevelNames[level], func(b *testing.B) {
+			benchmarkMainHandler(b, level, func() *http.Request {
+				return httptest.NewRequest("GET", "http://localhost:8080/v1beta/models?pageSize=10", nil)
+			})
+		})
+	}
+}
+
+func BenchmarkMainHandler_NonGeminiPOST(b *testing.B) {
+	for _, level := range []logLevel{levelInfo, levelWarn} {
+		b.Run(logLevelNames[level], func(b *testing.B) {
+			benchmarkMainHandler(b, level, func() *http.Request {
+				return httptest.NewRequest("POST", "http://localhost:8080/openai/chat/completions", strings.NewReader(`{"model":"m"}`))
+			})
+		})
+	}
+}
+
 func TestCreateMainHandler_CorsHeaders(t *testing.T) {
 	// Setup a dummy target server that checks the key
 	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -451,7 +534,7 @@ func TestCreateMainHandler_CorsHeaders(t *testing.T) {
 	keyParam := "key"
 	headerPaths := []string{"/openai/"} // Example header paths
 	proxy := newTestProxy(targetServer, km, keyParam, headerPaths)
-	mainHandler := createMainHandler(proxy, false, "") // addGoogleSearch=false
+	mainHandler := createMainHandler(proxy, mainHandlerOptions{}) // addGoogleSearch=false
 
 	// Test GET request (retryTransport should add key to query param)
 	reqGet := httptest.NewRequest("GET", "http://localhost:8080/some/path", nil)
@@ -506,7 +589,7 @@ func TestCreateMainHandler_PostRequestForwarding(t *testing.T) {
 	keyParam := "key"
 	headerPaths := []string{"/openai/"} // Path that should use header auth
 	proxy := newTestProxy(targetServer, km, keyParam, headerPaths)
-	mainHandler := createMainHandler(proxy, false, "") // addGoogleSearch=false
+	mainHandler := createMainHandler(proxy, mainHandlerOptions{}) // addGoogleSearch=false
 
 	postBody := `{"data": "value"}`
 
@@ -565,7 +648,7 @@ func TestCreateMainHandler_GeminiPathBodyModification(t *testing.T) {
 	headerPaths := []string{"/openai/"} // Gemini paths don't match this
 	proxy := newTestProxy(targetServer, km, keyParam, headerPaths)
 	// Enable google search addition
-	mainHandler := createMainHandler(proxy, true, "") // addGoogleSearch=true
+	mainHandler := createMainHandler(proxy, mainHandlerOptions{bodyModifierOptions: bodyModifierOptions{addGoogleSearch: true}}) // addGoogleSearch=true
 
 	// Test case 1: Simple JSON body, should have tools added
 	postBody1 := `{"contents": [{"parts":[{"text":"hello"}]}]}`
@@ -589,7 +672,7 @@ func TestCreateMainHandler_GeminiPathBodyModification(t *testing.T) {
 	req2 := httptest.NewRequest("POST", "http://localhost:8080/v1beta/models/gemini-1.5-flash:generateContent", strings.NewReader(postBody2))
 	req2.Header.Set("Content-Type", "application/json")
 	rr2 := httptest.NewRecorder()
-	searchHandler := createMainHandler(proxy, true, "search") // Add trigger word
+	searchHandler := createMainHandler(proxy, mainHandlerOptions{bodyModifierOptions: bodyModifierOptions{addGoogleSearch: true, searchTrigger: "search"}}) // Add trigger word
 	searchHandler(rr2, req2)
 
 	resp2 := rr2.Result()
@@ -601,7 +684,7 @@ func TestCreateMainHandler_GeminiPathBodyModification(t *testing.T) {
 	receivedBody, receivedApiKey, receivedAuthHeader, receivedContentType = "", "", "", "" // Reset
 
 	// Test case 3: Non-Gemini path, should NOT be modified
-	mainHandlerNoModify := createMainHandler(proxy, true, "") // Still true, but path won't match
+	mainHandlerNoModify := createMainHandler(proxy, mainHandlerOptions{bodyModifierOptions: bodyModifierOptions{addGoogleSearch: true}}) // Still true, but path won't match
 	postBody3 := `{"data": "value"}`
 	req3 := httptest.NewRequest("POST", "http://localhost:8080/other/api/v1/generate", strings.NewReader(postBody3))
 	req3.Header.Set("Content-Type", "application/json")
@@ -635,7 +718,7 @@ func TestCreateMainHandler_AddGoogleSearchFalse(t *testing.T) {
 	keyParam := "key"
 	headerPaths := []string{"/openai/"} // Example header paths
 	proxy := newTestProxy(targetServer, km, keyParam, headerPaths)
-	mainHandler := createMainHandler(proxy, false, "") // addGoogleSearch=false
+	mainHandler := createMainHandler(proxy, mainHandlerOptions{}) // addGoogleSearch=false
 
 	postBody := `{"contents": [{"parts":[{"text":"hello"}]}]}`
 	// Path matches Gemini pattern but not header path, should use query param
@@ -647,4 +730,1640 @@ func TestCreateMainHandler_AddGoogleSearchFalse(t *testing.T) {
 	resp := rr.Result()
 	assertInt(t, resp.StatusCode, http.StatusOK)
 	assertString(t, receivedBody, postBody) // Body should be unmodified
-}
\ No newline at end of file
+}
+
+func TestCreateMainHandler_ToolInjectionOnlyForEligibleMethods(t *testing.T) {
+	var receivedBody string
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, _ := io.ReadAll(r.Body)
+		receivedBody = string(bodyBytes)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"methodkey"}, 1*time.Minute)
+	proxy := newTestProxy(targetServer, km, "key", nil)
+	mainHandler := createMainHandler(proxy, mainHandlerOptions{bodyModifierOptions: bodyModifierOptions{addGoogleSearch: true}})
+
+	postBody := `{"contents": [{"parts":[{"text":"hello"}]}]}`
+	injectedBody := `{"contents":[{"parts":[{"text":"hello"}]}],"tools":[{"google_search":{}}]}`
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/v1beta/models/gemini-pro:generateContent", injectedBody},
+		{"/v1beta/models/gemini-pro:streamGenerateContent", injectedBody},
+		{"/v1/models/gemini-pro:generateContent", injectedBody},
+		{"/v1/models/gemini-pro:streamGenerateContent", injectedBody},
+		{"/v1beta/models/gemini-pro:countTokens", postBody},
+		{"/v1beta/models/gemini-embedding:embedContent", postBody},
+		{"/v1beta/models/gemini-embedding:batchEmbedContents", postBody},
+	}
+	for _, tt := range tests {
+		receivedBody = ""
+		req := httptest.NewRequest("POST", "http://localhost:8080"+tt.path, strings.NewReader(postBody))
+		rr := httptest.NewRecorder()
+		mainHandler(rr, req)
+
+		assertInt(t, rr.Code, http.StatusOK)
+		if receivedBody != tt.want {
+			t.Errorf("%s: upstream received %s, want %s", tt.path, receivedBody, tt.want)
+		}
+	}
+}
+
+func TestCreateMainHandler_SearchModelsAllowlist(t *testing.T) {
+	var receivedBody string
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, _ := io.ReadAll(r.Body)
+		receivedBody = string(bodyBytes)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"modelkey"}, 1*time.Minute)
+	proxy := newTestProxy(targetServer, km, "key", nil)
+	mainHandler := createMainHandler(proxy, mainHandlerOptions{
+		bodyModifierOptions: bodyModifierOptions{addGoogleSearch: true, triggerMode: triggerReplace},
+		toolMethods:         splitCommaList(defaultToolMethods),
+		searchModels:        []string{"gemini-1.5-*", "gemini-2.0-flash"},
+	})
+
+	postBody := `{"contents": [{"parts":[{"text":"hello"}]}]}`
+	injectedBody := `{"contents":[{"parts":[{"text":"hello"}]}],"tools":[{"google_search":{}}]}`
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/v1beta/models/gemini-1.5-pro:generateContent", injectedBody},
+		{"/v1beta/models/gemini-2.0-flash:streamGenerateContent", injectedBody},
+		{"/v1beta/models/gemini-2.0-flash-lite:generateContent", postBody},
+		{"/v1/models/gemini-pro:generateContent", postBody},
+	}
+	for _, tt := range tests {
+		receivedBody = ""
+		req := httptest.NewRequest("POST", "http://localhost:8080"+tt.path, strings.NewReader(postBody))
+		rr := httptest.NewRecorder()
+		mainHandler(rr, req)
+
+		assertInt(t, rr.Code, http.StatusOK)
+		if receivedBody != tt.want {
+			t.Errorf("%s: upstream received %s, want %s", tt.path, receivedBody, tt.want)
+		}
+	}
+}
+
+func TestCreateMainHandler_ForceSearchParam(t *testing.T) {
+	var receivedBody, receivedQuery string
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, _ := io.ReadAll(r.Body)
+		receivedBody = string(bodyBytes)
+		receivedQuery = r.URL.RawQuery
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"forcekey"}, 1*time.Minute)
+	mainHandler := createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{
+		bodyModifierOptions: bodyModifierOptions{searchTrigger: "search", triggerMode: triggerReplace},
+		toolMethods:         splitCommaList(defaultToolMethods),
+		forceSearchParam:    "force_search",
+	})
+
+	// No trigger word and -add-google-search off, yet the functions are replaced by google_search.
+	postBody := `{"contents":[{"parts":[{"text":"hello"}]}],"tools":[{"functionDeclarations":[{"name":"f"}]}]}`
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"?force_search=true&alt=sse", `{"contents":[{"parts":[{"text":"hello"}]}],"tools":[{"google_search":{}}]}`},
+		{"?force_search=false&alt=sse", postBody},
+		{"?alt=sse", postBody},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "http://localhost:8080/v1beta/models/gemini-pro:generateContent"+tt.query, strings.NewReader(postBody))
+		rr := httptest.NewRecorder()
+		mainHandler(rr, req)
+
+		assertInt(t, rr.Code, http.StatusOK)
+		if !jsonDeepEqual([]byte(receivedBody), []byte(tt.want)) {
+			t.Errorf("%s: upstream received %s, want %s", tt.query, receivedBody, tt.want)
+		}
+		if strings.Contains(receivedQuery, "force_search") {
+			t.Errorf("%s: force_search forwarded upstream: %s", tt.query, receivedQuery)
+		}
+		if !strings.Contains(receivedQuery, "alt=sse") {
+			t.Errorf("%s: other query params lost: %s", tt.query, receivedQuery)
+		}
+	}
+}
+
+func TestCreateMainHandler_EmptyPOSTBody(t *testing.T) {
+	var calls int
+	var receivedLength int64
+	var receivedTransferEncoding []string
+	var receivedBody string
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		receivedLength = r.ContentLength
+		receivedTransferEncoding = r.TransferEncoding
+		bodyBytes, _ := io.ReadAll(r.Body)
+		receivedBody = string(bodyBytes)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"emptykey"}, 1*time.Minute)
+	newHandler := func(strictJSON bool) http.HandlerFunc {
+		return createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{
+			bodyModifierOptions: bodyModifierOptions{addGoogleSearch: true, searchTrigger: "search", triggerMode: triggerReplace},
+			toolMethods:         splitCommaList(defaultToolMethods),
+			strictJSON:          strictJSON,
+		})
+	}
+	const path = "http://localhost:8080/v1beta/models/gemini-pro:generateContent"
+
+	// Known and unknown (chunked) empty bodies are both forwarded unmodified with Content-Length: 0,
+	// without a JSON parse warning.
+	for _, contentLength := range []int64{0, -1} {
+		logBuf := captureLogs(t, levelWarn)
+		req := httptest.NewRequest("POST", path, strings.NewReader(""))
+		req.ContentLength = contentLength
+		rr := httptest.NewRecorder()
+		newHandler(false)(rr, req)
+
+		assertInt(t, rr.Code, http.StatusOK)
+		assertString(t, receivedBody, "")
+		assertInt(t, int(receivedLength), 0)
+		assertInt(t, len(receivedTransferEncoding), 0)
+		if strings.Contains(logBuf.String(), "Failed to parse") {
+			t.Errorf("ContentLength %d: unexpected parse warning: %s", contentLength, logBuf.String())
+		}
+	}
+	assertInt(t, calls, 2)
+
+	// -strict-json rejects the empty body before it uses a key.
+	rr := httptest.NewRecorder()
+	newHandler(true)(rr, httptest.NewRequest("POST", path, strings.NewReader("")))
+	assertInt(t, rr.Code, http.StatusBadRequest)
+	if !strings.Contains(rr.Body.String(), "empty body") {
+		t.Errorf("unexpected strict rejection body: %q", rr.Body.String())
+	}
+	assertInt(t, calls, 2)
+}
+
+func TestCreateMainHandler_DisableToolInjectionHeader(t *testing.T) {
+	var receivedBody, receivedHeader string
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, _ := io.ReadAll(r.Body)
+		receivedBody = string(bodyBytes)
+		receivedHeader = r.Header.Get(disableToolInjectionHeader)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"abkey"}, 1*time.Minute)
+	postBody := `{"contents": [{"parts":[{"text":"hello"}]}]}`
+	injectedBody := `{"contents":[{"parts":[{"text":"hello"}]}],"tools":[{"google_search":{}}]}`
+
+	tests := []struct {
+		allowOverride bool
+		header        string
+		want          string
+	}{
+		{true, "true", postBody},
+		{true, "false", injectedBody},
+		{true, "", injectedBody},
+		{false, "true", injectedBody}, // Gated by the flag
+	}
+	for _, tt := range tests {
+		mainHandler := createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{
+			bodyModifierOptions:    bodyModifierOptions{addGoogleSearch: true, triggerMode: triggerReplace},
+			toolMethods:            splitCommaList(defaultToolMethods),
+			allowInjectionOverride: tt.allowOverride,
+		})
+		req := httptest.NewRequest("POST", "http://localhost:8080/v1beta/models/gemini-pro:generateContent", strings.NewReader(postBody))
+		if tt.header != "" {
+			req.Header.Set(disableToolInjectionHeader, tt.header)
+		}
+		rr := httptest.NewRecorder()
+		mainHandler(rr, req)
+
+		assertInt(t, rr.Code, http.StatusOK)
+		if receivedBody != tt.want {
+			t.Errorf("allow=%t header=%q: upstream received %s, want %s", tt.allowOverride, tt.header, receivedBody, tt.want)
+		}
+		assertString(t, receivedHeader, "")
+	}
+}
+
+func TestCreateMainHandler_Trace(t *testing.T) {
+	var calls int32
+	var receivedKey string
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		receivedKey = r.URL.Query().Get("key")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"tracekey"}, 1*time.Minute)
+	newHandler := func(allowTrace bool) http.HandlerFunc {
+		return createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{
+			toolMethods: splitCommaList(defaultToolMethods),
+			allowTrace:  allowTrace,
+		})
+	}
+
+	// Rejected by default, without reaching the upstream.
+	rr := httptest.NewRecorder()
+	newHandler(false)(rr, httptest.NewRequest("TRACE", "http://localhost:8080/v1beta/models", nil))
+	assertInt(t, rr.Code, http.StatusMethodNotAllowed)
+	assertInt(t, int(atomic.LoadInt32(&calls)), 0)
+
+	// Forwarded with the key when allowed.
+	rr = httptest.NewRecorder()
+	newHandler(true)(rr, httptest.NewRequest("TRACE", "http://localhost:8080/v1beta/models", nil))
+	assertInt(t, rr.Code, http.StatusOK)
+	assertInt(t, int(atomic.LoadInt32(&calls)), 1)
+	assertString(t, receivedKey, "tracekey")
+}
+
+func TestCreateMainHandler_PathAccessControl(t *testing.T) {
+	var calls int32
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	allowPaths, err := parsePathRules("/v1beta/models, ^/v1/models/[^/]+$")
+	assertNoError(t, err)
+	denyPaths, err := parsePathRules("/v1beta/models/secret")
+	assertNoError(t, err)
+
+	km, _ := newKeyManager([]string{"pathkey"}, 1*time.Minute)
+	mainHandler := createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{
+		toolMethods: splitCommaList(defaultToolMethods),
+		allowPaths:  allowPaths,
+		denyPaths:   denyPaths,
+	})
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{"/v1beta/models/gemini-pro", http.StatusOK},
+		{"/v1/models/gemini-pro", http.StatusOK},             // Regex rule
+		{"/v1/models/gemini-pro/extra", http.StatusNotFound}, // Regex does not match
+		{"/v1beta/models/secret-model", http.StatusForbidden},
+		{"/v1beta/files", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&calls, 0)
+		rr := httptest.NewRecorder()
+		mainHandler(rr, httptest.NewRequest("GET", "http://localhost:8080"+tt.path, nil))
+		assertInt(t, rr.Code, tt.wantStatus)
+		wantCalls := 0
+		if tt.wantStatus == http.StatusOK {
+			wantCalls = 1
+		}
+		if got := int(atomic.LoadInt32(&calls)); got != wantCalls {
+			t.Errorf("%s: upstream called %d time(s), want %d", tt.path, got, wantCalls)
+		}
+	}
+
+	_, err = parsePathRules("^/v1/(")
+	assertErrorContains(t, err, "invalid path pattern")
+}
+
+func TestCreateMainHandler_RestrictPaths(t *testing.T) {
+	var calls int32
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	knownPaths, err := parsePathRules(defaultKnownPaths)
+	assertNoError(t, err)
+
+	km, _ := newKeyManager([]string{"pathkey"}, 1*time.Minute)
+	mainHandler := createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{
+		toolMethods: splitCommaList(defaultToolMethods),
+		knownPaths:  knownPaths,
+	})
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{"/v1beta/models", http.StatusOK},
+		{"/v1beta/models/gemini-pro:countTokens", http.StatusOK},
+		{"/v1/models/gemini-pro", http.StatusOK},
+		{"/upload/v1beta/files", http.StatusOK},
+		{"/v1beta/openai/chat/completions", http.StatusOK},
+		{"/", http.StatusNotFound},
+		{"/wp-admin/index.php", http.StatusNotFound},
+		{"/v1beta/modelsx", http.StatusNotFound},
+		{"/v2/models", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&calls, 0)
+		rr := httptest.NewRecorder()
+		mainHandler(rr, httptest.NewRequest("GET", "http://localhost:8080"+tt.path, nil))
+		if rr.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.path, rr.Code, tt.wantStatus)
+		}
+		wantCalls := 0
+		if tt.wantStatus == http.StatusOK {
+			wantCalls = 1
+		}
+		if got := int(atomic.LoadInt32(&calls)); got != wantCalls {
+			t.Errorf("%s: upstream called %d time(s), want %d", tt.path, got, wantCalls)
+		}
+	}
+	// No key was used for the rejected paths.
+	assertInt(t, km.scopeCount(), 5)
+}
+
+func TestRewritePathPrefix(t *testing.T) {
+	tests := []struct {
+		path, strip, add, want string
+	}{
+		{"/gemini/v1beta/models", "/gemini", "", "/v1beta/models"},
+		{"/gemini", "/gemini", "", "/"},
+		{"/gemini/", "/gemini", "", "/"},
+		{"/geminis/models", "/gemini", "", "/geminis/models"}, // Whole segments only
+		{"/models/gemini-pro", "", "/v1beta", "/v1beta/models/gemini-pro"},
+		{"/v1beta/models", "", "/v1beta", "/v1beta/models"}, // Already present
+		{"/", "", "/v1beta", "/v1beta"},
+		{"/api/models", "/api", "/v1beta", "/v1beta/models"},
+	}
+	for _, tt := range tests {
+		if got := rewritePathPrefix(tt.path, tt.strip, tt.add); got != tt.want {
+			t.Errorf("rewritePathPrefix(%q, %q, %q) = %q, want %q", tt.path, tt.strip, tt.add, got, tt.want)
+		}
+	}
+	assertString(t, normalizePathPrefix("v1beta/"), "/v1beta")
+	assertString(t, normalizePathPrefix("/"), "")
+}
+
+func TestCreateProxyDirector_PrefixRewriteKeepsClientScope(t *testing.T) {
+	var receivedPath string
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedPath = r.URL.Path
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer targetServer.Close()
+	targetURL, _ := url.Parse(targetServer.URL)
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	proxy := newTestProxy(targetServer, km, "key", nil)
+	proxy.Director = createProxyDirector(targetURL, httputil.NewSingleHostReverseProxy(targetURL).Director, directorOptions{
+		stripPrefix: normalizePathPrefix("/gemini/"),
+		addPrefix:   normalizePathPrefix("v1beta"),
+	})
+	mainHandler := createMainHandler(proxy, mainHandlerOptions{})
+
+	rr := httptest.NewRecorder()
+	mainHandler(rr, httptest.NewRequest("GET", "http://localhost:8080/gemini/models/gemini-pro", nil))
+	assertString(t, receivedPath, "/v1beta/models/gemini-pro")
+
+	// Keys are sidelined in the scope of the path the client sent.
+	clientScope := buildScopeKey(targetURL.Host, "/gemini/models/gemini-pro")
+	km.lockAll()
+	defer km.unlockAll()
+	if _, exists := km.lookupScope(buildScopeKey(targetURL.Host, "/v1beta/models/gemini-pro")); exists {
+		t.Error("expected no scope for the rewritten path")
+	}
+	assertInt(t, len(getScopeState(t, km, clientScope).failingKeys), 2)
+}
+
+func TestModelFromPath(t *testing.T) {
+	assertString(t, modelFromPath("/v1beta/models/gemini-pro:generateContent"), "gemini-pro")
+	assertString(t, modelFromPath("/v1/models/gemini-1.5-flash"), "gemini-1.5-flash")
+	assertString(t, modelFromPath("/v1beta/tunedModels/x"), "")
+
+	_, err := parseSearchModels("gemini-[")
+	assertErrorContains(t, err, "invalid model pattern")
+}
+
+func TestIsToolInjectionPath_CustomMethods(t *testing.T) {
+	methods := []string{"generateContent", "countTokens"}
+	if !isToolInjectionPath("/v1beta/models/gemini-pro:countTokens", methods) {
+		t.Error("expected countTokens to be eligible when configured")
+	}
+	if isToolInjectionPath("/v1beta/models/gemini-pro:streamGenerateContent", methods) {
+		t.Error("expected streamGenerateContent to be ineligible when not configured")
+	}
+	if isToolInjectionPath("/v1beta/models/gemini-pro", methods) {
+		t.Error("expected path without a method suffix to be ineligible")
+	}
+	if isToolInjectionPath("/v1beta/models/other-model:generateContent", methods) {
+		t.Error("expected non-Gemini model path to be ineligible")
+	}
+}
+
+func TestIsToolInjectionPath_DefaultMethods(t *testing.T) {
+	// Without -tool-methods, the default methods and paths without a method suffix are eligible.
+	for _, path := range []string{"/v1beta/models/gemini-pro:generateContent", "/v1beta/models/gemini-pro:streamGenerateContent", "/v1beta/models/gemini-pro"} {
+		if !isToolInjectionPath(path, nil) {
+			t.Errorf("expected %s to be eligible by default", path)
+		}
+	}
+	if isToolInjectionPath("/v1beta/models/gemini-pro:countTokens", nil) {
+		t.Error("expected countTokens to be ineligible by default")
+	}
+}
+
+func TestIsToolInjectionPath_V1AndCustomPattern(t *testing.T) {
+	methods := []string{"generateContent"}
+	for _, path := range []string{"/v1/models/gemini-pro:generateContent", "/v1beta/models/gemini-pro:generateContent"} {
+		if !isToolInjectionPath(path, methods) {
+			t.Errorf("expected %s to be eligible with the default pattern", path)
+		}
+	}
+	if isToolInjectionPath("/v2/models/gemini-pro:generateContent", methods) {
+		t.Error("expected unknown API version to be ineligible")
+	}
+
+	prev := geminiPathRegex
+	defer func() { geminiPathRegex = prev }()
+	geminiPathRegex = regexp.MustCompile(`^/v1beta/models/gemini-1\.5-.*`)
+	if isToolInjectionPath("/v1/models/gemini-1.5-pro:generateContent", methods) {
+		t.Error("expected v1 path to be ineligible with a v1beta-only pattern")
+	}
+	if isToolInjectionPath("/v1beta/models/gemini-pro:generateContent", methods) {
+		t.Error("expected model excluded by the custom pattern to be ineligible")
+	}
+	if !isToolInjectionPath("/v1beta/models/gemini-1.5-pro:generateContent", methods) {
+		t.Error("expected model matched by the custom pattern to be eligible")
+	}
+}
+
+func TestCreateMainHandler_StrictJSON(t *testing.T) {
+	var upstreamCalls int32
+	var receivedBody string
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamCalls, 1)
+		bodyBytes, _ := io.ReadAll(r.Body)
+		receivedBody = string(bodyBytes)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"jsonkey"}, 1*time.Minute)
+	proxy := newTestProxy(targetServer, km, "key", nil)
+	malformed := `{"contents": [`
+	path := "http://localhost:8080/v1beta/models/gemini-pro:generateContent"
+
+	// Strict: rejected with 400 and the parse error, never forwarded.
+	strictHandler := createMainHandler(proxy, mainHandlerOptions{
+		bodyModifierOptions: bodyModifierOptions{addGoogleSearch: true},
+		toolMethods:         splitCommaList(defaultToolMethods),
+		strictJSON:          true,
+	})
+	rr := httptest.NewRecorder()
+	strictHandler(rr, httptest.NewRequest("POST", path, strings.NewReader(malformed)))
+	assertInt(t, rr.Code, http.StatusBadRequest)
+	if !strings.Contains(rr.Body.String(), "Invalid JSON request body: unexpected end of JSON input") {
+		t.Errorf("expected parse error in response body, got %q", rr.Body.String())
+	}
+	assertInt(t, int(atomic.LoadInt32(&upstreamCalls)), 0)
+
+	// Strict: valid bodies are still modified and forwarded.
+	rr = httptest.NewRecorder()
+	strictHandler(rr, httptest.NewRequest("POST", path, strings.NewReader(`{"contents": []}`)))
+	assertInt(t, rr.Code, http.StatusOK)
+	assertString(t, receivedBody, `{"contents":[],"tools":[{"google_search":{}}]}`)
+
+	// Lenient (default): malformed body is passed through unmodified.
+	lenientHandler := createMainHandler(proxy, mainHandlerOptions{bodyModifierOptions: bodyModifierOptions{addGoogleSearch: true}})
+	rr = httptest.NewRecorder()
+	lenientHandler(rr, httptest.NewRequest("POST", path, strings.NewReader(malformed)))
+	assertInt(t, rr.Code, http.StatusOK)
+	assertString(t, receivedBody, malformed)
+	assertInt(t, int(atomic.LoadInt32(&upstreamCalls)), 2)
+}
+
+// --- Test logResponseBody ---
+
+func TestLogResponseBody_DecodesGzipForLogOnly(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(`{"error":{"code":400,"message":"API key not valid"}}`))
+	gz.Close()
+	originalBytes := compressed.Bytes()
+
+	resp := &http.Response{
+		StatusCode: http.StatusBadRequest,
+		Header:     http.Header{"Content-Encoding": []string{"gzip"}},
+		Body:       io.NopCloser(bytes.NewReader(originalBytes)),
+	}
+
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	logResponseBody(resp)
+
+	logOutput := logBuf.String()
+	if !strings.Contains(logOutput, "API key not valid") {
+		t.Errorf("Expected decoded body text in logs, got: %s", logOutput)
+	}
+
+	// The client must receive exactly the encoded bytes the upstream sent.
+	clientBytes, err := io.ReadAll(resp.Body)
+	assertNoError(t, err)
+	if !bytes.Equal(clientBytes, originalBytes) {
+		t.Errorf("Expected client to receive original gzip bytes unchanged")
+	}
+}
+
+func TestLogResponseBody_DecodesDeflateForLog(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write([]byte("deflated error message"))
+	zw.Close()
+
+	resp := &http.Response{
+		StatusCode: http.StatusForbidden,
+		Header:     http.Header{"Content-Encoding": []string{"deflate"}},
+		Body:       io.NopCloser(bytes.NewReader(compressed.Bytes())),
+	}
+
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	logResponseBody(resp)
+
+	if !strings.Contains(logBuf.String(), "deflated error message") {
+		t.Errorf("Expected decoded deflate body in logs, got: %s", logBuf.String())
+	}
+}
+
+func TestLogResponseBody_InvalidGzipIsHandledGracefully(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusBadRequest,
+		Header:     http.Header{"Content-Encoding": []string{"gzip"}},
+		Body:       io.NopCloser(strings.NewReader("not really gzip")),
+	}
+
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	logResponseBody(resp)
+
+	logOutput := logBuf.String()
+	if !strings.Contains(logOutput, "Could not decode gzip-encoded response body") {
+		t.Errorf("Expected decode failure to be logged, got: %s", logOutput)
+	}
+	clientBytes, _ := io.ReadAll(resp.Body)
+	assertString(t, string(clientBytes), "not really gzip")
+}
+
+func TestLogResponseBody_BrotliLoggedAsByteCount(t *testing.T) {
+	// Arbitrary bytes standing in for a Brotli stream; they must reach the client unchanged.
+	brBody := "\x1b\x1d\x00\xf8\xa5\x40\x02\x8c\xb1"
+	resp := &http.Response{
+		StatusCode: http.StatusBadRequest,
+		Header:     http.Header{"Content-Encoding": []string{"br"}},
+		Body:       io.NopCloser(strings.NewReader(brBody)),
+	}
+
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	logResponseBody(resp)
+
+	logOutput := logBuf.String()
+	if !strings.Contains(logOutput, "<9 bytes of br-encoded data>") {
+		t.Errorf("Expected Brotli body to be logged as a byte count, got: %s", logOutput)
+	}
+	if strings.Contains(logOutput, "Could not decode") {
+		t.Errorf("Expected no decode warning for Brotli, got: %s", logOutput)
+	}
+	clientBytes, _ := io.ReadAll(resp.Body)
+	assertString(t, string(clientBytes), brBody)
+}
+
+// --- Test createProxyDirector ---
+
+func TestCreateProxyDirector_ForwardsClientIPChain(t *testing.T) {
+	var gotXFF, gotHost, gotProto string
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotXFF = r.Header.Get("X-Forwarded-For")
+		gotHost = r.Header.Get("X-Forwarded-Host")
+		gotProto = r.Header.Get("X-Forwarded-Proto")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"xffkey"}, 1*time.Minute)
+	proxy := newTestProxy(targetServer, km, "key", nil)
+	mainHandler := createMainHandler(proxy, mainHandlerOptions{})
+
+	// Header already present: client IP must be appended to the existing chain.
+	req := httptest.NewRequest("GET", "http://proxy.local:8080/some/path", nil)
+	req.RemoteAddr = "203.0.113.7:54321"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	rr := httptest.NewRecorder()
+	mainHandler(rr, req)
+
+	assertInt(t, rr.Code, http.StatusOK)
+	assertString(t, gotXFF, "198.51.100.1, 203.0.113.7")
+	assertString(t, gotHost, "proxy.local:8080")
+	assertString(t, gotProto, "http")
+
+	// No prior header: chain starts with the client IP.
+	req2 := httptest.NewRequest("GET", "http://proxy.local:8080/some/path", nil)
+	req2.RemoteAddr = "203.0.113.8:1111"
+	rr2 := httptest.NewRecorder()
+	mainHandler(rr2, req2)
+	assertString(t, gotXFF, "203.0.113.8")
+}
+
+func TestCreateProxyDirector_HidesClientIPWhenDisabled(t *testing.T) {
+	var gotXFF, gotHost, gotProto string
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotXFF = r.Header.Get("X-Forwarded-For")
+		gotHost = r.Header.Get("X-Forwarded-Host")
+		gotProto = r.Header.Get("X-Forwarded-Proto")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"xffkey"}, 1*time.Minute)
+	proxy := newTestProxy(targetServer, km, "key", nil)
+	targetURL, _ := url.Parse(targetServer.URL)
+	proxy.Director = createProxyDirector(targetURL, httputil.NewSingleHostReverseProxy(targetURL).Director, directorOptions{forwardClientIP: false})
+	mainHandler := createMainHandler(proxy, mainHandlerOptions{})
+
+	req := httptest.NewRequest("GET", "http://proxy.local:8080/some/path", nil)
+	req.RemoteAddr = "203.0.113.7:54321"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("X-Forwarded-Host", "internal.example")
+	rr := httptest.NewRecorder()
+	mainHandler(rr, req)
+
+	assertInt(t, rr.Code, http.StatusOK)
+	assertString(t, gotXFF, "")
+	assertString(t, gotHost, "")
+	assertString(t, gotProto, "")
+}
+
+func TestCreateHealthHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	createHealthHandler(nil, false)(rr, httptest.NewRequest("GET", "http://localhost:8080/healthz", nil))
+	assertInt(t, rr.Code, http.StatusOK)
+	assertString(t, strings.TrimSpace(rr.Body.String()), "ok")
+}
+
+// --- Test createClientTimeoutHandler ---
+
+func TestCreateClientTimeoutHandler_AbortsRetries(t *testing.T) {
+	var upstreamCalls int32
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamCalls, 1)
+		time.Sleep(60 * time.Millisecond)
+		w.WriteHeader(http.StatusInternalServerError) // Retryable
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	proxy := newTestProxy(targetServer, km, "key", nil)
+	handler := createClientTimeoutHandler(createMainHandler(proxy, mainHandlerOptions{}), 1*time.Minute)
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil)
+	req.Header.Set(proxyTimeoutHeader, "90ms")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assertInt(t, rr.Code, http.StatusGatewayTimeout)
+	if calls := atomic.LoadInt32(&upstreamCalls); calls >= int32(maxRetries) {
+		t.Errorf("expected the deadline to cut retries short, got %d upstream calls", calls)
+	}
+}
+
+func TestCreateClientTimeoutHandler_CapsAtMaximum(t *testing.T) {
+	var deadline time.Time
+	var hasDeadline bool
+	var forwardedHeader string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, hasDeadline = r.Context().Deadline()
+		forwardedHeader = r.Header.Get(proxyTimeoutHeader)
+	})
+	handler := createClientTimeoutHandler(next, 100*time.Millisecond)
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil)
+	req.Header.Set(proxyTimeoutHeader, "10m")
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !hasDeadline {
+		t.Fatal("expected a deadline on the request context")
+	}
+	if deadline.Sub(start) > 200*time.Millisecond {
+		t.Errorf("expected deadline capped at ~100ms, got %s", deadline.Sub(start))
+	}
+	assertString(t, forwardedHeader, "") // Control header must not be forwarded
+}
+
+func TestCreateClientTimeoutHandler_RejectsInvalidHeader(t *testing.T) {
+	called := false
+	handler := createClientTimeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}), time.Minute)
+
+	for _, value := range []string{"soon", "-5s", "0s"} {
+		req := httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil)
+		req.Header.Set(proxyTimeoutHeader, value)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assertInt(t, rr.Code, http.StatusBadRequest)
+	}
+	if called {
+		t.Error("expected invalid timeouts not to reach the proxy")
+	}
+}
+
+func TestCreateProxyErrorHandler_HandlesDeadlineExceeded(t *testing.T) {
+	handler := createProxyErrorHandler(nil, nil)
+	req := httptest.NewRequest("GET", "http://testerror.com/v1/deadline", nil)
+	rr := httptest.NewRecorder()
+
+	handler(rr, req, fmt.Errorf("attempt failed: %w", context.DeadlineExceeded))
+
+	assertInt(t, rr.Code, http.StatusGatewayTimeout)
+}
+
+func TestCreateProxyModifyResponse_RecordsFailureReason(t *testing.T) {
+	km, _ := newKeyManager([]string{"key1"}, 5*time.Minute)
+	modifier := createProxyModifyResponse(km, modifyResponseOptions{})
+
+	ctx := context.WithValue(context.Background(), keyIndexContextKey, 0)
+	req := httptest.NewRequest("POST", "http://test.com/v1/reason", nil).WithContext(ctx)
+	resp := &http.Response{
+		StatusCode: http.StatusUnauthorized,
+		Request:    req,
+		Body:       io.NopCloser(strings.NewReader("unauthorized")),
+	}
+	assertNoError(t, modifier(resp))
+
+	km.lockAll()
+	defer km.unlockAll()
+	state := getScopeState(t, km, buildScopeKey("test.com", "/v1/reason"))
+	assertString(t, state.failingKeys[0].reason, "status 401")
+}
+
+func TestCreateProxyDirector_StripsDeniedRequestHeaders(t *testing.T) {
+	var gotHeaders http.Header
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeaders = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"stripkey"}, 1*time.Minute)
+	proxy := newTestProxy(targetServer, km, "key", nil)
+	targetURL, _ := url.Parse(targetServer.URL)
+	proxy.Director = createProxyDirector(targetURL, httputil.NewSingleHostReverseProxy(targetURL).Director, directorOptions{
+		forwardClientIP: true,
+		stripHeaders:    append(splitCommaList(defaultStripRequestHeaders), "X-Internal-Token"),
+	})
+	mainHandler := createMainHandler(proxy, mainHandlerOptions{})
+
+	req := httptest.NewRequest("GET", "http://proxy.local:8080/some/path", nil)
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("Proxy-Authorization", "Basic abc")
+	req.Header.Set("X-Internal-Token", "internal")
+	req.Header.Set("Connection", "X-Connection-Scoped")
+	req.Header.Set("X-Connection-Scoped", "hop")
+	req.Header.Set("X-Request-Id", "req-123")
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	mainHandler(rr, req)
+
+	assertInt(t, rr.Code, http.StatusOK)
+	for _, name := range []string{"Cookie", "Proxy-Authorization", "X-Internal-Token", "X-Connection-Scoped"} {
+		if v := gotHeaders.Get(name); v != "" {
+			t.Errorf("expected %s to be stripped, upstream received %q", name, v)
+		}
+	}
+	assertString(t, gotHeaders.Get("X-Request-Id"), "req-123")
+	assertString(t, gotHeaders.Get("Content-Type"), "application/json")
+}
+
+func TestStripRequestHeaders_KeepsWebSocketUpgradeHeaders(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://proxy.local:8080/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Cookie", "session=secret")
+
+	stripRequestHeaders(req, splitCommaList(defaultStripRequestHeaders))
+
+	assertString(t, req.Header.Get("Connection"), "Upgrade")
+	assertString(t, req.Header.Get("Upgrade"), "websocket")
+	assertString(t, req.Header.Get("Cookie"), "")
+}
+
+func TestCreateProxyDirector_TargetOverride(t *testing.T) {
+	var defaultHits, overrideHits int32
+	var overrideSawHeader string
+	defaultServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&defaultHits, 1)
+	}))
+	defer defaultServer.Close()
+	overrideServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&overrideHits, 1)
+		overrideSawHeader = r.Header.Get(targetOverrideHeader)
+	}))
+	defer overrideServer.Close()
+	overrideURL, _ := url.Parse(overrideServer.URL)
+
+	newHandler := func(km *keyManager, allow bool) http.HandlerFunc {
+		proxy := newTestProxy(defaultServer, km, "key", nil)
+		targetURL, _ := url.Parse(defaultServer.URL)
+		proxy.Director = createProxyDirector(targetURL, httputil.NewSingleHostReverseProxy(targetURL).Director, directorOptions{allowTargetOverride: allow})
+		return createMainHandler(proxy, mainHandlerOptions{})
+	}
+	send := func(handler http.HandlerFunc, override string) {
+		req := httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil)
+		req.Header.Set(targetOverrideHeader, override)
+		handler(httptest.NewRecorder(), req)
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		km, _ := newKeyManager([]string{"k1"}, time.Minute)
+		send(newHandler(km, true), overrideServer.URL)
+		assertInt(t, int(atomic.LoadInt32(&overrideHits)), 1)
+		assertInt(t, int(atomic.LoadInt32(&defaultHits)), 0)
+		assertString(t, overrideSawHeader, "")
+
+		// The scope follows the overridden host.
+		km.lockAll()
+		_, exists := km.lookupScope(buildScopeKey(overrideURL.Host, "/v1beta/models"))
+		km.unlockAll()
+		if !exists {
+			t.Errorf("expected scope keyed by override host %s", overrideURL.Host)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		km, _ := newKeyManager([]string{"k1"}, time.Minute)
+		send(newHandler(km, false), overrideServer.URL)
+		assertInt(t, int(atomic.LoadInt32(&overrideHits)), 1) // Unchanged
+		assertInt(t, int(atomic.LoadInt32(&defaultHits)), 1)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		km, _ := newKeyManager([]string{"k1"}, time.Minute)
+		send(newHandler(km, true), "ftp:/no-host")
+		assertInt(t, int(atomic.LoadInt32(&overrideHits)), 1) // Unchanged
+		assertInt(t, int(atomic.LoadInt32(&defaultHits)), 2)
+	})
+}
+
+func TestParseTargetOverride(t *testing.T) {
+	for _, valid := range []string{"https://staging.example.com", "http://localhost:9000/ignored/path"} {
+		if _, err := parseTargetOverride(valid); err != nil {
+			t.Errorf("parseTargetOverride(%q) unexpected error: %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"staging.example.com", "ftp://example.com", "https://", "://bad"} {
+		if _, err := parseTargetOverride(invalid); err == nil {
+			t.Errorf("parseTargetOverride(%q) expected error", invalid)
+		}
+	}
+}
+
+// --- Test WebSocket passthrough ---
+
+// newWebSocketEchoServer returns an upstream that completes a WebSocket handshake and then
+// echoes raw bytes back. It records the API key it received in the query string.
+func newWebSocketEchoServer(t *testing.T, gotKey *string, gotAuth *string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*gotKey = r.URL.Query().Get("key")
+		*gotAuth = r.Header.Get("Authorization")
+		if !isWebSocketUpgrade(r) {
+			http.Error(w, "expected websocket upgrade", http.StatusBadRequest)
+			return
+		}
+		h := sha1.New()
+		io.WriteString(h, r.Header.Get("Sec-WebSocket-Key")+"258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
+		accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("hijack failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", accept)
+		rw.Flush()
+		io.Copy(conn, rw) // Echo until the client closes
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCreateMainHandler_WebSocketPassthrough(t *testing.T) {
+	var gotKey, gotAuth string
+	upstream := newWebSocketEchoServer(t, &gotKey, &gotAuth)
+
+	km, _ := newKeyManager([]string{"wskey"}, time.Minute)
+	// The path matches headerAuthPaths, but upgrades must still use the query param.
+	proxy := newTestProxy(upstream, km, "key", []string{"/openai"})
+	proxyServer := httptest.NewServer(createMainHandler(proxy, mainHandlerOptions{bodyModifierOptions: bodyModifierOptions{addGoogleSearch: true, searchTrigger: "search"}}))
+	defer proxyServer.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxyServer.URL, "http://"))
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "GET /openai/realtime HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("reading upgrade response: %v", err)
+	}
+	assertInt(t, resp.StatusCode, http.StatusSwitchingProtocols)
+	assertString(t, gotKey, "wskey")
+	assertString(t, gotAuth, "")
+
+	// Data flows both ways over the upgraded connection.
+	io.WriteString(conn, "ping")
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(reader, echo); err != nil {
+		t.Fatalf("reading echo: %v", err)
+	}
+	assertString(t, string(echo), "ping")
+}
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost/ws", nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "WebSocket")
+	if !isWebSocketUpgrade(req) {
+		t.Error("expected upgrade request to be detected")
+	}
+	req.Header.Set("Connection", "keep-alive")
+	if isWebSocketUpgrade(req) {
+		t.Error("expected request without Connection: Upgrade not to be detected")
+	}
+}
+
+func TestParseResponseHeaders(t *testing.T) {
+	headers, err := parseResponseHeaders("X-Proxy-Version: 1.2, X-Served-By:ai-proxy,Access-Control-Allow-Origin:https://evil.example")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertString(t, headers.Get("X-Proxy-Version"), "1.2")
+	assertString(t, headers.Get("X-Served-By"), "ai-proxy")
+	if _, ok := headers["Access-Control-Allow-Origin"]; ok {
+		t.Errorf("expected CORS header to be skipped, got %v", headers)
+	}
+
+	if _, err := parseResponseHeaders("NoColonHere"); err == nil {
+		t.Error("expected error for entry without a colon")
+	}
+	if _, err := parseResponseHeaders(":value"); err == nil {
+		t.Error("expected error for entry without a name")
+	}
+
+	// The JSON form keeps commas inside values.
+	headers, err = parseResponseHeaders(`{"Cache-Control": "no-cache, no-store", "X-Served-By": "ai-proxy", "Access-Control-Allow-Origin": "*"}`)
+	assertNoError(t, err)
+	assertString(t, headers.Get("Cache-Control"), "no-cache, no-store")
+	assertString(t, headers.Get("X-Served-By"), "ai-proxy")
+	assertInt(t, len(headers), 2)
+	_, err = parseResponseHeaders(`{"X-Count": 1}`)
+	assertErrorContains(t, err, "invalid response headers JSON")
+	_, err = parseResponseHeaders(`{" ": "value"}`)
+	assertErrorContains(t, err, "empty name")
+}
+
+func TestCreateProxyModifyResponse_InjectsResponseHeaders(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Served-By", "upstream")
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: chunk%d\n\n", i)
+			flusher.Flush()
+		}
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"key1"}, 1*time.Minute)
+	proxy := newTestProxy(targetServer, km, "key", []string{})
+	headers, err := parseResponseHeaders("X-Proxy-Version:1.2,X-Served-By:ai-proxy,Access-Control-Allow-Origin:https://evil.example")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	proxy.ModifyResponse = createProxyModifyResponse(km, modifyResponseOptions{responseHeaders: headers})
+	handler := createMainHandler(proxy, mainHandlerOptions{})
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/v1beta/models:streamGenerateContent", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assertInt(t, rr.Code, http.StatusOK)
+	assertString(t, rr.Header().Get("X-Proxy-Version"), "1.2")
+	if got := rr.Header().Values("X-Served-By"); len(got) != 1 || got[0] != "ai-proxy" {
+		t.Errorf("expected X-Served-By to be replaced with ai-proxy, got %v", got)
+	}
+	if got := rr.Header().Values("Access-Control-Allow-Origin"); len(got) != 1 || got[0] != "*" {
+		t.Errorf("expected CORS header to be untouched, got %v", got)
+	}
+	assertString(t, rr.Body.String(), "data: chunk0\n\ndata: chunk1\n\ndata: chunk2\n\n")
+}
+
+func TestProxyAttemptsHeader(t *testing.T) {
+	var calls int32
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		switch {
+		case r.URL.Path == "/always-fails":
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.URL.Path == "/flaky" && n == 1:
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer targetServer.Close()
+
+	tests := []struct {
+		path         string
+		wantStatus   int
+		wantAttempts string
+	}{
+		{"/ok", http.StatusOK, "1"},
+		{"/flaky", http.StatusOK, "2"},
+		{"/always-fails", http.StatusInternalServerError, "3"},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&calls, 0)
+		km, _ := newKeyManager([]string{"k1", "k2", "k3"}, 1*time.Minute)
+		mainHandler := createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{})
+
+		rr := httptest.NewRecorder()
+		mainHandler(rr, httptest.NewRequest("GET", "http://localhost:8080"+tt.path, nil))
+
+		assertInt(t, rr.Code, tt.wantStatus)
+		if got := rr.Header().Get(proxyAttemptsHeader); got != tt.wantAttempts {
+			t.Errorf("%s: %s = %q, want %q", tt.path, proxyAttemptsHeader, got, tt.wantAttempts)
+		}
+	}
+}
+
+func TestServerTimingHeader(t *testing.T) {
+	var calls int32
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(20 * time.Millisecond)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	proxy := newTestProxy(targetServer, km, "key", nil)
+	proxy.ModifyResponse = createProxyModifyResponse(km, modifyResponseOptions{serverTiming: true})
+	mainHandler := createMainHandler(proxy, mainHandlerOptions{})
+
+	rr := httptest.NewRecorder()
+	mainHandler(rr, httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil))
+	assertInt(t, rr.Code, http.StatusOK)
+
+	header := rr.Header().Get("Server-Timing")
+	var upstream, retries float64
+	if _, err := fmt.Sscanf(header, "upstream;dur=%f, retries;dur=%f", &upstream, &retries); err != nil {
+		t.Fatalf("unexpected Server-Timing format %q: %v", header, err)
+	}
+	if retries < 20 {
+		t.Errorf("expected the retried attempt (>= 20ms) in retries, got %q", header)
+	}
+	if upstream < 0 || upstream >= retries {
+		t.Errorf("expected a short final upstream attempt, got %q", header)
+	}
+
+	// Disabled by default.
+	rr = httptest.NewRecorder()
+	createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{})(rr, httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil))
+	assertString(t, rr.Header().Get("Server-Timing"), "")
+}
+
+func TestExposeKeyIndexHeader(t *testing.T) {
+	var receivedKey string
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedKey = r.URL.Query().Get("key")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	keys := []string{"secret-k1", "secret-k2"}
+	km, _ := newKeyManager(keys, 1*time.Minute)
+	proxy := newTestProxy(targetServer, km, "key", nil)
+	proxy.ModifyResponse = createProxyModifyResponse(km, modifyResponseOptions{exposeKeyIndex: true})
+
+	rr := httptest.NewRecorder()
+	createMainHandler(proxy, mainHandlerOptions{})(rr, httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil))
+	assertInt(t, rr.Code, http.StatusOK)
+	index, err := strconv.Atoi(rr.Header().Get(keyIndexHeader))
+	assertNoError(t, err)
+	assertString(t, keys[index], receivedKey)
+	for name, values := range rr.Header() {
+		for _, value := range values {
+			if strings.Contains(value, "secret") {
+				t.Errorf("Response header %s exposes the key: %q", name, value)
+			}
+		}
+	}
+
+	// Disabled by default.
+	proxy.ModifyResponse = createProxyModifyResponse(km, modifyResponseOptions{})
+	rr = httptest.NewRecorder()
+	createMainHandler(proxy, mainHandlerOptions{})(rr, httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil))
+	assertString(t, rr.Header().Get(keyIndexHeader), "")
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1beta/models/gemini-pro:streamGenerateContent":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.(http.Flusher).Flush() // Unknown length
+			io.WriteString(w, body)
+		case "/chunked":
+			w.(http.Flusher).Flush() // Unknown length
+			io.WriteString(w, body)
+		default:
+			io.WriteString(w, body) // Small enough for a Content-Length
+		}
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"k1"}, 1*time.Minute)
+	newHandler := func(limit int64) http.HandlerFunc {
+		proxy := newTestProxy(targetServer, km, "key", nil)
+		proxy.ModifyResponse = createProxyModifyResponse(km, modifyResponseOptions{maxResponseBytes: limit})
+		return createMainHandler(proxy, mainHandlerOptions{})
+	}
+	get := func(handler http.HandlerFunc, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("GET", "http://localhost:8080"+path, nil))
+		return rr
+	}
+
+	limited := newHandler(40)
+
+	// Declared length over the limit: rejected before anything is sent.
+	rr := get(limited, "/v1beta/models")
+	assertInt(t, rr.Code, http.StatusBadGateway)
+	if !strings.Contains(rr.Body.String(), "maximum response size") {
+		t.Errorf("expected a response size error, got %q", rr.Body.String())
+	}
+
+	// Unknown length over the limit: truncated at the limit.
+	rr = get(limited, "/chunked")
+	assertInt(t, rr.Code, http.StatusOK)
+	assertInt(t, rr.Body.Len(), 40)
+
+	// Streaming responses are never capped.
+	rr = get(limited, "/v1beta/models/gemini-pro:streamGenerateContent")
+	assertString(t, rr.Body.String(), body)
+
+	// Within the limit, or no limit: untouched.
+	assertString(t, get(newHandler(100), "/chunked").Body.String(), body)
+	assertString(t, get(newHandler(0), "/v1beta/models").Body.String(), body)
+}
+
+func TestSingleKeySidelined_Returns503WithNoKeysHeader(t *testing.T) {
+	var calls int32
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"onlykey"}, 1*time.Minute)
+	mainHandler := createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{})
+
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	// First request: the only key gets a 429 and is sidelined, leaving nothing to retry with.
+	// Rate limiting is the root cause, so the client sees that 429 without the no-keys header.
+	rr := httptest.NewRecorder()
+	mainHandler(rr, httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil))
+	assertInt(t, rr.Code, http.StatusTooManyRequests)
+	assertString(t, rr.Header().Get(noKeysAvailableHeader), "")
+	if !strings.Contains(logBuf.String(), "SINGLE KEY SIDELINED") {
+		t.Errorf("expected single-key sideline log, got:\n%s", logBuf.String())
+	}
+
+	// Subsequent requests fail fast without reaching the upstream.
+	rr = httptest.NewRecorder()
+	mainHandler(rr, httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil))
+	assertInt(t, rr.Code, http.StatusServiceUnavailable)
+	assertString(t, rr.Header().Get(noKeysAvailableHeader), "true")
+	assertInt(t, int(atomic.LoadInt32(&calls)), 1)
+}
+
+func TestRateLimitExhaustion_Returns429WithRetryAfter(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "17")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer targetServer.Close()
+
+	// Every key is rate limited: the retries run out with keys still available.
+	km, _ := newKeyManager([]string{"k1", "k2", "k3", "k4"}, 1*time.Minute)
+	mainHandler := createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{})
+	rr := httptest.NewRecorder()
+	mainHandler(rr, httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil))
+	assertInt(t, rr.Code, http.StatusTooManyRequests)
+	assertString(t, rr.Header().Get("Retry-After"), "17")
+	assertString(t, rr.Header().Get(noKeysAvailableHeader), "")
+
+	// Two keys: both get 429, then key acquisition fails. Still reported as rate limiting.
+	km, _ = newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	mainHandler = createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{})
+	rr = httptest.NewRecorder()
+	mainHandler(rr, httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil))
+	assertInt(t, rr.Code, http.StatusTooManyRequests)
+	assertString(t, rr.Header().Get("Retry-After"), "17")
+
+	// The keys are now sidelined: a new request never reaches upstream and gets 503 without Retry-After.
+	rr = httptest.NewRecorder()
+	mainHandler(rr, httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil))
+	assertInt(t, rr.Code, http.StatusServiceUnavailable)
+	assertString(t, rr.Header().Get(noKeysAvailableHeader), "true")
+	assertString(t, rr.Header().Get("Retry-After"), "")
+}
+
+func TestCreateProxyErrorHandler_DNSError(t *testing.T) {
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	errorHandler := createProxyErrorHandler(nil, nil)
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil)
+	dnsErr := &net.DNSError{Err: "no such host", Name: "generativelanguage.example.invalid", IsNotFound: true}
+	errorHandler(rr, req, &url.Error{Op: "Get", URL: "https://generativelanguage.example.invalid/v1beta/models", Err: &net.OpError{Op: "dial", Net: "tcp", Err: dnsErr}})
+
+	assertInt(t, rr.Code, http.StatusBadGateway)
+	if !strings.Contains(rr.Body.String(), "upstream host not found: generativelanguage.example.invalid") {
+		t.Errorf("expected a host-not-found body, got %q", rr.Body.String())
+	}
+	if !strings.Contains(logBuf.String(), `Upstream host "generativelanguage.example.invalid" not found`) {
+		t.Errorf("expected a DNS-specific log line, got:\n%s", logBuf.String())
+	}
+}
+
+func TestCreateProxyErrorHandler_NoKeysHeaderOnlyWhenKeysExhausted(t *testing.T) {
+	errorHandler := createProxyErrorHandler(nil, nil)
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil)
+	errorHandler(rr, req, &proxyErrorWithStatus{error: errors.New("upstream 500"), StatusCode: http.StatusInternalServerError})
+	assertString(t, rr.Header().Get(noKeysAvailableHeader), "")
+}
+
+func TestCreateHealthHandler_DegradedBelowMinAvailableKeys(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	km.minAvailableKeys = 2
+	scope := buildScopeKey("host", "/health")
+	km.getNextKey(scope)
+
+	healthy := httptest.NewRecorder()
+	createHealthHandler(km, true)(healthy, httptest.NewRequest("GET", "http://localhost:8080/healthz", nil))
+	assertInt(t, healthy.Code, http.StatusOK)
+
+	km.markKeyFailed(scope, 0, "status 400")
+
+	degraded := httptest.NewRecorder()
+	createHealthHandler(km, true)(degraded, httptest.NewRequest("GET", "http://localhost:8080/healthz", nil))
+	assertInt(t, degraded.Code, http.StatusServiceUnavailable)
+	if !strings.Contains(degraded.Body.String(), "degraded: 1 scope(s) below 2 available keys: "+scope) {
+		t.Errorf("unexpected degraded body: %q", degraded.Body.String())
+	}
+
+	// Without -degrade-healthz the alarm only logs.
+	logOnly := httptest.NewRecorder()
+	createHealthHandler(km, false)(logOnly, httptest.NewRequest("GET", "http://localhost:8080/healthz", nil))
+	assertInt(t, logOnly.Code, http.StatusOK)
+}
+
+func TestCreateMainHandler_CorsMaxAgeAndExposeHeaders(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-ID", "req-1")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"corskey"}, 1*time.Minute)
+	mainHandler := createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{
+		toolMethods:       splitCommaList(defaultToolMethods),
+		corsMaxAge:        10 * time.Minute,
+		corsExposeHeaders: []string{"X-Request-ID", proxyAttemptsHeader},
+	})
+
+	// Preflight carries both headers.
+	preflight := httptest.NewRecorder()
+	mainHandler(preflight, httptest.NewRequest("OPTIONS", "http://localhost:8080/v1beta/models", nil))
+	assertInt(t, preflight.Code, http.StatusOK)
+	assertString(t, preflight.Header().Get("Access-Control-Max-Age"), "600")
+	assertString(t, preflight.Header().Get("Access-Control-Expose-Headers"), "X-Request-ID, X-Proxy-Attempts")
+
+	// Actual responses expose the configured headers.
+	actual := httptest.NewRecorder()
+	mainHandler(actual, httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil))
+	assertInt(t, actual.Code, http.StatusOK)
+	assertString(t, actual.Header().Get("Access-Control-Expose-Headers"), "X-Request-ID, X-Proxy-Attempts")
+	assertString(t, actual.Header().Get("X-Request-ID"), "req-1")
+
+	// Defaults omit both headers.
+	plain := httptest.NewRecorder()
+	createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{})(plain, httptest.NewRequest("OPTIONS", "http://localhost:8080/v1beta/models", nil))
+	assertString(t, plain.Header().Get("Access-Control-Max-Age"), "")
+	assertString(t, plain.Header().Get("Access-Control-Expose-Headers"), "")
+}
+
+func TestCORSAllowMethodsAndHeaders(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"corskey"}, 1*time.Minute)
+	mainHandler := createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{
+		toolMethods:      splitCommaList(defaultToolMethods),
+		corsAllowMethods: splitCommaList("GET,POST,OPTIONS"),
+		corsAllowHeaders: splitCommaList("Content-Type, x-goog-api-key"),
+	})
+
+	preflight := httptest.NewRecorder()
+	mainHandler(preflight, httptest.NewRequest("OPTIONS", "http://localhost:8080/v1beta/models", nil))
+	assertInt(t, preflight.Code, http.StatusOK)
+	assertString(t, preflight.Header().Get("Access-Control-Allow-Methods"), "GET, POST, OPTIONS")
+	assertString(t, preflight.Header().Get("Access-Control-Allow-Headers"), "Content-Type, x-goog-api-key")
+
+	// Defaults are unchanged when nothing is configured.
+	plain := httptest.NewRecorder()
+	createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{})(plain, httptest.NewRequest("OPTIONS", "http://localhost:8080/v1beta/models", nil))
+	assertString(t, plain.Header().Get("Access-Control-Allow-Methods"), defaultCORSAllowMethods)
+	assertString(t, plain.Header().Get("Access-Control-Allow-Headers"), defaultCORSAllowHeaders)
+}
+
+func TestLogSampleRate(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	km, _ := newKeyManager([]string{"k1"}, 1*time.Minute)
+	run := func(rate float64) string {
+		buf := captureLogs(t, levelInfo)
+		proxy := newTestProxy(targetServer, km, "key", nil)
+		proxy.ModifyResponse = createProxyModifyResponse(km, modifyResponseOptions{logSampleRate: rate})
+		mainHandler := createMainHandler(proxy, mainHandlerOptions{})
+		for range 3 {
+			rr := httptest.NewRecorder()
+			mainHandler(rr, httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil))
+			assertInt(t, rr.Code, http.StatusOK)
+		}
+		return buf.String()
+	}
+
+	if out := run(0); strings.Contains(out, "Sampled:") {
+		t.Errorf("Expected no sampled lines at rate 0, got: %s", out)
+	}
+	out := run(1)
+	assertInt(t, strings.Count(out, "Sampled:"), 3)
+	if !strings.Contains(out, "[INFO] Sampled: GET /v1beta/models") || !strings.Contains(out, "key index 0 -> status 200") {
+		t.Errorf("Unexpected sampled line: %s", out)
+	}
+}
+
+func TestScopeUsesTargetHost(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer targetServer.Close()
+	targetURL, _ := url.Parse(targetServer.URL)
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	mainHandler := createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{})
+	for _, host := range []string{"localhost:8080", "proxy.internal.example", ""} {
+		req := httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil)
+		req.Host = host
+		mainHandler(httptest.NewRecorder(), req)
+	}
+
+	scopes := km.snapshot().Scopes
+	assertInt(t, len(scopes), 1)
+	if _, ok := scopes[buildScopeKey(targetURL.Host, "/v1beta/models")]; !ok {
+		t.Errorf("expected the scope to use the target host %s, got %v", targetURL.Host, scopes)
+	}
+}
+
+func TestProxyDirector_RecordsScope(t *testing.T) {
+	targetURL, _ := url.Parse("https://generativelanguage.googleapis.com")
+	director := createProxyDirector(targetURL, httputil.NewSingleHostReverseProxy(targetURL).Director, directorOptions{stripPrefix: "/gemini"})
+
+	req := httptest.NewRequest("GET", "http://proxy.local:8080/gemini/v1beta/models", nil)
+	director(req)
+	assertString(t, req.URL.Host, "generativelanguage.googleapis.com")
+	assertString(t, req.Context().Value(scopeContextKey).(string), "generativelanguage.googleapis.com|/gemini/v1beta/models")
+
+	// The recorded scope wins over the attempt's URL (e.g. a per-key target).
+	req.URL.Host = "europe-west4.example.com"
+	assertString(t, requestScope(req), "generativelanguage.googleapis.com|/gemini/v1beta/models")
+}
+
+func TestNoKeysAvailable_ServesFallbackResponse(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer targetServer.Close()
+	targetURL, _ := url.Parse(targetServer.URL)
+
+	fallbacks, err := parseFallbackResponses(`[{"path":"/v1beta/models","body":{"models":[]}},{"path":"/v1beta/models/gemini-pro","status":202,"body":"busy"}]`)
+	assertNoError(t, err)
+
+	km, _ := newKeyManager([]string{"k1"}, 1*time.Minute)
+	proxy := newTestProxy(targetServer, km, "key", nil)
+	proxy.ErrorHandler = createProxyErrorHandler(km, fallbacks)
+	mainHandler := createMainHandler(proxy, mainHandlerOptions{})
+	for _, path := range []string{"/v1beta/models", "/v1beta/models/gemini-pro:generateContent", "/v1beta/files"} {
+		km.markKeyFailed(buildScopeKey(targetURL.Host, path), 0, "status 429")
+	}
+
+	rr := httptest.NewRecorder()
+	mainHandler(rr, httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil))
+	assertInt(t, rr.Code, http.StatusOK)
+	assertString(t, rr.Body.String(), `{"models":[]}`)
+	assertString(t, rr.Header().Get("Content-Type"), "application/json")
+	assertString(t, rr.Header().Get(noKeysAvailableHeader), "true")
+
+	// The most specific fallback wins.
+	rr = httptest.NewRecorder()
+	mainHandler(rr, httptest.NewRequest("POST", "http://localhost:8080/v1beta/models/gemini-pro:generateContent", strings.NewReader(`{}`)))
+	assertInt(t, rr.Code, http.StatusAccepted)
+	assertString(t, rr.Body.String(), `"busy"`)
+
+	// Paths without a fallback keep the default 503.
+	rr = httptest.NewRecorder()
+	mainHandler(rr, httptest.NewRequest("GET", "http://localhost:8080/v1beta/files", nil))
+	assertInt(t, rr.Code, http.StatusServiceUnavailable)
+	assertString(t, rr.Header().Get(noKeysAvailableHeader), "true")
+}
+
+func TestNoKeysAvailable_FallbackNotServedForRelayedRateLimit(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer targetServer.Close()
+
+	fallbacks, err := parseFallbackResponses(`[{"path":"/v1beta/models","body":{"models":[]}}]`)
+	assertNoError(t, err)
+	km, _ := newKeyManager([]string{"k1"}, 1*time.Minute)
+	proxy := newTestProxy(targetServer, km, "key", nil)
+	proxy.ErrorHandler = createProxyErrorHandler(km, fallbacks)
+	mainHandler := createMainHandler(proxy, mainHandlerOptions{})
+
+	// The upstream's 429 sidelines the only key; the client gets that 429, not the fallback.
+	rr := httptest.NewRecorder()
+	mainHandler(rr, httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil))
+	assertInt(t, rr.Code, http.StatusTooManyRequests)
+	assertString(t, rr.Header().Get(noKeysAvailableHeader), "")
+
+	// Only once the key manager has no key for the request does the fallback apply.
+	rr = httptest.NewRecorder()
+	mainHandler(rr, httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil))
+	assertInt(t, rr.Code, http.StatusOK)
+	assertString(t, rr.Body.String(), `{"models":[]}`)
+	assertString(t, rr.Header().Get(noKeysAvailableHeader), "true")
+}
+
+func TestParseFallbackResponses_Invalid(t *testing.T) {
+	cases := map[string]string{
+		`{"path":"/x"}`:                         "invalid fallback response spec",
+		`[{"path":"","body":{}}]`:               "path is required",
+		`[{"path":"/x"}]`:                       "body is required",
+		`[{"path":"/x","status":42,"body":{}}]`: "invalid status 42",
+		`[{"path":"/x","body":{},"code":200}]`:  "unknown field",
+	}
+	for raw, want := range cases {
+		_, err := parseFallbackResponses(raw)
+		assertErrorContains(t, err, want)
+	}
+	fallbacks, err := parseFallbackResponses("")
+	assertNoError(t, err)
+	assertInt(t, len(fallbacks), 0)
+}
+
+func TestLogStreamChunks(t *testing.T) {
+	chunks := []string{"data: {\"n\":1}\n\n", "data: {\"n\":2}\n\n", "data: {\"n\":3}\n\n"}
+	release := make(chan struct{})
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+		for i, chunk := range chunks {
+			if i == 1 {
+				<-release // the first chunk must reach the client before the rest is sent
+			}
+			io.WriteString(w, chunk)
+			flusher.Flush()
+		}
+	}))
+	defer targetServer.Close()
+
+	buf := captureLogs(t, levelInfo)
+	km, _ := newKeyManager([]string{"k1"}, 1*time.Minute)
+	proxy := newTestProxy(targetServer, km, "key", nil)
+	proxy.ModifyResponse = createProxyModifyResponse(km, modifyResponseOptions{logStreamChunks: 2})
+	proxy.FlushInterval = -1
+	proxyServer := httptest.NewServer(createMainHandler(proxy, mainHandlerOptions{}))
+	defer proxyServer.Close()
+
+	resp, err := http.Get(proxyServer.URL + "/v1beta/models/gemini-pro:streamGenerateContent?alt=sse")
+	assertNoError(t, err)
+	defer resp.Body.Close()
+	first := make([]byte, len(chunks[0]))
+	_, err = io.ReadFull(resp.Body, first)
+	assertNoError(t, err)
+	assertString(t, string(first), chunks[0])
+	close(release)
+	rest, _ := io.ReadAll(resp.Body)
+	assertString(t, string(rest), chunks[1]+chunks[2])
+
+	out := buf.String()
+	if !strings.Contains(out, `Stream chunk 1 for /v1beta/models/gemini-pro:streamGenerateContent (15 bytes): "data: {\"n\":1}\n\n"`) {
+		t.Errorf("expected the first chunk to be logged, got:\n%s", out)
+	}
+	if !strings.Contains(out, "Stream chunk 2") || strings.Contains(out, "Stream chunk 3") {
+		t.Errorf("expected exactly two chunks to be logged, got:\n%s", out)
+	}
+}
+
+func TestNoBodyLogging(t *testing.T) {
+	const errorBody = `{"error":{"message":"sensitive patient data"}}`
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, errorBody)
+	}))
+	defer targetServer.Close()
+
+	disableBodyLogging = true
+	t.Cleanup(func() { disableBodyLogging = false })
+	buf := captureLogs(t, levelDebug)
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	rr := httptest.NewRecorder()
+	createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{})(rr, httptest.NewRequest("GET", "http://localhost:8080/v1beta/models", nil))
+
+	assertInt(t, rr.Code, http.StatusBadRequest)
+	assertString(t, rr.Body.String(), errorBody)
+	if strings.Contains(buf.String(), "sensitive patient data") {
+		t.Errorf("response body was logged:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "Non-2xx Response (Status 400); body logging is disabled.") {
+		t.Errorf("expected the status to be logged, got:\n%s", buf.String())
+	}
+}
+
+func TestProxyDirector_UserAgent(t *testing.T) {
+	targetURL, _ := url.Parse("https://generativelanguage.googleapis.com")
+	originalDirector := httputil.NewSingleHostReverseProxy(targetURL).Director
+
+	// Pass-through by default.
+	req := httptest.NewRequest("GET", "http://proxy.local:8080/v1beta/models", nil)
+	req.Header.Set("User-Agent", "client/2.0")
+	createProxyDirector(targetURL, originalDirector, directorOptions{})(req)
+	assertString(t, req.Header.Get("User-Agent"), "client/2.0")
+
+	// Overridden, with the proxy version appended.
+	req = httptest.NewRequest("GET", "http://proxy.local:8080/v1beta/models", nil)
+	req.Header.Set("User-Agent", "client/2.0")
+	createProxyDirector(targetURL, originalDirector, directorOptions{userAgent: "my-app/1.0"})(req)
+	assertString(t, req.Header.Get("User-Agent"), "my-app/1.0 ai-proxy/"+proxyVersion)
+}
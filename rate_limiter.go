@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// clientBucket is a token bucket for a single client IP.
+type clientBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// clientRateLimiter rate-limits requests per client IP using token buckets,
+// so a single client cannot drain the whole key pool.
+type clientRateLimiter struct {
+	mu      sync.Mutex
+	rps     float64
+	burst   float64
+	buckets map[string]*clientBucket
+	// Buckets idle for longer than this are dropped by cleanup.
+	idleTTL time.Duration
+}
+
+// newClientRateLimiter creates a limiter allowing rps requests per second per IP with the given burst,
+// and starts a background goroutine that removes idle client entries.
+func newClientRateLimiter(rps float64, burst int) *clientRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	rl := &clientRateLimiter{
+		rps:     rps,
+		burst:   float64(burst),
+		buckets: make(map[string]*clientBucket),
+		idleTTL: 10 * time.Minute,
+	}
+	go rl.cleanupLoop()
+	return rl
+}
+
+// allow consumes a token for ip. If none is available it returns false and how long
+// the client should wait before the next token becomes available.
+func (rl *clientRateLimiter) allow(ip string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	b, ok := rl.buckets[ip]
+	if !ok {
+		b = &clientBucket{tokens: rl.burst, lastSeen: now}
+		rl.buckets[ip] = b
+	} else {
+		elapsed := now.Sub(b.lastSeen).Seconds()
+		b.tokens = math.Min(rl.burst, b.tokens+elapsed*rl.rps)
+		b.lastSeen = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / rl.rps * float64(time.Second))
+	return false, wait
+}
+
+// cleanupLoop periodically drops idle client buckets to bound memory use.
+func (rl *clientRateLimiter) cleanupLoop() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		rl.cleanup()
+	}
+}
+
+// cleanup removes buckets that have not been used for longer than idleTTL.
+func (rl *clientRateLimiter) cleanup() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	removed := 0
+	cutoff := time.Now().Add(-rl.idleTTL)
+	for ip, b := range rl.buckets {
+		if b.lastSeen.Before(cutoff) {
+			delete(rl.buckets, ip)
+			removed++
+		}
+	}
+	return removed
+}
+
+// clientIP extracts the client IP from the request's RemoteAddr.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// wrap returns a handler that rejects clients exceeding their rate with 429 and Retry-After.
+// OPTIONS preflight requests are never limited.
+func (rl *clientRateLimiter) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := clientIP(r)
+		if ok, wait := rl.allow(ip); !ok {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			logWarnf("Rate limit exceeded for client %s on %s %s (retry after %ds)", ip, r.Method, r.URL.Path, retryAfter)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// concurrencyRetryAfter is the Retry-After value (seconds) sent when the in-flight cap is reached.
+const concurrencyRetryAfter = 1
+
+// concurrencyLimiter caps the number of proxied requests handled at once, so a traffic spike
+// fails fast with 503 instead of piling up goroutines and upstream connections.
+type concurrencyLimiter struct {
+	slots chan struct{}
+}
+
+// newConcurrencyLimiter creates a limiter allowing at most max requests in flight.
+func newConcurrencyLimiter(max int) *concurrencyLimiter {
+	return &concurrencyLimiter{slots: make(chan struct{}, max)}
+}
+
+// wrap returns a handler that rejects requests with 503 and Retry-After while the cap is reached.
+func (cl *concurrencyLimiter) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case cl.slots <- struct{}{}:
+			defer func() { <-cl.slots }()
+			next.ServeHTTP(w, r)
+		default:
+			logWarnf("Concurrency limit of %d reached, rejecting %s %s from %s", cap(cl.slots), r.Method, r.URL.Path, clientIP(r))
+			w.Header().Set("Retry-After", strconv.Itoa(concurrencyRetryAfter))
+			http.Error(w, "Service Unavailable: too many concurrent requests", http.StatusServiceUnavailable)
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientRateLimiter_ThrottlesPerIP(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	rl := newClientRateLimiter(0.5, 2) // Slow refill so the test does not race the clock
+	handler := rl.wrap(next)
+
+	doRequest := func(remoteAddr, method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://localhost:8080/v1beta/models", nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Burst of 2 is allowed, the third request is throttled.
+	assertInt(t, doRequest("203.0.113.1:1000", "GET").Code, http.StatusOK)
+	assertInt(t, doRequest("203.0.113.1:1001", "GET").Code, http.StatusOK)
+	throttled := doRequest("203.0.113.1:1002", "GET")
+	assertInt(t, throttled.Code, http.StatusTooManyRequests)
+	if throttled.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After header on throttled response")
+	}
+
+	// A different IP has its own bucket.
+	assertInt(t, doRequest("203.0.113.2:1000", "GET").Code, http.StatusOK)
+
+	// OPTIONS preflight requests are exempt.
+	assertInt(t, doRequest("203.0.113.1:1003", "OPTIONS").Code, http.StatusOK)
+}
+
+func TestClientRateLimiter_RefillsOverTime(t *testing.T) {
+	rl := newClientRateLimiter(50, 1)
+
+	ok, _ := rl.allow("198.51.100.1")
+	if !ok {
+		t.Fatal("expected first request to be allowed")
+	}
+	ok, wait := rl.allow("198.51.100.1")
+	if ok {
+		t.Fatal("expected second immediate request to be throttled")
+	}
+	if wait <= 0 {
+		t.Errorf("expected a positive wait, got %v", wait)
+	}
+
+	time.Sleep(40 * time.Millisecond) // 50 rps refills one token every 20ms
+	ok, _ = rl.allow("198.51.100.1")
+	if !ok {
+		t.Error("expected request to be allowed after refill")
+	}
+}
+
+func TestClientRateLimiter_CleanupRemovesIdleEntries(t *testing.T) {
+	rl := newClientRateLimiter(1, 1)
+	rl.allow("198.51.100.1")
+	rl.allow("198.51.100.2")
+
+	rl.mu.Lock()
+	rl.buckets["198.51.100.1"].lastSeen = time.Now().Add(-2 * rl.idleTTL)
+	rl.mu.Unlock()
+
+	assertInt(t, rl.cleanup(), 1)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	assertMapLength(t, rl.buckets, 1)
+	if _, ok := rl.buckets["198.51.100.2"]; !ok {
+		t.Error("expected active client entry to be retained")
+	}
+}
+
+func TestConcurrencyLimiter_RejectsOverCap(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := newConcurrencyLimiter(2).wrap(next)
+
+	doRequest := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://localhost:8080/v1beta/models/gemini-pro:generateContent", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	results := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() { results <- doRequest().Code }()
+	}
+	<-started
+	<-started
+
+	// Both slots are held, so the third request is rejected immediately.
+	rejected := doRequest()
+	assertInt(t, rejected.Code, http.StatusServiceUnavailable)
+	assertString(t, rejected.Header().Get("Retry-After"), "1")
+
+	close(release)
+	assertInt(t, <-results, http.StatusOK)
+	assertInt(t, <-results, http.StatusOK)
+
+	// Slots are released once the in-flight requests finish.
+	assertInt(t, doRequest().Code, http.StatusOK)
+}
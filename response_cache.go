@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheStatusHeader reports whether a response was served from the response cache.
+const cacheStatusHeader = "X-Cache"
+
+// cacheEntry is a cached response together with its lookup key and expiry.
+type cacheEntry struct {
+	key     string
+	resp    *bufferedResponse
+	expires time.Time
+}
+
+// responseCache is an in-memory LRU cache of successful responses to idempotent requests.
+// Requests are keyed like the coalescer's (method, request URI, Accept-Encoding and body),
+// and cache hits are served without contacting the upstream, so they consume no key.
+type responseCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	order      *list.List // most recently used at the front; values are *cacheEntry
+	entries    map[string]*list.Element
+	now        func() time.Time
+}
+
+// newResponseCache creates a cache holding up to maxEntries responses for ttl each.
+func newResponseCache(ttl time.Duration, maxEntries int) *responseCache {
+	return &responseCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+		now:        time.Now,
+	}
+}
+
+// isCacheable reports whether a request's response may be cached: GET and HEAD requests,
+// and countTokens calls, whose result depends only on the request body. Streaming calls
+// and WebSocket upgrades are never cached.
+func isCacheable(r *http.Request) bool {
+	if strings.HasSuffix(r.URL.Path, ":streamGenerateContent") || isWebSocketUpgrade(r) {
+		return false
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPost:
+		return strings.HasSuffix(r.URL.Path, ":countTokens")
+	}
+	return false
+}
+
+// get returns the cached response for key, or nil if there is none or it has expired.
+func (c *responseCache) get(key string) *bufferedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil
+	}
+	c.order.MoveToFront(elem)
+	return entry.resp
+}
+
+// put stores resp under key, evicting the least recently used entry when the cache is full.
+func (c *responseCache) put(key string, resp *bufferedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &cacheEntry{key: key, resp: resp, expires: c.now().Add(c.ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// hasCacheDirective reports whether the Cache-Control header contains directive.
+func hasCacheDirective(header http.Header, directive string) bool {
+	for _, value := range header.Values("Cache-Control") {
+		for _, d := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if strings.EqualFold(name, directive) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// storable reports whether a recorded response may be cached: 2xx, not a stream, and not
+// marked Cache-Control: no-store by the upstream.
+func storable(resp *bufferedResponse) bool {
+	if hasCacheDirective(resp.header, "no-store") {
+		return false
+	}
+	statusCode := resp.statusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	if statusCode < 200 || statusCode > 299 {
+		return false
+	}
+	return !strings.HasPrefix(resp.header.Get("Content-Type"), "text/event-stream")
+}
+
+// wrap returns a handler that serves cacheable requests from the cache when possible and
+// caches successful responses from next, honoring Cache-Control on requests and responses.
+func (c *responseCache) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isCacheable(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var bodyBytes []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			var err error
+			bodyBytes, err = io.ReadAll(io.LimitReader(r.Body, bodyReadLimit+1))
+			if err != nil {
+				logWarnf("[Cache] Error reading request body for %s: %v", r.URL.Path, err)
+				http.Error(w, "Error reading request body", http.StatusBadRequest)
+				return
+			}
+			if len(bodyBytes) > bodyReadLimit {
+				// Too large to hash and hold safely; forward without caching.
+				r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(bodyBytes), r.Body))
+				next.ServeHTTP(w, r)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+		}
+
+		// Cache-Control: no-cache asks for a fresh response, which is still cached;
+		// no-store also keeps the response out of the cache.
+		noStore := hasCacheDirective(r.Header, "no-store")
+		skipLookup := noStore || hasCacheDirective(r.Header, "no-cache")
+
+		// The coalesce key also covers the headers that change the upstream request.
+		key := coalesceKey(r, bodyBytes)
+		if skipLookup {
+			logDebugf("[Cache] Bypassing cache lookup for %s %s (Cache-Control)", r.Method, r.URL.Path)
+		} else if cached := c.get(key); cached != nil {
+			logDebugf("[Cache] Hit for %s %s", r.Method, r.URL.Path)
+			w.Header().Set(cacheStatusHeader, "HIT")
+			cached.replay(w)
+			return
+		}
+
+		resp := newBufferedResponse()
+		next.ServeHTTP(resp, r)
+		if !noStore && storable(resp) {
+			c.put(key, resp)
+		}
+		w.Header().Set(cacheStatusHeader, "MISS")
+		resp.replay(w)
+	})
+}
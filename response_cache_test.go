@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingHandler answers with the number of times it has been called.
+func countingHandler(calls *atomic.Int32, status int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"call":%d}`, n)
+	})
+}
+
+// serveCached sends a request through handler and returns the recorder.
+func serveCached(handler http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rr
+}
+
+func TestResponseCache_HitAndMiss(t *testing.T) {
+	var calls atomic.Int32
+	handler := newResponseCache(time.Minute, 10).wrap(countingHandler(&calls, http.StatusOK))
+
+	rr := serveCached(handler, "GET", "/v1beta/models", "")
+	assertString(t, rr.Header().Get(cacheStatusHeader), "MISS")
+	assertString(t, rr.Body.String(), `{"call":1}`)
+
+	rr = serveCached(handler, "GET", "/v1beta/models", "")
+	assertString(t, rr.Header().Get(cacheStatusHeader), "HIT")
+	assertString(t, rr.Body.String(), `{"call":1}`)
+	assertString(t, rr.Header().Get("Content-Type"), "application/json")
+
+	// A different URI or body is a different entry.
+	serveCached(handler, "GET", "/v1beta/models?pageSize=5", "")
+	serveCached(handler, "POST", "/v1beta/models/gemini-pro:countTokens", `{"a":1}`)
+	rr = serveCached(handler, "POST", "/v1beta/models/gemini-pro:countTokens", `{"a":2}`)
+	assertString(t, rr.Header().Get(cacheStatusHeader), "MISS")
+	rr = serveCached(handler, "POST", "/v1beta/models/gemini-pro:countTokens", `{"a":1}`)
+	assertString(t, rr.Header().Get(cacheStatusHeader), "HIT")
+	assertInt(t, int(calls.Load()), 4)
+
+	// Non-idempotent and streaming requests are never cached.
+	for range 2 {
+		serveCached(handler, "POST", "/v1beta/models/gemini-pro:generateContent", `{}`)
+		serveCached(handler, "POST", "/v1beta/models/gemini-pro:streamGenerateContent", `{}`)
+	}
+	assertInt(t, int(calls.Load()), 8)
+}
+
+func TestResponseCache_OnlyCachesSuccess(t *testing.T) {
+	var calls atomic.Int32
+	handler := newResponseCache(time.Minute, 10).wrap(countingHandler(&calls, http.StatusServiceUnavailable))
+
+	serveCached(handler, "GET", "/v1beta/models", "")
+	rr := serveCached(handler, "GET", "/v1beta/models", "")
+	assertInt(t, rr.Code, http.StatusServiceUnavailable)
+	assertString(t, rr.Header().Get(cacheStatusHeader), "MISS")
+	assertInt(t, int(calls.Load()), 2)
+}
+
+func TestResponseCache_TTLExpiry(t *testing.T) {
+	var calls atomic.Int32
+	cache := newResponseCache(time.Minute, 10)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	handler := cache.wrap(countingHandler(&calls, http.StatusOK))
+
+	serveCached(handler, "GET", "/v1beta/models", "")
+	now = now.Add(59 * time.Second)
+	assertString(t, serveCached(handler, "GET", "/v1beta/models", "").Header().Get(cacheStatusHeader), "HIT")
+	now = now.Add(time.Second)
+	rr := serveCached(handler, "GET", "/v1beta/models", "")
+	assertString(t, rr.Header().Get(cacheStatusHeader), "MISS")
+	assertString(t, rr.Body.String(), `{"call":2}`)
+}
+
+func TestResponseCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	var calls atomic.Int32
+	handler := newResponseCache(time.Minute, 2).wrap(countingHandler(&calls, http.StatusOK))
+
+	serveCached(handler, "GET", "/a", "")
+	serveCached(handler, "GET", "/b", "")
+	serveCached(handler, "GET", "/a", "") // /a is now the most recently used
+	serveCached(handler, "GET", "/c", "") // evicts /b
+
+	assertString(t, serveCached(handler, "GET", "/a", "").Header().Get(cacheStatusHeader), "HIT")
+	assertString(t, serveCached(handler, "GET", "/b", "").Header().Get(cacheStatusHeader), "MISS")
+}
+
+func TestResponseCache_RequestCacheControlBypass(t *testing.T) {
+	var calls atomic.Int32
+	handler := newResponseCache(time.Minute, 10).wrap(countingHandler(&calls, http.StatusOK))
+	serveWith := func(cacheControl string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/v1beta/models", nil)
+		req.Header.Set("Cache-Control", cacheControl)
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	serveCached(handler, "GET", "/v1beta/models", "")
+
+	// no-cache fetches a fresh response and caches it.
+	rr := serveWith("no-cache")
+	assertString(t, rr.Header().Get(cacheStatusHeader), "MISS")
+	assertString(t, rr.Body.String(), `{"call":2}`)
+	assertString(t, serveCached(handler, "GET", "/v1beta/models", "").Body.String(), `{"call":2}`)
+
+	// no-store fetches a fresh response without caching it.
+	rr = serveWith("max-age=0, No-Store")
+	assertString(t, rr.Header().Get(cacheStatusHeader), "MISS")
+	assertString(t, rr.Body.String(), `{"call":3}`)
+	assertString(t, serveCached(handler, "GET", "/v1beta/models", "").Body.String(), `{"call":2}`)
+}
+
+func TestResponseCache_ResponseNoStore(t *testing.T) {
+	var calls atomic.Int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "private, no-store")
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := newResponseCache(time.Minute, 10).wrap(next)
+
+	serveCached(handler, "GET", "/v1beta/models", "")
+	rr := serveCached(handler, "GET", "/v1beta/models", "")
+	assertString(t, rr.Header().Get(cacheStatusHeader), "MISS")
+	assertInt(t, int(calls.Load()), 2)
+}
+
+func TestResponseCache_SkipsWebSocketUpgrades(t *testing.T) {
+	var calls atomic.Int32
+	handler := newResponseCache(time.Minute, 10).wrap(countingHandler(&calls, http.StatusOK))
+
+	for range 2 {
+		req := httptest.NewRequest("GET", "/ws/live", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assertString(t, rr.Header().Get(cacheStatusHeader), "")
+	}
+	assertInt(t, int(calls.Load()), 2)
+}
+
+func TestResponseCache_KeyIncludesRequestShapingHeaders(t *testing.T) {
+	var calls atomic.Int32
+	handler := newResponseCache(time.Minute, 10).wrap(countingHandler(&calls, http.StatusOK))
+
+	serve := func(name, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v1beta/models", nil)
+		if name != "" {
+			req.Header.Set(name, value)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	serve("", "")
+	for _, name := range []string{targetOverrideHeader, disableToolInjectionHeader, keySessionHeader} {
+		rr := serve(name, "a")
+		assertString(t, rr.Header().Get(cacheStatusHeader), "MISS") // Must not reuse the plain entry
+		rr = serve(name, "b")
+		assertString(t, rr.Header().Get(cacheStatusHeader), "MISS")
+		rr = serve(name, "a")
+		assertString(t, rr.Header().Get(cacheStatusHeader), "HIT")
+	}
+	assertInt(t, int(calls.Load()), 7)
+}
@@ -1,25 +1,112 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
-	// Added time import
+	"sync/atomic"
+	"time"
 )
 
 // proxyErrorWithStatus wraps an error with the HTTP status code from the last response.
 type proxyErrorWithStatus struct {
 	error
 	StatusCode int
+	// Upstream Retry-After value when the failure was caused by rate limiting (429), if it sent one.
+	RetryAfter string
 }
 
+// Unwrap exposes the underlying error to errors.Is and errors.As.
+func (e *proxyErrorWithStatus) Unwrap() error {
+	return e.error
+}
+
+// retryTracker counts retries and upstream attempts spent across the whole lifetime of a
+// client request, which may span several RoundTrip calls. It is shared via the request context.
+type retryTracker struct {
+	retries  atomic.Int32
+	attempts atomic.Int32
+	// Time to response headers of the latest attempt, and the total of all earlier attempts.
+	lastAttemptNanos atomic.Int64
+	retryNanos       atomic.Int64
+	// When the proxy received the client request (see retryTransport.requestMaxAge).
+	received time.Time
+}
+
+// recordAttempt records the duration of an upstream attempt. The previous latest attempt,
+// if any, was retried, so its time moves to the retry total.
+func (t *retryTracker) recordAttempt(d time.Duration) {
+	t.retryNanos.Add(t.lastAttemptNanos.Swap(int64(d)))
+}
+
+// setServerTimingHeader sets a Server-Timing header reporting time spent in the final upstream
+// attempt and in earlier (retried) attempts, in milliseconds. It does nothing before the first attempt.
+func setServerTimingHeader(header http.Header, ctx context.Context) {
+	tracker := retryTrackerFromContext(ctx)
+	if tracker == nil || tracker.attempts.Load() == 0 {
+		return
+	}
+	upstream := time.Duration(tracker.lastAttemptNanos.Load())
+	retries := time.Duration(tracker.retryNanos.Load())
+	header.Set("Server-Timing", fmt.Sprintf("upstream;dur=%.1f, retries;dur=%.1f", durationMillis(upstream), durationMillis(retries)))
+}
+
+// durationMillis converts d to fractional milliseconds.
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// proxyAttemptsHeader reports to the client how many upstream attempts were made.
+const proxyAttemptsHeader = "X-Proxy-Attempts"
+
+// setAttemptsHeader sets proxyAttemptsHeader from the request's retryTracker, if it has one.
+func setAttemptsHeader(header http.Header, ctx context.Context) {
+	if tracker := retryTrackerFromContext(ctx); tracker != nil {
+		header.Set(proxyAttemptsHeader, strconv.Itoa(int(tracker.attempts.Load())))
+	}
+}
+
+const retryTrackerContextKey contextKey = "retryTracker"
+
+// withRetryTracker returns a context carrying a fresh retryTracker.
+func withRetryTracker(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryTrackerContextKey, &retryTracker{received: time.Now()})
+}
+
+// retryTrackerFromContext returns the request's retryTracker, or nil if there is none.
+func retryTrackerFromContext(ctx context.Context) *retryTracker {
+	tracker, _ := ctx.Value(retryTrackerContextKey).(*retryTracker)
+	return tracker
+}
+
+// tryConsume records one retry if the budget allows it. A budget <= 0 is unlimited.
+func (t *retryTracker) tryConsume(budget int) bool {
+	for {
+		current := t.retries.Load()
+		if budget > 0 && int(current) >= budget {
+			return false
+		}
+		if t.retries.CompareAndSwap(current, current+1) {
+			return true
+		}
+	}
+}
+
+// keySessionHeader pins a client's requests to the same key (sticky sessions) while it is available.
+const keySessionHeader = "X-Key-Session"
+
 const (
 	maxRetries    = 3
 	bodyReadLimit = 10 * 1024 * 1024 // Limit body size for buffering (e.g., 10MB)
@@ -32,6 +119,243 @@ type retryTransport struct {
 	keyMan              *keyManager
 	keyParam            string
 	headerAuthPaths     []string
+	// Maximum retries across the whole client request (see retryTracker). Zero means
+	// only maxRetries per RoundTrip applies.
+	retryBudget int
+	// Status codes that are never retried, whatever their class (see parseStatusCodes).
+	noRetryStatuses map[int]bool
+	// Header carrying the key on header-auth paths, and the optional scheme prefixed to
+	// the key (e.g. "Bearer"). An empty scheme sends the bare key.
+	authHeader string
+	authScheme string
+	// When non-nil, a non-streaming 2xx response whose body matches is retried with another
+	// key, and its key sidelined, as if it had failed (see matchRetryBodyPattern).
+	retryBodyPattern *regexp.Regexp
+	// Key indices holding OAuth access tokens (see splitBearerKeys), always sent as
+	// "Authorization: Bearer" whatever the path.
+	bearerKeys map[int]bool
+	// Per-key upstream scheme/host, by key index (see splitKeyTargets). Keys without an
+	// entry use the request's target. Scopes still follow the original request host.
+	keyTargets map[int]*url.URL
+	// Per-scope byte counters (see proxyMetrics). Nil disables byte accounting.
+	metrics *proxyMetrics
+	// When non-nil, query parameters not in this set are dropped before forwarding.
+	// The injected key parameter is always kept.
+	allowedQueryParams map[string]bool
+	// Wait between attempts (see backoffPolicy). The zero value retries immediately.
+	backoff backoffPolicy
+	// No retry is started once this long has passed since the client request was received;
+	// the request fails with 504 instead. Zero disables the limit.
+	requestMaxAge time.Duration
+	// Ask the upstream for gzip and decompress the final response (see decompressResponse),
+	// so ModifyResponse and the client always see a plaintext body.
+	decompressResponses bool
+	// When positive, an idempotent request still unanswered after this long is also sent with
+	// another key, and the first usable response wins (see hedgedRoundTrip).
+	hedgeDelay time.Duration
+}
+
+// defaultNoRetryStatuses lists the 5xx codes that are unlikely to change on retry.
+const defaultNoRetryStatuses = "501,505"
+
+// parseStatusCodes parses a comma-separated list of HTTP status codes into a set.
+func parseStatusCodes(raw string) (map[int]bool, error) {
+	codes := make(map[int]bool)
+	for _, entry := range splitCommaList(raw) {
+		code, err := strconv.Atoi(entry)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status code %q", entry)
+		}
+		codes[code] = true
+	}
+	return codes, nil
+}
+
+// newAttemptRequest clones req for one upstream attempt with the key at keyIndex: it restores
+// the buffered body, routes to the key's own target if it has one, and applies authentication.
+func (rt *retryTransport) newAttemptRequest(req *http.Request, bodyBytes []byte, scope string, keyIndex int, apiKey string, attempt int) *http.Request {
+	// --- Clone Request and Set Context/Body ---
+	// Clone the request for this attempt to avoid modifying the original request shared across retries.
+	// Use the request's original context as the base.
+	ctx := context.WithValue(req.Context(), keyIndexContextKey, keyIndex)
+	// The key itself, so a failure reported after a key reload is not pinned on another key.
+	ctx = context.WithValue(ctx, apiKeyContextKey, apiKey)
+	// Per-key targets change the attempt's host, so pass the scope on for ModifyResponse.
+	ctx = context.WithValue(ctx, scopeContextKey, scope)
+	currentReq := req.Clone(ctx)
+	currentReq.Header.Del(keySessionHeader) // Proxy control header, not for the upstream
+	if rt.decompressResponses && !isWebSocketUpgrade(currentReq) {
+		// Any client accepts identity, so the client's own Accept-Encoding is not needed.
+		currentReq.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	// Restore the body for this attempt. The body is fully buffered, so a chunked client
+	// request is forwarded with an explicit Content-Length instead.
+	currentReq.TransferEncoding = nil
+	currentReq.Header.Del("Transfer-Encoding")
+	if len(bodyBytes) > 0 {
+		currentReq.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+		currentReq.ContentLength = int64(len(bodyBytes))
+		currentReq.Header.Set("Content-Length", strconv.FormatInt(currentReq.ContentLength, 10))
+	} else {
+		// Ensure body is explicitly nil if no body bytes were read/buffered
+		currentReq.Body = http.NoBody
+		currentReq.ContentLength = 0
+		currentReq.Header.Del("Content-Length") // Remove header if no body
+	}
+
+	// Route this attempt to the key's own endpoint, if it has one.
+	if target, ok := rt.keyTargets[keyIndex]; ok {
+		logDebugf("[Retry Transport Attempt %d] Scope '%s': Routing key index %d to %s://%s", attempt+1, scopeForLog(scope), keyIndex, target.Scheme, target.Host)
+		currentReq.URL.Scheme = target.Scheme
+		currentReq.URL.Host = target.Host
+		currentReq.Host = target.Host
+	}
+
+	// --- Apply Authentication ---
+	useHeaderAuth := false
+	// WebSocket upgrades always carry the key in the query param, since headers
+	// cannot be changed once the connection has been upgraded.
+	isUpgrade := isWebSocketUpgrade(currentReq)
+	for _, path := range rt.headerAuthPaths {
+		if isUpgrade {
+			break
+		}
+		if strings.Contains(currentReq.URL.Path, path) {
+			useHeaderAuth = true
+			break
+		}
+	}
+
+	query := currentReq.URL.Query() // Get query parameters from the cloned request's URL
+	if rt.allowedQueryParams != nil {
+		for name := range query {
+			if !rt.allowedQueryParams[name] && name != rt.keyParam {
+				query.Del(name)
+			}
+		}
+	}
+	if rt.bearerKeys[keyIndex] {
+		logDebugf("[Retry Transport Attempt %d] Scope '%s': Using bearer token (Key Index: %d)", attempt+1, scopeForLog(scope), keyIndex)
+		currentReq.Header.Del(rt.authHeader)
+		currentReq.Header.Set("Authorization", "Bearer "+apiKey)
+		query.Del(rt.keyParam)
+	} else if useHeaderAuth {
+		logDebugf("[Retry Transport Attempt %d] Scope '%s': Using %s header (Key Index: %d)", attempt+1, scopeForLog(scope), rt.authHeader, keyIndex)
+		currentReq.Header.Del("Authorization") // Never forward the client's own credentials
+		authValue := apiKey
+		if rt.authScheme != "" {
+			authValue = rt.authScheme + " " + apiKey
+		}
+		currentReq.Header.Set(rt.authHeader, authValue)
+		query.Del(rt.keyParam) // Remove query param if it exists
+	} else {
+		logDebugf("[Retry Transport Attempt %d] Scope '%s': Using query parameter '%s' (Key Index: %d)", attempt+1, scopeForLog(scope), rt.keyParam, keyIndex)
+		currentReq.Header.Del("Authorization") // Ensure Authorization header is removed
+		currentReq.Header.Del(rt.authHeader)
+		query.Set(rt.keyParam, apiKey)
+	}
+	currentReq.URL.RawQuery = query.Encode() // Re-encode query parameters
+	return currentReq
+}
+
+// matchRetryBodyPattern buffers resp's body, reports whether it matches rt.retryBodyPattern,
+// and restores the body unchanged. Compressed bodies are decoded for matching only; Brotli
+// bodies (which cannot be decoded) and bodies over bodyReadLimit are passed through unmatched.
+// On a read error the body is closed.
+func (rt *retryTransport) matchRetryBodyPattern(resp *http.Response) (bool, error) {
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return false, nil
+	}
+	bodyBytes, err := io.ReadAll(io.LimitReader(resp.Body, bodyReadLimit+1))
+	if err != nil {
+		resp.Body.Close()
+		return false, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if len(bodyBytes) > bodyReadLimit {
+		logWarnf("Response body exceeds %d bytes; not matching -retry-body-pattern.", bodyReadLimit)
+		resp.Body = &decodedBody{Reader: io.MultiReader(bytes.NewReader(bodyBytes), resp.Body), body: resp.Body}
+		return false, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+
+	text := string(bodyBytes)
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+		decoded, err := decodeBodyForLog(encoding, bodyBytes, bodyReadLimit)
+		if errors.Is(err, errBrotliUnsupported) {
+			logDebugf("Not matching -retry-body-pattern against a br-encoded response body.")
+			return false, nil
+		}
+		if err != nil {
+			logWarnf("Could not decode %s-encoded response body for -retry-body-pattern: %v", encoding, err)
+			return false, nil
+		}
+		text = decoded
+	}
+	return rt.retryBodyPattern.MatchString(text), nil
+}
+
+// decodedBody reads a decompressed response body and closes the original one.
+type decodedBody struct {
+	io.Reader
+	body io.Closer
+}
+
+// Close closes the original response body.
+func (d *decodedBody) Close() error {
+	return d.body.Close()
+}
+
+// decompressResponse replaces a gzip- or deflate-encoded response body with a streaming
+// decoder and removes the Content-Encoding and Content-Length headers. Bodies with any other
+// encoding (e.g. br) are left as they are.
+func decompressResponse(resp *http.Response) error {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" || resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified ||
+		(resp.Request != nil && resp.Request.Method == http.MethodHead) {
+		return nil
+	}
+
+	buffered := bufio.NewReader(resp.Body)
+	var reader io.Reader
+	switch encoding {
+	case "gzip", "x-gzip":
+		if _, err := buffered.Peek(1); err == io.EOF {
+			reader = buffered // empty body
+			break
+		}
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		reader = gz
+	case "deflate":
+		// HTTP "deflate" is zlib-wrapped per the RFC, but some servers send raw deflate.
+		header, _ := buffered.Peek(2)
+		if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			zr, err := zlib.NewReader(buffered)
+			if err != nil {
+				return err
+			}
+			reader = zr
+		} else {
+			reader = flate.NewReader(buffered)
+		}
+	default:
+		logDebugf("Leaving %s-encoded response compressed", encoding)
+		return nil
+	}
+
+	resp.Body = &decodedBody{Reader: reader, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
 }
 
 // newRetryTransport creates a new retryTransport.
@@ -44,6 +368,9 @@ func newRetryTransport(transport http.RoundTripper, km *keyManager, keyParam str
 		keyMan:              km,
 		keyParam:            keyParam,
 		headerAuthPaths:     headerPaths,
+		noRetryStatuses:     map[int]bool{http.StatusNotImplemented: true, http.StatusHTTPVersionNotSupported: true},
+		authHeader:          "Authorization",
+		authScheme:          "Bearer",
 	}
 }
 
@@ -54,122 +381,176 @@ func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	var resp *http.Response
 	var bodyBytes []byte
 	var keyIndex int = -1 // Initialize keyIndex
+	attemptsMade := 0
+	// Set once an attempt is rate limited, so running out of keys afterwards is reported as 429.
+	rateLimited := false
+	rateLimitRetryAfter := ""
+
+	// Retries are counted per client request; fall back to a local tracker if none was set up.
+	tracker := retryTrackerFromContext(req.Context())
+	if tracker == nil {
+		tracker = &retryTracker{received: time.Now()}
+	}
 
 	// --- Buffer request body if necessary ---
 	// We need to buffer if it's not GET/HEAD/OPTIONS etc. *and* there's a body,
 	// as we might need to send it multiple times on retry.
-	if req.Body != nil && req.Body != http.NoBody && !isIdempotentMethod(req.Method) {
+	// Hedged requests are sent twice concurrently, so their bodies are buffered too.
+	if req.Body != nil && req.Body != http.NoBody && (!isIdempotentMethod(req.Method) || (rt.hedgeDelay > 0 && isHedgeable(req))) {
 		var readErr error
 		// Limit the amount read to prevent OOM errors with huge request bodies
 		limitedReader := io.LimitReader(req.Body, bodyReadLimit)
 		bodyBytes, readErr = io.ReadAll(limitedReader)
 		req.Body.Close() // Close original body reader
+		// A client that disconnects mid-upload leaves a partial body; don't send it upstream.
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			logInfof("[Retry Transport] Scope '%s': Request context done while reading the request body: %v", scopeForLog(requestScope(req)), ctxErr)
+			return nil, ctxErr
+		}
 		if readErr != nil {
 			return nil, fmt.Errorf("failed to read request body for potential retry: %w", readErr)
 		}
 		// Check if the body was truncated
 		if _, err := io.Copy(io.Discard, req.Body); err == nil {
 			// If we could still read more from the original body, it means the limit was hit
-			log.Printf("Warning: Request body exceeded %d bytes, potential truncation.", bodyReadLimit)
+			logWarnf("Request body exceeded %d bytes, potential truncation.", bodyReadLimit)
 			// Decide if this should be a hard error or just a warning
 			// return nil, fmt.Errorf("request body exceeded limit of %d bytes", bodyReadLimit)
 		}
 	}
 
+	// --- Sticky key session ---
+	preferredIndex := -1
+	if session := req.Header.Get(keySessionHeader); session != "" {
+		preferredIndex = rt.keyMan.sessionKeyIndex(session)
+	}
+
+	// Key indices already used for this request, so a retry moves on to a different key while one is available.
+	triedKeys := make(map[int]bool, maxRetries)
+
 	// --- Retry Loop ---
 	for attempt := range maxRetries {
+		// Stop before another attempt if the client went away or its deadline expired.
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			logInfof("[Retry Transport] Scope '%s': Request context done before attempt %d: %v", scopeForLog(requestScope(req)), attempt+1, ctxErr)
+			return nil, ctxErr
+		}
+		// Do not replay the buffered body once the request has grown too old.
+		if age := time.Since(tracker.received); attempt > 0 && rt.requestMaxAge > 0 && age > rt.requestMaxAge {
+			logErrorf("[Retry Transport] Scope '%s': Request is %s old, over the maximum age of %s; not retrying after %d attempts.", scopeForLog(requestScope(req)), age.Round(time.Millisecond), rt.requestMaxAge, attemptsMade)
+			return nil, &proxyErrorWithStatus{
+				error:      fmt.Errorf("request exceeded the maximum age of %s after %d attempts (scope '%s')", rt.requestMaxAge, attemptsMade, scopeForLog(requestScope(req))),
+				StatusCode: http.StatusGatewayTimeout,
+			}
+		}
+
 		// --- Create Scope Key ---
 		// Use the original request's URL to build the scope key, as it doesn't change between retries.
 		// Important: Use req.URL.Host and req.URL.Path from the *original* request passed to RoundTrip,
 		// not from currentReq inside the loop, as currentReq might have its Host field modified by the director.
-		scope := buildScopeKey(req.URL.Host, req.URL.Path)
+		scope := requestScope(req)
 
 		// --- Get API Key ---
-		apiKey, currentKeyIndex, keyErr := rt.keyMan.getNextKey(scope)
+		apiKey, currentKeyIndex, keyErr := rt.keyMan.getNextKeyExcluding(scope, preferredIndex, triedKeys)
 		if keyErr != nil {
-			log.Printf("[Retry Transport] Scope '%s': Error getting API key for attempt %d: %v", scope, attempt+1, keyErr)
+			logErrorf("[Retry Transport] Scope '%s': Error getting API key for attempt %d: %v", scopeForLog(scope), attempt+1, keyErr)
 			// If we couldn't get a key, even on the first attempt, return the error.
 			if resp != nil {
 				resp.Body.Close()
 			}
-			// Wrap the specific key error to give more context upstream
+			// Wrap the specific key error to give more context upstream. If an earlier attempt was
+			// rate limited, that is the root cause, so the client sees 429 and backs off; the key
+			// error is then not wrapped, so no X-No-Keys-Available header or fallback applies.
+			statusCode := http.StatusServiceUnavailable // Indicate no keys available for this scope
+			wrapped := fmt.Errorf("scope '%s': failed to get API key (attempt %d): %w", scopeForLog(scope), attempt+1, keyErr)
+			if rateLimited {
+				statusCode = http.StatusTooManyRequests
+				wrapped = fmt.Errorf("scope '%s': rate limited, and no other key to retry with (attempt %d): %v", scopeForLog(scope), attempt+1, keyErr)
+			}
 			return nil, &proxyErrorWithStatus{
-				error:      fmt.Errorf("scope '%s': failed to get API key (attempt %d): %w", scope, attempt+1, keyErr),
-				StatusCode: http.StatusServiceUnavailable, // Indicate no keys available for this scope
+				error:      wrapped,
+				StatusCode: statusCode,
+				RetryAfter: rateLimitRetryAfter,
 			}
 		}
 		keyIndex = currentKeyIndex // Store the index used for this attempt
 
-		// --- Clone Request and Set Context/Body ---
-		// Clone the request for this attempt to avoid modifying the original request shared across retries.
-		// Use the request's original context as the base.
-		ctx := context.WithValue(req.Context(), keyIndexContextKey, keyIndex)
-		currentReq := req.Clone(ctx)
-
-		// Restore the body for this attempt
-		if len(bodyBytes) > 0 {
-			currentReq.Body = io.NopCloser(bytes.NewReader(bodyBytes))
-			currentReq.ContentLength = int64(len(bodyBytes))
-			currentReq.Header.Set("Content-Length", strconv.FormatInt(currentReq.ContentLength, 10))
-		} else {
-			// Ensure body is explicitly nil if no body bytes were read/buffered
-			currentReq.Body = http.NoBody
-			currentReq.ContentLength = 0
-			currentReq.Header.Del("Content-Length") // Remove header if no body
-		}
-
-		// --- Apply Authentication ---
-		useHeaderAuth := false
-		for _, path := range rt.headerAuthPaths {
-			if strings.Contains(currentReq.URL.Path, path) {
-				useHeaderAuth = true
-				break
-			}
-		}
-
-		query := currentReq.URL.Query() // Get query parameters from the cloned request's URL
-		if useHeaderAuth {
-			log.Printf("[Retry Transport Attempt %d] Scope '%s': Using Authorization header (Key Index: %d)", attempt+1, scope, keyIndex)
-			currentReq.Header.Set("Authorization", "Bearer "+apiKey)
-			query.Del(rt.keyParam) // Remove query param if it exists
-		} else {
-			log.Printf("[Retry Transport Attempt %d] Scope '%s': Using query parameter '%s' (Key Index: %d)", attempt+1, scope, rt.keyParam, keyIndex)
-			currentReq.Header.Del("Authorization") // Ensure Authorization header is removed
-			query.Set(rt.keyParam, apiKey)
-		}
-		currentReq.URL.RawQuery = query.Encode() // Re-encode query parameters
-
 		// Log outgoing request details (optional, can be verbose)
-		// log.Printf("[Retry Transport Attempt %d] Scope '%s': Request URL: %s", attempt+1, scope, currentReq.URL.String())
-		// log.Printf("[Retry Transport Attempt %d] Scope '%s': Request Headers: %v", attempt+1, scope, currentReq.Header)
+		// log.Printf("[Retry Transport Attempt %d] Scope '%s': Request URL: %s", attempt+1, scopeForLog(scope), currentReq.URL.String())
+		// log.Printf("[Retry Transport Attempt %d] Scope '%s': Request Headers: %v", attempt+1, scopeForLog(scope), currentReq.Header)
 
 		// --- Execute Request ---
-		resp, lastErr = rt.underlyingTransport.RoundTrip(currentReq)
+		attemptStart := time.Now()
+		if attempt == 0 && rt.hedgeDelay > 0 && isHedgeable(req) {
+			resp, keyIndex, apiKey, lastErr = rt.hedgedRoundTrip(req, bodyBytes, scope, keyIndex, apiKey, attempt)
+		} else {
+			resp, lastErr = rt.underlyingTransport.RoundTrip(rt.newAttemptRequest(req, bodyBytes, scope, keyIndex, apiKey, attempt))
+		}
+		triedKeys[currentKeyIndex] = true
+		triedKeys[keyIndex] = true // differs from currentKeyIndex when a hedged attempt answered
+		record := attemptRecord{scope: scope, attempt: attempt + 1, keyIndex: keyIndex, err: lastErr, duration: time.Since(attemptStart)}
+		if resp != nil {
+			record.status = resp.StatusCode
+		}
+		tracker.recordAttempt(record.duration)
+		attemptsMade++
+		tracker.attempts.Add(1)
+		if rt.metrics != nil {
+			counters := rt.metrics.counters(scope)
+			counters.requestBytes.Add(int64(len(bodyBytes)))
+			if lastErr == nil && resp.Body != nil {
+				// Counted as the body is read, including bodies drained before a retry.
+				resp.Body = &countingReadCloser{ReadCloser: resp.Body, counter: &counters.responseBytes}
+			}
+		}
 
 		// --- Check for Retry Conditions ---
 		shouldRetry := false
 		if lastErr != nil {
-			log.Printf("[Retry Transport] Scope '%s': Attempt %d (Key Index %d) failed with transport error: %v", scope, attempt+1, keyIndex, lastErr)
+			record.reason = "transport_error"
 			// Check if the error is temporary/network related
-			if netErr, ok := lastErr.(net.Error); ok && netErr.Timeout() {
+			if ctxErr := req.Context().Err(); ctxErr != nil {
+				// The deadline or cancellation caused this failure; retrying cannot help.
+				record.outcome = attemptCanceled
+				record.log()
+				return nil, ctxErr
+			} else if netErr, ok := lastErr.(net.Error); ok && netErr.Timeout() {
 				shouldRetry = true
-				log.Printf("[Retry Transport] Scope '%s': Network error is temporary, will retry.", scope)
+				record.reason = "timeout"
 			} else if errors.Is(lastErr, io.ErrUnexpectedEOF) || errors.Is(lastErr, io.EOF) {
 				// Treat unexpected EOF as potentially temporary
 				shouldRetry = true
-				log.Printf("[Retry Transport] Scope '%s': EOF/UnexpectedEOF error, will retry.", scope)
+				record.reason = "eof"
 			}
 			// Note: No key marking needed here as the failure wasn't necessarily the key's fault.
+		} else if rt.retryBodyPattern != nil && resp.StatusCode >= 200 && resp.StatusCode < 300 && !isStreamingResponse(resp) {
+			if matched, err := rt.matchRetryBodyPattern(resp); err != nil {
+				lastErr, resp = err, nil
+				record.err = err
+				record.reason = "body_read_error"
+				shouldRetry = true
+			} else if matched {
+				record.reason = "body_pattern"
+				shouldRetry = true
+				rt.keyMan.markKeyFailedIfCurrent(scope, keyIndex, apiKey, "response body matched retry pattern")
+			}
+		} else if rt.noRetryStatuses[resp.StatusCode] {
+			// Configured as permanent for this upstream; return it as-is.
+			record.reason = "no_retry_status"
 		} else if resp.StatusCode == http.StatusTooManyRequests { // 429
-			log.Printf("[Retry Transport] Scope '%s': Attempt %d (Key Index %d) failed with status %d (Too Many Requests)", scope, attempt+1, keyIndex, resp.StatusCode)
+			record.reason = "rate_limited"
 			shouldRetry = true
-			rt.keyMan.markKeyFailed(scope, keyIndex) // Mark this key as failing for this scope
+			rateLimited = true
+			if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+				rateLimitRetryAfter = retryAfter
+			}
+			rt.keyMan.markKeyFailedIfCurrent(scope, keyIndex, apiKey, fmt.Sprintf("status %d", resp.StatusCode)) // Mark this key as failing for this scope
 			// Consume and close response body before retrying
 			io.Copy(io.Discard, resp.Body)
 			resp.Body.Close()
-		} else if resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented && resp.StatusCode != http.StatusHTTPVersionNotSupported {
-			// Retry on 5xx server errors (except specific ones unlikely to change)
-			log.Printf("[Retry Transport] Scope '%s': Attempt %d (Key Index %d) failed with status %d (Server Error)", scope, attempt+1, keyIndex, resp.StatusCode)
+		} else if resp.StatusCode >= 500 {
+			// Retry on 5xx server errors (except those in noRetryStatuses, handled above)
+			record.reason = "server_error"
 			shouldRetry = true
 			// Don't mark key failed for 5xx, it's likely a server issue.
 			io.Copy(io.Discard, resp.Body)
@@ -177,42 +558,109 @@ func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 		}
 
 		// --- Decide Action ---
+		// A retryable failure is final once the attempts or the request's retry budget run out.
+		retriesExhausted := ""
+		if shouldRetry {
+			if attempt == maxRetries-1 {
+				retriesExhausted = fmt.Sprintf("Max retries (%d) reached", maxRetries)
+			} else if !tracker.tryConsume(rt.retryBudget) {
+				retriesExhausted = fmt.Sprintf("Retry budget (%d) spent", rt.retryBudget)
+			}
+		}
+		switch {
+		case shouldRetry && retriesExhausted == "":
+			record.outcome = attemptRetryable
+		case shouldRetry, lastErr != nil || resp.StatusCode >= 400:
+			record.outcome = attemptFinal
+			if record.reason == "" {
+				record.reason = "client_error"
+			}
+		default:
+			record.outcome = attemptOK
+		}
+		record.log()
+
 		if !shouldRetry {
 			// Success or non-retryable error/status code
+			if lastErr == nil && rt.decompressResponses {
+				if err := decompressResponse(resp); err != nil {
+					resp.Body.Close()
+					return nil, &proxyErrorWithStatus{
+						error:      fmt.Errorf("failed to decompress upstream response: %w", err),
+						StatusCode: http.StatusBadGateway,
+					}
+				}
+			}
 			return resp, lastErr
 		}
 
-		// If we are about to retry, but it's the last attempt, break the loop
-		// and return the current response/error.
-		if attempt == maxRetries-1 {
-			log.Printf("[Retry Transport] Max retries (%d) reached for scope '%s'. Returning last response/error.", maxRetries, scope)
+		// Out of attempts or budget: break the loop and return the current response/error.
+		if retriesExhausted != "" {
+			logErrorf("[Retry Transport] %s for scope '%s'. Returning last response/error.", retriesExhausted, scopeForLog(scope))
 			break
 		}
+
+		if wait := rt.backoff.delay(attempt + 1); wait > 0 {
+			logDebugf("[Retry Transport] Scope '%s': Waiting %s before attempt %d", scopeForLog(scope), wait, attempt+2)
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				logInfof("[Retry Transport] Scope '%s': Request context done while backing off: %v", scopeForLog(scope), req.Context().Err())
+				return nil, req.Context().Err()
+			}
+		}
 	}
 
 	// If loop finished, it means all retries were exhausted.
 	// Return an error that includes the status code if the last attempt got a response.
 	if lastErr == nil && resp != nil {
 		// Last attempt got a response (e.g., 429, 5xx), but we're out of retries.
-		finalErrorMsg := fmt.Sprintf("upstream server returned status %d after %d attempts (scope '%s')", resp.StatusCode, maxRetries, buildScopeKey(req.URL.Host, req.URL.Path))
+		finalErrorMsg := fmt.Sprintf("upstream server returned status %d after %d attempts (scope '%s')", resp.StatusCode, attemptsMade, scopeForLog(requestScope(req)))
+		statusCode := resp.StatusCode
+		if statusCode < 300 {
+			// Only retried because its body matched -retry-body-pattern; not a success for the client.
+			finalErrorMsg = fmt.Sprintf("upstream response matched the retry body pattern after %d attempts (scope '%s')", attemptsMade, scopeForLog(requestScope(req)))
+			statusCode = http.StatusBadGateway
+		}
 		// Close the final response body as we are returning an error instead
 		io.Copy(io.Discard, resp.Body)
 		resp.Body.Close()
-		return nil, &proxyErrorWithStatus{
+		proxyErr := &proxyErrorWithStatus{
 			error:      errors.New(finalErrorMsg),
-			StatusCode: resp.StatusCode,
+			StatusCode: statusCode,
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			proxyErr.RetryAfter = rateLimitRetryAfter
 		}
+		return nil, proxyErr
 	}
 
 	// Last attempt resulted in a transport error or key acquisition failed earlier.
 	// If lastErr is nil here, it implies the initial key acquisition failed, which should be caught above.
 	if lastErr == nil {
 		lastErr = errors.New("internal error: retry loop exited without a final error or successful response")
-		log.Printf("[Retry Transport] Scope '%s': %v", buildScopeKey(req.URL.Host, req.URL.Path), lastErr)
+		logErrorf("[Retry Transport] Scope '%s': %v", scopeForLog(requestScope(req)), lastErr)
 	}
 	return nil, lastErr // Return the last transport error encountered
 }
 
+// isWebSocketUpgrade reports whether the request asks to upgrade the connection to a WebSocket.
+func isWebSocketUpgrade(req *http.Request) bool {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // isIdempotentMethod checks if a method is considered idempotent.
 // Used to determine if the body needs buffering for retries.
 // Note: This is a simplified check. PATCH can be non-idempotent.
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newCountingServer returns a test server that always responds with status and counts requests.
+func newCountingServer(t *testing.T, status int, calls *int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// --- Test Retry Budget ---
+
+func TestRetryTransport_RetryBudgetCapsAttempts(t *testing.T) {
+	var calls int32
+	server := newCountingServer(t, http.StatusInternalServerError, &calls)
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+	rt.retryBudget = 1
+
+	req := httptest.NewRequest("GET", server.URL+"/v1beta/models", nil)
+	req.RequestURI = ""
+	req = req.WithContext(withRetryTracker(req.Context()))
+
+	_, err := rt.RoundTrip(req)
+	assertErrorContains(t, err, "after 2 attempts")
+	assertInt(t, int(atomic.LoadInt32(&calls)), 2) // 1 attempt + 1 retry
+}
+
+func TestRetryTransport_RetryBudgetSharedAcrossRoundTrips(t *testing.T) {
+	var calls int32
+	server := newCountingServer(t, http.StatusServiceUnavailable, &calls)
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+	rt.retryBudget = 2
+
+	ctx := withRetryTracker(context.Background())
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", server.URL+"/v1beta/models", nil).WithContext(ctx)
+		req.RequestURI = ""
+		rt.RoundTrip(req)
+	}
+
+	// First call: 1 attempt + 2 retries (budget spent). Second call: a single attempt, no retries.
+	assertInt(t, int(atomic.LoadInt32(&calls)), 4)
+	assertInt(t, int(retryTrackerFromContext(ctx).retries.Load()), 2)
+}
+
+func TestRetryTransport_NoBudgetUsesMaxRetries(t *testing.T) {
+	var calls int32
+	server := newCountingServer(t, http.StatusInternalServerError, &calls)
+
+	km, _ := newKeyManager([]string{"k1"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+
+	req := httptest.NewRequest("GET", server.URL+"/v1beta/models", nil)
+	req.RequestURI = ""
+	rt.RoundTrip(req)
+
+	assertInt(t, int(atomic.LoadInt32(&calls)), maxRetries)
+}
+
+func TestRetryTransport_RetriesUseDistinctKeys(t *testing.T) {
+	var keysSeen []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keysSeen = append(keysSeen, r.URL.Query().Get("key"))
+		w.WriteHeader(http.StatusInternalServerError) // retried without sidelining the key
+	}))
+	defer server.Close()
+
+	km, _ := newKeyManager([]string{"k1", "k2", "k3"}, time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+
+	for i := 0; i < 10; i++ {
+		keysSeen = nil
+		req := httptest.NewRequest("GET", server.URL+"/v1beta/models", nil)
+		req.RequestURI = ""
+		rt.RoundTrip(req)
+
+		assertInt(t, len(keysSeen), maxRetries)
+		seen := make(map[string]bool)
+		for _, k := range keysSeen {
+			if seen[k] {
+				t.Fatalf("key %s reused within one request: %v", k, keysSeen)
+			}
+			seen[k] = true
+		}
+	}
+}
+
+func TestRetryTransport_RetriesReuseKeyWhenOnlyOne(t *testing.T) {
+	var keysSeen []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keysSeen = append(keysSeen, r.URL.Query().Get("key"))
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+	req := httptest.NewRequest("GET", server.URL+"/v1beta/models", nil)
+	req.RequestURI = ""
+	km.markKeyFailed(requestScope(req), 1, "test")
+	rt.RoundTrip(req)
+
+	// Only k1 is available, so every attempt still goes out with it.
+	assertString(t, strings.Join(keysSeen, ","), "k1,k1,k1")
+}
+
+// --- Test Sticky Key Sessions ---
+
+func TestRetryTransport_KeySessionPinsKey(t *testing.T) {
+	var keysSeen []string
+	var sessionHeaderSeen string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keysSeen = append(keysSeen, r.URL.Query().Get("key"))
+		sessionHeaderSeen += r.Header.Get(keySessionHeader)
+	}))
+	defer server.Close()
+
+	km, _ := newKeyManager([]string{"k1", "k2", "k3", "k4", "k5"}, time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+
+	for i := 0; i < 8; i++ {
+		req := httptest.NewRequest("POST", server.URL+"/v1beta/models/gemini-pro:generateContent", nil)
+		req.RequestURI = ""
+		req.Header.Set(keySessionHeader, "user-123")
+		resp, err := rt.RoundTrip(req)
+		assertNoError(t, err)
+		resp.Body.Close()
+	}
+
+	for _, k := range keysSeen {
+		assertString(t, k, keysSeen[0])
+	}
+	assertString(t, keysSeen[0], km.originalKeys[km.sessionKeyIndex("user-123")])
+	assertString(t, sessionHeaderSeen, "") // Never forwarded upstream
+}
+
+// --- Test Non-Retryable Statuses ---
+
+func TestRetryTransport_NoRetryStatuses(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+	noRetry, err := parseStatusCodes("501,503")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rt.noRetryStatuses = noRetry
+
+	// A configured 503 is returned after a single attempt.
+	var calls503 int32
+	server503 := newCountingServer(t, http.StatusServiceUnavailable, &calls503)
+	req := httptest.NewRequest("GET", server503.URL+"/v1beta/models", nil)
+	req.RequestURI = ""
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	assertInt(t, resp.StatusCode, http.StatusServiceUnavailable)
+	assertInt(t, int(atomic.LoadInt32(&calls503)), 1)
+
+	// A 500 is still retried up to maxRetries.
+	var calls500 int32
+	server500 := newCountingServer(t, http.StatusInternalServerError, &calls500)
+	req = httptest.NewRequest("GET", server500.URL+"/v1beta/models", nil)
+	req.RequestURI = ""
+	_, err = rt.RoundTrip(req)
+	assertErrorContains(t, err, "after 3 attempts")
+	assertInt(t, int(atomic.LoadInt32(&calls500)), maxRetries)
+}
+
+func TestParseStatusCodes(t *testing.T) {
+	codes, err := parseStatusCodes(defaultNoRetryStatuses)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(codes) != 2 || !codes[501] || !codes[505] {
+		t.Errorf("unexpected default codes: %v", codes)
+	}
+	for _, raw := range []string{"abc", "5000", "99"} {
+		if _, err := parseStatusCodes(raw); err == nil {
+			t.Errorf("expected error for %q", raw)
+		}
+	}
+}
+
+// --- Test Chunked Request Bodies ---
+
+func TestRetryTransport_ChunkedBodySentWithContentLength(t *testing.T) {
+	var gotLength int64
+	var gotTransferEncoding []string
+	var gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotLength = r.ContentLength
+		gotTransferEncoding = r.TransferEncoding
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	km, _ := newKeyManager([]string{"k1"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+
+	for _, body := range []string{`{"contents":[{"parts":[{"text":"hi"}]}]}`, ""} {
+		// Simulate a client request that arrived with Transfer-Encoding: chunked.
+		req := httptest.NewRequest("POST", server.URL+"/upload", io.NopCloser(strings.NewReader(body)))
+		req.RequestURI = ""
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+		req.Header.Set("Transfer-Encoding", "chunked")
+
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("unexpected error for body %q: %v", body, err)
+		}
+		resp.Body.Close()
+
+		assertInt(t, resp.StatusCode, http.StatusOK)
+		assertInt(t, int(gotLength), len(body))
+		if len(gotTransferEncoding) != 0 {
+			t.Errorf("body %q: expected no Transfer-Encoding upstream, got %v", body, gotTransferEncoding)
+		}
+		assertString(t, gotBody, body)
+	}
+}
+
+// --- Test Custom Auth Header ---
+
+func TestRetryTransport_CustomAuthHeaderWithoutScheme(t *testing.T) {
+	var gotHeaders http.Header
+	var gotQuery string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeaders = r.Header.Clone()
+		gotQuery = r.URL.RawQuery
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	km, _ := newKeyManager([]string{"azurekey"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", []string{"/openai/"})
+	rt.authHeader = "api-key"
+	rt.authScheme = ""
+
+	// Header-auth path: bare key in the custom header, no Authorization or query param.
+	req := httptest.NewRequest("POST", server.URL+"/openai/chat/completions?key=client", strings.NewReader(`{}`))
+	req.RequestURI = ""
+	req.Header.Set("Authorization", "Bearer client-token")
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	assertString(t, gotHeaders.Get("Api-Key"), "azurekey")
+	assertString(t, gotHeaders.Get("Authorization"), "")
+	assertString(t, gotQuery, "")
+
+	// Query-param path: the custom header is not forwarded.
+	req = httptest.NewRequest("GET", server.URL+"/v1beta/models", nil)
+	req.RequestURI = ""
+	req.Header.Set("api-key", "client-supplied")
+	resp, err = rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	assertString(t, gotHeaders.Get("Api-Key"), "")
+	assertString(t, gotQuery, "key=azurekey")
+}
+
+// --- Test Per-Key Targets ---
+
+func TestRetryTransport_KeyTargetRoutesToKeyEndpoint(t *testing.T) {
+	var defaultCalls, regionalCalls int32
+	var regionalKey string
+	defaultServer := newCountingServer(t, http.StatusOK, &defaultCalls)
+	regionalServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&regionalCalls, 1)
+		regionalKey = r.URL.Query().Get("key")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer regionalServer.Close()
+
+	keys, targets, err := splitKeyTargets([]string{"regional-key@" + regionalServer.URL})
+	assertNoError(t, err)
+	km, _ := newKeyManager(keys, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+	rt.keyTargets = targets
+
+	req := httptest.NewRequest("GET", defaultServer.URL+"/v1beta/models", nil)
+	req.RequestURI = ""
+	resp, err := rt.RoundTrip(req)
+	assertNoError(t, err)
+	resp.Body.Close()
+
+	assertInt(t, int(atomic.LoadInt32(&regionalCalls)), 1)
+	assertInt(t, int(atomic.LoadInt32(&defaultCalls)), 0)
+	assertString(t, regionalKey, "regional-key")
+
+	// Key state is still tracked under the original request's scope.
+	defaultURL, _ := url.Parse(defaultServer.URL)
+	if _, ok := km.snapshot().Scopes[buildScopeKey(defaultURL.Host, "/v1beta/models")]; !ok {
+		t.Errorf("expected scope for original host %s, got %v", defaultURL.Host, km.snapshot().Scopes)
+	}
+}
+
+// cancelingReader returns part of a body, then cancels the request context and fails,
+// like a client disconnecting mid-upload.
+type cancelingReader struct {
+	cancel context.CancelFunc
+	sent   bool
+}
+
+func (r *cancelingReader) Read(p []byte) (int, error) {
+	if !r.sent {
+		r.sent = true
+		return copy(p, `{"contents": [`), nil
+	}
+	r.cancel()
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestRetryTransport_ContextCanceledDuringBodyRead(t *testing.T) {
+	var calls int32
+	server := newCountingServer(t, http.StatusOK, &calls)
+
+	km, _ := newKeyManager([]string{"k1"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := httptest.NewRequest("POST", server.URL+"/v1beta/models/gemini-pro:generateContent", io.NopCloser(&cancelingReader{cancel: cancel})).WithContext(ctx)
+	req.RequestURI = ""
+
+	_, err := rt.RoundTrip(req)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	assertInt(t, int(atomic.LoadInt32(&calls)), 0)
+
+	// The error handler maps the cancellation to the client-closed response.
+	rr := httptest.NewRecorder()
+	createProxyErrorHandler(nil, nil)(rr, req, err)
+	assertInt(t, rr.Code, http.StatusRequestTimeout)
+}
+
+func TestRetryTransport_AllowedQueryParams(t *testing.T) {
+	var receivedQuery url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedQuery = r.URL.Query()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	km, _ := newKeyManager([]string{"k1"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+	send := func() {
+		req := httptest.NewRequest("GET", server.URL+"/v1beta/models?alt=sse&debug=1&key=client&pageSize=5", nil)
+		req.RequestURI = ""
+		resp, err := rt.RoundTrip(req)
+		assertNoError(t, err)
+		resp.Body.Close()
+	}
+
+	// Default: everything passes through, with the key replaced.
+	send()
+	assertString(t, receivedQuery.Encode(), "alt=sse&debug=1&key=k1&pageSize=5")
+
+	rt.allowedQueryParams = map[string]bool{"alt": true, "pageSize": true}
+	send()
+	assertString(t, receivedQuery.Encode(), "alt=sse&key=k1&pageSize=5")
+}
+
+func TestRetryTransport_RequestMaxAgeStopsRetries(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(40 * time.Millisecond)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	km, _ := newKeyManager([]string{"k1", "k2", "k3"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+	rt.requestMaxAge = 60 * time.Millisecond
+
+	req := httptest.NewRequest("GET", server.URL+"/v1beta/models", nil)
+	req.RequestURI = ""
+	req = req.WithContext(withRetryTracker(req.Context()))
+
+	_, err := rt.RoundTrip(req)
+	assertErrorContains(t, err, "maximum age")
+	var statusErr *proxyErrorWithStatus
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("Expected proxyErrorWithStatus, got %T", err)
+	}
+	assertInt(t, statusErr.StatusCode, http.StatusGatewayTimeout)
+	// Two 40ms attempts pass the 60ms limit, well before maxRetries.
+	assertInt(t, int(atomic.LoadInt32(&calls)), 2)
+}
+
+func TestRetryTransport_DecompressResponses(t *testing.T) {
+	var gotAcceptEncoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAcceptEncoding = r.Header.Get("Accept-Encoding")
+		// Always gzip, whatever the client asked for.
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Type", "application/json")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(`{"candidates":[]}`))
+		gz.Close()
+	}))
+	defer server.Close()
+
+	km, _ := newKeyManager([]string{"k1"}, 1*time.Minute)
+	proxy := newTestProxy(server, km, "key", nil)
+	proxy.Transport.(*retryTransport).decompressResponses = true
+	var modifierSaw string
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		modifierSaw = string(body)
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return nil
+	}
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/v1beta/models/gemini-pro:generateContent", strings.NewReader(`{}`))
+	req.Header.Set("Accept-Encoding", "br")
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, req)
+
+	assertInt(t, rr.Code, http.StatusOK)
+	assertString(t, gotAcceptEncoding, "gzip")
+	assertString(t, modifierSaw, `{"candidates":[]}`)
+	assertString(t, rr.Body.String(), `{"candidates":[]}`)
+	assertString(t, rr.Header().Get("Content-Encoding"), "")
+}
+
+func TestDecompressResponse_Deflate(t *testing.T) {
+	for _, raw := range []bool{false, true} {
+		var buf bytes.Buffer
+		if raw {
+			fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+			fw.Write([]byte("hello"))
+			fw.Close()
+		} else {
+			zw := zlib.NewWriter(&buf)
+			zw.Write([]byte("hello"))
+			zw.Close()
+		}
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Encoding": {"deflate"}, "Content-Length": {strconv.Itoa(buf.Len())}},
+			Body:       io.NopCloser(&buf),
+		}
+		assertNoError(t, decompressResponse(resp))
+		body, _ := io.ReadAll(resp.Body)
+		assertString(t, string(body), "hello")
+		assertString(t, resp.Header.Get("Content-Encoding"), "")
+		assertString(t, resp.Header.Get("Content-Length"), "")
+	}
+
+	// Unsupported encodings are left alone.
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Encoding": {"br"}}, Body: io.NopCloser(strings.NewReader("x"))}
+	assertNoError(t, decompressResponse(resp))
+	assertString(t, resp.Header.Get("Content-Encoding"), "br")
+}
+
+func TestRetryTransport_RetryBodyPattern(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first attempt is blocked by a content filter, the second succeeds.
+		if atomic.AddInt32(&calls, 1) == 1 {
+			io.WriteString(w, `{"candidates":[{"finishReason":"SAFETY"}]}`)
+			return
+		}
+		io.WriteString(w, `{"candidates":[{"finishReason":"STOP"}]}`)
+	}))
+	defer server.Close()
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+	rt.retryBodyPattern = regexp.MustCompile(`"finishReason":\s*"SAFETY"`)
+
+	req := httptest.NewRequest("POST", server.URL+"/v1beta/models/gemini-pro:generateContent", strings.NewReader(`{}`))
+	req.RequestURI = ""
+	resp, err := rt.RoundTrip(req)
+	assertNoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assertInt(t, resp.StatusCode, http.StatusOK)
+	assertString(t, string(body), `{"candidates":[{"finishReason":"STOP"}]}`)
+	assertInt(t, int(atomic.LoadInt32(&calls)), 2)
+	serverURL, _ := url.Parse(server.URL)
+	failing := km.snapshot().Scopes[buildScopeKey(serverURL.Host, "/v1beta/models/gemini-pro:generateContent")].FailingKeys
+	assertInt(t, len(failing), 1)
+	assertString(t, failing[0].Reason, "response body matched retry pattern")
+}
+
+func TestRetryTransport_RetryBodyPatternExhausted(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		io.WriteString(w, `{"candidates":[{"finishReason":"SAFETY"}]}`)
+	}))
+	defer server.Close()
+
+	km, _ := newKeyManager([]string{"k1", "k2", "k3", "k4", "k5"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+	rt.retryBudget = 1
+	rt.retryBodyPattern = regexp.MustCompile(`SAFETY`)
+
+	req := httptest.NewRequest("POST", server.URL+"/v1beta/models/gemini-pro:generateContent", strings.NewReader(`{}`))
+	req.RequestURI = ""
+	req = req.WithContext(withRetryTracker(req.Context()))
+	_, err := rt.RoundTrip(req)
+	assertErrorContains(t, err, "matched the retry body pattern after 2 attempts")
+	var statusErr *proxyErrorWithStatus
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("Expected proxyErrorWithStatus, got %T", err)
+	}
+	assertInt(t, statusErr.StatusCode, http.StatusBadGateway)
+
+	// Non-matching bodies pass straight through.
+	rt.retryBodyPattern = regexp.MustCompile(`never`)
+	req = httptest.NewRequest("POST", server.URL+"/v1beta/models/gemini-pro:generateContent", strings.NewReader(`{}`))
+	req.RequestURI = ""
+	resp, err := rt.RoundTrip(req)
+	assertNoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assertString(t, string(body), `{"candidates":[{"finishReason":"SAFETY"}]}`)
+}
+
+func TestRetryTransport_RetryBodyPatternSkipsBrotli(t *testing.T) {
+	// Arbitrary bytes standing in for a Brotli stream; they are neither decoded nor matched.
+	brBody := "\x1b\x1d\x00\xf8SAFETY\x8c\xb1"
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Encoding", "br")
+		io.WriteString(w, brBody)
+	}))
+	defer server.Close()
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, 1*time.Minute)
+	rt := newRetryTransport(http.DefaultTransport, km, "key", nil)
+	rt.retryBodyPattern = regexp.MustCompile(`SAFETY`)
+	logs := captureLogs(t, levelInfo)
+
+	req := httptest.NewRequest("POST", server.URL+"/v1beta/models/gemini-pro:generateContent", strings.NewReader(`{}`))
+	req.RequestURI = ""
+	resp, err := rt.RoundTrip(req)
+	assertNoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assertInt(t, resp.StatusCode, http.StatusOK)
+	assertString(t, resp.Header.Get("Content-Encoding"), "br")
+	assertString(t, string(body), brBody)
+	assertInt(t, int(atomic.LoadInt32(&calls)), 1)
+	if strings.Contains(logs.String(), "Could not decode") {
+		t.Errorf("Expected no decode warning for Brotli, got: %s", logs.String())
+	}
+}
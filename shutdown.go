@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+)
+
+// shutdownOnSignal waits for a signal (SIGINT or SIGTERM in main), then stops server gracefully,
+// giving in-flight requests up to shutdownTimeout to finish, and afterwards gives the webhook
+// notifier up to drainTimeout to deliver queued events, so alerts raised just before a deploy
+// are not lost. It returns once both steps are done or timed out.
+func shutdownOnSignal(server *http.Server, notifier *webhookNotifier, signals <-chan os.Signal, shutdownTimeout, drainTimeout time.Duration) {
+	sig := <-signals
+	logInfof("Received %v; shutting down (waiting up to %s for in-flight requests).", sig, shutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logWarnf("Server did not shut down cleanly: %v", err)
+	}
+	// Requests finishing above may have queued events, so the queue is drained afterwards.
+	if notifier != nil && notifier.drain(drainTimeout) {
+		logInfof("Webhook event queue flushed.")
+	}
+}
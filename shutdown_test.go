@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdownOnSignal_DeliversQueuedEvents(t *testing.T) {
+	var delivered atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		delivered.Add(1)
+	}))
+	defer receiver.Close()
+
+	km, _ := newKeyManager([]string{"k1", "k2"}, time.Minute)
+	km.notifier = newWebhookNotifier(receiver.URL, defaultWebhookQueueSize)
+	km.markKeyFailed(buildScopeKey("host", "/a"), 0, "status 429")
+	km.markKeyFailed(buildScopeKey("host", "/b"), 1, "status 429")
+
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		shutdownOnSignal(&http.Server{}, km.notifier, signals, time.Second, 5*time.Second)
+		close(done)
+	}()
+	signals <- syscall.SIGTERM
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not finish within the drain timeout")
+	}
+	assertInt(t, int(delivered.Load()), 2)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// persistedFailingKey is a sidelined key as written to the state file. The key itself is never
+// stored; keyHash identifies it so entries are dropped if the key list changes between restarts.
+type persistedFailingKey struct {
+	Index        int       `json:"index"`
+	KeyHash      string    `json:"keyHash"`
+	Reason       string    `json:"reason"`
+	FailedAt     time.Time `json:"failedAt"`
+	ReactivateAt time.Time `json:"reactivateAt"`
+}
+
+// persistedState is the JSON document stored in -state-file.
+type persistedState struct {
+	SavedAt time.Time                        `json:"savedAt"`
+	Scopes  map[string][]persistedFailingKey `json:"scopes"`
+}
+
+// keyFingerprint returns a short hash identifying key in the state file.
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// exportFailingState returns the sidelined keys of every scope. Scopes without failing keys are omitted.
+func (km *keyManager) exportFailingState() persistedState {
+	km.rlockAll()
+	defer km.runlockAll()
+
+	state := persistedState{
+		SavedAt: time.Now(),
+		Scopes:  make(map[string][]persistedFailingKey),
+	}
+	for scope, ss := range km.allScopes() {
+		if len(ss.failingKeys) == 0 {
+			continue
+		}
+		entries := make([]persistedFailingKey, 0, len(ss.failingKeys))
+		for index, info := range ss.failingKeys {
+			entries = append(entries, persistedFailingKey{
+				Index:        index,
+				KeyHash:      keyFingerprint(km.originalKeys[index]),
+				Reason:       info.reason,
+				FailedAt:     info.failedAt,
+				ReactivateAt: info.reactivateAt,
+			})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Index < entries[j].Index })
+		state.Scopes[scope] = entries
+	}
+	return state
+}
+
+// importFailingState sidelines the keys recorded in state, skipping entries whose reactivation
+// time has passed or whose key no longer matches. Returns the number of keys sidelined.
+func (km *keyManager) importFailingState(state persistedState, now time.Time) int {
+	km.lockAll()
+	defer km.unlockAll()
+
+	restored := 0
+	for scope, entries := range state.Scopes {
+		for _, entry := range entries {
+			if !entry.ReactivateAt.After(now) {
+				continue
+			}
+			if entry.Index < 0 || entry.Index >= len(km.originalKeys) || km.originalKeys[entry.Index] == "" ||
+				keyFingerprint(km.originalKeys[entry.Index]) != entry.KeyHash {
+				logWarnf("Scope '%s': Dropping saved state for key index %d: key list changed.", scopeForLog(scope), entry.Index)
+				continue
+			}
+			ss := km.getOrCreateScopeState(scope)
+			delete(ss.availableKeys, entry.Index)
+			ss.failingKeys[entry.Index] = failInfo{
+				reason:       entry.Reason,
+				failedAt:     entry.FailedAt,
+				reactivateAt: entry.ReactivateAt,
+			}
+			restored++
+		}
+	}
+	return restored
+}
+
+// saveStateFile writes the key manager's failing-key state to path. The file is replaced
+// atomically so a crash mid-write never leaves a truncated state file.
+func saveStateFile(km *keyManager, path string) error {
+	data, err := json.MarshalIndent(km.exportFailingState(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+	return nil
+}
+
+// loadStateFile restores failing-key state saved by saveStateFile. A missing file is not an error.
+// Returns the number of keys sidelined.
+func loadStateFile(km *keyManager, path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read state file: %w", err)
+	}
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	return km.importFailingState(state, time.Now()), nil
+}
+
+// runStatePersistence saves the state file every interval until stop is closed.
+// A nil stop channel runs forever.
+func runStatePersistence(km *keyManager, path string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := saveStateFile(km, path); err != nil {
+				logErrorf("Error saving state file: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateFile_SaveLoadRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	keys := []string{"k1", "k2", "k3"}
+	scope := buildScopeKey("api.example.com", "/v1beta/models/gemini-pro:generateContent")
+
+	km, _ := newKeyManager(keys, time.Hour)
+	km.markKeyFailed(scope, 1, "status 429")
+	assertNoError(t, saveStateFile(km, path))
+
+	restarted, _ := newKeyManager(keys, time.Hour)
+	restored, err := loadStateFile(restarted, path)
+	assertNoError(t, err)
+	assertInt(t, restored, 1)
+
+	restarted.lockAll()
+	defer restarted.unlockAll()
+	state := getScopeState(t, restarted, scope)
+	assertInt(t, len(state.availableKeys), 2)
+	info, ok := state.failingKeys[1]
+	if !ok {
+		t.Fatalf("expected key index 1 to be restored as failing, got %v", state.failingKeys)
+	}
+	assertString(t, info.reason, "status 429")
+	if time.Until(info.reactivateAt) < 59*time.Minute {
+		t.Errorf("expected the saved reactivation time to be kept, got %s", info.reactivateAt)
+	}
+}
+
+func TestStateFile_LoadDropsExpiredAndChangedKeys(t *testing.T) {
+	now := time.Now()
+	km, _ := newKeyManager([]string{"k1", "k2"}, time.Hour)
+	restored := km.importFailingState(persistedState{
+		Scopes: map[string][]persistedFailingKey{
+			buildScopeKey("host", "/expired"): {{Index: 0, KeyHash: keyFingerprint("k1"), ReactivateAt: now.Add(-time.Second)}},
+			buildScopeKey("host", "/changed"): {{Index: 1, KeyHash: keyFingerprint("old-key"), ReactivateAt: now.Add(time.Hour)}},
+			buildScopeKey("host", "/removed"): {{Index: 5, KeyHash: keyFingerprint("k6"), ReactivateAt: now.Add(time.Hour)}},
+			buildScopeKey("host", "/active"):  {{Index: 0, KeyHash: keyFingerprint("k1"), ReactivateAt: now.Add(time.Hour)}},
+		},
+	}, now)
+	assertInt(t, restored, 1)
+
+	km.lockAll()
+	defer km.unlockAll()
+	if _, exists := km.lookupScope(buildScopeKey("host", "/expired")); exists {
+		t.Error("expected no scope state for an expired entry")
+	}
+	assertInt(t, len(getScopeState(t, km, buildScopeKey("host", "/active")).failingKeys), 1)
+}
+
+func TestStateFile_MissingFileIsNotAnError(t *testing.T) {
+	km, _ := newKeyManager([]string{"k1"}, time.Hour)
+	restored, err := loadStateFile(km, filepath.Join(t.TempDir(), "missing.json"))
+	assertNoError(t, err)
+	assertInt(t, restored, 0)
+
+	path := filepath.Join(t.TempDir(), "bad.json")
+	os.WriteFile(path, []byte("{not json"), 0o600)
+	_, err = loadStateFile(km, path)
+	assertErrorContains(t, err, "failed to parse state file")
+}
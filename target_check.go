@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// targetCheckTimeout bounds the startup connectivity check.
+const targetCheckTimeout = 5 * time.Second
+
+// checkTarget verifies the target is reachable by dialing it, completing a TLS handshake
+// for https targets. It catches typos in -target before every request fails with 502.
+func checkTarget(target *url.URL, timeout time.Duration) error {
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(target.Hostname(), port)
+	dialer := &net.Dialer{Timeout: timeout}
+
+	if target.Scheme == "https" {
+		conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: target.Hostname()})
+		if err != nil {
+			return fmt.Errorf("TLS dial to %s failed: %w", addr, err)
+		}
+		return conn.Close()
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("TCP dial to %s failed: %w", addr, err)
+	}
+	return conn.Close()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCheckTarget_Reachable(t *testing.T) {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer httpServer.Close()
+	httpURL, _ := url.Parse(httpServer.URL)
+	assertNoError(t, checkTarget(httpURL, time.Second))
+}
+
+func TestCheckTarget_Unreachable(t *testing.T) {
+	// Grab a free port, then close the listener so nothing is listening on it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	target, _ := url.Parse("http://" + addr)
+	assertErrorContains(t, checkTarget(target, time.Second), "TCP dial to "+addr+" failed")
+}
+
+func TestCheckTarget_TLSHandshakeFailure(t *testing.T) {
+	// A plain HTTP server cannot complete a TLS handshake for an https target.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	target, _ := url.Parse("https://" + serverURL.Host)
+	assertErrorContains(t, checkTarget(target, time.Second), "TLS dial to "+serverURL.Host+" failed")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testCert is a generated certificate with its key, PEM-encoded for writing to files.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a certificate for commonName valid for 127.0.0.1. It is self-signed
+// when parent is nil, otherwise signed by parent. isCA marks it as a certificate authority.
+func newTestCert(t *testing.T, commonName string, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writeCertFiles writes c's certificate and key to temp files and returns their paths.
+func writeCertFiles(t *testing.T, c *testCert) (string, string) {
+	t.Helper()
+	return writeTempFile(t, "cert.pem", string(c.certPEM)), writeTempFile(t, "key.pem", string(c.keyPEM))
+}
+
+func TestBuildTLSConfig_ServesHTTPSAndProxies(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "from upstream")
+	}))
+	defer targetServer.Close()
+
+	serverCert := newTestCert(t, "proxy.local", nil, true)
+	certFile, keyFile := writeCertFiles(t, serverCert)
+	tlsConfig, err := buildTLSConfig(certFile, keyFile, "1.3", "")
+	assertNoError(t, err)
+	if tlsConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("expected minimum TLS 1.3, got %x", tlsConfig.MinVersion)
+	}
+
+	km, _ := newKeyManager([]string{"tlskey"}, 1*time.Minute)
+	proxyServer := httptest.NewUnstartedServer(createMainHandler(newTestProxy(targetServer, km, "key", nil), mainHandlerOptions{}))
+	proxyServer.TLS = tlsConfig
+	proxyServer.StartTLS()
+	defer proxyServer.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(serverCert.cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	resp, err := client.Get(proxyServer.URL + "/v1beta/models")
+	assertNoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assertInt(t, resp.StatusCode, http.StatusOK)
+	assertString(t, string(body), "from upstream")
+	if resp.TLS == nil || resp.TLS.Version != tls.VersionTLS13 {
+		t.Errorf("expected a TLS 1.3 connection, got %+v", resp.TLS)
+	}
+}
+
+func TestBuildTLSConfig_Errors(t *testing.T) {
+	config, err := buildTLSConfig("", "", "1.2", "")
+	assertNoError(t, err)
+	if config != nil {
+		t.Error("expected nil config (plain HTTP) when no cert/key is set")
+	}
+
+	_, err = buildTLSConfig("cert.pem", "", "1.2", "")
+	assertErrorContains(t, err, "both -tls-cert and -tls-key")
+
+	certFile, keyFile := writeCertFiles(t, newTestCert(t, "proxy.local", nil, false))
+	otherKeyFile := writeTempFile(t, "other-key.pem", string(newTestCert(t, "other", nil, false).keyPEM))
+	_, err = buildTLSConfig(certFile, otherKeyFile, "1.2", "")
+	assertErrorContains(t, err, "failed to load TLS certificate/key pair")
+
+	_, err = buildTLSConfig(certFile, keyFile, "1.4", "")
+	assertErrorContains(t, err, "invalid TLS minimum version")
+}
+
+func TestBuildTLSConfig_RequiresValidClientCert(t *testing.T) {
+	serverCert := newTestCert(t, "proxy.local", nil, true)
+	certFile, keyFile := writeCertFiles(t, serverCert)
+	clientCA := newTestCert(t, "Client CA", nil, true)
+	caFile := writeTempFile(t, "client-ca.pem", string(clientCA.certPEM))
+
+	tlsConfig, err := buildTLSConfig(certFile, keyFile, "1.2", caFile)
+	assertNoError(t, err)
+
+	var gotSubject string
+	server := httptest.NewUnstartedServer(withClientCertSubject(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSubject, _ = clientCertSubjectFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	})))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(serverCert.cert)
+	clientWith := func(c *testCert) *http.Client {
+		tlsCert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+		assertNoError(t, err)
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{tlsCert},
+		}}}
+	}
+
+	// A certificate signed by the configured CA is accepted and its subject recorded.
+	resp, err := clientWith(newTestCert(t, "billing-service", clientCA, false)).Get(server.URL + "/v1beta/models")
+	assertNoError(t, err)
+	resp.Body.Close()
+	assertInt(t, resp.StatusCode, http.StatusOK)
+	assertString(t, gotSubject, "CN=billing-service")
+
+	// A self-signed certificate from an unknown CA is rejected.
+	if resp, err := clientWith(newTestCert(t, "intruder", nil, false)).Get(server.URL + "/v1beta/models"); err == nil {
+		resp.Body.Close()
+		t.Error("expected request with an untrusted client certificate to fail")
+	}
+
+	// No certificate at all is rejected too.
+	noCertClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if resp, err := noCertClient.Get(server.URL + "/v1beta/models"); err == nil {
+		resp.Body.Close()
+		t.Error("expected request without a client certificate to fail")
+	}
+}
+
+func TestBuildTLSConfig_ClientCAErrors(t *testing.T) {
+	_, err := buildTLSConfig("", "", "1.2", "ca.pem")
+	assertErrorContains(t, err, "-tls-client-ca requires -tls-cert and -tls-key")
+
+	certFile, keyFile := writeCertFiles(t, newTestCert(t, "proxy.local", nil, false))
+	_, err = buildTLSConfig(certFile, keyFile, "1.2", writeTempFile(t, "ca.pem", "not a certificate"))
+	assertErrorContains(t, err, "no valid PEM certificates")
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultTriggerPaths is where Gemini requests keep the message text: every part of every content.
+const defaultTriggerPaths = "contents[].parts[].text"
+
+// defaultParsedTriggerPaths is defaultTriggerPaths, parsed once.
+var defaultParsedTriggerPaths, _ = parseTriggerPaths(defaultTriggerPaths)
+
+// triggerPathSegment is one step of a trigger path: an object key, an array index, or (all)
+// every element of an array.
+type triggerPathSegment struct {
+	key   string
+	index int
+	all   bool
+	// isIndex is set for "[N]" segments, where index is used instead of key.
+	isIndex bool
+}
+
+// triggerPath is a parsed -trigger-paths entry.
+type triggerPath []triggerPathSegment
+
+// parseTriggerPaths parses the -trigger-paths flag: a comma-separated list of paths in dot/bracket
+// notation, e.g. "contents[].parts[].text,messages[0].content". "[]" selects every element of an
+// array and "[N]" a single element. An empty value means the default Gemini paths.
+func parseTriggerPaths(raw string) ([]triggerPath, error) {
+	if strings.TrimSpace(raw) == "" {
+		raw = defaultTriggerPaths
+	}
+	var paths []triggerPath
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		path, err := parseTriggerPath(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trigger path %q: %w", entry, err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// parseTriggerPath parses a single dot/bracket path.
+func parseTriggerPath(raw string) (triggerPath, error) {
+	var path triggerPath
+	for _, part := range strings.Split(raw, ".") {
+		key := part
+		brackets := ""
+		if open := strings.IndexByte(part, '['); open >= 0 {
+			key, brackets = part[:open], part[open:]
+		}
+		if key == "" && (brackets == "" || len(path) > 0) {
+			return nil, fmt.Errorf("empty key in %q", part)
+		}
+		if key != "" {
+			path = append(path, triggerPathSegment{key: key})
+		}
+		for brackets != "" {
+			closeIdx := strings.IndexByte(brackets, ']')
+			if brackets[0] != '[' || closeIdx < 0 {
+				return nil, fmt.Errorf("malformed brackets in %q", part)
+			}
+			inner := brackets[1:closeIdx]
+			brackets = brackets[closeIdx+1:]
+			if inner == "" {
+				path = append(path, triggerPathSegment{all: true})
+				continue
+			}
+			idx, err := strconv.Atoi(inner)
+			if err != nil || idx < 0 {
+				return nil, fmt.Errorf("invalid array index %q in %q", inner, part)
+			}
+			path = append(path, triggerPathSegment{index: idx, isIndex: true})
+		}
+	}
+	return path, nil
+}
+
+// collectTriggerTexts returns every string found at the given paths in a decoded JSON body.
+// Paths that do not match the body's structure simply contribute nothing.
+func collectTriggerTexts(node any, paths []triggerPath) []string {
+	var texts []string
+	for _, path := range paths {
+		texts = appendPathStrings(texts, node, path)
+	}
+	return texts
+}
+
+// appendPathStrings walks path from node and appends the strings it ends on to texts.
+func appendPathStrings(texts []string, node any, path triggerPath) []string {
+	if len(path) == 0 {
+		if text, ok := node.(string); ok {
+			texts = append(texts, text)
+		}
+		return texts
+	}
+	segment, rest := path[0], path[1:]
+	switch {
+	case segment.all:
+		if arr, ok := node.([]any); ok {
+			for _, item := range arr {
+				texts = appendPathStrings(texts, item, rest)
+			}
+		}
+	case segment.isIndex:
+		if arr, ok := node.([]any); ok && segment.index < len(arr) {
+			texts = appendPathStrings(texts, arr[segment.index], rest)
+		}
+	default:
+		if obj, ok := node.(map[string]any); ok {
+			if child, ok := obj[segment.key]; ok {
+				texts = appendPathStrings(texts, child, rest)
+			}
+		}
+	}
+	return texts
+}
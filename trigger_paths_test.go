@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTriggerPaths(t *testing.T) {
+	paths, err := parseTriggerPaths("")
+	assertNoError(t, err)
+	assertInt(t, len(paths), 1)
+	assertInt(t, len(paths[0]), 5) // contents, [], parts, [], text
+
+	paths, err = parseTriggerPaths("messages[].content, input[0][1].text")
+	assertNoError(t, err)
+	assertInt(t, len(paths), 2)
+	assertInt(t, len(paths[1]), 4)
+	if !paths[1][1].isIndex || paths[1][1].index != 0 || paths[1][2].index != 1 {
+		t.Errorf("unexpected segments for input[0][1].text: %+v", paths[1])
+	}
+
+	for _, bad := range []string{"messages..content", "messages[x].content", "messages[.content", "messages[-1]"} {
+		_, err := parseTriggerPaths(bad)
+		assertErrorContains(t, err, "invalid trigger path")
+	}
+}
+
+func TestCollectTriggerTexts(t *testing.T) {
+	var body map[string]any
+	assertNoError(t, decodeJSONPreservingNumbers([]byte(`{"messages":[{"content":"first"},{"content":"second"},{"content":7}],"input":[["a","b"]]}`), &body))
+
+	paths, err := parseTriggerPaths("messages[].content,input[0][1],missing[].text")
+	assertNoError(t, err)
+	assertString(t, strings.Join(collectTriggerTexts(body, paths), "|"), "first|second|b")
+}
+
+func TestModifyBodyWithGoogleSearch_CustomTriggerPaths(t *testing.T) {
+	paths, err := parseTriggerPaths("messages[].content")
+	assertNoError(t, err)
+	tools := `"tools":[{"functionDeclarations":[{"name":"f"}]}]`
+
+	// The trigger in a custom location fires: functionDeclarations are replaced by google_search.
+	body := `{"messages":[{"role":"user","content":"please search the web"}],` + tools + `}`
+	got, err := modifyBodyWithGoogleSearch([]byte(body), "search", triggerReplace, paths, false)
+	assertNoError(t, err)
+	want := `{"messages":[{"role":"user","content":"please search the web"}],"tools":[{"google_search":{}}]}`
+	if !jsonDeepEqual(got, []byte(want)) {
+		t.Errorf("custom path body = %s, want %s", got, want)
+	}
+
+	// The default Gemini location is no longer scanned once custom paths are configured.
+	body = `{"contents":[{"parts":[{"text":"please search the web"}]}],` + tools + `}`
+	got, err = modifyBodyWithGoogleSearch([]byte(body), "search", triggerReplace, paths, false)
+	assertNoError(t, err)
+	if !jsonDeepEqual(got, []byte(body)) {
+		t.Errorf("unscanned path body = %s, want unchanged %s", got, body)
+	}
+}
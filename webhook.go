@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Webhook event types.
+const (
+	webhookEventKeySidelined  = "key_sidelined"
+	webhookEventPoolExhausted = "pool_exhausted"
+)
+
+const (
+	// defaultWebhookQueueSize bounds the events waiting for delivery; further events are dropped.
+	defaultWebhookQueueSize = 100
+	// webhookMaxAttempts is how many times an event is posted before it is dropped.
+	webhookMaxAttempts = 3
+	// webhookRetryDelay is the delay before the first retry; it doubles on each further attempt.
+	webhookRetryDelay = time.Second
+	// poolExhaustedEventInterval is the minimum time between pool_exhausted events for one scope,
+	// so every request hitting an exhausted scope does not produce an event.
+	poolExhaustedEventInterval = time.Minute
+)
+
+// webhookEvent is the JSON body posted to -webhook-url. KeyIndex is -1 for pool_exhausted.
+type webhookEvent struct {
+	Type      string    `json:"type"`
+	Scope     string    `json:"scope"`
+	KeyIndex  int       `json:"keyIndex"`
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// webhookNotifier delivers key events to a webhook URL from a background worker.
+type webhookNotifier struct {
+	url        string
+	client     *http.Client
+	queue      chan webhookEvent
+	retryDelay time.Duration
+	// Guards closed, so notify never sends on the queue after drain closed it.
+	mu     sync.RWMutex
+	closed bool
+	// Closed by the worker once the queue is closed and every event in it was handled.
+	done chan struct{}
+}
+
+// newWebhookNotifier creates a notifier posting to url with room for queueSize pending events
+// and starts its delivery worker.
+func newWebhookNotifier(url string, queueSize int) *webhookNotifier {
+	n := &webhookNotifier{
+		url:        url,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		queue:      make(chan webhookEvent, queueSize),
+		retryDelay: webhookRetryDelay,
+		done:       make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+// notify queues ev for delivery. It never blocks: when the queue is full the event is dropped.
+// Safe to call on a nil notifier.
+func (n *webhookNotifier) notify(ev webhookEvent) {
+	if n == nil {
+		return
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.closed {
+		logWarnf("Webhook notifier is shutting down; dropping %s event for scope '%s'.", ev.Type, ev.Scope)
+		return
+	}
+	select {
+	case n.queue <- ev:
+	default:
+		logWarnf("Webhook queue full; dropping %s event for scope '%s'.", ev.Type, ev.Scope)
+	}
+}
+
+// drain stops accepting events and waits up to timeout for the queued ones to be delivered (or
+// given up on). It reports whether the queue was flushed in time. Safe to call on a nil notifier.
+func (n *webhookNotifier) drain(timeout time.Duration) bool {
+	if n == nil {
+		return true
+	}
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-n.done:
+		return true
+	case <-timer.C:
+		logWarnf("Webhook: %d queued event(s) not delivered within the %s drain timeout.", len(n.queue), timeout)
+		return false
+	}
+}
+
+// run delivers queued events until the queue is closed and empty.
+func (n *webhookNotifier) run() {
+	defer close(n.done)
+	for ev := range n.queue {
+		delay := n.retryDelay
+		for attempt := 1; ; attempt++ {
+			err := n.deliver(ev)
+			if err == nil {
+				break
+			}
+			if attempt >= webhookMaxAttempts {
+				logErrorf("Webhook: giving up on %s event after %d attempts: %v", ev.Type, attempt, err)
+				break
+			}
+			logWarnf("Webhook: delivering %s event failed (attempt %d): %v", ev.Type, attempt, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// deliver posts ev to the webhook URL once. Any non-2xx status is an error.
+func (n *webhookNotifier) deliver(ev webhookEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
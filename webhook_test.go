@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// receiveWebhookEvent waits for the next event posted to events.
+func receiveWebhookEvent(t *testing.T, events <-chan webhookEvent) webhookEvent {
+	t.Helper()
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for webhook event")
+		return webhookEvent{}
+	}
+}
+
+func TestWebhook_KeySidelinedAndPoolExhausted(t *testing.T) {
+	events := make(chan webhookEvent, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("Failed to decode event: %v", err)
+		}
+		events <- ev
+	}))
+	defer receiver.Close()
+
+	km, _ := newKeyManager([]string{"k1"}, time.Minute)
+	km.notifier = newWebhookNotifier(receiver.URL, defaultWebhookQueueSize)
+	scope := buildScopeKey("host", "/path")
+
+	km.markKeyFailed(scope, 0, "status 429")
+	ev := receiveWebhookEvent(t, events)
+	assertString(t, ev.Type, webhookEventKeySidelined)
+	assertString(t, ev.Scope, scope)
+	assertInt(t, ev.KeyIndex, 0)
+	assertString(t, ev.Reason, "status 429")
+	if ev.Timestamp.IsZero() {
+		t.Error("Expected a timestamp")
+	}
+
+	if _, _, err := km.getNextKey(scope); err == nil {
+		t.Fatal("Expected pool exhaustion error")
+	}
+	ev = receiveWebhookEvent(t, events)
+	assertString(t, ev.Type, webhookEventPoolExhausted)
+	assertInt(t, ev.KeyIndex, -1)
+
+	// A second exhausted request within the interval sends no event.
+	km.getNextKey(scope)
+	select {
+	case ev := <-events:
+		t.Errorf("Unexpected repeated event: %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhook_RetriesFailedDelivery(t *testing.T) {
+	var calls atomic.Int32
+	delivered := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		close(delivered)
+	}))
+	defer receiver.Close()
+
+	n := newWebhookNotifier(receiver.URL, 1)
+	n.retryDelay = time.Millisecond
+	n.notify(webhookEvent{Type: webhookEventKeySidelined, Scope: "s", KeyIndex: 0})
+
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event was not redelivered")
+	}
+	assertInt(t, int(calls.Load()), 2)
+}
+
+func TestWebhook_NotifyNeverBlocks(t *testing.T) {
+	// No worker drains this queue, so it fills after one event.
+	n := &webhookNotifier{queue: make(chan webhookEvent, 1)}
+	done := make(chan struct{})
+	go func() {
+		for range 5 {
+			n.notify(webhookEvent{Type: webhookEventPoolExhausted})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("notify blocked on a full queue")
+	}
+	assertInt(t, len(n.queue), 1)
+
+	var nilNotifier *webhookNotifier
+	nilNotifier.notify(webhookEvent{}) // must not panic
+}
+
+func TestWebhook_DrainDeliversQueuedEvents(t *testing.T) {
+	var delivered atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond) // slow enough that events are still queued at drain
+		delivered.Add(1)
+	}))
+	defer receiver.Close()
+
+	n := newWebhookNotifier(receiver.URL, defaultWebhookQueueSize)
+	for range 5 {
+		n.notify(webhookEvent{Type: webhookEventKeySidelined, Scope: "s"})
+	}
+	if !n.drain(5 * time.Second) {
+		t.Fatal("Expected the queue to be flushed within the timeout")
+	}
+	assertInt(t, int(delivered.Load()), 5)
+
+	// Events raised after the drain are dropped instead of panicking on the closed queue.
+	n.notify(webhookEvent{Type: webhookEventPoolExhausted})
+	assertInt(t, int(delivered.Load()), 5)
+	if !n.drain(time.Second) {
+		t.Error("A second drain should return immediately")
+	}
+}
+
+func TestWebhook_DrainIsBounded(t *testing.T) {
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer receiver.Close()
+	defer close(release)
+
+	n := newWebhookNotifier(receiver.URL, defaultWebhookQueueSize)
+	n.notify(webhookEvent{Type: webhookEventKeySidelined, Scope: "s"})
+
+	start := time.Now()
+	if n.drain(50 * time.Millisecond) {
+		t.Error("Expected the drain to time out while delivery is stuck")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("drain took %s, longer than its timeout", elapsed)
+	}
+
+	var nilNotifier *webhookNotifier
+	if !nilNotifier.drain(time.Millisecond) {
+		t.Error("A nil notifier has nothing to drain")
+	}
+}